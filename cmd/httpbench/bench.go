@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"httpfromtcp/internal/response"
+)
+
+// config is what a run does, from the flags
+type config struct {
+	target      *url.URL
+	method      string
+	wire        []byte // the serialized request
+	connections int
+	pipeline    int  // requests in flight on each connection
+	keepAlive   bool // reuse connections; off means one request per connection
+	rate        float64
+	requests    int64 // stop after this many, 0 for no limit
+	duration    time.Duration
+	timeout     time.Duration
+	insecure    bool
+}
+
+// stats is what one worker saw; workers keep their own and they are merged at the end
+type stats struct {
+	latency   histogram
+	responses uint64
+	bytesRead uint64
+	status    map[int]uint64
+	errors    map[string]uint64
+}
+
+func newStats() *stats {
+	return &stats{status: make(map[int]uint64), errors: make(map[string]uint64)}
+}
+
+func (s *stats) merge(o *stats) {
+	s.latency.merge(&o.latency)
+	s.responses += o.responses
+	s.bytesRead += o.bytesRead
+	for code, n := range o.status {
+		s.status[code] += n
+	}
+	for kind, n := range o.errors {
+		s.errors[kind] += n
+	}
+}
+
+// bench runs the workers and gathers their stats
+type bench struct {
+	cfg  config
+	end  time.Time
+	sent atomic.Int64 // requests handed out, for -n
+
+	// schedule hands out the times requests are due at with -rate; nil in closed-loop mode
+	schedule chan time.Time
+}
+
+func run(ctx context.Context, cfg config) (*stats, time.Duration) {
+	b := &bench{cfg: cfg}
+	if cfg.duration > 0 {
+		b.end = time.Now().Add(cfg.duration)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, b.end)
+		defer cancel()
+	}
+	if cfg.rate > 0 {
+		b.schedule = make(chan time.Time, cfg.connections*cfg.pipeline)
+		go b.pace(ctx)
+	}
+
+	start := time.Now()
+	results := make([]*stats, cfg.connections)
+	var wg sync.WaitGroup
+	for i := range results {
+		results[i] = newStats()
+		wg.Add(1)
+		go func(s *stats) {
+			defer wg.Done()
+			b.worker(ctx, s)
+		}(results[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := newStats()
+	for _, s := range results {
+		total.merge(s)
+	}
+	return total, elapsed
+}
+
+// pace sends the due time of each request at the configured rate. Latency is then
+// measured from when a request was due rather than when it was sent, so a stalled
+// server can't hide the requests that queued up behind it.
+func (b *bench) pace(ctx context.Context) {
+	defer close(b.schedule)
+	interval := time.Duration(float64(time.Second) / b.cfg.rate)
+	due := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		for now := time.Now(); !due.After(now); due = due.Add(interval) {
+			select {
+			case b.schedule <- due:
+			case <-ctx.Done():
+				return
+			}
+		}
+		timer.Reset(time.Until(due))
+	}
+}
+
+// take reserves up to n requests and returns when each is due, or nothing once the run is over
+func (b *bench) take(ctx context.Context, n int) []time.Time {
+	if b.cfg.requests > 0 {
+		left := b.cfg.requests - b.sent.Add(int64(n)) + int64(n)
+		n = int(min(int64(n), left))
+		if n <= 0 {
+			return nil
+		}
+	}
+	due := make([]time.Time, 0, n)
+	if b.schedule == nil {
+		now := time.Now()
+		for i := 0; i < n; i++ {
+			due = append(due, now)
+		}
+		return due
+	}
+	for len(due) < n {
+		select {
+		case t, ok := <-b.schedule:
+			if !ok {
+				return due
+			}
+			due = append(due, t)
+		case <-ctx.Done():
+			return due
+		}
+		// Don't hold on to due requests waiting for a full batch
+		if len(b.schedule) == 0 {
+			break
+		}
+	}
+	return due
+}
+
+// worker drives one connection at a time until the run is over
+func (b *bench) worker(ctx context.Context, s *stats) {
+	var c *benchConn
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+
+	for ctx.Err() == nil {
+		due := b.take(ctx, b.cfg.pipeline)
+		if len(due) == 0 {
+			return
+		}
+
+		if c == nil {
+			var err error
+			if c, err = b.dial(ctx); err != nil {
+				if !b.over() {
+					for range due {
+						s.errors[classify(err, "connect")]++
+					}
+				}
+				continue
+			}
+		}
+
+		keep := b.exchange(c, due, s)
+		if !keep {
+			c.Close()
+			c = nil
+		}
+	}
+}
+
+// over reports whether the run has reached its end, so errors caused by stopping aren't counted
+func (b *bench) over() bool {
+	return !b.end.IsZero() && !time.Now().Before(b.end)
+}
+
+type benchConn struct {
+	net.Conn
+	br      *bufio.Reader
+	counter *countingReader
+}
+
+// countingReader counts the bytes read from the connection
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += uint64(n)
+	return n, err
+}
+
+func (b *bench) dial(ctx context.Context) (*benchConn, error) {
+	d := net.Dialer{Timeout: b.cfg.timeout}
+	raw, err := d.DialContext(ctx, "tcp", hostPort(b.cfg.target))
+	if err != nil {
+		return nil, err
+	}
+	if b.cfg.target.Scheme == "https" {
+		tlsConn := tls.Client(raw, &tls.Config{
+			ServerName:         b.cfg.target.Hostname(),
+			InsecureSkipVerify: b.cfg.insecure,
+			NextProtos:         []string{"http/1.1"},
+		})
+		hsCtx, cancel := context.WithTimeout(ctx, b.cfg.timeout)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		raw = tlsConn
+	}
+	cr := &countingReader{r: raw}
+	return &benchConn{Conn: raw, br: bufio.NewReaderSize(cr, 32<<10), counter: cr}, nil
+}
+
+// exchange writes one request per due time in a single batch, then reads the
+// responses in order. It reports whether the connection can be used again.
+func (b *bench) exchange(c *benchConn, due []time.Time, s *stats) bool {
+	deadline := time.Now().Add(b.cfg.timeout)
+	if !b.end.IsZero() && b.end.Before(deadline) {
+		deadline = b.end
+	}
+	c.SetDeadline(deadline)
+
+	batch := make([]byte, 0, len(b.cfg.wire)*len(due))
+	for range due {
+		batch = append(batch, b.cfg.wire...)
+	}
+	before := c.counter.n
+	defer func() { s.bytesRead += c.counter.n - before }()
+
+	if _, err := c.Write(batch); err != nil {
+		if !b.over() {
+			for range due {
+				s.errors[classify(err, "write")]++
+			}
+		}
+		return false
+	}
+
+	keep := b.cfg.keepAlive
+	for i, t := range due {
+		resp, err := response.ResponseFromReaderForMethod(c.br, b.cfg.method)
+		if err != nil {
+			if !b.over() {
+				// The rest of the batch is lost with the connection
+				for range due[i:] {
+					s.errors[classify(err, "read")]++
+				}
+			}
+			return false
+		}
+		s.latency.record(time.Since(t))
+		s.responses++
+		s.status[int(resp.StatusLine.StatusCode)]++
+		if closes(resp) {
+			keep = false
+			if i < len(due)-1 {
+				for range due[i+1:] {
+					s.errors["closed"]++
+				}
+				return false
+			}
+		}
+	}
+	return keep
+}
+
+// closes reports whether the server ends the connection after resp
+func closes(resp *response.Response) bool {
+	conn := strings.ToLower(resp.Headers["connection"])
+	if resp.StatusLine.HttpVersion == "1.0" {
+		return !strings.Contains(conn, "keep-alive")
+	}
+	return strings.Contains(conn, "close")
+}
+
+// classify names the kind of failure for the error breakdown
+func classify(err error, stage string) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, response.ErrMalformedResponse):
+		return "malformed response"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return "closed"
+	case strings.Contains(err.Error(), "connection refused"):
+		return "connection refused"
+	case strings.Contains(err.Error(), "connection reset"):
+		return "connection reset"
+	case strings.HasPrefix(err.Error(), "incomplete") || strings.HasPrefix(err.Error(), "body shorter"):
+		return "closed"
+	}
+	return stage + " error"
+}
+
+// hostPort is the address to dial for u, with the scheme's default port if it has none
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math/bits"
+	"time"
+)
+
+// subBucketBits sets the precision of the histogram: every power of two is split
+// into 1<<subBucketBits buckets, so a recorded value is off by less than 1%
+const subBucketBits = 7
+
+// histogram counts latencies in microseconds in log-linear buckets, the way HDR
+// histograms do: exact below 128µs, and with a relative error under 1% above,
+// from microseconds to hours in a few thousand counters.
+type histogram struct {
+	counts []uint64
+	total  uint64
+	sum    uint64
+	min    uint64
+	max    uint64
+}
+
+// bucketIndex maps v to its bucket. Values below 1<<subBucketBits get a bucket of
+// their own; above that, each power of two [2^k, 2^(k+1)) is split evenly.
+func bucketIndex(v uint64) int {
+	if v < 1<<subBucketBits {
+		return int(v)
+	}
+	shift := bits.Len64(v) - subBucketBits - 1
+	return shift<<subBucketBits + int(v>>shift)
+}
+
+// bucketHigh is the highest value that lands in bucket i
+func bucketHigh(i int) uint64 {
+	if i < 1<<subBucketBits {
+		return uint64(i)
+	}
+	shift := i>>subBucketBits - 1
+	sub := uint64(i - shift<<subBucketBits)
+	return (sub+1)<<shift - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	v := uint64(max(d.Microseconds(), 0))
+	i := bucketIndex(v)
+	if i >= len(h.counts) {
+		grown := make([]uint64, i+1+len(h.counts)/2)
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	h.counts[i]++
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	h.max = max(h.max, v)
+	h.total++
+	h.sum += v
+}
+
+// merge adds the counts of o to h
+func (h *histogram) merge(o *histogram) {
+	if o.total == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		grown := make([]uint64, len(o.counts))
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	if h.total == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	h.max = max(h.max, o.max)
+	h.total += o.total
+	h.sum += o.sum
+}
+
+// quantile returns the value below which the fraction q of the recorded values fall,
+// as the highest value of its bucket
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.total) + 0.5)
+	rank = min(max(rank, 1), h.total)
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			return time.Duration(min(bucketHigh(i), h.max)) * time.Microsecond
+		}
+	}
+	return time.Duration(h.max) * time.Microsecond
+}
+
+func (h *histogram) mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return time.Duration(h.sum/h.total) * time.Microsecond
+}
@@ -0,0 +1,299 @@
+// httpbench puts load on an HTTP/1.1 server and reports throughput, latency
+// percentiles, status codes and errors. Requests are written with Request.WriteTo
+// and responses read with ResponseFromReader.
+//
+//	httpbench -c 50 -d 10s http://localhost:42069/
+//	httpbench -c 10 -rate 2000 -json http://localhost:42069/ > before.json
+//	httpbench -c 4 -pipeline 8 -n 100000 http://localhost:42069/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+)
+
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+	var headerFlags stringList
+	connections := flag.Int("c", 10, "concurrent connections")
+	requests := flag.Int64("n", 0, "stop after this many requests (default: run for -d)")
+	duration := flag.Duration("d", 10*time.Second, "how long to run; with -n, an upper bound (0 for none)")
+	rate := flag.Float64("rate", 0, "requests per second over all connections; 0 sends each request as soon as the last response is in")
+	pipeline := flag.Int("pipeline", 1, "requests sent on a connection before reading their responses")
+	keepAlive := flag.Bool("keepalive", true, "reuse connections; with -keepalive=false every request opens its own")
+	method := flag.String("X", "GET", "request method")
+	flag.Var(&headerFlags, "H", "request header as 'Name: value' (repeat for several)")
+	body := flag.String("body", "", "request body; @file reads it from a file")
+	timeout := flag.Duration("timeout", 10*time.Second, "limit for connecting and for each batch of responses")
+	insecure := flag.Bool("k", false, "don't verify the server's certificate for https URLs")
+	jsonOut := flag.Bool("json", false, "print the report as JSON, to diff between runs")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: httpbench [flags] URL\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	durationSet := false
+	flag.Visit(func(f *flag.Flag) { durationSet = durationSet || f.Name == "d" })
+	if *requests > 0 && !durationSet {
+		*duration = 0
+	}
+	if *connections < 1 || *pipeline < 1 {
+		fatalf("-c and -pipeline must be at least 1")
+	}
+	if !*keepAlive && *pipeline > 1 {
+		fatalf("-pipeline needs keep-alive")
+	}
+
+	target, err := parseURL(flag.Arg(0))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var payload []byte
+	if name, ok := strings.CutPrefix(*body, "@"); ok {
+		if payload, err = os.ReadFile(name); err != nil {
+			fatalf("reading body: %v", err)
+		}
+	} else {
+		payload = []byte(*body)
+	}
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: *method, RequestTarget: target.RequestURI(), HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+		Body:        payload,
+	}
+	req.Headers.Set("Host", target.Host)
+	req.Headers.Set("User-Agent", "httpbench")
+	if !*keepAlive {
+		req.Headers.Set("Connection", "close")
+	}
+	if len(payload) > 0 || *method == "POST" || *method == "PUT" || *method == "PATCH" {
+		req.Headers.Set("Content-Length", fmt.Sprint(len(payload)))
+	}
+	for _, h := range headerFlags {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			fatalf("invalid header %q, expected 'Name: value'", h)
+		}
+		req.Headers.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	var wire bytes.Buffer
+	if _, err := req.WriteTo(&wire); err != nil {
+		fatalf("%v", err)
+	}
+
+	cfg := config{
+		target:      target,
+		method:      *method,
+		wire:        wire.Bytes(),
+		connections: *connections,
+		pipeline:    *pipeline,
+		keepAlive:   *keepAlive,
+		rate:        *rate,
+		requests:    *requests,
+		duration:    *duration,
+		timeout:     *timeout,
+		insecure:    *insecure,
+	}
+
+	// Ctrl-C ends the run early but still prints the report
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if !*jsonOut {
+		fmt.Printf("Running against %s\n  %s\n\n", target, describe(cfg))
+	}
+	s, elapsed := run(ctx, cfg)
+
+	rep := newReport(cfg, s, elapsed)
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rep)
+		return
+	}
+	rep.print(os.Stdout)
+}
+
+func describe(cfg config) string {
+	parts := []string{fmt.Sprintf("%d connections", cfg.connections)}
+	if cfg.pipeline > 1 {
+		parts = append(parts, fmt.Sprintf("pipeline %d", cfg.pipeline))
+	}
+	if !cfg.keepAlive {
+		parts = append(parts, "no keep-alive")
+	}
+	if cfg.rate > 0 {
+		parts = append(parts, fmt.Sprintf("%g req/s", cfg.rate))
+	} else {
+		parts = append(parts, "closed loop")
+	}
+	if cfg.requests > 0 {
+		parts = append(parts, fmt.Sprintf("%d requests", cfg.requests))
+	}
+	if cfg.duration > 0 {
+		parts = append(parts, cfg.duration.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// report is the outcome of a run. Its JSON form has a stable layout, so two runs can be diffed.
+type report struct {
+	Target      string  `json:"target"`
+	Method      string  `json:"method"`
+	Connections int     `json:"connections"`
+	Pipeline    int     `json:"pipeline"`
+	KeepAlive   bool    `json:"keep_alive"`
+	Rate        float64 `json:"rate"`
+
+	DurationSeconds float64 `json:"duration_seconds"`
+	Responses       uint64  `json:"responses"`
+	Errors          uint64  `json:"errors"`
+	Throughput      float64 `json:"throughput_rps"`
+	BytesRead       uint64  `json:"bytes_read"`
+
+	// Latencies in milliseconds
+	Latency latencyReport `json:"latency_ms"`
+
+	// Status codes and error kinds with how often they occurred
+	Status     map[string]uint64 `json:"status"`
+	ErrorKinds map[string]uint64 `json:"error_kinds"`
+}
+
+type latencyReport struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p99.9"`
+	Max  float64 `json:"max"`
+}
+
+func newReport(cfg config, s *stats, elapsed time.Duration) *report {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	h := &s.latency
+	rep := &report{
+		Target:          cfg.target.String(),
+		Method:          cfg.method,
+		Connections:     cfg.connections,
+		Pipeline:        cfg.pipeline,
+		KeepAlive:       cfg.keepAlive,
+		Rate:            cfg.rate,
+		DurationSeconds: elapsed.Seconds(),
+		Responses:       s.responses,
+		Throughput:      float64(s.responses) / elapsed.Seconds(),
+		BytesRead:       s.bytesRead,
+		Latency: latencyReport{
+			Min:  ms(time.Duration(h.min) * time.Microsecond),
+			Mean: ms(h.mean()),
+			P50:  ms(h.quantile(0.50)),
+			P90:  ms(h.quantile(0.90)),
+			P99:  ms(h.quantile(0.99)),
+			P999: ms(h.quantile(0.999)),
+			Max:  ms(time.Duration(h.max) * time.Microsecond),
+		},
+		Status:     make(map[string]uint64),
+		ErrorKinds: make(map[string]uint64),
+	}
+	for code, n := range s.status {
+		rep.Status[fmt.Sprint(code)] = n
+	}
+	for kind, n := range s.errors {
+		rep.ErrorKinds[kind] = n
+		rep.Errors += n
+	}
+	return rep
+}
+
+func (r *report) print(w io.Writer) {
+	fmt.Fprintf(w, "Requests:   %d responses in %.2fs, %.1f/s, %s read\n", r.Responses, r.DurationSeconds, r.Throughput, formatBytes(r.BytesRead))
+	l := r.Latency
+	fmt.Fprintf(w, "Latency:    min %.2fms  mean %.2fms  max %.2fms\n", l.Min, l.Mean, l.Max)
+	fmt.Fprintf(w, "            p50 %.2fms  p90 %.2fms  p99 %.2fms  p99.9 %.2fms\n", l.P50, l.P90, l.P99, l.P999)
+	fmt.Fprintf(w, "Status:     %s\n", formatCounts(r.Status))
+	if r.Errors > 0 {
+		fmt.Fprintf(w, "Errors:     %d (%s)\n", r.Errors, formatCounts(r.ErrorKinds))
+	}
+}
+
+// formatCounts lists counts by key, e.g. "200: 9800, 404: 200"
+func formatCounts(counts map[string]uint64) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s: %d", k, counts[k])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// parseURL accepts http and https URLs, and host:port/path shorthand for http
+func parseURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in URL %q", raw)
+	}
+	return u, nil
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "httpbench: "+format+"\n", args...)
+	os.Exit(1)
+}
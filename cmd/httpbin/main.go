@@ -0,0 +1,45 @@
+// httpbin serves the common httpbin.org endpoints locally, so the proxy and the
+// tools can be tried out without the internet.
+//
+//	go run ./cmd/httpbin -port 8080
+//	curl http://localhost:8080/stream/3
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"httpfromtcp/internal/httpbin"
+	"httpfromtcp/internal/middleware"
+	"httpfromtcp/internal/server"
+)
+
+func main() {
+	port := flag.Int("port", 8080, "port to listen on (127.0.0.1)")
+	prefix := flag.String("prefix", "", "path the endpoints are mounted under, e.g. /httpbin")
+	maxDelay := flag.Duration("max-delay", 10*time.Second, "longest /delay and /drip will take")
+	flag.Parse()
+
+	hb := httpbin.New(*prefix)
+	hb.MaxDelay = *maxDelay
+	s := &server.Server{
+		Addr: "localhost",
+		Port: *port,
+		Handler: middleware.Apply(hb.ServeHTTP,
+			middleware.Logger(log.New(os.Stdout, "", log.LstdFlags)),
+		),
+	}
+	if err := s.Start(); err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+	defer s.Close()
+	log.Printf("httpbin listening on http://localhost:%d%s/", s.Port, *prefix)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"httpfromtcp/internal/client"
+)
+
+// newSession returns the session the requests go out on. With verbose it prints what
+// happens to the connection and the raw exchange to out.
+func newSession(timeout time.Duration, insecure, verbose bool, out io.Writer, color bool) *client.Session {
+	s := &client.Session{
+		Timeout:   timeout,
+		TLSConfig: &tls.Config{InsecureSkipVerify: insecure},
+		Record:    verbose,
+	}
+	if verbose {
+		s.Note = func(msg string) {
+			fmt.Fprintln(out, paint(color, colorNote, "* "+msg))
+		}
+		s.Sending = func(wire []byte) {
+			dumpRequest(out, wire, color)
+		}
+		s.Received = func(ex *client.Exchange) {
+			dumpResponse(out, ex.Raw, ex.Response, color)
+		}
+	}
+	return s
+}
+
+// printTimings breaks down one exchange
+func printTimings(w io.Writer, target string, ex *client.Exchange) {
+	fmt.Fprintf(w, "%s\n", target)
+	if ex.Reused {
+		fmt.Fprintf(w, "  connect:  reused connection\n")
+	} else {
+		fmt.Fprintf(w, "  connect:  %v\n", ex.Connect)
+		if ex.TLS > 0 {
+			fmt.Fprintf(w, "  tls:      %v\n", ex.TLS)
+		}
+	}
+	fmt.Fprintf(w, "  ttfb:     %v\n", ex.TTFB)
+	fmt.Fprintf(w, "  transfer: %v\n", ex.Transfer)
+	fmt.Fprintf(w, "  total:    %v\n", ex.Total)
+}
+
+// sendRaw writes payload to u's host as it is and copies whatever comes back to
+// out until the server closes the connection or goes quiet for timeout
+func sendRaw(timeout time.Duration, insecure bool, u *url.URL, payload []byte, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	c, err := client.Dial(ctx, u, &tls.Config{InsecureSkipVerify: insecure})
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.Write(payload); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 32<<10)
+	for {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		n, err := c.Read(buf)
+		out.Write(buf[:n])
+		var netErr net.Error
+		switch {
+		case err == nil:
+		case errors.Is(err, io.EOF):
+			return nil
+		case errors.As(err, &netErr) && netErr.Timeout():
+			fmt.Fprintln(os.Stderr, "* no more data, connection still open")
+			return nil
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"httpfromtcp/internal/response"
+)
+
+// ANSI colours for -v on a terminal
+const (
+	colorNote    = "2"  // dim
+	colorChunk   = "36" // cyan
+	colorTrailer = "33" // yellow
+)
+
+func paint(enabled bool, color, s string) string {
+	if !enabled {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// dumpRequest prints the bytes of a serialized request, prefixed with "> "
+func dumpRequest(w io.Writer, wire []byte, color bool) {
+	head, body, _ := bytes.Cut(wire, []byte("\r\n\r\n"))
+	printHead(w, "> ", head)
+	chunked := false
+	for _, line := range strings.Split(string(head), "\r\n") {
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(name, "transfer-encoding") && strings.HasSuffix(strings.ToLower(strings.TrimSpace(value)), "chunked") {
+			chunked = true
+		}
+	}
+	printBody(w, "> ", body, chunked, color)
+}
+
+// dumpResponse prints the bytes a response came in as, prefixed with "< ", with
+// the chunk-size lines and trailers of a chunked body marked. Interim 1xx
+// responses that came before it are printed too.
+func dumpResponse(w io.Writer, raw []byte, resp *response.Response, color bool) {
+	for {
+		head, rest, found := bytes.Cut(raw, []byte("\r\n\r\n"))
+		printHead(w, "< ", head)
+		raw = rest
+		if !found || !isInterim(head) {
+			break
+		}
+	}
+	printBody(w, "< ", raw, resp.Chunked, color)
+}
+
+// isInterim reports whether head is that of a 1xx response other than 101
+func isInterim(head []byte) bool {
+	line, _, _ := bytes.Cut(head, []byte("\r\n"))
+	fields := strings.Fields(string(line))
+	return len(fields) >= 2 && strings.HasPrefix(fields[1], "1") && fields[1] != "101"
+}
+
+func printHead(w io.Writer, prefix string, head []byte) {
+	for _, line := range strings.Split(string(head), "\r\n") {
+		fmt.Fprintln(w, prefix+line)
+	}
+	fmt.Fprintln(w, prefix)
+}
+
+// printBody prints a body as it was framed on the wire
+func printBody(w io.Writer, prefix string, body []byte, chunked, color bool) {
+	if !chunked {
+		printData(w, prefix, body)
+		return
+	}
+
+	rest := body
+	for len(rest) > 0 {
+		lineEnd := bytes.Index(rest, []byte("\r\n"))
+		if lineEnd == -1 {
+			printData(w, prefix, rest)
+			return
+		}
+		sizeLine := string(rest[:lineEnd])
+		rest = rest[lineEnd+2:]
+		sizeField, _, _ := strings.Cut(sizeLine, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil {
+			fmt.Fprintln(w, prefix+paint(color, colorChunk, sizeLine+"  [invalid chunk size]"))
+			printData(w, prefix, rest)
+			return
+		}
+
+		if size == 0 {
+			fmt.Fprintln(w, prefix+paint(color, colorChunk, sizeLine+"  [last chunk]"))
+			trailers, _, _ := bytes.Cut(rest, []byte("\r\n\r\n"))
+			if len(trailers) > 0 && !bytes.HasPrefix(rest, []byte("\r\n")) {
+				for _, line := range strings.Split(string(trailers), "\r\n") {
+					fmt.Fprintln(w, prefix+paint(color, colorTrailer, line+"  [trailer]"))
+				}
+			}
+			fmt.Fprintln(w, prefix)
+			return
+		}
+
+		fmt.Fprintln(w, prefix+paint(color, colorChunk, fmt.Sprintf("%s  [chunk, %d bytes]", sizeLine, size)))
+		n := min(int(size), len(rest))
+		printData(w, prefix, rest[:n])
+		rest = bytes.TrimPrefix(rest[n:], []byte("\r\n"))
+	}
+}
+
+// printData prints body bytes line by line, or just their size if they aren't text
+func printData(w io.Writer, prefix string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if !isText(data) {
+		fmt.Fprintf(w, "%s[%d bytes of binary data]\n", prefix, len(data))
+		return
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintln(w, prefix+strings.TrimSuffix(line, "\r"))
+	}
+}
+
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, b := range data {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedKeys returns the keys of h in order
+func sortedKeys(h map[string]string) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,202 @@
+// httpc is a small curl for poking at the server, built on the project's own
+// request writer and response parser instead of net/http.
+//
+//	httpc http://localhost:42069/
+//	httpc -v -X POST -H 'Content-Type: text/plain' -d @body.txt http://localhost:42069/echo
+//	httpc -timing http://localhost:42069/ http://localhost:42069/httpbin/get   # one connection
+//	httpc -raw malformed.txt http://localhost:42069/                           # bytes as they are
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+	var headerFlags stringList
+	method := flag.String("X", "", "request method (default GET, or POST with -d)")
+	flag.Var(&headerFlags, "H", "request header as 'Name: value' (repeat for several)")
+	data := flag.String("d", "", "request body; @file reads it from a file and @- from stdin")
+	chunked := flag.Bool("chunked", false, "send the body with chunked transfer coding instead of Content-Length")
+	include := flag.Bool("i", false, "print the status line and headers before the body")
+	verbose := flag.Bool("v", false, "print the raw request and response to stderr, marking chunks and trailers")
+	timing := flag.Bool("timing", false, "print connect, TLS, time to first byte and transfer times to stderr")
+	raw := flag.String("raw", "", "send this file (- for stdin) byte for byte to the first URL's host and print what comes back")
+	insecure := flag.Bool("k", false, "don't verify the server's certificate for https URLs")
+	timeout := flag.Duration("timeout", 30*time.Second, "limit for each connect and each response; in -raw mode, how long to wait for more bytes")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: httpc [flags] URL [URL...]\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	targets := make([]*url.URL, 0, flag.NArg())
+	for _, arg := range flag.Args() {
+		u, err := parseURL(arg)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		targets = append(targets, u)
+	}
+
+	if *raw != "" {
+		payload, err := readInput(*raw)
+		if err != nil {
+			fatalf("reading %s: %v", *raw, err)
+		}
+		if err := sendRaw(*timeout, *insecure, targets[0], payload, os.Stdout); err != nil {
+			fatalf("%v", err)
+		}
+		return
+	}
+
+	var body []byte
+	if *data != "" {
+		var err error
+		if body, err = readBody(*data); err != nil {
+			fatalf("reading body: %v", err)
+		}
+	}
+	if *method == "" {
+		*method = "GET"
+		if *data != "" {
+			*method = "POST"
+		}
+	}
+	extra := headers.NewHeaders()
+	for _, h := range headerFlags {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			fatalf("invalid header %q, expected 'Name: value'", h)
+		}
+		extra.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	s := newSession(*timeout, *insecure, *verbose, os.Stderr, isTerminal(os.Stderr))
+	defer s.Close()
+
+	failed := false
+	for _, u := range targets {
+		req := newRequest(*method, u, extra, body, *chunked, *data != "")
+		ex, err := s.Do(u, req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "httpc: %s: %v\n", u, err)
+			failed = true
+			continue
+		}
+		if *include {
+			writeHead(os.Stdout, ex.Response)
+		}
+		os.Stdout.Write(ex.Response.Body)
+		if *timing {
+			printTimings(os.Stderr, u.String(), ex)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// parseURL accepts http and https URLs, and host:port/path shorthand for http
+func parseURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in URL %q", raw)
+	}
+	return u, nil
+}
+
+// newRequest builds the request for u. Headers given with -H replace the defaults.
+func newRequest(method string, u *url.URL, extra headers.Headers, body []byte, chunked, hasBody bool) *request.Request {
+	h := headers.NewHeaders()
+	h.Set("Host", u.Host)
+	h.Set("User-Agent", "httpc")
+	h.Set("Accept", "*/*")
+	if hasBody {
+		if chunked {
+			h.Set("Transfer-Encoding", "chunked")
+		} else {
+			// Also for an empty body, so the server doesn't wait for one
+			h.Set("Content-Length", fmt.Sprint(len(body)))
+		}
+	}
+	for name, value := range extra {
+		h[name] = value
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: u.RequestURI(), HttpVersion: "1.1"},
+		Headers:     h,
+		Body:        body,
+	}
+}
+
+// readBody reads a -d value: literal text, @file or @- for stdin
+func readBody(data string) ([]byte, error) {
+	if name, ok := strings.CutPrefix(data, "@"); ok {
+		return readInput(name)
+	}
+	return []byte(data), nil
+}
+
+// readInput reads the named file, or stdin for "-"
+func readInput(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+// writeHead prints the status line and headers of resp as they came, but with the usual casing
+func writeHead(w io.Writer, resp *response.Response) {
+	line := resp.StatusLine
+	fmt.Fprintf(w, "HTTP/%s %d %s\r\n", line.HttpVersion, line.StatusCode, line.ReasonPhrase)
+	for _, name := range sortedKeys(resp.Headers) {
+		fmt.Fprintf(w, "%s: %s\r\n", textproto.CanonicalMIMEHeaderKey(name), resp.Headers[name])
+	}
+	fmt.Fprint(w, "\r\n")
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "httpc: "+format+"\n", args...)
+	os.Exit(1)
+}
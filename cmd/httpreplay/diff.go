@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"httpfromtcp/internal/har"
+	"httpfromtcp/internal/response"
+)
+
+// framingHeaders depend on how a body was sent rather than what it is, so they
+// are never compared; the bodies are
+var framingHeaders = map[string]bool{
+	"content-length":    true,
+	"transfer-encoding": true,
+	"connection":        true,
+	"keep-alive":        true,
+	"trailer":           true,
+}
+
+// maxDiffLines caps how much of a body diff is printed
+const maxDiffLines = 20
+
+// diff lists how resp differs from the recorded response, nothing if they match
+func diff(recorded *har.Response, resp *response.Response, ignore map[string]bool) []string {
+	var out []string
+	if int(resp.StatusLine.StatusCode) != recorded.Status {
+		out = append(out, fmt.Sprintf("status %d, was %d", resp.StatusLine.StatusCode, recorded.Status))
+	}
+
+	was := make(map[string]string)
+	for _, h := range recorded.Headers {
+		name := strings.ToLower(h.Name)
+		if prev, ok := was[name]; ok {
+			was[name] = prev + ", " + h.Value
+		} else {
+			was[name] = h.Value
+		}
+	}
+	names := make(map[string]bool)
+	for name := range was {
+		names[name] = true
+	}
+	for name := range resp.Headers {
+		names[name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		if framingHeaders[name] || ignore[name] {
+			continue
+		}
+		before, hadBefore := was[name]
+		after, hasAfter := resp.Headers[name]
+		switch {
+		case !hadBefore:
+			out = append(out, fmt.Sprintf("header %s added: %q", name, after))
+		case !hasAfter:
+			out = append(out, fmt.Sprintf("header %s removed, was %q", name, before))
+		case before != after:
+			out = append(out, fmt.Sprintf("header %s: %q, was %q", name, after, before))
+		}
+	}
+
+	body, err := recorded.Content.Body()
+	if err != nil {
+		return append(out, fmt.Sprintf("recorded body unreadable: %v", err))
+	}
+	if !bytes.Equal(body, resp.Body) {
+		out = append(out, diffBodies(body, resp.Body)...)
+	}
+	return out
+}
+
+// diffBodies describes how two bodies differ: line by line for text, with JSON
+// compared by value so that key order and spacing don't count
+func diffBodies(before, after []byte) []string {
+	if a, b, ok := canonicalJSON(before, after); ok {
+		if a == b {
+			return nil
+		}
+		return append([]string{"body (JSON):"}, lineDiff(a, b)...)
+	}
+	if !utf8.Valid(before) || !utf8.Valid(after) {
+		return []string{fmt.Sprintf("body: %d bytes of binary data, was %d bytes", len(after), len(before))}
+	}
+	return append([]string{"body:"}, lineDiff(string(before), string(after))...)
+}
+
+// canonicalJSON re-encodes both bodies with sorted keys and indentation, if both are JSON
+func canonicalJSON(before, after []byte) (string, string, bool) {
+	var a, b any
+	if json.Unmarshal(before, &a) != nil || json.Unmarshal(after, &b) != nil {
+		return "", "", false
+	}
+	ja, _ := json.MarshalIndent(a, "", "  ")
+	jb, _ := json.MarshalIndent(b, "", "  ")
+	return string(ja), string(jb), true
+}
+
+// lineDiff returns the lines removed ("- ") and added ("+ ") between two texts, from
+// a longest common subsequence of their lines. Texts too long for that are only
+// compared up to their first differing line.
+func lineDiff(before, after string) []string {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+	if len(a)*len(b) > 1_000_000 {
+		for i := 0; ; i++ {
+			if i >= len(a) || i >= len(b) || a[i] != b[i] {
+				out := []string{fmt.Sprintf("  (first difference at line %d)", i+1)}
+				if i < len(a) {
+					out = append(out, "  - "+a[i])
+				}
+				if i < len(b) {
+					out = append(out, "  + "+b[i])
+				}
+				return out
+			}
+		}
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for (i < len(a) || j < len(b)) && len(out) < maxDiffLines {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "  - "+a[i])
+			i++
+		default:
+			out = append(out, "  + "+b[j])
+			j++
+		}
+	}
+	if len(out) == maxDiffLines && (i < len(a) || j < len(b)) {
+		out = append(out, "  ...")
+	}
+	return out
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
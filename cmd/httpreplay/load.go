@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"httpfromtcp/internal/har"
+	"httpfromtcp/internal/request"
+)
+
+// item is a request to replay and, from a HAR file, the response it got back then
+type item struct {
+	req      *request.Request
+	url      *url.URL  // where it was sent, nil for raw captures
+	started  time.Time // zero for raw captures
+	recorded *har.Response
+}
+
+// load reads the requests in a HAR file or, for anything that isn't JSON, a raw
+// capture of HTTP/1.1 requests one after another as they went over the wire
+func load(path string) ([]item, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return loadHAR(data)
+	}
+	return loadRaw(data)
+}
+
+func loadHAR(data []byte) ([]item, error) {
+	f, err := har.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]item, 0, len(f.Log.Entries))
+	for i := range f.Log.Entries {
+		entry := &f.Log.Entries[i]
+		req, err := entry.Request.ToRequest()
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		items = append(items, item{req: req, url: u, started: entry.StartedDateTime, recorded: &entry.Response})
+	}
+	return items, nil
+}
+
+// loadRaw parses requests back to back. The parser may read past the end of a request,
+// so each one is cut off where the trace says it ended.
+func loadRaw(data []byte) ([]item, error) {
+	var items []item
+	for base := 0; base < len(data); {
+		end := -1
+		req, err := request.RequestFromReaderTrace(bytes.NewReader(data[base:]), func(state, offset int) {
+			if state == request.StateDone {
+				end = base + offset
+			}
+		})
+		var perr *request.ParseError
+		if errors.As(err, &perr) {
+			return nil, fmt.Errorf("request %d at byte %d: %w", len(items)+1, base+perr.Offset, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item{req: req})
+		if end <= base {
+			break
+		}
+		base = end
+		// Blank lines between requests are ignored, as servers do
+		for base < len(data) && (data[base] == '\r' || data[base] == '\n') {
+			base++
+		}
+	}
+	if len(items) == 0 {
+		return nil, errors.New("no requests found")
+	}
+	return items, nil
+}
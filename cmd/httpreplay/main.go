@@ -0,0 +1,154 @@
+// httpreplay sends recorded requests again, e.g. to a new build of the server, and
+// reports where the responses differ from the recorded ones. It reads HAR files, such as
+// httpserver -har writes or a browser exports, and raw captures of HTTP/1.1 requests,
+// which have no responses to compare against. Requests are written with Request.WriteTo.
+//
+//	httpserver -har before.har    # then exercise it and stop it
+//	httpreplay -target http://localhost:42069 before.har
+//	httpreplay -target localhost:42069 requests.txt
+//
+// The exit status is 1 if any response differed or any request failed.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/client"
+)
+
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+	ignoreHeaders := stringList{"date"}
+	target := flag.String("target", "", "scheme://host:port to send to (default: where each request went; needed for raw captures)")
+	flag.Var(&ignoreHeaders, "ignore-header", "response header not to compare (repeat for several; date always)")
+	realtime := flag.Bool("realtime", false, "keep the recorded gaps between requests")
+	noDiff := flag.Bool("no-diff", false, "only send the requests and print their status")
+	timeout := flag.Duration("timeout", 10*time.Second, "limit for connecting and for each response")
+	insecure := flag.Bool("k", false, "don't verify the server's certificate for https targets")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: httpreplay [flags] FILE...\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var base *url.URL
+	if *target != "" {
+		var err error
+		if base, err = parseTarget(*target); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	ignore := make(map[string]bool)
+	for _, name := range ignoreHeaders {
+		ignore[strings.ToLower(name)] = true
+	}
+
+	var items []item
+	for _, path := range flag.Args() {
+		loaded, err := load(path)
+		if err != nil {
+			fatalf("%s: %v", path, err)
+		}
+		items = append(items, loaded...)
+	}
+
+	s := &client.Session{Timeout: *timeout, TLSConfig: &tls.Config{InsecureSkipVerify: *insecure}}
+	defer s.Close()
+	var same, differ, failed, unchecked int
+	var first time.Time
+	replayStart := time.Now()
+	for i, it := range items {
+		u := base
+		if u == nil {
+			if it.url == nil {
+				fatalf("request %d has no URL, give -target", i+1)
+			}
+			u = it.url
+		}
+		if *realtime && !it.started.IsZero() {
+			if first.IsZero() {
+				first = it.started
+			}
+			time.Sleep(time.Until(replayStart.Add(it.started.Sub(first))))
+		}
+
+		line := fmt.Sprintf("%3d %-7s %s", i+1, it.req.RequestLine.Method, it.req.RequestLine.RequestTarget)
+		ex, err := s.Do(u, it.req)
+		if err != nil {
+			failed++
+			fmt.Printf("%s  FAILED: %v\n", line, err)
+			continue
+		}
+		resp := ex.Response
+		line = fmt.Sprintf("%s  %d  %s", line, resp.StatusLine.StatusCode, ex.Total.Round(time.Microsecond*100))
+		if *noDiff || it.recorded == nil {
+			unchecked++
+			fmt.Println(line)
+			continue
+		}
+		diffs := diff(it.recorded, resp, ignore)
+		if len(diffs) == 0 {
+			same++
+			fmt.Printf("%s  same\n", line)
+			continue
+		}
+		differ++
+		fmt.Printf("%s  DIFFERS\n", line)
+		for _, d := range diffs {
+			fmt.Printf("      %s\n", d)
+		}
+	}
+
+	fmt.Printf("\nReplayed %d requests: %d same, %d different, %d failed", len(items), same, differ, failed)
+	if unchecked > 0 {
+		fmt.Printf(", %d not compared", unchecked)
+	}
+	fmt.Println()
+	if differ > 0 || failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// parseTarget accepts a URL with only a scheme and host, or host:port shorthand for http
+func parseTarget(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported target scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in target %q", raw)
+	}
+	return u, nil
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "httpreplay: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -1,335 +1,150 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
+	"httpfromtcp/internal/accesslog"
+	"httpfromtcp/internal/certs"
+	"httpfromtcp/internal/har"
 	"httpfromtcp/internal/headers" // Import headers package
+	"httpfromtcp/internal/httpbin"
+	"httpfromtcp/internal/metrics"
+	"httpfromtcp/internal/proxy"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
-	"io"
+	"httpfromtcp/internal/router"
+	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/static"
+	"httpfromtcp/internal/websocket"
 	"log"
-	"net"
-	"net/http"
 	"os"
 	"os/signal"
 	"strings"
-	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-// Handler is a function type that processes an HTTP request and writes a response
-type Handler func(req *request.Request, w *response.Writer)
-
-// Server struct definition remains the same
-type Server struct {
-	Addr     string
-	Port     int
-	Listener net.Listener
-	State    atomic.Bool
-	Handler  Handler
-}
-
-func Serve(port int, handler Handler) (*Server, error) {
-	addr := fmt.Sprintf("127.0.0.1:%d", port)
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to start listener: %w", err)
-	}
-
-	server := &Server{
-		Addr:     "localhost",
-		Port:     port,
-		Listener: listener,
-		Handler:  handler,
-	}
-	server.State.Store(true)
+const port = 42069
 
-	// Start listening in a goroutine
-	go server.listen()
+// stringList is a flag that can be given several times
+type stringList []string
 
-	return server, nil
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-func (s *Server) Close() error {
-	s.State.Store(false)
-	if s.Listener != nil {
-		return s.Listener.Close()
-	}
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
 	return nil
 }
 
-func (s *Server) listen() {
-	for s.State.Load() {
-		conn, err := s.Listener.Accept()
-		if err != nil {
-			// Check if server is closed before logging error
-			if !s.State.Load() {
-				return
-			}
-			log.Printf("Error accepting connection: %v", err)
-			continue
-		}
-
-		// Handle each connection in a goroutine
-		go s.handle(conn)
+// tlsConfigFromFlags builds the server TLS config, or returns nil when TLS isn't enabled.
+// The returned stop function ends certificate hot-reloading.
+func tlsConfigFromFlags(certFiles, keyFiles []string, clientCA string, dev bool, devCAOut string, reload time.Duration) (*tls.Config, func(), error) {
+	noop := func() {}
+	if !dev && len(certFiles) == 0 {
+		return nil, noop, nil
+	}
+	if len(certFiles) != len(keyFiles) {
+		return nil, noop, fmt.Errorf("got %d -tls-cert but %d -tls-key flags", len(certFiles), len(keyFiles))
 	}
-}
-
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
-
-	// Capture the raw request for debugging
-	var requestData bytes.Buffer
-	teeReader := io.TeeReader(conn, &requestData)
-
-	// set a read timeout for the connection
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-
-	// Parse the HTTP request
-	req, err := request.RequestFromReader(teeReader)
-	if err != nil {
-		log.Printf("Raw request data received before error:\n%s", requestData.String())
-		log.Printf("Error parsing request: %v", err)
-
-		// Attempt to handle specific error cases based on path if possible
-		path := extractPathFromRawRequest(requestData.String())
-		if path != "" {
-			log.Printf("Extracted path from raw request: %s", path)
-			minimalReq := &request.Request{
-				RequestLine: request.RequestLine{
-					RequestTarget: path,
-					Method:        "GET", // Assume GET for error handling
-					HttpVersion:   "1.1",
-				},
-				Headers: make(map[string]string),
-				Body:    nil,
-			}
-
-			// Use new response Writer
-			respWriter := response.NewWriter(conn)
-			s.Handler(minimalReq, respWriter)
 
-			// Flush the response
-			if err := respWriter.Flush(); err != nil {
-				log.Printf("Error flushing response: %v", err)
-			}
-			return
+	var store *certs.Store
+	if dev {
+		devStore, ca, err := certs.DevStore()
+		if err != nil {
+			return nil, noop, err
 		}
-
-		// Generic bad request if path extraction failed or wasn't applicable
-		respWriter := response.NewWriter(conn)
-		respWriter.WriteStatusLine(response.StatusBadRequest)
-
-		// Set headers
-		headers := headers.NewHeaders()
-		headers.Set("Content-Type", "text/html; charset=utf-8")
-		respWriter.WriteHeaders(headers)
-
-		// Write body
-		respWriter.WriteBody([]byte("Invalid request format\n"))
-
-		// Flush response
-		if err := respWriter.Flush(); err != nil {
-			log.Printf("Error flushing response: %v", err)
+		store = devStore
+		if devCAOut != "" {
+			if err := os.WriteFile(devCAOut, ca.PEM(), 0o644); err != nil {
+				return nil, noop, fmt.Errorf("failed to write dev CA: %w", err)
+			}
+			log.Printf("Wrote dev CA certificate to %s (use curl --cacert %s)", devCAOut, devCAOut)
 		}
-		return
-	}
-
-	// Log successful request parsing
-	log.Printf("Received %s request for %s", req.RequestLine.Method, req.RequestLine.RequestTarget)
-
-	// Create response writer and pass to handler
-	respWriter := response.NewWriter(conn)
-
-	// Call the handler with the new Writer
-	s.Handler(req, respWriter)
-
-	// Flush the response to send it
-	if err := respWriter.Flush(); err != nil {
-		log.Printf("Error flushing response: %v", err)
+	} else {
+		store = certs.NewStore()
 	}
-}
 
-// extractPathFromRawRequest is a helper function to get the path from a raw HTTP request
-func extractPathFromRawRequest(rawRequest string) string {
-	lines := strings.Split(rawRequest, "\n")
-	if len(lines) == 0 {
-		return ""
+	for i := range certFiles {
+		if err := store.AddFiles(certFiles[i], keyFiles[i]); err != nil {
+			return nil, noop, err
+		}
 	}
 
-	// Parse the first line which should be like "GET /path HTTP/1.1"
-	parts := strings.Split(lines[0], " ")
-	if len(parts) < 2 {
-		return ""
+	var clientCAs *x509.CertPool
+	if clientCA != "" {
+		pool, err := certs.LoadPool(clientCA)
+		if err != nil {
+			return nil, noop, err
+		}
+		clientCAs = pool
 	}
 
-	return parts[1]
+	return certs.ServerConfig(store, clientCAs), store.Watch(reload), nil
 }
 
-const port = 42069
-
-// proxyToHttpbin handles requests to the /httpbin endpoint by proxying to httpbin.org
-func proxyToHttpbin(path string, w *response.Writer) {
-	// Extract the actual path to forward to httpbin.org
-	httpbinPath := strings.TrimPrefix(path, "/httpbin")
-	httpbinURL := "https://httpbin.org" + httpbinPath
-
-	log.Printf("Proxying request to: %s", httpbinURL)
-
-	// Make HTTP request to httpbin.org
-	resp, err := http.Get(httpbinURL)
+func main() {
+	accessLogPath := flag.String("access-log", "", "file to append the access log to (default stdout)")
+	accessLogFormat := flag.String("access-log-format", "combined", "access log format: common, combined or json")
+	harPath := flag.String("har", "", "record every request and response to this HAR file, as they complete")
+	metricsPath := flag.String("metrics-path", "/metrics", "path serving Prometheus metrics (empty to disable)")
+	var tlsCerts, tlsKeys stringList
+	flag.Var(&tlsCerts, "tls-cert", "PEM certificate chain to serve over HTTPS (repeat for several hosts, SNI picks one)")
+	flag.Var(&tlsKeys, "tls-key", "PEM private key for the -tls-cert at the same position")
+	tlsClientCA := flag.String("tls-client-ca", "", "require client certificates signed by the CAs in this PEM file")
+	tlsDev := flag.Bool("tls-dev", false, "serve HTTPS with an in-memory self-signed CA and localhost certificate")
+	tlsDevCAOut := flag.String("tls-dev-ca-out", "", "with -tls-dev, write the generated CA certificate to this file")
+	tlsReload := flag.Duration("tls-reload", time.Minute, "how often to check certificate files for changes")
+	disableHTTP2 := flag.Bool("disable-http2", false, "serve HTTP/1.1 only, without h2 (ALPN) or h2c")
+	assetsDir := flag.String("assets", "assets", "directory served under /assets/ (vim.mp4 in it is also served at /video)")
+	var proxyTargets stringList
+	flag.Var(&proxyTargets, "proxy-target", "upstream that /httpbin/ is proxied to (repeat to balance over several; default: a local httpbin on a loopback port)")
+	proxyPolicy := flag.String("proxy-policy", "round-robin", "how requests are spread over the upstreams: round-robin, least-conn or hash")
+	proxyHashHeader := flag.String("proxy-hash-header", "", "with -proxy-policy hash, key on this header instead of the client IP")
+	proxyHealthPath := flag.String("proxy-health-path", "", "path to GET on every upstream to check its health (empty to disable)")
+	proxyHealthInterval := flag.Duration("proxy-health-interval", 10*time.Second, "how often to check the upstreams' health")
+	flag.Parse()
+
+	tlsConfig, stopReloading, err := tlsConfigFromFlags(tlsCerts, tlsKeys, *tlsClientCA, *tlsDev, *tlsDevCAOut, *tlsReload)
 	if err != nil {
-		log.Printf("Error making request to httpbin: %v", err)
-		w.WriteStatusLine(response.StatusServerError)
-		h := headers.NewHeaders()
-		h.Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeaders(h)
-		w.WriteBody([]byte("<html><body><h1>Proxy Error</h1><p>Failed to connect to httpbin.org</p></body></html>"))
-		return
+		log.Fatalf("Error configuring TLS: %v", err)
 	}
-	defer resp.Body.Close()
+	defer stopReloading()
 
-	// Set status code based on httpbin response
-	var statusCode response.StatusCode
-	switch resp.StatusCode {
-	case 200:
-		statusCode = response.StatusOK
-	case 400:
-		statusCode = response.StatusBadRequest
-	case 500:
-		statusCode = response.StatusServerError
-	default:
-		// Default to OK for other status codes since we don't have all mappings
-		statusCode = response.StatusOK
+	format, err := accesslog.ParseFormat(*accessLogFormat)
+	if err != nil {
+		log.Fatalf("Error configuring access log: %v", err)
 	}
-	w.WriteStatusLine(statusCode)
 
-	// Set up headers for chunked encoding
-	h := headers.NewHeaders()
-
-	// Copy relevant headers from the httpbin response
-	for key, values := range resp.Header {
-		// Skip content-length as we're using chunked encoding
-		if strings.ToLower(key) != "content-length" {
-			h.Set(key, strings.Join(values, ", "))
+	// Log to stdout unless a file is given; files are reopened on SIGHUP for logrotate
+	accessLog := accesslog.New(os.Stdout, format)
+	if *accessLogPath != "" {
+		accessLog, err = accesslog.OpenFile(*accessLogPath, format)
+		if err != nil {
+			log.Fatalf("Error opening access log: %v", err)
 		}
+		defer accessLog.Close()
+		stopReopening := accessLog.ReopenOnSIGHUP()
+		defer stopReopening()
 	}
 
-	// Set transfer encoding to chunked
-	h.Set("Transfer-Encoding", "chunked")
-
-	// Announce the trailers we'll be sending
-	h.Set("Trailer", "X-Content-SHA256, X-Content-Length")
-
-	// Set connection to close
-	h.Set("Connection", "close")
-
-	w.WriteHeaders(h)
-
-	// Initialize hash at the beginning
-	hasher := sha256.New()
-
-	// Track content length
-	var contentLength int64
-
-	// Read and forward the response body in chunks
-	buffer := make([]byte, 1024) // Buffer size (you can adjust this)
-	for {
-		n, err := resp.Body.Read(buffer)
-		log.Printf("Read %d bytes from httpbin", n)
-
-		if n > 0 {
-			// Update hash with this chunk
-			hasher.Write(buffer[:n])
-
-			// Update content length counter
-			contentLength += int64(n)
-
-			// Write this chunk to the client
-			_, writeErr := w.WriteChunkedBody(buffer[:n])
-			if writeErr != nil {
-				log.Printf("Error writing chunk: %v", writeErr)
-				break
-			}
-		}
-
-		if err == io.EOF {
-			// End of response body
-			break
-		}
-
+	// Every exchange is appended to the HAR file as its response completes
+	var capture *har.Recorder
+	if *harPath != "" {
+		capture, err = har.OpenFile(*harPath)
 		if err != nil {
-			log.Printf("Error reading from httpbin: %v", err)
-			break
+			log.Fatalf("Error opening HAR file: %v", err)
 		}
+		defer func() {
+			if err := capture.Close(); err != nil {
+				log.Printf("Error writing HAR file: %v", err)
+			}
+		}()
 	}
 
-	// Finish the chunked body (writes the "0\r\n" marker)
-	_, err = w.WriteChunkedBodyDone()
-	if err != nil {
-		log.Printf("Error finalizing chunked response: %v", err)
-		return
-	}
-
-	// Get final hash
-	finalHash := hasher.Sum(nil)
-	hashString := hex.EncodeToString(finalHash)
-
-	// Create trailers
-	trailers := headers.NewHeaders()
-	trailers.Set("X-Content-SHA256", hashString)
-	trailers.Set("X-Content-Length", fmt.Sprintf("%d", contentLength))
-
-	// Write trailers
-	err = w.WriteTrailers(trailers)
-	if err != nil {
-		log.Printf("Error writing trailers: %v", err)
-	}
-}
-
-// serveVideo serves the video file from the assets directory
-func serveVideo(w *response.Writer) {
-	log.Printf("Serving video file")
-
-	// Set the status code to OK
-	w.WriteStatusLine(response.StatusOK)
-
-	// Read the video file from the assets directory
-	videoData, err := os.ReadFile("assets/vim.mp4")
-	if err != nil {
-		log.Printf("Error reading video file: %v", err)
-
-		// Return an error if we can't read the file
-		w.WriteStatusLine(response.StatusServerError)
-		h := headers.NewHeaders()
-		h.Set("Content-Type", "text/html; charset=utf-8")
-		h.Set("Connection", "close")
-		w.WriteHeaders(h)
-		w.WriteBody([]byte("<html><body><h1>Error</h1><p>Could not load video file</p></body></html>"))
-		return
-	}
-
-	// Set up headers for video content
-	h := headers.NewHeaders()
-	h.Set("Content-Type", "video/mp4")
-	h.Set("Connection", "close")
-	h.Set("Accept-Ranges", "bytes")
-	h.Set("Content-Length", fmt.Sprintf("%d", len(videoData)))
-	w.WriteHeaders(h)
-
-	// Write the video data to the response
-	_, err = w.WriteBody(videoData)
-	if err != nil {
-		log.Printf("Error writing video data: %v", err)
-	}
-
-	log.Printf("Successfully served video file of size %d bytes", len(videoData))
-}
-
-func main() {
 	// HTML content for responses
 	badRequestHTML := `<html>
   <head>
@@ -361,55 +176,134 @@ func main() {
   </body>
 </html>`
 
-	// Define our custom handler with the new signature
-	handler := func(req *request.Request, w *response.Writer) {
-		log.Printf("Handler called with path: %s", req.RequestLine.RequestTarget)
-
-		// Check if this is a request for the video file
-		if req.RequestLine.RequestTarget == "/video" {
-			serveVideo(w)
-			return
-		}
-
-		// Check if this is a request to be proxied to httpbin.org
-		if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-			proxyToHttpbin(req.RequestLine.RequestTarget, w)
-			return
-		}
+	// htmlPage returns a handler that writes a fixed HTML page with the given status
+	htmlPage := func(status response.StatusCode, body string) server.Handler {
+		return func(req *request.Request, w *response.Writer) {
+			htmlHeaders := headers.NewHeaders()
+			htmlHeaders.Set("Content-Type", "text/html; charset=utf-8")
 
-		// Set up common HTML headers
-		htmlHeaders := headers.NewHeaders()
-		htmlHeaders.Set("Content-Type", "text/html; charset=utf-8")
-		htmlHeaders.Set("Connection", "close")
-
-		switch req.RequestLine.RequestTarget {
-		case "/yourproblem":
-			log.Printf("Matched /yourproblem route")
-			w.WriteStatusLine(response.StatusBadRequest)
+			w.WriteStatusLine(status)
 			w.WriteHeaders(htmlHeaders)
-			w.WriteBody([]byte(badRequestHTML))
+			w.WriteBody([]byte(body))
+		}
+	}
 
-		case "/myproblem":
-			log.Printf("Matched /myproblem route")
-			w.WriteStatusLine(response.StatusServerError)
-			w.WriteHeaders(htmlHeaders)
-			w.WriteBody([]byte(serverErrorHTML))
+	// The proxy registers its metrics next to the server's
+	var serverMetrics *metrics.ServerMetrics
+	if *metricsPath != "" {
+		serverMetrics = metrics.NewServerMetrics(metrics.NewRegistry())
+	}
 
-		default:
-			log.Printf("Using default route")
-			w.WriteStatusLine(response.StatusOK)
-			w.WriteHeaders(htmlHeaders)
-			w.WriteBody([]byte(successHTML))
+	// Register our routes
+	// No middleware.Recoverer: the server recovers panics itself and reports them to OnPanic
+	r := router.New()
+	r.Get("/", htmlPage(response.StatusOK, successHTML))
+	r.Get("/yourproblem", htmlPage(response.StatusBadRequest, badRequestHTML))
+	r.Get("/myproblem", htmlPage(response.StatusServerError, serverErrorHTML))
+	// Static files, with the demo video at its old address
+	assets := static.Dir(*assetsDir)
+	assets.Prefix = "/assets"
+	assets.Listing = true
+	assets.Precompressed = true
+	r.Get("/assets/*path", assets.ServeHTTP)
+	r.Get("/video", func(req *request.Request, w *response.Writer) {
+		assets.ServeFile(req, w, "vim.mp4")
+	})
+	// Proxy everything under /httpbin to the upstreams. Without any, a local httpbin is
+	// started on a loopback port so the proxy works offline.
+	if len(proxyTargets) == 0 {
+		local := &server.Server{Addr: "127.0.0.1", DisableHTTP2: true, Handler: httpbin.New("").ServeHTTP}
+		if err := local.Start(); err != nil {
+			log.Fatalf("Error starting local httpbin: %v", err)
 		}
+		defer local.Close()
+		proxyTargets = stringList{fmt.Sprintf("http://127.0.0.1:%d", local.Port)}
 	}
+	pool, err := proxy.NewPool(proxyTargets...)
+	if err != nil {
+		log.Fatalf("Error configuring proxy: %v", err)
+	}
+	pool.Name = "httpbin"
+	pool.HashHeader = *proxyHashHeader
+	if pool.Policy, err = proxy.ParsePolicy(*proxyPolicy); err != nil {
+		log.Fatalf("Error configuring proxy: %v", err)
+	}
+	if serverMetrics != nil {
+		pool.Metrics = metrics.NewProxyMetrics(serverMetrics.Registry)
+	}
+	if *proxyHealthPath != "" {
+		stopChecking := pool.StartHealthChecks(*proxyHealthPath, *proxyHealthInterval)
+		defer stopChecking()
+	}
+	httpbinProxy := &proxy.ReverseProxy{Pool: pool, StripPrefix: "/httpbin"}
+	// The chunked relay demo: /httpbin/stream bodies are followed by their checksum as trailers
+	checksumProxy := &proxy.ReverseProxy{Pool: pool, StripPrefix: "/httpbin", ChecksumTrailers: true}
+	r.Get("/httpbin/stream/*path", checksumProxy.ServeHTTP)
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"} {
+		r.Handle(method, "/httpbin/*path", httpbinProxy.ServeHTTP)
+	}
+	// Stream the time to every subscriber once a second
+	clock := response.NewHub(60)
+	go func() {
+		for now := range time.Tick(time.Second) {
+			clock.Publish(response.Event{Event: "tick", Data: now.Format(time.RFC3339)})
+		}
+	}()
+	r.Get("/events", func(req *request.Request, w *response.Writer) {
+		stream, err := response.NewEventStream(w)
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		stream.Heartbeat(15 * time.Second)
+		clock.Serve(stream, req.Headers["last-event-id"])
+	})
+	// Echo every WebSocket message back
+	upgrader := &websocket.Upgrader{EnableCompression: true}
+	r.Get("/ws", func(req *request.Request, w *response.Writer) {
+		conn, err := upgrader.Upgrade(req, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			op, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(op, msg); err != nil {
+				return
+			}
+		}
+	})
 
 	// Start the server with our handler
-	s, err := Serve(port, handler)
-	if err != nil {
+	s := &server.Server{
+		Addr:         "localhost",
+		Port:         port,
+		Handler:      r.ServeHTTP,
+		AccessLog:    accessLog,
+		Capture:      capture,
+		TLSConfig:    tlsConfig,
+		DisableHTTP2: *disableHTTP2,
+		// Uploads go through the proxy as they arrive instead of piling up here first
+		StreamBody: func(req *request.Request) bool {
+			return strings.HasPrefix(req.Path(), "/httpbin/")
+		},
+	}
+	if serverMetrics != nil {
+		s.Metrics = serverMetrics
+		s.MetricsPath = *metricsPath
+	}
+	if err := s.Start(); err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
 	defer s.Close()
-	log.Printf("Server started on http://localhost:%d", port)
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	log.Printf("Server started on %s://localhost:%d", scheme, port)
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
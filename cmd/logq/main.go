@@ -0,0 +1,129 @@
+// logq searches the server's access logs, in any of the formats of -access-log-format,
+// and what logrotate left of them: gzipped files are read as they are. It started as
+// findPatternInLargeFile, a substring search on one goroutine; now the files are cut
+// into blocks that a pool of workers searches at the same time, and the matching lines
+// still come out in the order of the files.
+//
+// The arguments are conditions on the fields of a line, all of which have to hold, and
+// files, standard input if there are none. A condition is a field, a comparison and a
+// value:
+//
+//	status>=500  status=4xx  method=POST  path^=/api  target~\?id=\d+  ip=10.0.0.0/8
+//	bytes>1000000  duration>1s  time>=2024-05-01T12:00  ua~curl  referer!=-
+//
+// The comparisons are = != > >= < <=, ^= for a prefix and ~ for a regular expression.
+// Only the JSON format has the duration; other lines never match a duration condition.
+//
+//	go run ./cmd/logq 'status>=500' 'path^=/api' access.log access.log.1.gz
+//	go run ./cmd/logq -e 'timeout|reset' -n access.log
+//	go run ./cmd/logq -summary -top 20 'duration>1s' access.log*
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+func main() {
+	expr := flag.String("e", "", "regular expression the whole line has to match")
+	numbers := flag.Bool("n", false, "print the line number of each matching line")
+	count := flag.Bool("c", false, "only print how many lines match, per file")
+	summarize := flag.Bool("summary", false, "print a summary of the matching lines instead of them: status codes, methods, paths, durations")
+	top := flag.Int("top", 10, "paths shown in the summary")
+	workers := flag.Int("workers", runtime.NumCPU(), "blocks searched at the same time")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: logq [flags] [CONDITION...] [FILE...]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "conditions: FIELD OP VALUE, e.g. status>=500 path^=/api duration>1s\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "fields: bytes duration ip method path proto referer status target time ua\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "ops: = != > >= < <= ^= (prefix) ~ (regexp)\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	q := &query{}
+	if *expr != "" {
+		re, err := regexp.Compile(*expr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "logq: -e: %v\n", err)
+			os.Exit(2)
+		}
+		q.raw = re
+	}
+	conditions, files, err := parseArgs(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logq: %v\n", err)
+		os.Exit(2)
+	}
+	q.conditions = conditions
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	s := &scanner{
+		q:       q,
+		workers: max(1, *workers),
+		numbers: *numbers,
+		names:   len(files) > 1,
+		quiet:   *count || *summarize,
+		counts:  make(map[string]int),
+	}
+	if *summarize {
+		s.sum = newSummary()
+	}
+	total := s.scan(os.Stdout, files)
+
+	if *count {
+		if len(files) > 1 {
+			for _, name := range files {
+				fmt.Printf("%s:%d\n", name, s.counts[name])
+			}
+		} else {
+			fmt.Println(total)
+		}
+	}
+	if *summarize {
+		s.sum.print(os.Stdout, *top)
+	}
+
+	// Like grep: 1 if nothing matched, 2 if a file couldn't be read
+	switch {
+	case s.failures > 0:
+		os.Exit(2)
+	case total == 0:
+		os.Exit(1)
+	}
+}
+
+// parseArgs tells the conditions from the files. An argument that starts with a field
+// name and a comparison is a condition, unless a file of that name exists.
+func parseArgs(args []string) ([]condition, []string, error) {
+	var conditions []condition
+	var files []string
+	for _, arg := range args {
+		if _, err := os.Stat(arg); err == nil || !looksLikeCondition(arg) {
+			files = append(files, arg)
+			continue
+		}
+		c, err := parseCondition(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, files, nil
+}
+
+// looksLikeCondition reports whether arg starts with a field name and a comparison, so
+// that a mistyped value is an error rather than a missing file
+func looksLikeCondition(arg string) bool {
+	i := strings.IndexAny(arg, "=!<>^~")
+	if i <= 0 {
+		return false
+	}
+	_, ok := fields[strings.ToLower(arg[:i])]
+	return ok
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/accesslog"
+)
+
+// record is a parsed access log line
+type record struct {
+	accesslog.Entry
+	format accesslog.Format
+}
+
+// path is the target without its query string
+func (r *record) path() string {
+	path, _, _ := strings.Cut(r.Target, "?")
+	return path
+}
+
+// ip is the client address without its port, which only the JSON format has
+func (r *record) ip() string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// condition is one field comparison from the command line, like status>=500
+type condition struct {
+	field, op, value string
+
+	num    int64         // status and bytes
+	class  int64         // status=5xx compares status/100 with 5
+	dur    time.Duration // duration
+	t      time.Time     // time
+	prefix netip.Prefix  // ip=10.0.0.0/8
+	re     *regexp.Regexp
+}
+
+// fields are what a condition can look at, and the comparisons each allows
+var fields = map[string]string{
+	"status":   "number",
+	"bytes":    "number",
+	"duration": "duration",
+	"time":     "time",
+	"method":   "text",
+	"path":     "text",
+	"target":   "text",
+	"proto":    "text",
+	"ip":       "text",
+	"referer":  "text",
+	"ua":       "text",
+}
+
+// operators, the two-byte ones first so that >= isn't taken for >
+var operators = []string{">=", "<=", "!=", "^=", "=", ">", "<", "~"}
+
+// parseCondition parses field, operator and value, as in path^=/api or duration>1.5s
+func parseCondition(s string) (condition, error) {
+	i := strings.IndexAny(s, "=!<>^~")
+	if i <= 0 {
+		return condition{}, fmt.Errorf("%q: no comparison", s)
+	}
+	c := condition{field: strings.ToLower(s[:i])}
+	kind, ok := fields[c.field]
+	if !ok {
+		return condition{}, fmt.Errorf("%q: unknown field %q", s, c.field)
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(s[i:], op) {
+			c.op, c.value = op, s[i+len(op):]
+			break
+		}
+	}
+	if c.op == "" {
+		return condition{}, fmt.Errorf("%q: unknown comparison", s)
+	}
+
+	var err error
+	if c.op == "~" {
+		c.re, err = regexp.Compile(c.value)
+		return c, err
+	}
+	ordered := c.op == ">" || c.op == ">=" || c.op == "<" || c.op == "<="
+	switch kind {
+	case "number":
+		if c.field == "status" && len(c.value) == 3 && strings.HasSuffix(strings.ToLower(c.value), "xx") && (c.op == "=" || c.op == "!=") {
+			c.class, err = strconv.ParseInt(c.value[:1], 10, 64)
+		} else if c.op != "^=" {
+			c.num, err = strconv.ParseInt(c.value, 10, 64)
+		}
+	case "duration":
+		if c.op != "^=" {
+			c.dur, err = time.ParseDuration(c.value)
+		}
+	case "time":
+		if c.op != "^=" {
+			c.t, err = parseTime(c.value)
+		}
+	case "text":
+		if ordered {
+			return condition{}, fmt.Errorf("%q: %s can't be compared with %s", s, c.field, c.op)
+		}
+		if c.field == "ip" && strings.Contains(c.value, "/") {
+			c.prefix, err = netip.ParsePrefix(c.value)
+		}
+	}
+	if err != nil {
+		return condition{}, fmt.Errorf("%q: %w", s, err)
+	}
+	return c, nil
+}
+
+// parseTime takes a time from the command line, as precise as the user cares to be
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q, want 2006-01-02 or RFC 3339", s)
+}
+
+// match reports whether r satisfies the condition. Lines in the common and combined
+// formats have no duration, so no duration condition matches them.
+func (c *condition) match(r *record) bool {
+	switch c.field {
+	case "status":
+		if c.class != 0 {
+			return (int64(r.Status)/100 == c.class) == (c.op == "=")
+		}
+		return c.compareNumber(int64(r.Status))
+	case "bytes":
+		return c.compareNumber(r.Bytes)
+	case "duration":
+		if r.format != accesslog.FormatJSON {
+			return false
+		}
+		if c.re != nil || c.op == "^=" {
+			return c.compareText(r.Duration.String())
+		}
+		return compare(c.op, int64(r.Duration), int64(c.dur))
+	case "time":
+		if c.re != nil || c.op == "^=" {
+			return c.compareText(r.Time.Format(time.RFC3339))
+		}
+		return compare(c.op, r.Time.UnixNano(), c.t.UnixNano())
+	case "method":
+		if c.re == nil && c.op != "^=" {
+			return strings.EqualFold(r.Method, c.value) == (c.op == "=")
+		}
+		return c.compareText(r.Method)
+	case "path":
+		return c.compareText(r.path())
+	case "target":
+		return c.compareText(r.Target)
+	case "proto":
+		return c.compareText(r.Proto)
+	case "ip":
+		if c.prefix.IsValid() {
+			addr, err := netip.ParseAddr(r.ip())
+			return err == nil && c.prefix.Contains(addr.Unmap()) == (c.op == "=")
+		}
+		return c.compareText(r.ip())
+	case "referer":
+		return c.compareText(r.Referer)
+	case "ua":
+		return c.compareText(r.UserAgent)
+	}
+	return false
+}
+
+func (c *condition) compareNumber(n int64) bool {
+	if c.re != nil || c.op == "^=" {
+		return c.compareText(strconv.FormatInt(n, 10))
+	}
+	return compare(c.op, n, c.num)
+}
+
+func (c *condition) compareText(s string) bool {
+	switch c.op {
+	case "~":
+		return c.re.MatchString(s)
+	case "^=":
+		return strings.HasPrefix(s, c.value)
+	case "=":
+		return s == c.value
+	case "!=":
+		return s != c.value
+	}
+	return false
+}
+
+func compare(op string, a, b int64) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
+
+// query is everything a line has to match: the -e expression on the raw line, and all
+// of the conditions on its fields
+type query struct {
+	raw        *regexp.Regexp
+	conditions []condition
+}
+
+// match reports whether a line matches, parsing it if anything needs its fields. The
+// record is nil if the line was never parsed or isn't an access log line.
+func (q *query) match(line []byte, parse bool) (bool, *record) {
+	if q.raw != nil && !q.raw.Match(line) {
+		return false, nil
+	}
+	if len(q.conditions) == 0 && !parse {
+		return true, nil
+	}
+	e, format, err := accesslog.ParseLine(line)
+	if err != nil {
+		return len(q.conditions) == 0, nil
+	}
+	r := &record{Entry: e, format: format}
+	for i := range q.conditions {
+		if !q.conditions[i].match(r) {
+			return false, r
+		}
+	}
+	return true, r
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// blockSize is roughly how much of a file each worker gets at a time; a block is cut at
+// the end of a line, so it holds whole lines
+const blockSize = 4 << 20
+
+// block is a piece of a file, and what the worker made of it
+type block struct {
+	name      string // the file, for the output and errors
+	firstLine int    // the number of the block's first line in its file
+	data      []byte
+
+	// Filled in by the worker, before done is closed
+	out     bytes.Buffer
+	matches int
+	sum     *summary
+	done    chan struct{}
+}
+
+// scanner runs the query over files with a pool of workers and writes the results in
+// the order of the files and of the lines in them
+type scanner struct {
+	q        *query
+	workers  int
+	numbers  bool // prefix lines with their number
+	names    bool // prefix lines with the file name
+	quiet    bool // count and summarize only
+	sum      *summary
+	counts   map[string]int
+	failures int
+}
+
+// scan reads the files one after the other, and returns the number of matching lines
+func (s *scanner) scan(w io.Writer, files []string) int {
+	jobs := make(chan *block)
+	// Blocks waiting to be written, in order. Its size bounds the blocks in memory.
+	pending := make(chan *block, 2*s.workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				s.run(b)
+				close(b.done)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(pending)
+		defer close(jobs)
+		for _, name := range files {
+			if err := s.split(name, func(b *block) {
+				pending <- b
+				jobs <- b
+			}); err != nil {
+				// Written in order with the blocks, after what was read before the error
+				b := &block{name: name, done: make(chan struct{})}
+				fmt.Fprintf(&b.out, "logq: %v\n", err)
+				b.matches = -1
+				close(b.done)
+				pending <- b
+			}
+		}
+	}()
+
+	total := 0
+	out := bufio.NewWriterSize(w, 64<<10)
+	for b := range pending {
+		<-b.done
+		if b.matches < 0 {
+			out.Flush()
+			os.Stderr.Write(b.out.Bytes())
+			s.failures++
+			continue
+		}
+		out.Write(b.out.Bytes())
+		total += b.matches
+		s.counts[b.name] += b.matches
+		if b.sum != nil {
+			s.sum.merge(b.sum)
+		}
+	}
+	out.Flush()
+	wg.Wait()
+	return total
+}
+
+// split cuts a file, gzipped or not, into blocks and hands them to send
+func (s *scanner) split(name string, send func(*block)) error {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	br := bufio.NewReaderSize(r, 64<<10)
+	// Rotated logs are often gzipped; they start with the gzip magic number
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		defer zr.Close()
+		br = bufio.NewReaderSize(zr, 64<<10)
+	}
+
+	line := 1
+	for {
+		data := make([]byte, blockSize, blockSize+4096)
+		n, err := io.ReadFull(br, data)
+		data = data[:n]
+		if err == nil {
+			// Finish the last line
+			var rest []byte
+			rest, err = br.ReadBytes('\n')
+			data = append(data, rest...)
+		}
+		if len(data) > 0 {
+			send(&block{name: name, firstLine: line, data: data, done: make(chan struct{})})
+			line += bytes.Count(data, []byte{'\n'})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+}
+
+// run matches the lines of a block
+func (s *scanner) run(b *block) {
+	summarize := s.sum != nil
+	if summarize {
+		b.sum = newSummary()
+	}
+	data := b.data
+	for n := b.firstLine; len(data) > 0; n++ {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+
+		ok, r := s.q.match(line, summarize)
+		if !ok {
+			continue
+		}
+		b.matches++
+		if summarize {
+			b.sum.add(r)
+		}
+		if s.quiet {
+			continue
+		}
+		if s.names {
+			b.out.WriteString(b.name)
+			b.out.WriteByte(':')
+		}
+		if s.numbers {
+			b.out.WriteString(strconv.Itoa(n))
+			b.out.WriteByte(':')
+		}
+		b.out.Write(line)
+		b.out.WriteByte('\n')
+	}
+	// The worker is done with the data; the output is what stays until it is written
+	b.data = nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/accesslog"
+)
+
+// summary adds up the matching lines. Each block gets its own, merged in at the end, so
+// the workers never share one.
+type summary struct {
+	lines    int
+	unparsed int // matching lines that aren't access log lines
+	status   map[int]int
+	methods  map[string]int
+	paths    map[string]int
+	bytes    int64
+
+	first, last time.Time
+	durations   []time.Duration // only the JSON format has them
+}
+
+func newSummary() *summary {
+	return &summary{status: make(map[int]int), methods: make(map[string]int), paths: make(map[string]int)}
+}
+
+func (s *summary) add(r *record) {
+	s.lines++
+	if r == nil {
+		s.unparsed++
+		return
+	}
+	s.status[r.Status]++
+	if r.Method == "" {
+		s.methods["-"]++
+	} else {
+		s.methods[r.Method]++
+		s.paths[r.path()]++
+	}
+	s.bytes += r.Bytes
+	if s.first.IsZero() || r.Time.Before(s.first) {
+		s.first = r.Time
+	}
+	if r.Time.After(s.last) {
+		s.last = r.Time
+	}
+	if r.format == accesslog.FormatJSON {
+		s.durations = append(s.durations, r.Duration)
+	}
+}
+
+func (s *summary) merge(o *summary) {
+	s.lines += o.lines
+	s.unparsed += o.unparsed
+	for k, n := range o.status {
+		s.status[k] += n
+	}
+	for k, n := range o.methods {
+		s.methods[k] += n
+	}
+	for k, n := range o.paths {
+		s.paths[k] += n
+	}
+	s.bytes += o.bytes
+	if !o.first.IsZero() && (s.first.IsZero() || o.first.Before(s.first)) {
+		s.first = o.first
+	}
+	if o.last.After(s.last) {
+		s.last = o.last
+	}
+	s.durations = append(s.durations, o.durations...)
+}
+
+// count is a key and how often it came up
+type count[K comparable] struct {
+	key K
+	n   int
+}
+
+// sorted returns the counts of m, most first and then by key
+func sorted[K string | int](m map[K]int) []count[K] {
+	counts := make([]count[K], 0, len(m))
+	for k, n := range m {
+		counts = append(counts, count[K]{k, n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].n != counts[j].n {
+			return counts[i].n > counts[j].n
+		}
+		return counts[i].key < counts[j].key
+	})
+	return counts
+}
+
+// print writes the summary, with the top most requested paths
+func (s *summary) print(w io.Writer, top int) {
+	parsed := s.lines - s.unparsed
+	fmt.Fprintf(w, "%d lines", s.lines)
+	if s.unparsed > 0 {
+		fmt.Fprintf(w, " (%d not access log lines)", s.unparsed)
+	}
+	fmt.Fprintln(w)
+	if parsed == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s to %s, %s sent\n", s.first.Format(time.RFC3339), s.last.Format(time.RFC3339), formatBytes(s.bytes))
+
+	fmt.Fprintf(w, "\nstatus\n")
+	classes := make(map[int]int)
+	codes := make([]int, 0, len(s.status))
+	for code, n := range s.status {
+		classes[code/100] += n
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for class := 0; class <= 5; class++ {
+		if classes[class] == 0 {
+			continue
+		}
+		label := fmt.Sprintf("%dxx", class)
+		if class == 0 {
+			label = "-" // no response was written
+		}
+		fmt.Fprintf(w, "  %-6s %9d %6.1f%%  %s\n", label, classes[class], percent(classes[class], parsed), bar(classes[class], parsed))
+		for _, code := range codes {
+			if code/100 == class && class != 0 {
+				fmt.Fprintf(w, "    %-4d %9d %6.1f%%\n", code, s.status[code], percent(s.status[code], parsed))
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "\nmethods\n")
+	for _, c := range sorted(s.methods) {
+		fmt.Fprintf(w, "  %-8s %9d %6.1f%%\n", c.key, c.n, percent(c.n, parsed))
+	}
+
+	fmt.Fprintf(w, "\ntop paths\n")
+	paths := sorted(s.paths)
+	for _, c := range paths[:min(top, len(paths))] {
+		fmt.Fprintf(w, "  %9d %6.1f%%  %s\n", c.n, percent(c.n, parsed), c.key)
+	}
+	if len(paths) > top {
+		fmt.Fprintf(w, "  (%d more)\n", len(paths)-top)
+	}
+
+	if len(s.durations) > 0 {
+		sort.Slice(s.durations, func(i, j int) bool { return s.durations[i] < s.durations[j] })
+		at := func(p float64) time.Duration {
+			return s.durations[min(len(s.durations)-1, int(p*float64(len(s.durations))))]
+		}
+		fmt.Fprintf(w, "\nduration (%d lines)\n", len(s.durations))
+		fmt.Fprintf(w, "  p50 %v  p90 %v  p99 %v  max %v\n", at(0.50), at(0.90), at(0.99), s.durations[len(s.durations)-1])
+	}
+}
+
+func percent(n, total int) float64 {
+	return 100 * float64(n) / float64(total)
+}
+
+func bar(n, total int) string {
+	return strings.Repeat("#", (40*n+total-1)/total)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
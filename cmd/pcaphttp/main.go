@@ -0,0 +1,242 @@
+// pcaphttp reads a packet capture, as written by tcpdump -w or Wireshark, and prints the
+// HTTP/1.1 requests in it with the responses they got and how long those took. Each TCP
+// connection is put back together from its segments, and what the client sent goes through
+// the same request parser the server uses, so the capture shows what the server would
+// have made of the traffic.
+//
+//	sudo tcpdump -i lo -w traffic.pcap port 42069
+//	go run ./cmd/pcaphttp traffic.pcap
+//	go run ./cmd/pcaphttp -port 42069 -v traffic.pcapng
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/pcap"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// exchange is a request from a capture and the response it got, if any
+type exchange struct {
+	req      *request.Request
+	resp     *response.Response
+	sent     time.Time // first byte of the request
+	sentEnd  time.Time // last byte of the request
+	received time.Time // first byte of the response
+	done     time.Time // last byte of the response
+}
+
+func main() {
+	port := flag.Int("port", 0, "only show connections to this server port")
+	verbose := flag.Bool("v", false, "print the headers of requests and responses")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: pcaphttp [flags] FILE\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conns, skipped, err := assemble(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pcaphttp: %v\n", err)
+		os.Exit(1)
+	}
+
+	var shown, requests, unanswered int
+	for _, c := range conns {
+		if *port != 0 && int(c.Server.Src.Port()) != *port {
+			continue
+		}
+		if len(c.Client.Data) == 0 {
+			continue
+		}
+		shown++
+		fmt.Printf("%s %s -> %s\n", c.Start.Local().Format("15:04:05.000000"), c.Client.Src, c.Server.Src)
+		if gaps := c.Client.Gaps + c.Server.Gaps; gaps > 0 {
+			fmt.Printf("  (%d gaps in the capture, data after them may not parse)\n", gaps)
+		}
+		exchanges, err := pair(c)
+		for _, ex := range exchanges {
+			requests++
+			if ex.resp == nil {
+				unanswered++
+			}
+			printExchange(ex, *verbose)
+		}
+		if err != nil {
+			fmt.Printf("  %v\n", err)
+		}
+	}
+	fmt.Printf("\n%d connections, %d requests, %d without a response", shown, requests, unanswered)
+	if skipped > 0 {
+		fmt.Printf(", %d packets skipped", skipped)
+	}
+	fmt.Println()
+}
+
+// assemble reads every packet in the file and puts the TCP connections back together.
+// Packets that can't be decoded are counted rather than treated as fatal, as a capture
+// often ends in the middle of one.
+func assemble(path string) ([]*pcap.Conn, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	a := pcap.NewAssembler()
+	skipped := 0
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Keep what was read before a cut-off or corrupt end
+			fmt.Fprintf(os.Stderr, "pcaphttp: %v\n", err)
+			break
+		}
+		seg, err := pcap.DecodeTCP(p)
+		if errors.Is(err, pcap.ErrNotTCP) {
+			continue
+		}
+		if err != nil {
+			skipped++
+			continue
+		}
+		a.Add(seg, p.Time)
+	}
+	return a.Flush(), skipped, nil
+}
+
+// pair parses the requests of a connection, and the responses the server sent back to
+// them in the same order. It returns what it parsed up to the first error.
+func pair(c *pcap.Conn) ([]exchange, error) {
+	var exchanges []exchange
+	data := c.Client.Data
+	for base := 0; base < len(data); {
+		// Blank lines between requests are ignored, as servers do
+		if data[base] == '\r' || data[base] == '\n' {
+			base++
+			continue
+		}
+		// The parser may read past the end of a request; the trace says where it ended
+		end := -1
+		req, err := request.RequestFromReaderTrace(bytes.NewReader(data[base:]), func(state, offset int) {
+			if state == request.StateDone {
+				end = base + offset
+			}
+		})
+		if err != nil {
+			var perr *request.ParseError
+			if errors.As(err, &perr) {
+				return exchanges, fmt.Errorf("request %d: parse error at byte %d: %v", len(exchanges)+1, base+perr.Offset, err)
+			}
+			return exchanges, fmt.Errorf("request %d: %v", len(exchanges)+1, err)
+		}
+		if end <= base {
+			end = len(data)
+		}
+		exchanges = append(exchanges, exchange{
+			req:     req,
+			sent:    c.Client.TimeAt(base),
+			sentEnd: c.Client.TimeAt(end - 1),
+		})
+		base = end
+	}
+
+	data = c.Server.Data
+	rd := bytes.NewReader(data)
+	br := bufio.NewReaderSize(rd, 64<<10)
+	offset := func() int { return len(data) - rd.Len() - br.Buffered() }
+	for i := range exchanges {
+		for {
+			start := offset()
+			if start == len(data) {
+				return exchanges, nil
+			}
+			resp, err := response.ResponseFromReaderForMethod(br, exchanges[i].req.RequestLine.Method)
+			if err != nil {
+				return exchanges, fmt.Errorf("response %d: %v", i+1, err)
+			}
+			code := resp.StatusLine.StatusCode
+			// Interim responses come before the real one
+			if code >= 100 && code < 200 && code != 101 {
+				continue
+			}
+			exchanges[i].resp = resp
+			exchanges[i].received = c.Server.TimeAt(start)
+			exchanges[i].done = c.Server.TimeAt(offset() - 1)
+			if code == 101 {
+				// What follows is another protocol
+				return exchanges[:i+1], nil
+			}
+			break
+		}
+	}
+	return exchanges, nil
+}
+
+func printExchange(ex exchange, verbose bool) {
+	line := fmt.Sprintf("  %s %-7s %s", ex.sent.Local().Format("15:04:05.000000"), ex.req.RequestLine.Method, ex.req.RequestLine.RequestTarget)
+	if ex.resp == nil {
+		fmt.Printf("%s  (no response)\n", line)
+	} else {
+		fmt.Printf("%s  %d  %s  wait %s  transfer %s\n", line, ex.resp.StatusLine.StatusCode, size(len(ex.resp.Body)),
+			duration(ex.received.Sub(ex.sentEnd)), duration(ex.done.Sub(ex.received)))
+	}
+	if !verbose {
+		return
+	}
+	printHeaders("> ", ex.req.Headers)
+	if ex.resp != nil {
+		printHeaders("< ", ex.resp.Headers)
+	}
+}
+
+func printHeaders(prefix string, h headers.Headers) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("      %s%s: %s\n", prefix, name, h[name])
+	}
+}
+
+func size(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// duration rounds to the microseconds most captures have, and never goes below zero,
+// which timestamps taken on several CPUs can otherwise give
+func duration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	return d.Round(time.Microsecond).String()
+}
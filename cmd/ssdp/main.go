@@ -0,0 +1,159 @@
+// ssdp searches for, announces and watches services with SSDP, the discovery protocol of
+// UPnP. Everything goes to the multicast group 239.255.255.250:1900 unless -addr gives
+// another address, e.g. a loopback one for simulated networks without multicast.
+//
+//	go run ./cmd/ssdp search -st upnp:rootdevice
+//	go run ./cmd/ssdp advertise -location http://192.168.1.10:42069/device.xml
+//	go run ./cmd/ssdp listen
+//
+// With unicast addresses, advertise answers searches on -addr and sends its NOTIFYs to
+// -notify, where listen is:
+//
+//	go run ./cmd/ssdp listen -addr 127.0.0.1:1901
+//	go run ./cmd/ssdp advertise -addr 127.0.0.1:1900 -notify 127.0.0.1:1901
+//	go run ./cmd/ssdp search -addr 127.0.0.1:1900
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"httpfromtcp/internal/ssdp"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "search":
+		err = search(ctx, args)
+	case "advertise":
+		err = advertise(ctx, args)
+	case "listen":
+		err = listen(ctx, args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ssdp: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ssdp search|advertise|listen [flags]")
+	os.Exit(2)
+}
+
+// interfaceFlag adds -iface to fs and returns a function giving the interface it names
+func interfaceFlag(fs *flag.FlagSet) func() (*net.Interface, error) {
+	name := fs.String("iface", "", "network interface for multicast (default: the system's choice)")
+	return func() (*net.Interface, error) {
+		if *name == "" {
+			return nil, nil
+		}
+		return net.InterfaceByName(*name)
+	}
+}
+
+func search(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	addr := fs.String("addr", ssdp.MulticastAddr, "where to send the M-SEARCH")
+	target := fs.String("st", ssdp.All, "search target")
+	mx := fs.Duration("mx", 2*time.Second, "how long devices may take to answer, 1s to 5s")
+	fs.Parse(args)
+
+	found, err := ssdp.Search(ctx, *addr, *target, *mx)
+	if err != nil {
+		return err
+	}
+	for _, s := range found {
+		fmt.Printf("%s\n  type     %s\n  location %s\n  server   %s\n  max-age  %s\n", s.USN, s.Type, s.Location, s.Server, s.MaxAge)
+	}
+	fmt.Printf("%d found\n", len(found))
+	return nil
+}
+
+func advertise(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("advertise", flag.ExitOnError)
+	addr := fs.String("addr", ssdp.MulticastAddr, "where to answer searches")
+	notify := fs.String("notify", "", "where to send NOTIFYs (default: -addr)")
+	uuid := fs.String("uuid", "", "device UUID (default: a random one)")
+	deviceType := fs.String("type", "urn:schemas-upnp-org:device:Basic:1", "device type announced besides the root device")
+	location := fs.String("location", "http://localhost:42069/device.xml", "URL of the device description")
+	maxAge := fs.Duration("max-age", ssdp.DefaultMaxAge, "how long announcements hold")
+	iface := interfaceFlag(fs)
+	fs.Parse(args)
+
+	ifi, err := iface()
+	if err != nil {
+		return err
+	}
+	if *uuid == "" {
+		*uuid = randomUUID()
+	}
+	server := fmt.Sprintf("%s/1.0 UPnP/1.1 httpfromtcp/1.0", runtime.GOOS)
+	device := "uuid:" + *uuid
+	// A root device announces itself three times: as a root device, by its UUID and by its type
+	a := &ssdp.Advertiser{
+		Addr:       *addr,
+		NotifyAddr: *notify,
+		Interface:  ifi,
+		Services: []ssdp.Service{
+			{Type: ssdp.RootDevice, USN: device + "::" + ssdp.RootDevice, Location: *location, Server: server, MaxAge: *maxAge},
+			{Type: device, USN: device, Location: *location, Server: server, MaxAge: *maxAge},
+			{Type: *deviceType, USN: device + "::" + *deviceType, Location: *location, Server: server, MaxAge: *maxAge},
+		},
+	}
+	if err := a.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("Advertising %s on %s, Ctrl-C to stop\n", device, a.LocalAddr())
+	<-ctx.Done()
+	return a.Close()
+}
+
+func listen(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("listen", flag.ExitOnError)
+	addr := fs.String("addr", ssdp.MulticastAddr, "where to listen for NOTIFYs")
+	iface := interfaceFlag(fs)
+	fs.Parse(args)
+
+	ifi, err := iface()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Listening on %s, Ctrl-C to stop\n", *addr)
+	return ssdp.Listen(ctx, *addr, ifi, func(n *ssdp.Notification) {
+		nts := "byebye"
+		if n.Alive {
+			nts = "alive "
+		}
+		fmt.Printf("%s %s %s from %s\n", time.Now().Format("15:04:05"), nts, n.USN, n.From)
+		if n.Alive {
+			fmt.Printf("         %s max-age %s\n", n.Location, n.MaxAge)
+		}
+	})
+}
+
+// randomUUID returns a version 4 UUID
+func randomUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
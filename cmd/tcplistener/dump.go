@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const bytesPerRow = 16
+
+// mark is a note shown in a dump just before the byte at offset
+type mark struct {
+	offset int
+	text   string
+}
+
+// addMark appends a mark, replacing the last one if it is at the same offset: a body that
+// is empty ends where it starts, and the next request starts where the last one ended.
+func addMark(marks []mark, offset int, text string) []mark {
+	if n := len(marks); n > 0 && marks[n-1].offset == offset {
+		marks[n-1].text = text
+		return marks
+	}
+	return append(marks, mark{offset, text})
+}
+
+// hexdump writes data as offset, hex and ASCII columns, 16 bytes to a row, with CR and LF
+// shown as ␍ and ␊. A row is cut short where a mark falls inside it, so the note sits right
+// before the byte it is about; columns stay aligned to the offset in the stream.
+func hexdump(w io.Writer, data []byte, marks []mark) {
+	sort.SliceStable(marks, func(i, j int) bool { return marks[i].offset < marks[j].offset })
+
+	next := 0 // first mark not yet printed
+	for pos := 0; pos < len(data); {
+		for next < len(marks) && marks[next].offset <= pos {
+			fmt.Fprintf(w, "  -- %s\n", marks[next].text)
+			next++
+		}
+
+		end := min((pos/bytesPerRow+1)*bytesPerRow, len(data))
+		if next < len(marks) && marks[next].offset < end {
+			end = marks[next].offset
+		}
+		writeRow(w, pos, data[pos:end])
+		pos = end
+	}
+	for ; next < len(marks); next++ {
+		fmt.Fprintf(w, "  -- %s\n", marks[next].text)
+	}
+}
+
+// writeRow prints the bytes in row, which start at offset and don't cross a 16 byte boundary
+func writeRow(w io.Writer, offset int, row []byte) {
+	var hex, ascii strings.Builder
+	first := offset % bytesPerRow
+	for col := 0; col < bytesPerRow; col++ {
+		if col == bytesPerRow/2 {
+			hex.WriteByte(' ')
+		}
+		i := col - first
+		if i < 0 || i >= len(row) {
+			hex.WriteString("   ")
+			ascii.WriteByte(' ')
+			continue
+		}
+		fmt.Fprintf(&hex, "%02x ", row[i])
+		ascii.WriteString(visible(row[i]))
+	}
+	fmt.Fprintf(w, "  %08x  %s |%s|\n", offset, hex.String(), ascii.String())
+}
+
+// recorder passes reads through and keeps a copy of the first max bytes
+type recorder struct {
+	r     io.Reader
+	max   int
+	data  []byte
+	total int
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.total += n
+	if keep := min(n, r.max-len(r.data)); keep > 0 {
+		r.data = append(r.data, p[:keep]...)
+	}
+	return n, err
+}
+
+// summary describes how much was recorded, e.g. "312 bytes" or "65536 of 1048576 bytes shown"
+func (r *recorder) summary() string {
+	if len(r.data) < r.total {
+		return fmt.Sprintf("%d of %d bytes shown", len(r.data), r.total)
+	}
+	return fmt.Sprintf("%d bytes", r.total)
+}
+
+// visible returns how b is shown in the ASCII column
+func visible(b byte) string {
+	switch {
+	case b == '\r':
+		return "␍"
+	case b == '\n':
+		return "␊"
+	case b == '\t':
+		return "␉"
+	case b >= 0x20 && b < 0x7f:
+		return string(rune(b))
+	}
+	return "."
+}
@@ -1,52 +1,272 @@
+// tcplistener shows what arrives on a TCP connection and what the request parser makes of
+// it: the raw bytes as hex and ASCII with CR and LF made visible, where the parser moved from
+// one state to the next, and the byte offset of anything it rejected.
+//
+// On its own it answers every request itself, with the request as parsed. With -upstream it
+// sits in front of a server instead, passing bytes through unchanged and dumping both
+// directions once the connection is over. With -lines it only prints the lines that arrive,
+// as they arrive, whichever of LF, CRLF or CR ends them.
+//
+//	go run ./cmd/tcplistener
+//	go run ./cmd/tcplistener -addr localhost:9000 -upstream localhost:42069
+//	go run ./cmd/tcplistener -lines
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/lines"
 	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func main() {
-	listener, err := net.Listen("tcp", "localhost:42069")
+	addr := flag.String("addr", "localhost:42069", "address to listen on")
+	upstream := flag.String("upstream", "", "forward connections to this host:port and log both directions")
+	maxDump := flag.Int("max-dump", 64<<10, "bytes per direction kept for the dump")
+	timeout := flag.Duration("timeout", 30*time.Second, "close connections idle for this long")
+	lineMode := flag.Bool("lines", false, "print the lines received instead of parsing requests")
+	maxLine := flag.Int("max-line", lines.DefaultMaxLength, "longest line accepted in -lines mode")
+	flag.Parse()
+
+	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error listening: %v\n", err)
 		os.Exit(1)
 	}
 	defer listener.Close()
 
-	fmt.Println("Server listening on localhost:42069")
+	if *upstream != "" {
+		fmt.Printf("Server listening on %s, forwarding to %s\n", listener.Addr(), *upstream)
+	} else {
+		fmt.Printf("Server listening on %s\n", listener.Addr())
+	}
 
+	in := &inspector{upstream: *upstream, maxDump: *maxDump, timeout: *timeout, out: os.Stdout}
+	if *lineMode {
+		in.maxLine = *maxLine
+	}
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error accepting connection: %v\n", err)
 			continue // Continue to the next iteration instead of exiting
 		}
+		go in.handle(conn)
+	}
+}
+
+// inspector handles connections concurrently. Each one is reported as a single block,
+// so the output of connections that overlap doesn't interleave.
+type inspector struct {
+	upstream string
+	maxDump  int
+	timeout  time.Duration
+	maxLine  int // print lines of up to this length instead of parsing; 0 to parse
+	out      io.Writer
 
-		fmt.Println("Connection accepted")
+	mu     sync.Mutex // guards out
+	nextID atomic.Int64
+}
 
-		// Get a channel of lines from the connection
-		// linesChan := getLinesChannel(conn)
+func (in *inspector) handle(conn net.Conn) {
+	defer conn.Close()
+	id := in.nextID.Add(1)
+	start := time.Now()
+	if in.maxLine > 0 {
+		in.printLines(conn, id, start)
+		return
+	}
 
-		// When we call request.RequestFromReader(conn), it uses the Read method from net.Conn interface
-		req, err := request.RequestFromReader(conn)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading request: %v\n", err)
-			conn.Close()
-			continue // Continue to the next iteration instead of exiting
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "#%d connection from %s\n", id, conn.RemoteAddr())
+	if in.upstream != "" {
+		in.forward(conn, &report)
+	} else {
+		in.answer(conn, &report)
+	}
+	fmt.Fprintf(&report, "#%d closed after %s\n\n", id, time.Since(start).Round(time.Millisecond))
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.out.Write(report.Bytes())
+}
+
+// printLines prints each line from conn as soon as it is complete, rather than as one
+// block at the end, for watching what a client sends
+func (in *inspector) printLines(conn net.Conn, id int64, start time.Time) {
+	in.printf("#%d connection from %s\n", id, conn.RemoteAddr())
+	for line := range lines.Channel(context.Background(), idleReader{conn, in.timeout}, in.maxLine) {
+		if line.Err != nil {
+			in.printf("#%d error: %v\n", id, line.Err)
+			break
+		}
+		in.printf("#%d %s\n", id, line.Text)
+	}
+	in.printf("#%d closed after %s\n", id, time.Since(start).Round(time.Millisecond))
+}
+
+func (in *inspector) printf(format string, args ...any) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	fmt.Fprintf(in.out, format, args...)
+}
+
+// answer parses one request from conn and replies with what the parser made of it
+func (in *inspector) answer(conn net.Conn, report *bytes.Buffer) {
+	conn.SetDeadline(time.Now().Add(in.timeout))
+	rec := &recorder{r: conn, max: in.maxDump}
+	var marks []mark
+	req, err := request.RequestFromReaderTrace(rec, func(state, offset int) {
+		marks = addMark(marks, offset, stateNote(1, state))
+	})
+	var perr *request.ParseError
+	if errors.As(err, &perr) {
+		marks = addMark(marks, perr.Offset, "parse error: "+perr.Error())
+	}
+
+	fmt.Fprintf(report, "client -> server, %s\n", rec.summary())
+	hexdump(report, rec.data, marks)
+
+	w := response.NewWriter(conn)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Connection", "close")
+	switch {
+	case perr != nil:
+		fmt.Fprintf(report, "parse error at byte %d, in the %s: %v\n", perr.Offset, request.StateName(perr.State), perr.Err)
+		w.WriteStatusLine(response.StatusBadRequest)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(fmt.Sprintf("parse error at byte %d: %v\n", perr.Offset, perr.Err)))
+	case err != nil:
+		fmt.Fprintf(report, "error reading request: %v\n", err)
+		return
+	default:
+		report.WriteString(req.String())
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(req.String()))
+	}
+	w.Flush()
+}
+
+// forward relays conn to the upstream in both directions and dumps what went each way
+func (in *inspector) forward(conn net.Conn, report *bytes.Buffer) {
+	up, err := net.DialTimeout("tcp", in.upstream, in.timeout)
+	if err != nil {
+		fmt.Fprintf(report, "error connecting to %s: %v\n", in.upstream, err)
+		return
+	}
+	defer up.Close()
+
+	toServer := &recorder{r: idleReader{conn, in.timeout}, max: in.maxDump}
+	toClient := &recorder{r: idleReader{up, in.timeout}, max: in.maxDump}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(up, toServer)
+		// Pass the client's half-close on, the server may still be answering
+		if tcp, ok := up.(*net.TCPConn); ok {
+			tcp.CloseWrite()
 		}
+	}()
+	io.Copy(conn, toClient)
+	// Once the server is done there is nothing left to relay
+	conn.Close()
+	<-done
 
-		// Range over the channel and print each line
-		// for line := range linesChan {
-		// 	fmt.Println(line) // Just print the line without "read:" prefix
-		// }
+	reqMarks, methods := requestMarks(toServer.data)
+	fmt.Fprintf(report, "client -> server, %s\n", toServer.summary())
+	hexdump(report, toServer.data, reqMarks)
+	fmt.Fprintf(report, "server -> client, %s\n", toClient.summary())
+	hexdump(report, toClient.data, responseMarks(toClient.data, methods))
+}
 
-		// Print the request details
-		fmt.Println(req)
+// requestMarks parses the requests in data one after another and notes where each
+// state of each one starts. It also returns their methods, needed to read the responses.
+func requestMarks(data []byte) ([]mark, []string) {
+	var marks []mark
+	var methods []string
+	for base, n := 0, 1; base < len(data); n++ {
+		end := -1
+		req, err := request.RequestFromReaderTrace(bytes.NewReader(data[base:]), func(state, offset int) {
+			marks = addMark(marks, base+offset, stateNote(n, state))
+			if state == request.StateDone {
+				end = base + offset
+			}
+		})
+		var perr *request.ParseError
+		if errors.As(err, &perr) {
+			marks = addMark(marks, base+perr.Offset, "parse error: "+perr.Error())
+			break
+		}
+		if err != nil || end <= base {
+			break
+		}
+		methods = append(methods, req.RequestLine.Method)
+		base = end
+	}
+	return marks, methods
+}
 
-		fmt.Println("Connection closed")
+// responseMarks notes where each response in data starts, with its status, given the
+// methods of the requests they answer
+func responseMarks(data []byte, methods []string) []mark {
+	var marks []mark
+	rd := bytes.NewReader(data)
+	// A buffer the size of the data lets the parser see all of it without reading past a response
+	br := bufio.NewReaderSize(rd, len(data))
+	for n := 1; ; {
+		start := len(data) - rd.Len() - br.Buffered()
+		if start >= len(data) {
+			break
+		}
+		method := "GET"
+		if n <= len(methods) {
+			method = methods[n-1]
+		}
+		resp, err := response.ResponseFromReaderForMethod(br, method)
+		if err != nil {
+			marks = append(marks, mark{start, fmt.Sprintf("response %d: parse error: %v", n, err)})
+			break
+		}
+		s := resp.StatusLine
+		marks = append(marks, mark{start, fmt.Sprintf("response %d: %d %s", n, s.StatusCode, s.ReasonPhrase)})
+		// Interim 1xx responses come before the one that answers the request
+		if s.StatusCode >= 200 {
+			n++
+		}
 	}
+	return marks
+}
+
+func stateNote(n, state int) string {
+	if state == request.StateDone {
+		return fmt.Sprintf("request %d: end", n)
+	}
+	return fmt.Sprintf("request %d: %s", n, request.StateName(state))
+}
+
+// idleReader gives up on a connection that has been silent for timeout
+type idleReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
 }
 
 /*
@@ -0,0 +1,280 @@
+// udplistener is the receiving end of udpsender. It prints the lines that arrive, put back
+// together per sender as UDP has no notion of lines or connections, and keeps statistics
+// for every sender: datagrams, bytes, lines and, for datagrams that start with a sequence
+// number ("#12 hello"), how many were lost, came out of order or twice.
+//
+// With -echo every datagram is also sent back as it came, so that udpsender -seq can show
+// round-trip times.
+//
+//	go run ./cmd/udplistener -echo
+//	go run ./cmd/udpsender -seq
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"httpfromtcp/internal/lines"
+)
+
+// maxMissing bounds the sequence numbers remembered as missing per peer, so that a jump
+// in the numbers can't use up memory; late datagrams beyond it count as duplicates
+const maxMissing = 4096
+
+// peer is everything known about one sender
+type peer struct {
+	addr *net.UDPAddr
+
+	// The datagrams go into w, and the lines come out of a lines.Channel on the other end.
+	// Both are nil while the peer is idle.
+	w    *io.PipeWriter
+	done chan struct{} // closed once the last line has been printed
+
+	packets, bytes, lines int
+	last                  time.Time
+
+	// Sequence numbers, counted from the first one seen
+	sequenced              bool
+	next                   uint64
+	lost, reordered, dupes int
+	missing                map[uint64]bool
+}
+
+type listener struct {
+	conn    *net.UDPConn
+	echo    bool
+	idle    time.Duration
+	maxLine int
+
+	mu    sync.Mutex // guards peers and their counters, and output
+	peers map[string]*peer
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:42069", "address to listen on")
+	echo := flag.Bool("echo", false, "send every datagram back to its sender")
+	idle := flag.Duration("idle", time.Minute, "end a sender's last line when it has been quiet this long")
+	every := flag.Duration("stats", 0, "print statistics this often (default: only on exit)")
+	maxLine := flag.Int("max-line", lines.DefaultMaxLength, "longest line accepted from a sender")
+	flag.Parse()
+
+	udpAddr, err := net.ResolveUDPAddr("udp", *addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving address: %v\n", err)
+		os.Exit(1)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listening: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Listening for UDP on %s\n", conn.LocalAddr())
+
+	l := &listener{conn: conn, echo: *echo, idle: *idle, maxLine: *maxLine, peers: make(map[string]*peer)}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		conn.Close()
+	}()
+	if *every > 0 {
+		go func() {
+			for range time.Tick(*every) {
+				l.printStats()
+			}
+		}()
+	}
+
+	l.serve()
+	l.closeIdle(0)
+	l.printStats()
+}
+
+func (l *listener) serve() {
+	buf := make([]byte, 64<<10)
+	lastSweep := time.Now()
+	for {
+		// Wake up now and then to end the lines of senders that went quiet
+		l.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := l.conn.ReadFromUDP(buf)
+		if time.Since(lastSweep) >= time.Second {
+			l.closeIdle(l.idle)
+			lastSweep = time.Now()
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		l.receive(buf[:n], from)
+	}
+}
+
+func (l *listener) receive(data []byte, from *net.UDPAddr) {
+	if l.echo {
+		// A lost echo is the sender's to notice, like any lost datagram
+		l.conn.WriteToUDP(data, from)
+	}
+
+	l.mu.Lock()
+	p := l.peers[from.String()]
+	if p == nil {
+		p = &peer{addr: from, missing: make(map[uint64]bool)}
+		l.peers[from.String()] = p
+	}
+	p.packets++
+	p.bytes += len(data)
+	p.last = time.Now()
+	if seq, rest, ok := cutSeq(data); ok {
+		p.sequence(seq)
+		data = rest
+	}
+	if p.w == nil {
+		l.start(p)
+	}
+	w := p.w
+	l.mu.Unlock()
+
+	// Blocks until the line reader has taken it all, after which buf can be reused.
+	// It fails if the reader gave up on a line too long, and the next datagram starts
+	// over, or if closeIdle closed the pipe in the meantime: then the datagram goes
+	// into a new one.
+	if n, err := w.Write(data); err != nil {
+		l.mu.Lock()
+		if p.w == w {
+			p.w, p.done = nil, nil
+			l.mu.Unlock()
+			return
+		}
+		if p.w == nil {
+			l.start(p)
+		}
+		w = p.w
+		l.mu.Unlock()
+		w.Write(data[n:])
+	}
+}
+
+// start opens the pipe the peer's datagrams go through to be split into lines
+func (l *listener) start(p *peer) {
+	r, w := io.Pipe()
+	p.w, p.done = w, make(chan struct{})
+	ch := lines.Channel(context.Background(), r, l.maxLine)
+	done := p.done
+	go func() {
+		defer close(done)
+		for line := range ch {
+			l.mu.Lock()
+			if line.Err != nil {
+				fmt.Printf("%s  error: %v\n", p.addr, line.Err)
+			} else {
+				p.lines++
+				fmt.Printf("%s  %s\n", p.addr, line.Text)
+			}
+			l.mu.Unlock()
+		}
+	}()
+}
+
+// pipe is a peer's pipe as it was when closeIdle decided to close it
+type pipe struct {
+	p    *peer
+	w    *io.PipeWriter
+	done chan struct{}
+}
+
+// closeIdle ends the pipes of peers quiet for longer than idle, so that a last line
+// without a newline is printed. The statistics stay.
+func (l *listener) closeIdle(idle time.Duration) {
+	l.mu.Lock()
+	var closing []pipe
+	for _, p := range l.peers {
+		if p.w != nil && time.Since(p.last) >= idle {
+			closing = append(closing, pipe{p, p.w, p.done})
+			// The next datagram starts a new pipe rather than going into this one
+			p.w, p.done = nil, nil
+		}
+	}
+	l.mu.Unlock()
+
+	for _, c := range closing {
+		c.w.Close()
+		<-c.done
+	}
+}
+
+func (l *listener) printStats() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	peers := make([]*peer, 0, len(l.peers))
+	for _, p := range l.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].addr.String() < peers[j].addr.String() })
+
+	fmt.Printf("\n%-22s %8s %10s %8s %6s %9s %6s  %s\n", "peer", "packets", "bytes", "lines", "lost", "reordered", "dupes", "last seen")
+	for _, p := range peers {
+		lost, reordered, dupes := "-", "-", "-"
+		if p.sequenced {
+			lost, reordered, dupes = strconv.Itoa(p.lost), strconv.Itoa(p.reordered), strconv.Itoa(p.dupes)
+		}
+		fmt.Printf("%-22s %8d %10d %8d %6s %9s %6s  %s ago\n", p.addr, p.packets, p.bytes, p.lines,
+			lost, reordered, dupes, time.Since(p.last).Round(time.Second))
+	}
+	if len(peers) == 0 {
+		fmt.Println("(nothing received)")
+	}
+}
+
+// sequence counts a datagram's sequence number: one past the highest seen is in order,
+// a jump means the ones in between are lost until they turn up late
+func (p *peer) sequence(seq uint64) {
+	switch {
+	case !p.sequenced:
+		p.sequenced, p.next = true, seq+1
+	case seq == p.next:
+		p.next++
+	case seq > p.next:
+		for s := p.next; s < seq && len(p.missing) < maxMissing; s++ {
+			p.missing[s] = true
+		}
+		p.lost += int(seq - p.next)
+		p.next = seq + 1
+	case p.missing[seq]:
+		delete(p.missing, seq)
+		p.lost--
+		p.reordered++
+	default:
+		p.dupes++
+	}
+}
+
+// cutSeq takes a "#12 " sequence number off the start of a datagram
+func cutSeq(data []byte) (uint64, []byte, bool) {
+	if len(data) < 3 || data[0] != '#' {
+		return 0, data, false
+	}
+	end := bytes.IndexByte(data, ' ')
+	if end < 2 {
+		return 0, data, false
+	}
+	seq, err := strconv.ParseUint(string(data[1:end]), 10, 64)
+	if err != nil {
+		return 0, data, false
+	}
+	return seq, data[end+1:], true
+}
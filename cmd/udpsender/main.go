@@ -1,27 +1,69 @@
+// udpsender sends what is typed on stdin as UDP datagrams, one line each. With -httpu a
+// datagram is a whole HTTPU message instead: lines are collected until an empty one and
+// sent with CRLF line ends, and whatever comes back is printed, e.g. to try an M-SEARCH
+// by hand:
+//
+//	go run ./cmd/udpsender -httpu -addr 239.255.255.250:1900
+//	> M-SEARCH * HTTP/1.1
+//	> HOST: 239.255.255.250:1900
+//	> MAN: "ssdp:discover"
+//	> MX: 1
+//	> ST: ssdp:all
+//	>
+//
+// With -seq every line goes out as "#N line", numbered from 1, which udplistener uses to
+// count lost datagrams; when it echoes them back the round-trip time is printed.
 package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// sent remembers when numbered datagrams went out, to time their echoes
+type sent struct {
+	mu sync.Mutex
+	at map[uint64]time.Time
+}
+
 func main() {
-	addr, err := net.ResolveUDPAddr("udp", "localhost:42069")
+	target := flag.String("addr", "localhost:42069", "host:port to send to")
+	httpu := flag.Bool("httpu", false, "send a message per datagram, ended by an empty line")
+	seq := flag.Bool("seq", false, "number the datagrams, and time the echoes of udplistener -echo")
+	flag.Parse()
+	if *httpu && *seq {
+		fmt.Println("-seq and -httpu can't be used together")
+		return
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", *target)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
+	// An unconnected socket, so replies from other addresses than the one sent to, as
+	// devices answering a multicast search, get through
+	conn, err := net.ListenUDP("udp", nil)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	defer conn.Close()
 
+	times := &sent{at: make(map[uint64]time.Time)}
+	go printReplies(conn, times)
+
 	reader := bufio.NewReader(os.Stdin)
+	var message strings.Builder
+	var next uint64
 
 	for {
 		// Print a prompt character
@@ -34,8 +76,26 @@ func main() {
 			return
 		}
 
-		// Write the line to the UDP connection
-		count, err := conn.Write([]byte(line))
+		datagram := line
+		if *httpu {
+			line = strings.TrimRight(line, "\r\n")
+			message.WriteString(line + "\r\n")
+			if line != "" {
+				continue
+			}
+			datagram = message.String()
+			message.Reset()
+		}
+		if *seq {
+			next++
+			datagram = fmt.Sprintf("#%d %s", next, datagram)
+			times.mu.Lock()
+			times.at[next] = time.Now()
+			times.mu.Unlock()
+		}
+
+		// Write the datagram to the UDP connection
+		count, err := conn.WriteToUDP([]byte(datagram), addr)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -44,3 +104,36 @@ func main() {
 		fmt.Printf("Sent %d bytes\n", count)
 	}
 }
+
+// printReplies prints every datagram that arrives, with who sent it, and for the echo
+// of a numbered datagram how long it took
+func printReplies(conn *net.UDPConn, times *sent) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if seq, ok := echoSeq(buf[:n]); ok {
+			times.mu.Lock()
+			at, found := times.at[seq]
+			delete(times.at, seq)
+			times.mu.Unlock()
+			if found {
+				fmt.Printf("\n< echo of #%d after %s\n> ", seq, time.Since(at).Round(time.Microsecond))
+				continue
+			}
+		}
+		fmt.Printf("\n< %d bytes from %s\n%s\n> ", n, from, strings.ReplaceAll(string(buf[:n]), "\r\n", "\n"))
+	}
+}
+
+// echoSeq reads the "#12 " sequence number at the start of an echoed datagram
+func echoSeq(data []byte) (uint64, bool) {
+	num, _, ok := strings.Cut(string(data), " ")
+	if !ok || !strings.HasPrefix(num, "#") {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(num[1:], 10, 64)
+	return seq, err == nil
+}
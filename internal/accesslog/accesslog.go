@@ -0,0 +1,252 @@
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Format selects how each access log line is written
+type Format int
+
+const (
+	FormatCommon   Format = iota // Apache Common Log Format
+	FormatCombined               // Common plus referer and user agent
+	FormatJSON                   // one JSON object per line, via log/slog
+)
+
+// clfTimeFormat is the timestamp layout used by Apache, e.g. 10/Oct/2000:13:55:36 -0700
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// ParseFormat turns "common", "combined" or "json" into a Format
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "common", "clf":
+		return FormatCommon, nil
+	case "combined":
+		return FormatCombined, nil
+	case "json":
+		return FormatJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown access log format %q: expected common, combined or json", name)
+	}
+}
+
+// Entry is everything we record about one request
+type Entry struct {
+	Time       time.Time // when the request started
+	RemoteAddr string    // "ip:port" of the client
+	Method     string
+	Target     string
+	Proto      string // "HTTP/1.1"
+	Status     int
+	Bytes      int64 // response body bytes
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+}
+
+// Logger writes one line per request to an io.Writer.
+// It is safe for concurrent use by all connections of a server.
+type Logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format Format
+	json   slog.Handler
+
+	// path and file are only set for loggers created with OpenFile, so they can be reopened
+	path string
+	file *os.File
+}
+
+// New creates a logger that writes to out in the given format
+func New(out io.Writer, format Format) *Logger {
+	l := &Logger{out: out, format: format}
+	l.json = slog.NewJSONHandler(lockedWriter{l}, &slog.HandlerOptions{ReplaceAttr: dropLevel})
+	return l
+}
+
+// OpenFile creates a logger that appends to the file at path, creating it if needed.
+// Call Reopen (or ReopenOnSIGHUP) after the file has been rotated away.
+func OpenFile(path string, format Format) (*Logger, error) {
+	file, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := New(file, format)
+	l.path = path
+	l.file = file
+	return l, nil
+}
+
+func openLogFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %w", err)
+	}
+	return file, nil
+}
+
+// Reopen closes the log file and opens it again at the same path, so that
+// after logrotate has renamed the old file we start writing to a fresh one.
+// It is a no-op for loggers that don't write to a file.
+func (l *Logger) Reopen() error {
+	if l.path == "" {
+		return nil
+	}
+
+	file, err := openLogFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	old := l.file
+	l.file = file
+	l.out = file
+	l.mu.Unlock()
+
+	return old.Close()
+}
+
+// ReopenOnSIGHUP reopens the log file every time the process receives SIGHUP,
+// until the returned stop function is called
+func (l *Logger) ReopenOnSIGHUP() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if err := l.Reopen(); err != nil {
+					fmt.Fprintf(os.Stderr, "Error reopening access log: %v\n", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// Close closes the log file, if the logger owns one
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Log writes the entry as a single line
+func (l *Logger) Log(e Entry) {
+	if l.format == FormatJSON {
+		l.logJSON(e)
+		return
+	}
+
+	line := formatCommon(e)
+	if l.format == FormatCombined {
+		line += fmt.Sprintf(" %q %q", orDash(e.Referer), orDash(e.UserAgent))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.out, line)
+}
+
+// formatCommon renders host ident authuser [date] "request" status bytes
+func formatCommon(e Entry) string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	status := "-"
+	if e.Status > 0 {
+		status = strconv.Itoa(e.Status)
+	}
+
+	requestLine := "-"
+	if e.Method != "" {
+		requestLine = strings.TrimSpace(e.Method + " " + e.Target + " " + e.Proto)
+	}
+
+	return fmt.Sprintf("%s - - [%s] %q %s %s",
+		orDash(host(e.RemoteAddr)),
+		e.Time.Format(clfTimeFormat),
+		requestLine,
+		status,
+		size,
+	)
+}
+
+func (l *Logger) logJSON(e Entry) {
+	record := slog.NewRecord(e.Time, slog.LevelInfo, "request", 0)
+	record.AddAttrs(
+		slog.String("remote_addr", e.RemoteAddr),
+		slog.String("method", e.Method),
+		slog.String("target", e.Target),
+		slog.String("proto", e.Proto),
+		slog.Int("status", e.Status),
+		slog.Int64("bytes", e.Bytes),
+		slog.Float64("duration_ms", float64(e.Duration.Microseconds())/1000),
+		slog.String("referer", e.Referer),
+		slog.String("user_agent", e.UserAgent),
+	)
+	l.json.Handle(context.Background(), record)
+}
+
+// lockedWriter lets the slog handler write to whatever file the logger currently holds
+type lockedWriter struct {
+	l *Logger
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.l.mu.Lock()
+	defer w.l.mu.Unlock()
+	return w.l.out.Write(p)
+}
+
+// dropLevel removes the level attribute, which is always INFO for access logs
+func dropLevel(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.LevelKey {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// host strips the port from an "ip:port" address
+func host(addr string) string {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return h
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
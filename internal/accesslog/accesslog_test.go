@@ -0,0 +1,139 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var sampleEntry = Entry{
+	Time:       time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60)),
+	RemoteAddr: "127.0.0.1:54321",
+	Method:     "GET",
+	Target:     "/apache_pb.gif",
+	Proto:      "HTTP/1.1",
+	Status:     200,
+	Bytes:      2326,
+	Duration:   1500 * time.Microsecond,
+	Referer:    "http://www.example.com/start.html",
+	UserAgent:  "Mozilla/4.08",
+}
+
+func TestCommonFormat(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, FormatCommon).Log(sampleEntry)
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326`+"\n", buf.String())
+}
+
+func TestCombinedFormat(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, FormatCombined).Log(sampleEntry)
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"`+"\n", buf.String())
+
+	t.Run("Missing fields become dashes", func(t *testing.T) {
+		buf.Reset()
+		New(&buf, FormatCombined).Log(Entry{Time: sampleEntry.Time, RemoteAddr: "10.0.0.1:1", Status: 400})
+		assert.Equal(t, `10.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "-" 400 - "-" "-"`+"\n", buf.String())
+	})
+}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, FormatJSON).Log(sampleEntry)
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "request", line["msg"])
+	assert.Equal(t, "127.0.0.1:54321", line["remote_addr"])
+	assert.Equal(t, "/apache_pb.gif", line["target"])
+	assert.Equal(t, float64(200), line["status"])
+	assert.Equal(t, float64(2326), line["bytes"])
+	assert.Equal(t, 1.5, line["duration_ms"])
+	assert.Equal(t, "Mozilla/4.08", line["user_agent"])
+	assert.NotContains(t, line, "level")
+	assert.True(t, strings.HasPrefix(line["time"].(string), "2000-10-10T13:55:36"))
+}
+
+func TestParseLine(t *testing.T) {
+	for _, format := range []Format{FormatCommon, FormatCombined, FormatJSON} {
+		var buf bytes.Buffer
+		New(&buf, format).Log(sampleEntry)
+		got, gotFormat, err := ParseLine(buf.Bytes())
+		require.NoError(t, err, buf.String())
+		assert.Equal(t, format, gotFormat)
+
+		want := sampleEntry
+		switch format {
+		case FormatCommon:
+			want.RemoteAddr, want.Duration, want.Referer, want.UserAgent = "127.0.0.1", 0, "", ""
+		case FormatCombined:
+			want.RemoteAddr, want.Duration = "127.0.0.1", 0
+		}
+		assert.True(t, want.Time.Equal(got.Time), "%s: time %s", buf.String(), got.Time)
+		got.Time = want.Time
+		assert.Equal(t, want, got, buf.String())
+	}
+
+	t.Run("Dashes and quotes", func(t *testing.T) {
+		var buf bytes.Buffer
+		New(&buf, FormatCombined).Log(Entry{Time: sampleEntry.Time, RemoteAddr: "10.0.0.1:1", Status: 400, UserAgent: `say "hi"`})
+		e, _, err := ParseLine(buf.Bytes())
+		require.NoError(t, err)
+		assert.Equal(t, 400, e.Status)
+		assert.Empty(t, e.Method)
+		assert.Equal(t, "-", e.Referer)
+		assert.Equal(t, `say "hi"`, e.UserAgent)
+	})
+
+	for _, line := range []string{
+		"",
+		"hello world",
+		`127.0.0.1 - - [yesterday] "GET / HTTP/1.1" 200 5`,
+		`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" ok 5`,
+		`{"msg":"something else"}`,
+	} {
+		_, _, err := ParseLine([]byte(line))
+		assert.ErrorIs(t, err, ErrUnparsable, line)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for name, want := range map[string]Format{"common": FormatCommon, "Combined": FormatCombined, "json": FormatJSON} {
+		got, err := ParseFormat(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := ParseFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	l, err := OpenFile(path, FormatCommon)
+	require.NoError(t, err)
+	defer l.Close()
+
+	l.Log(sampleEntry)
+
+	// Simulate logrotate moving the file away, then reopen
+	rotated := filepath.Join(dir, "access.log.1")
+	require.NoError(t, os.Rename(path, rotated))
+	require.NoError(t, l.Reopen())
+	l.Log(sampleEntry)
+
+	old, err := os.ReadFile(rotated)
+	require.NoError(t, err)
+	fresh, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(old), "\n"))
+	assert.Equal(t, 1, strings.Count(string(fresh), "\n"))
+}
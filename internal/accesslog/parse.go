@@ -0,0 +1,145 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnparsable is returned by ParseLine for lines that aren't in any of our formats
+var ErrUnparsable = errors.New("not an access log line")
+
+// jsonEntry is a line written by logJSON
+type jsonEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Target     string    `json:"target"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS *float64  `json:"duration_ms"`
+	Referer    string    `json:"referer"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+// ParseLine reads back a line written by Log, and tells which format it was in. The
+// common and combined formats leave things out: the client's port, and the duration,
+// which is then 0. Referer and UserAgent are empty for the common format and "-".
+func ParseLine(line []byte) (Entry, Format, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) > 0 && line[0] == '{' {
+		var j jsonEntry
+		if err := json.Unmarshal(line, &j); err != nil || j.Time.IsZero() || j.DurationMS == nil {
+			return Entry{}, FormatJSON, ErrUnparsable
+		}
+		return Entry{
+			Time:       j.Time,
+			RemoteAddr: j.RemoteAddr,
+			Method:     j.Method,
+			Target:     j.Target,
+			Proto:      j.Proto,
+			Status:     j.Status,
+			Bytes:      j.Bytes,
+			Duration:   time.Duration(*j.DurationMS * float64(time.Millisecond)),
+			Referer:    j.Referer,
+			UserAgent:  j.UserAgent,
+		}, FormatJSON, nil
+	}
+	return parseCommon(string(line))
+}
+
+// parseCommon reads host ident authuser [date] "request" status bytes, and for the
+// combined format "referer" "user agent" after that
+func parseCommon(line string) (Entry, Format, error) {
+	fail := func(what string) (Entry, Format, error) {
+		return Entry{}, FormatCommon, fmt.Errorf("%w: bad %s", ErrUnparsable, what)
+	}
+	var e Entry
+	s := line
+
+	// host, ident and authuser
+	for i := 0; i < 3; i++ {
+		field, rest, ok := strings.Cut(s, " ")
+		if !ok {
+			return fail("host")
+		}
+		if i == 0 && field != "-" {
+			e.RemoteAddr = field
+		}
+		s = rest
+	}
+
+	if !strings.HasPrefix(s, "[") {
+		return fail("date")
+	}
+	date, rest, ok := strings.Cut(s[1:], "] ")
+	if !ok {
+		return fail("date")
+	}
+	t, err := time.Parse(clfTimeFormat, date)
+	if err != nil {
+		return fail("date")
+	}
+	e.Time = t
+	s = rest
+
+	requestLine, s, err := quoted(s)
+	if err != nil {
+		return fail("request line")
+	}
+	if requestLine != "-" {
+		parts := strings.Split(requestLine, " ")
+		if len(parts) < 2 || len(parts) > 3 {
+			return fail("request line")
+		}
+		e.Method, e.Target = parts[0], parts[1]
+		if len(parts) == 3 {
+			e.Proto = parts[2]
+		}
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return fail("status")
+	}
+	if fields[0] != "-" {
+		if e.Status, err = strconv.Atoi(fields[0]); err != nil {
+			return fail("status")
+		}
+	}
+	if fields[1] != "-" {
+		if e.Bytes, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return fail("size")
+		}
+	}
+
+	// The combined format goes on with the referer and user agent
+	_, rest, _ = strings.Cut(strings.TrimLeft(s, " "), " ")
+	_, rest, _ = strings.Cut(strings.TrimLeft(rest, " "), " ")
+	if rest = strings.TrimLeft(rest, " "); rest == "" {
+		return e, FormatCommon, nil
+	}
+	if e.Referer, rest, err = quoted(rest); err != nil {
+		return fail("referer")
+	}
+	if e.UserAgent, _, err = quoted(rest); err != nil {
+		return fail("user agent")
+	}
+	return e, FormatCombined, nil
+}
+
+// quoted takes a Go-quoted string, as %q writes it, off the start of s
+func quoted(s string) (string, string, error) {
+	s = strings.TrimLeft(s, " ")
+	prefix, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return "", s, err
+	}
+	value, err := strconv.Unquote(prefix)
+	return value, s[len(prefix):], err
+}
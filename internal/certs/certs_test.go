@@ -0,0 +1,106 @@
+package certs
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePair issues a server certificate for hosts and writes it to dir
+func writePair(t *testing.T, ca *CA, dir string, hosts ...string) (certFile, keyFile string) {
+	t.Helper()
+	cert, err := ca.IssueServer(hosts...)
+	require.NoError(t, err)
+	certPEM, keyPEM, err := EncodePEM(cert)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	return certFile, keyFile
+}
+
+func servedName(t *testing.T, s *Store, serverName string) string {
+	t.Helper()
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	require.NoError(t, err)
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestSNISelection(t *testing.T) {
+	ca, err := NewDevCA()
+	require.NoError(t, err)
+
+	store := NewStore()
+	_, err = store.GetCertificate(&tls.ClientHelloInfo{})
+	assert.ErrorIs(t, err, ErrNoCertificates)
+
+	for _, hosts := range [][]string{{"default.test"}, {"api.test"}, {"*.apps.test"}} {
+		cert, err := ca.IssueServer(hosts...)
+		require.NoError(t, err)
+		require.NoError(t, store.Add(cert))
+	}
+
+	assert.Equal(t, "api.test", servedName(t, store, "API.test"))
+	assert.Equal(t, "*.apps.test", servedName(t, store, "blog.apps.test"))
+	assert.Equal(t, "default.test", servedName(t, store, "unknown.test"))
+	assert.Equal(t, "default.test", servedName(t, store, ""))
+}
+
+func TestReloadFromDisk(t *testing.T) {
+	ca, err := NewDevCA()
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	certFile, keyFile := writePair(t, ca, dir, "old.test")
+	store := NewStore()
+	require.NoError(t, store.AddFiles(certFile, keyFile))
+	assert.Equal(t, "old.test", servedName(t, store, "old.test"))
+
+	// Nothing changed, nothing reloaded
+	require.NoError(t, store.Reload())
+	assert.Equal(t, "old.test", servedName(t, store, ""))
+
+	// Replace the files with a renewed certificate and bump their mtime
+	writePair(t, ca, dir, "new.test")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, store.Reload())
+	assert.Equal(t, "new.test", servedName(t, store, "new.test"))
+
+	// A broken renewal keeps the last good certificate
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	evenLater := later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, evenLater, evenLater))
+	assert.Error(t, store.Reload())
+	assert.Equal(t, "new.test", servedName(t, store, ""))
+}
+
+func TestDevStoreHandshake(t *testing.T) {
+	store, ca, err := DevStore()
+	require.NoError(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", ServerConfig(store, nil))
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: ca.Pool(), ServerName: "localhost"})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "localhost", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+}
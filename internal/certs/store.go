@@ -0,0 +1,246 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoCertificates is returned when a handshake arrives before any certificate was added
+var ErrNoCertificates = errors.New("no TLS certificates configured")
+
+// Store holds the server certificates and picks one per handshake from the
+// SNI server name. Certificates loaded from files can be reloaded while the
+// server runs, so renewed certificates are picked up without a restart.
+type Store struct {
+	mu      sync.RWMutex
+	entries []*entry
+	byName  map[string]*entry // lowercase DNS name (or "*.suffix") -> entry
+}
+
+// entry is one certificate and, if it came from disk, where to reload it from
+type entry struct {
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+	modTime  time.Time
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{byName: make(map[string]*entry)}
+}
+
+// AddFiles loads a PEM certificate chain and its private key and adds them to the store.
+// The first certificate added is the default for clients that don't send SNI.
+func (s *Store) AddFiles(certFile, keyFile string) error {
+	cert, modTime, err := loadPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.add(&entry{cert: cert, certFile: certFile, keyFile: keyFile, modTime: modTime})
+	return nil
+}
+
+// Add adds an in-memory certificate, e.g. one issued by a dev CA
+func (s *Store) Add(cert tls.Certificate) error {
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		cert.Leaf = leaf
+	}
+	s.add(&entry{cert: &cert})
+	return nil
+}
+
+func (s *Store) add(e *entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+	s.index()
+}
+
+// index rebuilds the name lookup; earlier entries win when names overlap
+func (s *Store) index() {
+	s.byName = make(map[string]*entry)
+	for _, e := range s.entries {
+		for _, name := range e.cert.Leaf.DNSNames {
+			name = strings.ToLower(name)
+			if _, taken := s.byName[name]; !taken {
+				s.byName[name] = e
+			}
+		}
+		for _, ip := range e.cert.Leaf.IPAddresses {
+			if _, taken := s.byName[ip.String()]; !taken {
+				s.byName[ip.String()] = e
+			}
+		}
+	}
+}
+
+// GetCertificate chooses the certificate for a handshake. It has the signature
+// of tls.Config.GetCertificate: exact names first, then a wildcard for the
+// parent domain, then the default certificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.entries) == 0 {
+		return nil, ErrNoCertificates
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if e, ok := s.byName[name]; ok {
+		return e.cert, nil
+	}
+
+	// "a.example.com" may be served by "*.example.com"
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		if e, ok := s.byName["*"+name[dot:]]; ok {
+			return e.cert, nil
+		}
+	}
+
+	return s.entries[0].cert, nil
+}
+
+// Reload re-reads every certificate whose files changed since they were loaded.
+// A pair that fails to load keeps serving its previous certificate.
+func (s *Store) Reload() error {
+	s.mu.RLock()
+	entries := append([]*entry(nil), s.entries...)
+	s.mu.RUnlock()
+
+	var errs []error
+	changed := false
+	for _, e := range entries {
+		if e.certFile == "" {
+			continue
+		}
+
+		modTime, err := latestModTime(e.certFile, e.keyFile)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !modTime.After(e.modTime) {
+			continue
+		}
+
+		cert, modTime, err := loadPair(e.certFile, e.keyFile)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		s.mu.Lock()
+		e.cert = cert
+		e.modTime = modTime
+		s.mu.Unlock()
+		changed = true
+	}
+
+	if changed {
+		s.mu.Lock()
+		s.index()
+		s.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// Watch calls Reload every interval until the returned stop function is called
+func (s *Store) Watch(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Reload(); err != nil {
+					log.Printf("Error reloading TLS certificates: %v", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// loadPair reads a key pair from disk and parses its leaf certificate
+func loadPair(certFile, keyFile string) (*tls.Certificate, time.Time, error) {
+	modTime, err := latestModTime(certFile, keyFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to load key pair %s: %w", certFile, err)
+	}
+
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to parse certificate %s: %w", certFile, err)
+		}
+		cert.Leaf = leaf
+	}
+
+	return &cert, modTime, nil
+}
+
+// latestModTime returns the newest modification time of the given files
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ServerConfig builds a TLS config that takes its certificates from store.
+// If clientCAs is not nil, clients must present a certificate signed by one of them.
+func ServerConfig(store *Store, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: store.GetCertificate,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// LoadPool reads PEM certificates from a file into a pool, e.g. the CAs trusted for client certificates
+func LoadPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
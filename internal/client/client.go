@@ -0,0 +1,338 @@
+// Package client is an HTTP/1.1 client built on the project's own framing: it
+// writes requests itself and parses responses with headers.Parse, keeping
+// connections alive in a pool between requests.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/response"
+)
+
+const (
+	// DefaultIdleConnTimeout is how long an unused connection is kept unless Client.IdleConnTimeout says otherwise
+	DefaultIdleConnTimeout = 90 * time.Second
+	// DefaultMaxIdleConnsPerHost is how many unused connections are kept per host unless Client.MaxIdleConnsPerHost says otherwise
+	DefaultMaxIdleConnsPerHost = 2
+)
+
+// aLongTimeAgo is a deadline that has passed, to make blocked reads and writes return
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Client sends requests over HTTP/1.1 and keeps connections alive between them.
+// The zero value is ready to use, and a Client is safe for concurrent use.
+type Client struct {
+	// DialTimeout bounds connecting, including the TLS handshake; 0 means no limit
+	// besides the request's context
+	DialTimeout time.Duration
+
+	// ResponseHeaderTimeout bounds the wait for the response head once the
+	// request has been sent; 0 means no limit
+	ResponseHeaderTimeout time.Duration
+
+	// IdleConnTimeout is how long an unused connection stays in the pool; 0 means DefaultIdleConnTimeout
+	IdleConnTimeout time.Duration
+
+	// MaxIdleConnsPerHost caps the pool for each host; 0 means DefaultMaxIdleConnsPerHost
+	MaxIdleConnsPerHost int
+
+	// DisableKeepAlives sends every request on a new connection, with Connection: close
+	DisableKeepAlives bool
+
+	// TLSConfig is used for https URLs; nil means the defaults, verifying the server
+	TLSConfig *tls.Config
+
+	mu   sync.Mutex
+	idle map[string][]*conn
+}
+
+// conn is a connection to a host and its buffers
+type conn struct {
+	net.Conn
+	br        *bufio.Reader
+	bw        *bufio.Writer
+	key       string
+	idleSince time.Time
+	reused    bool
+}
+
+// Get sends a GET request for rawURL
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(ctx, req)
+}
+
+// Do sends req and returns the response once its head has arrived. The body is
+// read from Response.Body, which must be closed. Cancelling ctx aborts the
+// request, including the read of the body.
+//
+// A request that fails on a kept-alive connection before any response comes back
+// is sent again on a new connection if it is idempotent and its body can be replayed,
+// as the server most likely closed the connection while it sat in the pool.
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	if req.URL == nil {
+		return nil, errors.New("client: request without URL")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("client: unsupported URL scheme %q", req.URL.Scheme)
+	}
+
+	body := req.Body
+	for attempt := 0; ; attempt++ {
+		cn, err := c.getConn(ctx, req)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+		resp, err := c.roundTrip(ctx, cn, req, body)
+		if err == nil {
+			return resp, nil
+		}
+		cn.Close()
+
+		var noResp *noResponseError
+		if attempt == 0 && cn.reused && errors.As(err, &noResp) && ctx.Err() == nil && req.idempotent() && !isTimeout(err) {
+			if req.Body == nil {
+				continue
+			}
+			if req.GetBody != nil {
+				if body, err = req.GetBody(); err == nil {
+					continue
+				}
+			}
+		}
+		return nil, contextError(ctx, err)
+	}
+}
+
+// noResponseError is a failure before any byte of the response was read
+type noResponseError struct {
+	err error
+}
+
+func (e *noResponseError) Error() string { return e.err.Error() }
+func (e *noResponseError) Unwrap() error { return e.err }
+
+// roundTrip sends req on cn and reads the response head
+func (c *Client) roundTrip(ctx context.Context, cn *conn, req *Request, body io.Reader) (*Response, error) {
+	// Cancelling the context unblocks whatever the connection is doing
+	stop := context.AfterFunc(ctx, func() { cn.SetDeadline(aLongTimeAgo) })
+
+	closeConn := c.DisableKeepAlives || req.Close
+	if err := writeRequest(cn.bw, req, body, closeConn); err != nil {
+		stop()
+		return nil, &noResponseError{err}
+	}
+
+	if c.ResponseHeaderTimeout > 0 {
+		cn.SetReadDeadline(time.Now().Add(c.ResponseHeaderTimeout))
+	}
+	if _, err := cn.br.Peek(1); err != nil {
+		stop()
+		return nil, &noResponseError{err}
+	}
+	resp, err := readResponseHead(cn.br)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	if c.ResponseHeaderTimeout > 0 {
+		cn.SetReadDeadline(time.Time{})
+		// The context may have fired in between, and its deadline was just undone
+		if ctx.Err() != nil {
+			stop()
+			return nil, ctx.Err()
+		}
+	}
+
+	framed, err := bodyFraming(cn.br, resp, req.Method)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	reusable := !closeConn && !resp.Close && resp.StatusCode != response.StatusSwitchingProtocols
+	b := &bodyReader{r: framed, cn: cn, client: c, stop: stop, reusable: reusable, ctx: ctx}
+	if framed == nil {
+		// Nothing to read, the connection is free right away
+		b.finishLocked(true)
+		b.err = io.EOF
+	}
+	resp.Body = b
+	return resp, nil
+}
+
+// bodyReader hands the connection back to the pool once the body has been read.
+// Read and Close must not be called at the same time; cancel the request's
+// context to abort a Read.
+type bodyReader struct {
+	r        io.Reader
+	cn       *conn
+	client   *Client
+	stop     func() bool
+	reusable bool
+	ctx      context.Context
+
+	mu     sync.Mutex
+	done   bool  // the connection has been released
+	err    error // what Read returns from now on
+	closed bool
+}
+
+var errBodyClosed = errors.New("client: read on closed body")
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, errBodyClosed
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.finishLocked(true)
+		b.err = io.EOF
+	} else if err != nil {
+		b.finishLocked(false)
+		err = contextError(b.ctx, err)
+		b.err = err
+	}
+	return n, err
+}
+
+// Close releases the connection; a body that wasn't read to the end takes the connection with it
+func (b *bodyReader) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.finishLocked(false)
+	return nil
+}
+
+func (b *bodyReader) finishLocked(complete bool) {
+	if b.done {
+		return
+	}
+	b.done = true
+	// stop reports false if the context already fired and poisoned the connection
+	if b.stop() && complete && b.reusable {
+		b.client.putIdle(b.cn)
+		return
+	}
+	b.cn.Close()
+}
+
+// hostKey identifies the connections that can serve a request
+func hostKey(req *Request) string {
+	return req.URL.Scheme + "://" + HostPort(req.URL)
+}
+
+// getConn takes an idle connection for req's host from the pool, or dials a new one
+func (c *Client) getConn(ctx context.Context, req *Request) (*conn, error) {
+	key := hostKey(req)
+	if !c.DisableKeepAlives {
+		if cn := c.takeIdle(key); cn != nil {
+			return cn, nil
+		}
+	}
+	return c.dial(ctx, req, key)
+}
+
+func (c *Client) dial(ctx context.Context, req *Request, key string) (*conn, error) {
+	if c.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.DialTimeout)
+		defer cancel()
+	}
+
+	raw, err := Dial(ctx, req.URL, c.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		Conn: raw,
+		br:   bufio.NewReaderSize(raw, 64<<10),
+		bw:   bufio.NewWriterSize(raw, 32<<10),
+		key:  key,
+	}, nil
+}
+
+// takeIdle returns the most recently used idle connection for key, dropping expired ones
+func (c *Client) takeIdle(key string) *conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timeout := c.IdleConnTimeout
+	if timeout <= 0 {
+		timeout = DefaultIdleConnTimeout
+	}
+	conns := c.idle[key]
+	for len(conns) > 0 {
+		cn := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(cn.idleSince) > timeout {
+			cn.Close()
+			continue
+		}
+		c.idle[key] = conns
+		cn.reused = true
+		return cn
+	}
+	delete(c.idle, key)
+	return nil
+}
+
+// putIdle keeps cn for the next request to its host, or closes it if the pool is full
+func (c *Client) putIdle(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	max := c.MaxIdleConnsPerHost
+	if max <= 0 {
+		max = DefaultMaxIdleConnsPerHost
+	}
+	if len(c.idle[cn.key]) >= max {
+		cn.Close()
+		return
+	}
+	if c.idle == nil {
+		c.idle = make(map[string][]*conn)
+	}
+	cn.idleSince = time.Now()
+	c.idle[cn.key] = append(c.idle[cn.key], cn)
+}
+
+// CloseIdleConnections closes the connections in the pool; those in use are left alone
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, conns := range c.idle {
+		for _, cn := range conns {
+			cn.Close()
+		}
+		delete(c.idle, key)
+	}
+}
+
+// contextError reports the context's error instead of the deadline error its
+// cancellation caused on the connection
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w (%w)", ctxErr, err)
+	}
+	return err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,566 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// countingServer is an httptest server that counts the connections it accepts
+func countingServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+// scriptedServer runs serve on every connection accepted on a local port
+func scriptedServer(t *testing.T, serve func(conn net.Conn, br *bufio.Reader)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn, bufio.NewReader(conn))
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+// readRequestHead consumes a request head from br and returns it
+func readRequestHead(br *bufio.Reader) string {
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		head.WriteString(line)
+		if err != nil || line == "\r\n" {
+			return head.String()
+		}
+	}
+}
+
+func readAll(t *testing.T, resp *Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestWriteRequest(t *testing.T) {
+	req, err := NewRequest("POST", "http://example.com:8080/search?q=go", strings.NewReader("hello"))
+	require.NoError(t, err)
+	req.Header.Set("x-request-id", "42")
+	req.Header.Set("content-type", "text/plain")
+	req.Header.Set("content-length", "999") // replaced by ContentLength
+
+	var out bytes.Buffer
+	require.NoError(t, writeRequest(bufio.NewWriter(&out), req, req.Body, false))
+	assert.Equal(t, "POST /search?q=go HTTP/1.1\r\n"+
+		"Host: example.com:8080\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"X-Request-Id: 42\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n"+
+		"hello", out.String())
+
+	t.Run("unknown length is chunked", func(t *testing.T) {
+		req, err := NewRequest("PUT", "http://example.com/upload", iotest.OneByteReader(strings.NewReader("abc")))
+		require.NoError(t, err)
+		assert.EqualValues(t, -1, req.ContentLength)
+		req.Host = "files.example"
+
+		var out bytes.Buffer
+		require.NoError(t, writeRequest(bufio.NewWriter(&out), req, req.Body, true))
+		assert.Equal(t, "PUT /upload HTTP/1.1\r\n"+
+			"Host: files.example\r\n"+
+			"Connection: close\r\n"+
+			"Transfer-Encoding: chunked\r\n"+
+			"\r\n"+
+			"1\r\na\r\n1\r\nb\r\n1\r\nc\r\n0\r\n\r\n", out.String())
+	})
+
+	t.Run("empty POST says so", func(t *testing.T) {
+		req, err := NewRequest("POST", "http://example.com/", nil)
+		require.NoError(t, err)
+		var out bytes.Buffer
+		require.NoError(t, writeRequest(bufio.NewWriter(&out), req, nil, false))
+		assert.Equal(t, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\n\r\n", out.String())
+	})
+
+	t.Run("short body", func(t *testing.T) {
+		req, err := NewRequest("POST", "http://example.com/", strings.NewReader("abc"))
+		require.NoError(t, err)
+		req.ContentLength = 10
+		assert.Error(t, writeRequest(bufio.NewWriter(io.Discard), req, req.Body, false))
+	})
+
+	t.Run("header injection", func(t *testing.T) {
+		req, err := NewRequest("GET", "http://example.com/", nil)
+		require.NoError(t, err)
+		req.Header.Set("x-evil", "a\r\nInjected: yes")
+		assert.Error(t, writeRequest(bufio.NewWriter(io.Discard), req, nil, false))
+	})
+}
+
+func TestNewRequest(t *testing.T) {
+	_, err := NewRequest("GET", "ftp://example.com/", nil)
+	assert.Error(t, err)
+	_, err = NewRequest("GET", "/relative", nil)
+	assert.Error(t, err)
+
+	// In-memory bodies can be replayed
+	for _, body := range []io.Reader{bytes.NewReader([]byte("data")), bytes.NewBufferString("data"), strings.NewReader("data")} {
+		req, err := NewRequest("PUT", "http://example.com/", body)
+		require.NoError(t, err)
+		assert.EqualValues(t, 4, req.ContentLength)
+		io.ReadAll(req.Body)
+		for i := 0; i < 2; i++ {
+			again, err := req.GetBody()
+			require.NoError(t, err)
+			data, _ := io.ReadAll(again)
+			assert.Equal(t, "data", string(data))
+		}
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		raw     string
+		status  response.StatusCode
+		reason  string
+		body    string
+		length  int64
+		chunked bool
+		close   bool
+		trailer map[string]string
+	}{
+		{
+			name:   "content-length",
+			raw:    "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			status: 200, reason: "OK", body: "hello", length: 5,
+		},
+		{
+			name:   "chunked with extensions and trailers",
+			raw:    "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n5;name=v\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: abc\r\nX-Other: 1\r\n\r\n",
+			status: 200, reason: "OK", body: "hello world", length: -1, chunked: true,
+			trailer: map[string]string{"x-sum": "abc", "x-other": "1"},
+		},
+		{
+			name:   "close-delimited",
+			raw:    "HTTP/1.1 200 OK\r\n\r\nuntil the end",
+			status: 200, reason: "OK", body: "until the end", length: -1, close: true,
+		},
+		{
+			name:   "HEAD has no body",
+			method: "HEAD",
+			raw:    "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n",
+			status: 200, reason: "OK",
+		},
+		{
+			name:   "204 has no body",
+			raw:    "HTTP/1.1 204 No Content\r\n\r\n",
+			status: 204, reason: "No Content",
+		},
+		{
+			name:   "304 has no body",
+			raw:    "HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n",
+			status: 304, reason: "Not Modified",
+		},
+		{
+			name:   "interim responses are skipped",
+			raw:    "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+			status: 201, reason: "Created", body: "ok", length: 2,
+		},
+		{
+			name:   "connection close",
+			raw:    "HTTP/1.1 404 Not Found\r\nConnection: close\r\nContent-Length: 3\r\n\r\nnot",
+			status: 404, reason: "Not Found", body: "not", length: 3, close: true,
+		},
+		{
+			name:   "HTTP/1.0 closes by default",
+			raw:    "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			status: 200, reason: "OK", body: "ok", length: 2, close: true,
+		},
+		{
+			name:   "empty reason",
+			raw:    "HTTP/1.1 200 \r\nContent-Length: 0\r\n\r\n",
+			status: 200,
+		},
+		{
+			name:   "repeated identical Content-Length",
+			raw:    "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nok",
+			status: 200, reason: "OK", body: "ok", length: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		// Feeding one byte at a time checks that every boundary is handled
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = strings.NewReader(tc.raw)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			br := bufio.NewReader(r)
+			method := tc.method
+			if method == "" {
+				method = "GET"
+			}
+
+			resp, err := readResponseHead(br)
+			require.NoError(t, err, tc.name)
+			body, err := bodyFraming(br, resp, method)
+			require.NoError(t, err, tc.name)
+			assert.Equal(t, tc.status, resp.StatusCode, tc.name)
+			assert.Equal(t, tc.reason, resp.Reason, tc.name)
+			assert.Equal(t, tc.length, resp.ContentLength, tc.name)
+			assert.Equal(t, tc.chunked, resp.Chunked, tc.name)
+			assert.Equal(t, tc.close, resp.Close, tc.name)
+			if body == nil {
+				assert.Empty(t, tc.body, tc.name)
+				continue
+			}
+			data, err := io.ReadAll(body)
+			require.NoError(t, err, tc.name)
+			assert.Equal(t, tc.body, string(data), tc.name)
+			if tc.trailer != nil {
+				assert.Equal(t, tc.trailer, map[string]string(resp.Trailer), tc.name)
+			}
+		}
+	}
+}
+
+func TestReadResponseErrors(t *testing.T) {
+	heads := map[string]string{
+		"no status code":      "HTTP/1.1\r\n\r\n",
+		"bad status code":     "HTTP/1.1 20x OK\r\n\r\n",
+		"two digit status":    "HTTP/1.1 20 OK\r\n\r\n",
+		"unknown version":     "HTTP/2.0 200 OK\r\n\r\n",
+		"not http":            "SSH-2.0-OpenSSH\r\n\r\n",
+		"bare LF":             "HTTP/1.1 200 OK\n\n",
+		"malformed header":    "HTTP/1.1 200 OK\r\nno colon here\r\n\r\n",
+		"truncated head":      "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n",
+		"conflicting lengths": "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 3\r\n\r\n",
+		"negative length":     "HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+	}
+	for name, raw := range heads {
+		br := bufio.NewReader(strings.NewReader(raw))
+		resp, err := readResponseHead(br)
+		if err == nil {
+			_, err = bodyFraming(br, resp, "GET")
+		}
+		if name == "truncated head" {
+			assert.ErrorIs(t, err, io.ErrUnexpectedEOF, name)
+		} else {
+			assert.ErrorIs(t, err, response.ErrMalformedResponse, name)
+		}
+	}
+
+	bodies := map[string]string{
+		"short fixed body":   "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort",
+		"truncated chunk":    "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\nshort",
+		"missing last chunk": "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n",
+		"bad chunk size":     "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nok\r\n0\r\n\r\n",
+		"chunk overrun":      "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nokay\r\n0\r\n\r\n",
+	}
+	for name, raw := range bodies {
+		br := bufio.NewReader(strings.NewReader(raw))
+		resp, err := readResponseHead(br)
+		require.NoError(t, err, name)
+		body, err := bodyFraming(br, resp, "GET")
+		require.NoError(t, err, name)
+		_, err = io.ReadAll(body)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	srv, conns := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/close" {
+			w.Header().Set("Connection", "close")
+		}
+		io.WriteString(w, r.Method+" "+r.URL.Path)
+	})
+	c := &Client{}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(ctx, srv.URL+"/again")
+		require.NoError(t, err)
+		assert.Equal(t, "GET /again", readAll(t, resp))
+	}
+	assert.EqualValues(t, 1, conns.Load(), "one connection for requests in a row")
+
+	// A body closed before its end takes the connection with it
+	resp, err := c.Get(ctx, srv.URL+"/unread")
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp, err = c.Get(ctx, srv.URL+"/after")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /after", readAll(t, resp))
+	assert.EqualValues(t, 2, conns.Load())
+
+	// So does Connection: close
+	resp, err = c.Get(ctx, srv.URL+"/close")
+	require.NoError(t, err)
+	assert.True(t, resp.Close)
+	readAll(t, resp)
+	resp, err = c.Get(ctx, srv.URL+"/")
+	require.NoError(t, err)
+	readAll(t, resp)
+	assert.EqualValues(t, 3, conns.Load())
+
+	// A HEAD has nothing to read, its connection is free at once
+	req, err := NewRequest("HEAD", srv.URL+"/head", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(ctx, req)
+	require.NoError(t, err)
+	resp, err = c.Get(ctx, srv.URL+"/")
+	require.NoError(t, err)
+	readAll(t, resp)
+	assert.EqualValues(t, 3, conns.Load())
+
+	c.CloseIdleConnections()
+	resp, err = c.Get(ctx, srv.URL+"/")
+	require.NoError(t, err)
+	readAll(t, resp)
+	assert.EqualValues(t, 4, conns.Load())
+
+	t.Run("disabled", func(t *testing.T) {
+		c := &Client{DisableKeepAlives: true}
+		before := conns.Load()
+		for i := 0; i < 2; i++ {
+			resp, err := c.Get(ctx, srv.URL+"/")
+			require.NoError(t, err)
+			readAll(t, resp)
+		}
+		assert.EqualValues(t, before+2, conns.Load())
+	})
+}
+
+func TestStaleConnection(t *testing.T) {
+	// Answers one request per connection without saying it will close
+	addr := scriptedServer(t, func(conn net.Conn, br *bufio.Reader) {
+		readRequestHead(br)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+	c := &Client{}
+	ctx := context.Background()
+
+	resp, err := c.Get(ctx, addr+"/")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readAll(t, resp))
+	time.Sleep(20 * time.Millisecond)
+
+	// The pooled connection is dead; a GET quietly moves to a new one
+	resp, err = c.Get(ctx, addr+"/")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readAll(t, resp))
+	time.Sleep(20 * time.Millisecond)
+
+	// A POST might have been processed, so it isn't sent twice
+	req, err := NewRequest("POST", addr+"/", strings.NewReader("x"))
+	require.NoError(t, err)
+	_, err = c.Do(ctx, req)
+	assert.Error(t, err)
+}
+
+func TestTimeoutsAndCancellation(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	addr := scriptedServer(t, func(conn net.Conn, br *bufio.Reader) {
+		head := readRequestHead(br)
+		if strings.HasPrefix(head, "GET /slow-body") {
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhalf")
+		}
+		<-release
+	})
+
+	t.Run("response header timeout", func(t *testing.T) {
+		c := &Client{ResponseHeaderTimeout: 50 * time.Millisecond}
+		_, err := c.Get(context.Background(), addr+"/silent")
+		require.Error(t, err)
+		assert.True(t, isTimeout(err), err)
+	})
+
+	t.Run("context deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := (&Client{}).Get(ctx, addr+"/silent")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("cancel while reading the body", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		resp, err := (&Client{}).Get(ctx, addr+"/slow-body")
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(resp.Body, buf)
+		require.NoError(t, err)
+		time.AfterFunc(20*time.Millisecond, cancel)
+		_, err = io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, context.Canceled)
+		resp.Body.Close()
+	})
+
+	t.Run("dial timeout", func(t *testing.T) {
+		// 192.0.2.0/24 is reserved for documentation, nothing answers there
+		c := &Client{DialTimeout: 50 * time.Millisecond}
+		start := time.Now()
+		_, err := c.Get(context.Background(), "http://192.0.2.1:81/")
+		require.Error(t, err)
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+}
+
+func TestDoAgainstServers(t *testing.T) {
+	t.Run("streams a chunked upload", func(t *testing.T) {
+		srv, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Trailer", "X-Length")
+			io.WriteString(w, strings.Join(r.TransferEncoding, ",")+":"+string(body))
+			w.(http.Flusher).Flush()
+			w.Header().Set("X-Length", "done")
+		})
+		pr, pw := io.Pipe()
+		go func() {
+			for _, part := range []string{"one ", "two ", "three"} {
+				pw.Write([]byte(part))
+			}
+			pw.Close()
+		}()
+		req, err := NewRequest("POST", srv.URL+"/upload", pr)
+		require.NoError(t, err)
+		resp, err := (&Client{}).Do(context.Background(), req)
+		require.NoError(t, err)
+		assert.True(t, resp.Chunked)
+		assert.Equal(t, "chunked:one two three", readAll(t, resp))
+		assert.Equal(t, "done", resp.Trailer["x-length"])
+	})
+
+	t.Run("https", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		}))
+		defer srv.Close()
+
+		_, err := (&Client{}).Get(context.Background(), srv.URL)
+		var unknownAuthority x509.UnknownAuthorityError
+		assert.True(t, errors.As(err, &unknownAuthority), err)
+
+		c := &Client{TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig}
+		resp, err := c.Get(context.Background(), srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1", readAll(t, resp))
+	})
+}
+
+func TestSession(t *testing.T) {
+	get := func(u *url.URL) *request.Request {
+		return &request.Request{
+			RequestLine: request.RequestLine{Method: "GET", RequestTarget: u.RequestURI(), HttpVersion: "1.1"},
+			Headers:     headers.Headers{"host": u.Host},
+		}
+	}
+
+	t.Run("keeps the connection between requests", func(t *testing.T) {
+		srv, conns := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.URL.Path)
+		})
+		var notes []string
+		var sent int
+		s := &Session{Record: true, Note: func(msg string) { notes = append(notes, msg) }, Sending: func([]byte) { sent++ }}
+		defer s.Close()
+
+		u, _ := url.Parse(srv.URL + "/one")
+		ex, err := s.Do(u, get(u))
+		require.NoError(t, err)
+		assert.Equal(t, "/one", string(ex.Response.Body))
+		assert.False(t, ex.Reused)
+		assert.Positive(t, ex.Connect)
+		assert.True(t, strings.HasPrefix(string(ex.Raw), "HTTP/1.1 200 OK\r\n"))
+		assert.True(t, strings.HasSuffix(string(ex.Raw), "\r\n\r\n/one"))
+
+		u, _ = url.Parse(srv.URL + "/two")
+		ex, err = s.Do(u, get(u))
+		require.NoError(t, err)
+		assert.Equal(t, "/two", string(ex.Response.Body))
+		assert.True(t, ex.Reused)
+		assert.Zero(t, ex.Connect)
+		assert.EqualValues(t, 1, conns.Load())
+		assert.Equal(t, 2, sent)
+		assert.True(t, strings.HasPrefix(notes[0], "connected to "+u.Scheme+"://"+HostPort(u)))
+		assert.Equal(t, "reusing connection to "+u.Scheme+"://"+HostPort(u), notes[1])
+	})
+
+	t.Run("reconnects when the server closed the connection", func(t *testing.T) {
+		// Answers one request per connection without saying it will close
+		addr := scriptedServer(t, func(conn net.Conn, br *bufio.Reader) {
+			readRequestHead(br)
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		})
+		s := &Session{Timeout: time.Second}
+		defer s.Close()
+		u, _ := url.Parse(addr + "/")
+		for i := 0; i < 3; i++ {
+			ex, err := s.Do(u, get(u))
+			require.NoError(t, err)
+			assert.Equal(t, "ok", string(ex.Response.Body))
+			assert.False(t, ex.Reused, "request %d went out on a new connection", i)
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	t.Run("https offers only HTTP/1.1", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		}))
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+		defer srv.Close()
+
+		s := &Session{TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig}
+		defer s.Close()
+		u, _ := url.Parse(srv.URL)
+		ex, err := s.Do(u, get(u))
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1", string(ex.Response.Body))
+		assert.Positive(t, ex.TLS)
+	})
+}
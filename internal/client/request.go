@@ -0,0 +1,200 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+)
+
+// Request is a request to send with a Client
+type Request struct {
+	Method string
+	URL    *url.URL
+
+	// Header holds the request headers. Host, Content-Length, Transfer-Encoding
+	// and Connection are set by the client from the other fields.
+	Header headers.Headers
+
+	// Host overrides the Host header, which is URL.Host by default
+	Host string
+
+	// Body is sent after the headers; nil means no body
+	Body io.Reader
+
+	// ContentLength is the length of Body. -1, or 0 with a non-nil Body, means
+	// unknown and the body is sent chunked.
+	ContentLength int64
+
+	// GetBody returns a fresh copy of Body, so the request can be sent again on a
+	// new connection when a kept-alive one turns out to be closed. NewRequest sets it
+	// for in-memory bodies.
+	GetBody func() (io.Reader, error)
+
+	// Close asks the server to close the connection after the response
+	Close bool
+}
+
+// NewRequest creates a request for method and rawURL. The length of body, and a way
+// to send it again, are known for *bytes.Reader, *bytes.Buffer and *strings.Reader.
+func NewRequest(method, rawURL string, body io.Reader) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in URL %q", rawURL)
+	}
+
+	req := &Request{Method: method, URL: u, Header: headers.NewHeaders(), Body: body}
+	switch b := body.(type) {
+	case nil:
+	case *bytes.Reader:
+		req.ContentLength = int64(b.Len())
+		snapshot := *b
+		req.GetBody = func() (io.Reader, error) {
+			r := snapshot
+			return &r, nil
+		}
+	case *bytes.Buffer:
+		req.ContentLength = int64(b.Len())
+		data := b.Bytes()
+		req.GetBody = func() (io.Reader, error) { return bytes.NewReader(data), nil }
+	case *strings.Reader:
+		req.ContentLength = int64(b.Len())
+		snapshot := *b
+		req.GetBody = func() (io.Reader, error) {
+			r := snapshot
+			return &r, nil
+		}
+	default:
+		req.ContentLength = -1
+	}
+	return req, nil
+}
+
+// idempotent reports whether sending the request twice has the same effect as once
+func (r *Request) idempotent() bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// chunked reports whether the body goes out with chunked transfer coding
+func (r *Request) chunked() bool {
+	return r.Body != nil && r.ContentLength <= 0
+}
+
+// writeRequest serializes req with the given body to bw and flushes it
+func writeRequest(bw *bufio.Writer, req *Request, body io.Reader, closeConn bool) error {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	target := req.URL.RequestURI()
+	if strings.ContainsAny(req.Method, " \r\n") || req.Method == "" {
+		return fmt.Errorf("invalid method %q", req.Method)
+	}
+
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", req.Method, target)
+	fmt.Fprintf(bw, "Host: %s\r\n", host)
+
+	// Sorted, so the same request is always written the same way
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		switch name {
+		case "host", "content-length", "transfer-encoding", "connection":
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := req.Header[name]
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value for header %s", name)
+		}
+		fmt.Fprintf(bw, "%s: %s\r\n", textproto.CanonicalMIMEHeaderKey(name), value)
+	}
+
+	if closeConn {
+		bw.WriteString("Connection: close\r\n")
+	}
+	switch {
+	case req.chunked():
+		bw.WriteString("Transfer-Encoding: chunked\r\n")
+	case req.Body != nil:
+		fmt.Fprintf(bw, "Content-Length: %d\r\n", req.ContentLength)
+	case req.Method == "POST" || req.Method == "PUT" || req.Method == "PATCH":
+		// Without it a server can't tell an empty body from a missing one
+		bw.WriteString("Content-Length: 0\r\n")
+	}
+	bw.WriteString("\r\n")
+
+	if req.Body != nil {
+		if req.chunked() {
+			if err := writeChunked(bw, body); err != nil {
+				return err
+			}
+		} else {
+			n, err := io.CopyN(flushWriter{bw}, body, req.ContentLength)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return fmt.Errorf("request body is %d bytes, ContentLength says %d", n, req.ContentLength)
+				}
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// flushWriter sends each write right away, like writeChunked its chunks
+type flushWriter struct {
+	bw *bufio.Writer
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.bw.Write(p)
+	if err == nil {
+		err = f.bw.Flush()
+	}
+	return n, err
+}
+
+// writeChunked copies body to bw as chunks, ending with the zero-length chunk
+func writeChunked(bw *bufio.Writer, body io.Reader) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(bw, "%x\r\n", n)
+			bw.Write(buf[:n])
+			bw.WriteString("\r\n")
+			// Send each chunk as it comes, the body may be a stream
+			if werr := bw.Flush(); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := bw.WriteString("0\r\n\r\n")
+	return err
+}
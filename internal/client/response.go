@@ -0,0 +1,268 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+)
+
+// maxHeaderBytes bounds the status line and headers of a response, and the trailers
+const maxHeaderBytes = 1 << 20
+
+// ErrHeaderTooLarge is returned when the head of a response passes maxHeaderBytes
+var ErrHeaderTooLarge = errors.New("response headers too large")
+
+// Response is the answer to a Request
+type Response struct {
+	// Proto is the version the server answered with, "1.1" or "1.0"
+	Proto      string
+	StatusCode response.StatusCode
+	Reason     string
+	Header     headers.Headers
+
+	// Body streams the response body. It must be closed, which puts the
+	// connection back in the pool once the body has been read to the end.
+	Body io.ReadCloser
+
+	// ContentLength is the length of Body, or -1 if it is chunked or runs until the connection closes
+	ContentLength int64
+
+	// Trailer holds the trailer fields of a chunked body. It is filled in when
+	// Body returns io.EOF.
+	Trailer headers.Headers
+
+	// Chunked reports whether Body came with chunked transfer coding
+	Chunked bool
+
+	// Close reports whether the server closes the connection after this response
+	Close bool
+}
+
+// readLine reads one CRLF-terminated line, including the CRLF
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, ErrHeaderTooLarge
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("%w: line not ended by CRLF", response.ErrMalformedResponse)
+	}
+	return line, nil
+}
+
+// readHeaders parses header lines with headers.Parse up to the empty line
+func readHeaders(br *bufio.Reader) (headers.Headers, error) {
+	h := headers.NewHeaders()
+	total := 0
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if total += len(line); total > maxHeaderBytes {
+			return nil, ErrHeaderTooLarge
+		}
+		_, done, err := h.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", response.ErrMalformedResponse, err)
+		}
+		if done {
+			return h, nil
+		}
+	}
+}
+
+// readResponseHead reads a status line and headers, skipping any 1xx interim
+// responses except 101 Switching Protocols
+func readResponseHead(br *bufio.Reader) (*Response, error) {
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		statusLine, err := response.ParseStatusLine(string(line[:len(line)-2]))
+		if err != nil {
+			return nil, err
+		}
+		resp := &Response{Proto: statusLine.HttpVersion, StatusCode: statusLine.StatusCode, Reason: statusLine.ReasonPhrase}
+		if resp.Header, err = readHeaders(br); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != response.StatusSwitchingProtocols {
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// bodyFraming works out how the body of resp, the answer to a request with the
+// given method, is delimited (RFC 9112 Section 6.3). It sets ContentLength,
+// Chunked and Close, and returns a reader for the body with its framing removed.
+func bodyFraming(br *bufio.Reader, resp *Response, method string) (io.Reader, error) {
+	resp.Close = headerHasToken(resp.Header["connection"], "close") ||
+		(resp.Proto == "1.0" && !headerHasToken(resp.Header["connection"], "keep-alive"))
+
+	if method == "HEAD" || resp.StatusCode < 200 || resp.StatusCode == response.StatusNoContent || resp.StatusCode == response.StatusNotModified {
+		resp.ContentLength = 0
+		return nil, nil
+	}
+
+	if te, ok := resp.Header["transfer-encoding"]; ok {
+		// A Content-Length next to it is ignored, but might have fooled someone along the way
+		if _, ok := resp.Header["content-length"]; ok {
+			resp.Close = true
+		}
+		resp.ContentLength = -1
+		if headers.IsChunked(te) {
+			resp.Chunked = true
+			return &chunkedReader{br: br, resp: resp}, nil
+		}
+		resp.Close = true
+		return br, nil
+	}
+
+	if cl, ok := resp.Header["content-length"]; ok {
+		n, err := response.ParseContentLength(cl)
+		if err != nil {
+			return nil, err
+		}
+		resp.ContentLength = n
+		if n == 0 {
+			return nil, nil
+		}
+		return &fixedReader{r: br, remaining: n}, nil
+	}
+
+	// Neither: the body runs until the server closes the connection
+	resp.ContentLength = -1
+	resp.Close = true
+	return br, nil
+}
+
+// headerHasToken reports whether the comma-separated value contains token, ignoring case
+func headerHasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// fixedReader reads a body of known length, failing if the connection ends early
+type fixedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (f *fixedReader) Read(p []byte) (int, error) {
+	if f.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	f.remaining -= int64(n)
+	if err == io.EOF && f.remaining > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	if f.remaining == 0 {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// chunkedReader decodes a chunked body and stores its trailers on resp
+type chunkedReader struct {
+	br        *bufio.Reader
+	resp      *Response
+	remaining int64 // bytes left in the current chunk
+	needCRLF  bool  // the current chunk's data has been read, its CRLF hasn't
+	err       error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining == 0 {
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining == 0 {
+		c.needCRLF = true
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// nextChunk reads up to the next chunk's data. After the last chunk it reads the
+// trailers and returns io.EOF.
+func (c *chunkedReader) nextChunk() error {
+	if c.needCRLF {
+		line, err := readLine(c.br)
+		if err != nil {
+			return unexpected(err)
+		}
+		if len(line) != 2 {
+			return fmt.Errorf("%w: chunk data longer than its size", response.ErrMalformedResponse)
+		}
+		c.needCRLF = false
+	}
+
+	line, err := readLine(c.br)
+	if err != nil {
+		return unexpected(err)
+	}
+	size, err := response.ParseChunkSize(string(line[:len(line)-2]))
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		c.remaining = size
+		return nil
+	}
+
+	trailer, err := readHeaders(c.br)
+	if err != nil {
+		return unexpected(err)
+	}
+	if len(trailer) > 0 {
+		c.resp.Trailer = trailer
+	}
+	return io.EOF
+}
+
+// unexpected turns a clean EOF in the middle of a body into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
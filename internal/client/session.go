@@ -0,0 +1,297 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// HostPort is the address to dial for u, with the scheme's default port if it has none
+func HostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Dial connects to u's host, with TLS for https. cfg may be nil for the defaults;
+// the handshake gets u's host as ServerName unless cfg has one.
+func Dial(ctx context.Context, u *url.URL, cfg *tls.Config) (net.Conn, error) {
+	raw, err := dialTCP(ctx, u)
+	if err != nil || u.Scheme != "https" {
+		return raw, err
+	}
+	return handshake(ctx, raw, u, cfg)
+}
+
+func dialTCP(ctx context.Context, u *url.URL) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", HostPort(u))
+}
+
+// handshake starts TLS on raw, closing it if that fails
+func handshake(ctx context.Context, raw net.Conn, u *url.URL, cfg *tls.Config) (net.Conn, error) {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	// We only speak HTTP/1.1, so don't let ALPN pick h2
+	cfg.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(raw, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Session sends requests one after another on a single connection, keeping it open
+// between them while the server allows it and the next request goes to the same
+// scheme://host:port. Unlike Client it sends requests as request.WriteTo writes them
+// and reads whole responses with the response parser, which is what tools that show
+// or compare the exchange want. A Session is not safe for concurrent use.
+type Session struct {
+	// Timeout bounds connecting, the TLS handshake and each exchange; 0 means no limit
+	Timeout time.Duration
+
+	// TLSConfig is used for https URLs; nil means the defaults, verifying the server
+	TLSConfig *tls.Config
+
+	// Record keeps the bytes of each response as they arrived in Exchange.Raw
+	Record bool
+
+	// Note, if set, is told what happens to the connection: dialed, reused, closed
+	Note func(msg string)
+
+	// Sending, if set, gets each serialized request just before it goes out
+	Sending func(wire []byte)
+
+	// Received, if set, gets each exchange as soon as its response has been read
+	Received func(ex *Exchange)
+
+	conn *sessionConn
+}
+
+// Exchange is a response read by Session.Do, and how long it took
+type Exchange struct {
+	Response *response.Response
+
+	// Raw is the response as it came off the wire, if Session.Record is set
+	Raw []byte
+
+	Reused   bool          // the request went out on a connection kept from before
+	Connect  time.Duration // dialing, 0 for a reused connection
+	TLS      time.Duration // the TLS handshake, 0 for plain HTTP or a reused connection
+	TTFB     time.Duration // from sending the request to the first byte of the response
+	Transfer time.Duration // from the first byte to the end of the response
+	Total    time.Duration
+}
+
+// sessionConn is the open connection of a Session
+type sessionConn struct {
+	net.Conn
+	key string
+	tap *tap
+	br  *bufio.Reader
+}
+
+// tap sits under the connection's buffered reader, noting when the first byte of a
+// response arrives and keeping a copy of the bytes for Session.Record
+type tap struct {
+	r         io.Reader
+	n         int
+	firstByte time.Time
+	record    *bytes.Buffer
+}
+
+func (t *tap) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if t.n == 0 {
+			t.firstByte = time.Now()
+		}
+		t.n += n
+		if t.record != nil {
+			t.record.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+// reset starts watching for the next response
+func (t *tap) reset(record bool) {
+	t.n = 0
+	t.firstByte = time.Time{}
+	t.record = nil
+	if record {
+		t.record = &bytes.Buffer{}
+	}
+}
+
+// Close closes the connection, if there is one
+func (s *Session) Close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Do sends req to u's host and reads the response. A request that hits a kept-alive
+// connection the server closed in the meantime is sent again on a new one.
+func (s *Session) Do(u *url.URL, req *request.Request) (*Exchange, error) {
+	var wire bytes.Buffer
+	if _, err := req.WriteTo(&wire); err != nil {
+		return nil, err
+	}
+
+	key := u.Scheme + "://" + HostPort(u)
+	if s.conn != nil && s.conn.key != key {
+		s.Close()
+	}
+	ex, err := s.exchange(u, key, req.RequestLine.Method, wire.Bytes())
+	if err != nil && ex != nil && ex.Reused && s.conn == nil {
+		s.note("connection closed by the server, reconnecting")
+		ex, err = s.exchange(u, key, req.RequestLine.Method, wire.Bytes())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+// exchange sends the serialized request and reads the response. If a reused
+// connection fails before any byte of the response, it returns an Exchange with
+// Reused set and s.conn cleared so the caller can try again.
+func (s *Session) exchange(u *url.URL, key, method string, wire []byte) (*Exchange, error) {
+	ex := &Exchange{}
+	start := time.Now()
+	if s.conn != nil {
+		ex.Reused = true
+		s.note("reusing connection to " + s.conn.key)
+	} else {
+		c, err := s.dial(u, key, ex)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = c
+		s.note(fmt.Sprintf("connected to %s (%s)", c.key, c.RemoteAddr()))
+	}
+	c := s.conn
+
+	if s.Sending != nil {
+		s.Sending(wire)
+	}
+	c.tap.reset(s.Record)
+	if s.Timeout > 0 {
+		c.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	sent := time.Now()
+	_, err := c.Write(wire)
+	if err == nil {
+		ex.Response, err = response.ResponseFromReaderForMethod(c.br, method)
+	}
+	end := time.Now()
+	if err != nil {
+		stale := ex.Reused && c.tap.n == 0
+		s.Close()
+		if stale {
+			return ex, err
+		}
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+
+	if !c.tap.firstByte.IsZero() {
+		ex.TTFB = c.tap.firstByte.Sub(sent)
+		ex.Transfer = end.Sub(c.tap.firstByte)
+	}
+	ex.Total = end.Sub(start)
+	if s.Record {
+		ex.Raw = c.tap.record.Bytes()
+	}
+	if s.Received != nil {
+		s.Received(ex)
+	}
+
+	if !keepAlive(ex.Response, method) {
+		s.note("server closes the connection")
+		s.Close()
+	}
+	return ex, nil
+}
+
+// dial connects to u, timing the connection and the handshake on ex
+func (s *Session) dial(u *url.URL, key string, ex *Exchange) (*sessionConn, error) {
+	ctx, cancel := s.context()
+	start := time.Now()
+	raw, err := dialTCP(ctx, u)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	ex.Connect = time.Since(start)
+
+	if u.Scheme == "https" {
+		ctx, cancel := s.context()
+		start = time.Now()
+		raw, err = handshake(ctx, raw, u, s.TLSConfig)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		ex.TLS = time.Since(start)
+	}
+
+	tp := &tap{r: raw}
+	return &sessionConn{Conn: raw, key: key, tap: tp, br: bufio.NewReaderSize(tp, 32<<10)}, nil
+}
+
+// context bounds one step of dialing by Timeout
+func (s *Session) context() (context.Context, context.CancelFunc) {
+	if s.Timeout > 0 {
+		return context.WithTimeout(context.Background(), s.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (s *Session) note(msg string) {
+	if s.Note != nil {
+		s.Note(msg)
+	}
+}
+
+// keepAlive reports whether the connection can carry another request after resp
+func keepAlive(resp *response.Response, method string) bool {
+	conn := resp.Headers["connection"]
+	if resp.StatusLine.HttpVersion == "1.0" {
+		return headerHasToken(conn, "keep-alive") && hasLength(resp, method)
+	}
+	return !headerHasToken(conn, "close") && hasLength(resp, method)
+}
+
+// hasLength reports whether the end of resp's body is known without the connection closing
+func hasLength(resp *response.Response, method string) bool {
+	code := resp.StatusLine.StatusCode
+	if method == "HEAD" || code < 200 || code == response.StatusNoContent || code == response.StatusNotModified || resp.Chunked {
+		return true
+	}
+	_, ok := resp.Headers["content-length"]
+	return ok
+}
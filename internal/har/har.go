@@ -0,0 +1,247 @@
+// Package har reads and writes HTTP Archive (HAR 1.2) files, the JSON format browsers
+// export from their network panel. Recorder builds one from the traffic a server sees,
+// and Request.ToRequest turns an entry back into a request that can be sent again.
+//
+// See http://www.softwareishard.com/blog/har-12-spec/
+package har
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+)
+
+// File is the top level of a HAR document
+type File struct {
+	Log Log `json:"log"`
+}
+
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Entries []Entry `json:"entries"`
+}
+
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Entry is one request and its response
+type Entry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"` // total milliseconds, the sum of the timings
+	Request         Request   `json:"request"`
+	Response        Response  `json:"response"`
+	Cache           struct{}  `json:"cache"`
+	Timings         Timings   `json:"timings"`
+	ServerIPAddress string    `json:"serverIPAddress,omitempty"`
+	Connection      string    `json:"connection,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+}
+
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"` // -1 if unknown
+	BodySize    int         `json:"bodySize"`    // -1 if unknown
+}
+
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []Cookie    `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"` // bytes of body on the wire, chunk framing included
+}
+
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type Cookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PostData is a request body. HAR 1.2 has no encoding for it, so a body that
+// isn't UTF-8 text is base64 in Text with the custom field Encoding set.
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+// Content is a response body, decoded from its transfer coding. Encoding is
+// "base64" when Text isn't UTF-8 text.
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Timings splits Entry.Time in milliseconds; -1 means the phase doesn't apply
+type Timings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Read parses a HAR document
+func Read(r io.Reader) (*File, error) {
+	var f File
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("reading HAR: %w", err)
+	}
+	if f.Log.Version == "" {
+		return nil, errors.New("reading HAR: no log.version, not a HAR file")
+	}
+	return &f, nil
+}
+
+// ReadFile parses the HAR document at path
+func ReadFile(path string) (*File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Read(file)
+}
+
+// WriteTo writes f as indented JSON
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(data, '\n'))
+	return int64(n), err
+}
+
+// ToRequest turns a recorded request back into one that Request.WriteTo can send.
+// The Host header is kept as recorded, so the request can go to a different address.
+func (r *Request) ToRequest() (*request.Request, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request URL: %w", err)
+	}
+	version := strings.TrimPrefix(r.HTTPVersion, "HTTP/")
+	if version == "" || version == "2" || version == "2.0" {
+		// Replayed over HTTP/1.1 whatever it came in as
+		version = "1.1"
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: r.Method, RequestTarget: u.RequestURI(), HttpVersion: version},
+		Headers:     headers.NewHeaders(),
+	}
+	for _, h := range r.Headers {
+		// HTTP/2 pseudo-headers, as browsers record them, have no place in HTTP/1.1
+		if strings.HasPrefix(h.Name, ":") {
+			continue
+		}
+		if v, err := req.Headers.Get(h.Name); err == nil {
+			req.Headers.Set(h.Name, v+", "+h.Value)
+		} else {
+			req.Headers.Set(h.Name, h.Value)
+		}
+	}
+	if _, ok := req.Headers["host"]; !ok && u.Host != "" {
+		req.Headers.Set("Host", u.Host)
+	}
+	if r.PostData != nil {
+		if r.PostData.Encoding == "base64" {
+			if req.Body, err = base64.StdEncoding.DecodeString(r.PostData.Text); err != nil {
+				return nil, fmt.Errorf("invalid request body: %w", err)
+			}
+		} else {
+			req.Body = []byte(r.PostData.Text)
+		}
+	}
+	return req, nil
+}
+
+// Body returns the decoded response body
+func (c *Content) Body() ([]byte, error) {
+	if c.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(c.Text)
+	}
+	return []byte(c.Text), nil
+}
+
+// Get returns the value of the first header with the given name, in any case
+func Get(hdrs []NameValue, name string) string {
+	for _, h := range hdrs {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// nameValues lists h with the usual casing of each name, sorted by name
+func nameValues(h headers.Headers) []NameValue {
+	list := make([]NameValue, 0, len(h))
+	for name, value := range h {
+		list = append(list, NameValue{Name: textproto.CanonicalMIMEHeaderKey(name), Value: value})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// queryString lists the parameters of a query string in the order they appear
+func queryString(rawQuery string) []NameValue {
+	list := []NameValue{}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		list = append(list, NameValue{Name: name, Value: value})
+	}
+	return list
+}
+
+// cookies splits a Cookie request header into its pairs
+func cookies(header string) []Cookie {
+	list := []Cookie{}
+	for _, pair := range strings.Split(header, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && name != "" {
+			list = append(list, Cookie{Name: name, Value: value})
+		}
+	}
+	return list
+}
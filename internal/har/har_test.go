@@ -0,0 +1,182 @@
+package har
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+)
+
+func newTestRequest(method, target string, body []byte, hdrs map[string]string) *request.Request {
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+		Body:        body,
+		RemoteAddr:  "127.0.0.1:50000",
+	}
+	for name, value := range hdrs {
+		req.Headers.Set(name, value)
+	}
+	return req
+}
+
+func TestRecorder(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	binary := []byte{0xff, 0x00, 0xfe}
+
+	r := NewRecorder()
+	r.Record(Exchange{
+		Request:   newTestRequest("GET", "/later", nil, map[string]string{"Host": "example.com", "Cookie": "a=1; b=2"}),
+		Response:  []byte("HTTP/1.1 302 Found\r\nLocation: /elsewhere\r\nContent-Length: 0\r\n\r\n"),
+		Start:     start.Add(time.Second),
+		Parsed:    start.Add(time.Second + 2*time.Millisecond),
+		FirstByte: start.Add(time.Second + 5*time.Millisecond),
+		End:       start.Add(time.Second + 6*time.Millisecond),
+	})
+	r.Record(Exchange{
+		Request:  newTestRequest("PUT", "/upload", binary, map[string]string{"Host": "example.com", "Content-Type": "application/octet-stream"}),
+		Response: []byte("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: 3\r\n\r\n\xff\x00\xfe"),
+		Start:    start,
+		Parsed:   start.Add(time.Millisecond),
+		End:      start.Add(3 * time.Millisecond),
+	})
+	r.Record(Exchange{
+		Request:   newTestRequest("GET", "/video", nil, map[string]string{"Host": "example.com"}),
+		Response:  []byte("HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\nabc"),
+		Status:    200,
+		Truncated: true,
+		Start:     start.Add(2 * time.Second),
+		End:       start.Add(2 * time.Second),
+	})
+
+	f := r.File()
+	assert.Equal(t, "1.2", f.Log.Version)
+	require.Len(t, f.Log.Entries, 3)
+
+	// Ordered by start, not by when they were recorded
+	upload, redirect, video := f.Log.Entries[0], f.Log.Entries[1], f.Log.Entries[2]
+	assert.Equal(t, "http://example.com/upload", upload.Request.URL)
+	require.NotNil(t, upload.Request.PostData)
+	assert.Equal(t, "base64", upload.Request.PostData.Encoding)
+	assert.Equal(t, "base64", upload.Response.Content.Encoding)
+	body, err := upload.Response.Content.Body()
+	require.NoError(t, err)
+	assert.Equal(t, binary, body)
+	// No response bytes were written, so all of the time after parsing is wait
+	assert.Equal(t, Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Send: 1, Wait: 2, Receive: 0}, upload.Timings)
+
+	assert.Equal(t, "/elsewhere", redirect.Response.RedirectURL)
+	assert.Equal(t, []Cookie{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, redirect.Request.Cookies)
+	assert.Equal(t, Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Send: 2, Wait: 3, Receive: 1}, redirect.Timings)
+	assert.Equal(t, 6.0, redirect.Time)
+	assert.Equal(t, "50000", redirect.Connection)
+	assert.Equal(t, "/elsewhere", Get(redirect.Response.Headers, "location"))
+
+	assert.Equal(t, 200, video.Response.Status)
+	assert.Equal(t, -1, video.Response.BodySize)
+	assert.Contains(t, video.Comment, "response not recorded")
+}
+
+func TestRecorderMaxEntries(t *testing.T) {
+	r := NewRecorder()
+	r.MaxEntries = 2
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		r.Record(Exchange{
+			Request:  newTestRequest("GET", fmt.Sprintf("/%d", i), nil, map[string]string{"Host": "x"}),
+			Response: []byte("HTTP/1.1 204 No Content\r\n\r\n"),
+			Start:    start.Add(time.Duration(i) * time.Second),
+		})
+	}
+	entries := r.File().Log.Entries
+	require.Len(t, entries, 2)
+	assert.Equal(t, "http://x/3", entries[0].Request.URL)
+	assert.Equal(t, "http://x/4", entries[1].Request.URL)
+}
+
+func TestToRequest(t *testing.T) {
+	r := NewRecorder()
+	req := newTestRequest("POST", "/submit?q=a%20b", []byte("name=value"), map[string]string{
+		"Host":         "localhost:42069",
+		"Content-Type": "application/x-www-form-urlencoded",
+		"X-Trace":      "abc",
+	})
+	r.Record(Exchange{Request: req, Response: []byte("HTTP/1.1 204 No Content\r\n\r\n")})
+	entry := r.File().Log.Entries[0]
+	assert.Equal(t, []NameValue{{Name: "q", Value: "a b"}}, entry.Request.QueryString)
+
+	// A recorded request comes back out as it went in
+	back, err := entry.Request.ToRequest()
+	require.NoError(t, err)
+	var want, got bytes.Buffer
+	_, err = req.WriteTo(&want)
+	require.NoError(t, err)
+	_, err = back.WriteTo(&got)
+	require.NoError(t, err)
+	assert.Equal(t, want.String(), got.String())
+
+	t.Run("Browser export", func(t *testing.T) {
+		browser := Request{
+			Method:      "GET",
+			URL:         "https://example.com/a?b=c",
+			HTTPVersion: "HTTP/2",
+			Headers: []NameValue{
+				{Name: ":authority", Value: "example.com"},
+				{Name: "accept", Value: "text/html"},
+				{Name: "accept", Value: "*/*"},
+			},
+		}
+		req, err := browser.ToRequest()
+		require.NoError(t, err)
+		assert.Equal(t, request.RequestLine{Method: "GET", RequestTarget: "/a?b=c", HttpVersion: "1.1"}, req.RequestLine)
+		assert.Equal(t, headers.Headers{"host": "example.com", "accept": "text/html, */*"}, req.Headers)
+	})
+}
+
+func TestFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.har")
+	r, err := OpenFile(path)
+	require.NoError(t, err)
+
+	// The file is valid right away, before anything was recorded
+	f, err := ReadFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, f.Log.Entries)
+
+	// Every entry is in the file as soon as it is recorded, and none is kept in memory
+	for _, body := range []string{"hi", "there"} {
+		r.Record(Exchange{
+			Request:  newTestRequest("GET", "/", nil, map[string]string{"Host": "x"}),
+			Response: []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)),
+			Start:    time.Now(),
+		})
+		f, err = ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, body, f.Log.Entries[len(f.Log.Entries)-1].Response.Content.Text)
+	}
+	assert.Len(t, f.Log.Entries, 2)
+	assert.Empty(t, r.File().Log.Entries)
+
+	// Written all at once, the file would look the same
+	var whole bytes.Buffer
+	_, err = f.WriteTo(&whole)
+	require.NoError(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.JSONEq(t, whole.String(), string(data))
+	require.NoError(t, r.Close())
+
+	_, err = Read(strings.NewReader(`{"entries": []}`))
+	assert.ErrorContains(t, err, "not a HAR file")
+	_, err = OpenFile(filepath.Join(t.TempDir(), "missing", "capture.har"))
+	assert.Error(t, err)
+}
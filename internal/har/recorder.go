@@ -0,0 +1,274 @@
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// Exchange is one request and the response the server sent for it
+type Exchange struct {
+	Request *request.Request
+
+	// Response is the response as written to the connection, status line to last chunk.
+	// Status is the code the handler set, in case Response can't be parsed. Truncated
+	// says Response is only the start of a response too big to keep.
+	Response  []byte
+	Status    int
+	Truncated bool
+
+	Start     time.Time // the connection was accepted
+	Parsed    time.Time // the request was read and handed to the handler
+	FirstByte time.Time // the first byte of the response was written, zero if none was
+	End       time.Time // the response was complete
+}
+
+// DefaultMaxEntries is how many entries a recorder without a file keeps unless
+// Recorder.MaxEntries says otherwise
+const DefaultMaxEntries = 1000
+
+// Recorder collects exchanges into a HAR log. It is safe for concurrent use by
+// all connections of a server. A recorder from OpenFile writes every entry to its
+// file as it comes and keeps none in memory; one from NewRecorder keeps the latest.
+type Recorder struct {
+	// MaxEntries caps the entries kept in memory, dropping the oldest; 0 means DefaultMaxEntries
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries []Entry
+
+	file   *os.File
+	end    int64 // where the next entry goes, just before fileTail
+	count  int   // entries in the file
+	err    error // the first write error, after which nothing more is written
+	closed bool
+}
+
+// fileHead and fileTail are what a HAR file written by a Recorder has around its entries
+var fileHead, fileTail = func() (string, string) {
+	data, _ := json.MarshalIndent(newFile(nil), "", "  ")
+	head, tail, _ := strings.Cut(string(data), "[]")
+	return head + "[", "\n    ]" + tail + "\n"
+}()
+
+func newFile(entries []Entry) *File {
+	if entries == nil {
+		entries = []Entry{}
+	}
+	return &File{Log: Log{
+		Version: "1.2",
+		Creator: Creator{Name: "httpfromtcp", Version: "1.0"},
+		Entries: entries,
+	}}
+}
+
+// NewRecorder creates a recorder that keeps the last MaxEntries entries in memory; see File
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// OpenFile creates a recorder that writes its log to path. Each entry is added as
+// its response completes, in that order, and the file is a valid HAR file all along,
+// so a capture survives the server being killed. The file is created right away, so
+// a path that can't be written fails here rather than at the end.
+func OpenFile(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.WriteString(fileHead + fileTail); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Recorder{file: file, end: int64(len(fileHead))}, nil
+}
+
+// Record adds an exchange to the log
+func (r *Recorder) Record(x Exchange) {
+	entry := newEntry(x)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		r.write(entry)
+		return
+	}
+	max := r.MaxEntries
+	if max <= 0 {
+		max = DefaultMaxEntries
+	}
+	if len(r.entries) >= max {
+		r.entries = append(r.entries[:0], r.entries[len(r.entries)-max+1:]...)
+	}
+	r.entries = append(r.entries, entry)
+}
+
+// write puts entry at the end of the file, followed by the tail again. r.mu must be held.
+func (r *Recorder) write(entry Entry) {
+	if r.err != nil || r.closed {
+		return
+	}
+	data, err := json.MarshalIndent(entry, "      ", "  ")
+	if err != nil {
+		r.err = err
+		return
+	}
+	sep := ",\n      "
+	if r.count == 0 {
+		sep = "\n      "
+	}
+	chunk := append([]byte(sep), data...)
+	if _, err := r.file.WriteAt(append(chunk, fileTail...), r.end); err != nil {
+		r.err = err
+		return
+	}
+	r.end += int64(len(chunk))
+	r.count++
+}
+
+// File returns the entries kept in memory, ordered by when they started. A recorder
+// writing to a file keeps none; read the file back with ReadFile.
+func (r *Recorder) File() *File {
+	r.mu.Lock()
+	entries := make([]Entry, len(r.entries))
+	copy(entries, r.entries)
+	r.mu.Unlock()
+
+	// Entries are recorded as responses finish; a slow one started before faster ones
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+	return newFile(entries)
+}
+
+// Close closes the file given to OpenFile, if any, and returns the first error
+// writing to it
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil || r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.file.Close()
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+func newEntry(x Exchange) Entry {
+	ms := func(from, to time.Time) float64 {
+		if from.IsZero() || to.Before(from) {
+			return 0
+		}
+		return float64(to.Sub(from).Microseconds()) / 1000
+	}
+	firstByte := x.FirstByte
+	if firstByte.IsZero() {
+		firstByte = x.End
+	}
+
+	entry := Entry{
+		StartedDateTime: x.Start,
+		Request:         newRequest(x.Request),
+		Timings: Timings{
+			Blocked: -1,
+			DNS:     -1,
+			Connect: -1,
+			SSL:     -1,
+			Send:    ms(x.Start, x.Parsed),
+			Wait:    ms(x.Parsed, firstByte),
+			Receive: ms(firstByte, x.End),
+		},
+	}
+	entry.Time = entry.Timings.Send + entry.Timings.Wait + entry.Timings.Receive
+	// HAR identifies the connection by its client port
+	if _, port, err := net.SplitHostPort(x.Request.RemoteAddr); err == nil {
+		entry.Connection = port
+	}
+
+	resp, err := response.ResponseFromReaderForMethod(bytes.NewReader(x.Response), x.Request.RequestLine.Method)
+	if x.Truncated {
+		err = fmt.Errorf("only the first %d bytes were kept", len(x.Response))
+	}
+	if err != nil {
+		// Cut off or too big to keep: record what is known
+		entry.Response = Response{
+			Status:      x.Status,
+			StatusText:  response.StatusText(response.StatusCode(x.Status)),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []Cookie{},
+			Headers:     []NameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+		entry.Comment = fmt.Sprintf("response not recorded: %v", err)
+		return entry
+	}
+	entry.Response = newResponse(resp, x.Response)
+	return entry
+}
+
+func newRequest(req *request.Request) Request {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	host := req.Headers["host"]
+	_, rawQuery, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	r := Request{
+		Method:      req.RequestLine.Method,
+		URL:         scheme + "://" + host + req.RequestLine.RequestTarget,
+		HTTPVersion: "HTTP/" + req.RequestLine.HttpVersion,
+		Cookies:     cookies(req.Headers["cookie"]),
+		Headers:     nameValues(req.Headers),
+		QueryString: queryString(rawQuery),
+		HeadersSize: -1,
+		BodySize:    len(req.Body),
+	}
+	if len(req.Body) > 0 {
+		r.PostData = &PostData{MimeType: req.Headers["content-type"]}
+		r.PostData.Text, r.PostData.Encoding = encodeBody(req.Body)
+	}
+	return r
+}
+
+// newResponse describes resp, which was parsed from raw
+func newResponse(resp *response.Response, raw []byte) Response {
+	headersSize := bytes.Index(raw, []byte("\r\n\r\n")) + 4
+	r := Response{
+		Status:      int(resp.StatusLine.StatusCode),
+		StatusText:  resp.StatusLine.ReasonPhrase,
+		HTTPVersion: "HTTP/" + resp.StatusLine.HttpVersion,
+		Cookies:     []Cookie{},
+		Headers:     nameValues(resp.Headers),
+		Content: Content{
+			Size:     len(resp.Body),
+			MimeType: resp.Headers["content-type"],
+		},
+		RedirectURL: resp.Headers["location"],
+		HeadersSize: headersSize,
+		BodySize:    len(raw) - headersSize,
+	}
+	r.Content.Text, r.Content.Encoding = encodeBody(resp.Body)
+	return r
+}
+
+// encodeBody returns body as text, base64 encoded if it isn't valid UTF-8
+func encodeBody(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
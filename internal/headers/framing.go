@@ -0,0 +1,43 @@
+package headers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidFraming is returned for a Content-Length or chunk size that can't be parsed
+var ErrInvalidFraming = errors.New("invalid message framing")
+
+// ParseContentLength parses a Content-Length value. Parse joins repeated headers, so a
+// list is accepted as long as its values agree.
+func ParseContentLength(value string) (int64, error) {
+	var n int64 = -1
+	for _, v := range strings.Split(value, ",") {
+		parsed, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil || parsed < 0 || (n >= 0 && parsed != n) {
+			return 0, fmt.Errorf("%w: Content-Length %q", ErrInvalidFraming, value)
+		}
+		n = parsed
+	}
+	return n, nil
+}
+
+// ParseChunkSize parses the chunk-size line of a chunked body, without its CRLF.
+// Chunk extensions after ';' carry nothing we use and are ignored.
+func ParseChunkSize(line string) (int64, error) {
+	sizeField, _, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("%w: chunk size %q", ErrInvalidFraming, sizeField)
+	}
+	return size, nil
+}
+
+// IsChunked reports whether a Transfer-Encoding value ends in chunked, the only
+// coding that delimits a body
+func IsChunked(te string) bool {
+	codings := strings.Split(te, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
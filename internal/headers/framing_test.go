@@ -0,0 +1,35 @@
+package headers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFraming(t *testing.T) {
+	for value, want := range map[string]int64{"0": 0, "42": 42, " 7 ": 7, "5, 5": 5, "5,5,5": 5} {
+		n, err := ParseContentLength(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, want, n, value)
+	}
+	for _, bad := range []string{"", "-1", "x", "5, 6", "1e3", "0x10"} {
+		_, err := ParseContentLength(bad)
+		assert.ErrorIs(t, err, ErrInvalidFraming, bad)
+	}
+
+	for line, want := range map[string]int64{"0": 0, "a": 10, "FF": 255, "1f;name=value": 31, "10 ; ext": 16} {
+		n, err := ParseChunkSize(line)
+		require.NoError(t, err, line)
+		assert.Equal(t, want, n, line)
+	}
+	for _, bad := range []string{"", "zz", "-1", ";ext"} {
+		_, err := ParseChunkSize(bad)
+		assert.ErrorIs(t, err, ErrInvalidFraming, bad)
+	}
+
+	assert.True(t, IsChunked("chunked"))
+	assert.True(t, IsChunked("gzip, Chunked"))
+	assert.False(t, IsChunked("chunked, gzip"))
+	assert.False(t, IsChunked("identity"))
+}
@@ -0,0 +1,367 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ClientPreface is what every HTTP/2 client sends before its first frame (RFC 9113 Section 3.4)
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	frameHeaderLen = 9
+
+	// DefaultMaxFrameSize is the largest frame payload a peer may send before SETTINGS say otherwise
+	DefaultMaxFrameSize = 16384
+	maxFrameSizeLimit   = 1<<24 - 1
+
+	// DefaultWindowSize is the initial flow-control window of streams and of the connection
+	DefaultWindowSize = 65535
+	maxWindowSize     = 1<<31 - 1
+)
+
+// FrameType identifies the kind of a frame
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+var frameTypeNames = map[FrameType]string{
+	FrameData:         "DATA",
+	FrameHeaders:      "HEADERS",
+	FramePriority:     "PRIORITY",
+	FrameRSTStream:    "RST_STREAM",
+	FrameSettings:     "SETTINGS",
+	FramePushPromise:  "PUSH_PROMISE",
+	FramePing:         "PING",
+	FrameGoAway:       "GOAWAY",
+	FrameWindowUpdate: "WINDOW_UPDATE",
+	FrameContinuation: "CONTINUATION",
+}
+
+func (t FrameType) String() string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+}
+
+// Flags are the frame flags; their meaning depends on the frame type
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1  // DATA, HEADERS
+	FlagAck        Flags = 0x1  // SETTINGS, PING
+	FlagEndHeaders Flags = 0x4  // HEADERS, CONTINUATION
+	FlagPadded     Flags = 0x8  // DATA, HEADERS
+	FlagPriority   Flags = 0x20 // HEADERS
+)
+
+// Has reports whether all bits of flag are set
+func (f Flags) Has(flag Flags) bool {
+	return f&flag == flag
+}
+
+// SettingID identifies a SETTINGS parameter
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+// Setting is one parameter of a SETTINGS frame
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+// ErrCode is the error code carried by RST_STREAM and GOAWAY
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_ERROR_CODE_%d", uint32(c))
+}
+
+// ConnectionError is a protocol violation that ends the whole connection with a GOAWAY
+type ConnectionError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("http2: connection error %v: %s", e.Code, e.Reason)
+}
+
+// StreamError is a problem confined to one stream, answered with a RST_STREAM
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %v: %s", e.StreamID, e.Code, e.Reason)
+}
+
+func connError(code ErrCode, format string, args ...any) error {
+	return ConnectionError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func streamError(id uint32, code ErrCode, format string, args ...any) error {
+	return StreamError{StreamID: id, Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// ErrBadPreface is returned when a connection doesn't start with ClientPreface
+var ErrBadPreface = errors.New("http2: invalid client preface")
+
+// Frame is a frame header with its raw payload
+type Frame struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+func (f *Frame) String() string {
+	return fmt.Sprintf("%v flags=0x%02x stream=%d len=%d", f.Type, uint8(f.Flags), f.StreamID, len(f.Payload))
+}
+
+// Framer reads and writes frames. Reads and writes may happen concurrently,
+// but the caller has to serialize writes.
+type Framer struct {
+	r io.Reader
+	w *bufio.Writer
+
+	// MaxReadSize is the largest payload ReadFrame accepts, our SETTINGS_MAX_FRAME_SIZE
+	MaxReadSize uint32
+
+	header [frameHeaderLen]byte
+}
+
+// NewFramer creates a framer reading from r and writing to w
+func NewFramer(w io.Writer, r io.Reader) *Framer {
+	return &Framer{
+		r:           r,
+		w:           bufio.NewWriter(w),
+		MaxReadSize: DefaultMaxFrameSize,
+	}
+}
+
+// ReadFrame reads the next frame. The payload is freshly allocated, so it
+// stays valid after the next call.
+func (fr *Framer) ReadFrame() (*Frame, error) {
+	if _, err := io.ReadFull(fr.r, fr.header[:]); err != nil {
+		return nil, err
+	}
+
+	length := uint32(fr.header[0])<<16 | uint32(fr.header[1])<<8 | uint32(fr.header[2])
+	f := &Frame{
+		Type:     FrameType(fr.header[3]),
+		Flags:    Flags(fr.header[4]),
+		StreamID: binary.BigEndian.Uint32(fr.header[5:]) & (1<<31 - 1),
+	}
+	if length > fr.MaxReadSize {
+		return nil, connError(ErrCodeFrameSize, "%v frame of %d bytes exceeds %d", f.Type, length, fr.MaxReadSize)
+	}
+
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(fr.r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteFrame writes one frame and flushes it
+func (fr *Framer) WriteFrame(t FrameType, flags Flags, streamID uint32, payload []byte) error {
+	if err := fr.writeFrame(t, flags, streamID, payload); err != nil {
+		return err
+	}
+	return fr.w.Flush()
+}
+
+// writeFrame buffers one frame without flushing, so several can go out in one write
+func (fr *Framer) writeFrame(t FrameType, flags Flags, streamID uint32, payload []byte) error {
+	if len(payload) > maxFrameSizeLimit {
+		return fmt.Errorf("http2: %v payload of %d bytes is too large", t, len(payload))
+	}
+	header := [frameHeaderLen]byte{
+		byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+		byte(t), byte(flags),
+	}
+	binary.BigEndian.PutUint32(header[5:], streamID&(1<<31-1))
+
+	if _, err := fr.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := fr.w.Write(payload)
+	return err
+}
+
+// WriteSettings writes a SETTINGS frame with the given parameters
+func (fr *Framer) WriteSettings(settings ...Setting) error {
+	payload := make([]byte, 0, 6*len(settings))
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Value)
+	}
+	return fr.WriteFrame(FrameSettings, 0, 0, payload)
+}
+
+// WriteSettingsAck acknowledges the peer's SETTINGS
+func (fr *Framer) WriteSettingsAck() error {
+	return fr.WriteFrame(FrameSettings, FlagAck, 0, nil)
+}
+
+// WritePing writes a PING, or the answer to one if ack is set
+func (fr *Framer) WritePing(ack bool, data [8]byte) error {
+	var flags Flags
+	if ack {
+		flags = FlagAck
+	}
+	return fr.WriteFrame(FramePing, flags, 0, data[:])
+}
+
+// WriteGoAway tells the peer the connection is ending and which streams may have been processed
+func (fr *Framer) WriteGoAway(lastStreamID uint32, code ErrCode, debugData []byte) error {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID&(1<<31-1))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	payload = append(payload, debugData...)
+	return fr.WriteFrame(FrameGoAway, 0, 0, payload)
+}
+
+// WriteRSTStream ends a single stream abnormally
+func (fr *Framer) WriteRSTStream(streamID uint32, code ErrCode) error {
+	return fr.WriteFrame(FrameRSTStream, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+// WriteWindowUpdate grants the peer increment more bytes on the stream, or on the connection for stream 0
+func (fr *Framer) WriteWindowUpdate(streamID, increment uint32) error {
+	return fr.WriteFrame(FrameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, increment&(1<<31-1)))
+}
+
+// WriteData writes a DATA frame
+func (fr *Framer) WriteData(streamID uint32, endStream bool, data []byte) error {
+	var flags Flags
+	if endStream {
+		flags = FlagEndStream
+	}
+	return fr.WriteFrame(FrameData, flags, streamID, data)
+}
+
+// WriteHeaders writes a header block as a HEADERS frame followed by as many
+// CONTINUATION frames as needed to keep each under maxFrameSize
+func (fr *Framer) WriteHeaders(streamID uint32, endStream bool, block []byte, maxFrameSize uint32) error {
+	var flags Flags
+	if endStream {
+		flags = FlagEndStream
+	}
+
+	frameType := FrameHeaders
+	for {
+		chunk := block
+		if uint32(len(chunk)) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+
+		if err := fr.writeFrame(frameType, flags, streamID, chunk); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return fr.w.Flush()
+		}
+		frameType, flags = FrameContinuation, 0
+	}
+}
+
+// parseSettings splits a SETTINGS payload into its parameters
+func parseSettings(f *Frame) ([]Setting, error) {
+	if len(f.Payload)%6 != 0 {
+		return nil, connError(ErrCodeFrameSize, "SETTINGS length %d is not a multiple of 6", len(f.Payload))
+	}
+	settings := make([]Setting, 0, len(f.Payload)/6)
+	for p := f.Payload; len(p) > 0; p = p[6:] {
+		settings = append(settings, Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(p)),
+			Value: binary.BigEndian.Uint32(p[2:]),
+		})
+	}
+	return settings, nil
+}
+
+// stripPadding removes the pad length byte and the padding of a PADDED frame
+func stripPadding(f *Frame) ([]byte, error) {
+	payload := f.Payload
+	if !f.Flags.Has(FlagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, connError(ErrCodeProtocol, "padded %v frame without pad length", f.Type)
+	}
+	padLen := int(payload[0])
+	if padLen >= len(payload) {
+		return nil, connError(ErrCodeProtocol, "padding of %d bytes is longer than the %v payload", padLen, f.Type)
+	}
+	return payload[1 : len(payload)-padLen], nil
+}
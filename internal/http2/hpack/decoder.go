@@ -0,0 +1,140 @@
+package hpack
+
+import "fmt"
+
+// Decoder turns header blocks back into fields. One Decoder serves a whole
+// connection, because the dynamic table carries over from block to block.
+type Decoder struct {
+	table dynamicTable
+
+	// allowedMaxSize is the limit we advertised in SETTINGS_HEADER_TABLE_SIZE;
+	// the peer may shrink its table below it but never grow past it
+	allowedMaxSize uint32
+
+	// MaxStringLength caps a single name or value, 0 means no limit
+	MaxStringLength int
+}
+
+// NewDecoder creates a decoder whose peer may use a dynamic table of up to maxTableSize bytes
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table:          dynamicTable{maxSize: maxTableSize},
+		allowedMaxSize: maxTableSize,
+	}
+}
+
+// Decode decodes one complete header block (the HEADERS payload plus any CONTINUATIONs)
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	sawField := false
+
+	for len(block) > 0 {
+		b := block[0]
+		var (
+			field HeaderField
+			n     int
+			err   error
+		)
+
+		switch {
+		case b&0x80 != 0:
+			// Indexed Header Field: 1xxxxxxx
+			field, n, err = d.readIndexed(block)
+
+		case b&0xc0 == 0x40:
+			// Literal with Incremental Indexing: 01xxxxxx
+			field, n, err = d.readLiteral(block, 6)
+			if err == nil {
+				d.table.add(field)
+			}
+
+		case b&0xe0 == 0x20:
+			// Dynamic Table Size Update: 001xxxxx, only allowed before the first field
+			if sawField {
+				return nil, ErrTableSizeUpdate
+			}
+			var size uint64
+			size, n, err = readInt(block, 5)
+			if err == nil && size > uint64(d.allowedMaxSize) {
+				err = fmt.Errorf("hpack: table size %d above the allowed %d", size, d.allowedMaxSize)
+			}
+			if err == nil {
+				d.table.setMaxSize(uint32(size))
+			}
+			block = block[n:]
+			if err != nil {
+				return nil, err
+			}
+			continue
+
+		case b&0xf0 == 0x10:
+			// Literal Never Indexed: 0001xxxx
+			field, n, err = d.readLiteral(block, 4)
+			field.Sensitive = true
+
+		default:
+			// Literal without Indexing: 0000xxxx
+			field, n, err = d.readLiteral(block, 4)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+		sawField = true
+		block = block[n:]
+	}
+
+	return fields, nil
+}
+
+// SetAllowedMaxTableSize changes the limit we advertise to the peer
+func (d *Decoder) SetAllowedMaxTableSize(n uint32) {
+	d.allowedMaxSize = n
+}
+
+func (d *Decoder) readIndexed(block []byte) (HeaderField, int, error) {
+	index, n, err := readInt(block, 7)
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	field, ok := d.table.at(index)
+	if !ok {
+		return HeaderField{}, 0, fmt.Errorf("%w: %d", ErrInvalidIndex, index)
+	}
+	return field, n, nil
+}
+
+// readLiteral reads a literal field whose name index has an n-bit prefix.
+// An index of 0 means the name follows as a string literal.
+func (d *Decoder) readLiteral(block []byte, prefix uint) (HeaderField, int, error) {
+	index, consumed, err := readInt(block, prefix)
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+
+	var field HeaderField
+	if index == 0 {
+		name, n, err := readString(block[consumed:], d.MaxStringLength)
+		if err != nil {
+			return HeaderField{}, 0, err
+		}
+		field.Name = name
+		consumed += n
+	} else {
+		named, ok := d.table.at(index)
+		if !ok {
+			return HeaderField{}, 0, fmt.Errorf("%w: %d", ErrInvalidIndex, index)
+		}
+		field.Name = named.Name
+	}
+
+	value, n, err := readString(block[consumed:], d.MaxStringLength)
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	field.Value = value
+	consumed += n
+
+	return field, consumed, nil
+}
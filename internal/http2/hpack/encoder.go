@@ -0,0 +1,77 @@
+package hpack
+
+// Encoder turns fields into header blocks. Like the Decoder it lives as long
+// as the connection, since both ends must keep identical dynamic tables.
+type Encoder struct {
+	table dynamicTable
+
+	// pendingSizeUpdate is set when the table size changed since the last block;
+	// the change has to be announced at the start of the next one
+	pendingSizeUpdate bool
+	minSizeSinceBlock uint32
+}
+
+// NewEncoder creates an encoder using the default 4096-byte dynamic table
+func NewEncoder() *Encoder {
+	return &Encoder{
+		table:             dynamicTable{maxSize: DefaultTableSize},
+		minSizeSinceBlock: DefaultTableSize,
+	}
+}
+
+// SetMaxTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	if n == e.table.maxSize {
+		return
+	}
+	if n < e.minSizeSinceBlock {
+		e.minSizeSinceBlock = n
+	}
+	e.table.setMaxSize(n)
+	e.pendingSizeUpdate = true
+}
+
+// Encode appends the header block for fields to dst
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.pendingSizeUpdate {
+		// If the table shrank and grew again, the decoder must see the smallest size
+		// first so it evicts the same entries we did (RFC 7541 Section 4.2)
+		if e.minSizeSinceBlock < e.table.maxSize {
+			dst = appendInt(dst, 0x20, 5, uint64(e.minSizeSinceBlock))
+		}
+		dst = appendInt(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.pendingSizeUpdate = false
+		e.minSizeSinceBlock = e.table.maxSize
+	}
+
+	for _, f := range fields {
+		dst = e.encodeField(dst, f)
+	}
+	return dst
+}
+
+func (e *Encoder) encodeField(dst []byte, f HeaderField) []byte {
+	index, exact := e.table.search(f)
+	if exact && !f.Sensitive {
+		// Indexed Header Field
+		return appendInt(dst, 0x80, 7, index)
+	}
+
+	switch {
+	case f.Sensitive:
+		// Literal Never Indexed
+		dst = appendInt(dst, 0x10, 4, index)
+	case f.Size() > e.table.maxSize:
+		// It would just empty the table, so don't index it
+		dst = appendInt(dst, 0x00, 4, index)
+	default:
+		// Literal with Incremental Indexing
+		dst = appendInt(dst, 0x40, 6, index)
+		e.table.add(f)
+	}
+
+	if index == 0 {
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
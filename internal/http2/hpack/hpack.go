@@ -0,0 +1,194 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultTableSize is the dynamic table size both sides start with (RFC 7541 Section 4.2)
+const DefaultTableSize = 4096
+
+// entryOverhead is added to the name and value length of every table entry (RFC 7541 Section 4.1)
+const entryOverhead = 32
+
+var (
+	ErrIntegerOverflow = errors.New("hpack: integer overflow")
+	ErrTruncated       = errors.New("hpack: truncated header block")
+	ErrInvalidIndex    = errors.New("hpack: invalid table index")
+	ErrTableSizeUpdate = errors.New("hpack: dynamic table size update not allowed here")
+	ErrStringTooLong   = errors.New("hpack: string literal exceeds the limit")
+)
+
+// HeaderField is a single name/value pair. Sensitive fields are never added
+// to a dynamic table, so intermediaries won't compress them either.
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+// Size is the space the field takes up in a dynamic table
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + entryOverhead)
+}
+
+func (f HeaderField) String() string {
+	return fmt.Sprintf("%s: %s", f.Name, f.Value)
+}
+
+// dynamicTable is the FIFO table of recently used fields. The newest entry has index 62.
+type dynamicTable struct {
+	entries []HeaderField // oldest first
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+// evict drops the oldest entries until the table fits in maxSize.
+// An entry larger than the whole table simply empties it.
+func (t *dynamicTable) evict() {
+	drop := 0
+	for t.size > t.maxSize && drop < len(t.entries) {
+		t.size -= t.entries[drop].Size()
+		drop++
+	}
+	if drop > 0 {
+		t.entries = append(t.entries[:0], t.entries[drop:]...)
+	}
+}
+
+// at returns the entry for an HPACK index, which covers the static table then the dynamic one
+func (t *dynamicTable) at(index uint64) (HeaderField, bool) {
+	if index == 0 {
+		return HeaderField{}, false
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], true
+	}
+	i := index - uint64(len(staticTable)) - 1
+	if i >= uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[len(t.entries)-1-int(i)], true
+}
+
+// search looks for the field in both tables. It returns the index of an exact match,
+// or failing that of the first entry with the same name, or 0.
+func (t *dynamicTable) search(f HeaderField) (index uint64, exact bool) {
+	for i, e := range staticTable {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		if index == 0 {
+			index = uint64(i + 1)
+		}
+	}
+
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		dynamicIndex := uint64(len(staticTable) + len(t.entries) - i)
+		if e.Value == f.Value {
+			return dynamicIndex, true
+		}
+		if index == 0 {
+			index = dynamicIndex
+		}
+	}
+	return index, false
+}
+
+// appendInt appends an integer with an n-bit prefix (RFC 7541 Section 5.1).
+// first holds the bits of the first byte above the prefix.
+func appendInt(dst []byte, first byte, n uint, v uint64) []byte {
+	max := uint64(1)<<n - 1
+	if v < max {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(max))
+	v -= max
+	for v >= 128 {
+		dst = append(dst, byte(v&0x7f)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+// readInt reads an integer with an n-bit prefix and returns it with the bytes consumed
+func readInt(data []byte, n uint) (uint64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, ErrTruncated
+	}
+	max := uint64(1)<<n - 1
+	v := uint64(data[0]) & max
+	if v < max {
+		return v, 1, nil
+	}
+
+	var shift uint
+	for i := 1; i < len(data); i++ {
+		b := data[i]
+		v += uint64(b&0x7f) << shift
+		if shift > 56 {
+			return 0, 0, ErrIntegerOverflow
+		}
+		if b&0x80 == 0 {
+			return v, i + 1, nil
+		}
+		shift += 7
+	}
+	return 0, 0, ErrTruncated
+}
+
+// appendString appends a string literal, Huffman-encoded when that is shorter
+func appendString(dst []byte, s string) []byte {
+	if huffLen := HuffmanEncodedLen(s); huffLen < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(huffLen))
+		return AppendHuffman(dst, s)
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// readString reads a string literal and returns it with the bytes consumed
+func readString(data []byte, maxLen int) (string, int, error) {
+	if len(data) == 0 {
+		return "", 0, ErrTruncated
+	}
+	huffman := data[0]&0x80 != 0
+	length, n, err := readInt(data, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	if maxLen > 0 && length > uint64(maxLen) {
+		return "", 0, ErrStringTooLong
+	}
+	if uint64(len(data)-n) < length {
+		return "", 0, ErrTruncated
+	}
+
+	raw := data[n : n+int(length)]
+	if !huffman {
+		return string(raw), n + int(length), nil
+	}
+	s, err := DecodeHuffman(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	return s, n + int(length), nil
+}
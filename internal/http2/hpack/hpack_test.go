@@ -0,0 +1,168 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+// The request examples of RFC 7541 Appendix C.3 (plain) and C.4 (Huffman)
+var requestExamples = [][]HeaderField{
+	{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	},
+	{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "cache-control", Value: "no-cache"},
+	},
+	{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "custom-key", Value: "custom-value"},
+	},
+}
+
+func TestDecodeRFCExamples(t *testing.T) {
+	blocks := map[string][]string{
+		"C.3 without Huffman": {
+			"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			"8286 84be 5808 6e6f 2d63 6163 6865",
+			"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		},
+		"C.4 with Huffman": {
+			"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+			"8286 84be 5886 a8eb 1064 9cbf",
+			"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+		},
+	}
+
+	for name, hexBlocks := range blocks {
+		t.Run(name, func(t *testing.T) {
+			// One decoder for all three, the dynamic table carries over
+			dec := NewDecoder(DefaultTableSize)
+			for i, block := range hexBlocks {
+				fields, err := dec.Decode(unhex(t, block))
+				require.NoError(t, err)
+				assert.Equal(t, requestExamples[i], fields)
+			}
+			assert.Equal(t, uint32(164), dec.table.size)
+		})
+	}
+}
+
+func TestEncodeMatchesRFCExamples(t *testing.T) {
+	enc := NewEncoder()
+	expected := []string{
+		"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+		"8286 84be 5886 a8eb 1064 9cbf",
+		"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+	}
+	for i, fields := range requestExamples {
+		assert.Equal(t, unhex(t, expected[i]), enc.Encode(nil, fields))
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	enc := NewEncoder()
+	dec := NewDecoder(DefaultTableSize)
+
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/html; charset=utf-8"},
+		{Name: "x-binary", Value: "\x00\xff\x7f"},
+		{Name: "authorization", Value: "Bearer secret", Sensitive: true},
+		{Name: "x-long", Value: strings.Repeat("a", 5000)}, // larger than the whole table
+	}
+	for i := 0; i < 3; i++ {
+		decoded, err := dec.Decode(enc.Encode(nil, fields))
+		require.NoError(t, err)
+		assert.Equal(t, fields, decoded)
+	}
+
+	// Sensitive fields must stay out of the table
+	_, exact := dec.table.search(HeaderField{Name: "authorization", Value: "Bearer secret"})
+	assert.False(t, exact)
+}
+
+func TestTableSizeUpdate(t *testing.T) {
+	enc := NewEncoder()
+	dec := NewDecoder(DefaultTableSize)
+
+	fields := []HeaderField{{Name: "x-a", Value: "1"}, {Name: "x-b", Value: "2"}}
+	_, err := dec.Decode(enc.Encode(nil, fields))
+	require.NoError(t, err)
+	require.Len(t, dec.table.entries, 2)
+
+	// Shrinking to 0 and back must clear the decoder's table as well
+	enc.SetMaxTableSize(0)
+	enc.SetMaxTableSize(100)
+	block := enc.Encode(nil, []HeaderField{{Name: "x-c", Value: "3"}})
+	assert.Equal(t, byte(0x20), block[0])
+
+	decoded, err := dec.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "x-c", Value: "3"}}, decoded)
+	assert.Len(t, dec.table.entries, 1)
+	assert.Equal(t, uint32(100), dec.table.maxSize)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := map[string]string{
+		"index zero":              "80",
+		"index past the tables":   "be",
+		"truncated string":        "4005 6162",
+		"truncated integer":       "ff",
+		"size update above max":   "3fe2 1f",
+		"size update after field": "82 20",
+		"huffman with EOS":        "0084 ffff ffff",
+	}
+	for name, block := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewDecoder(DefaultTableSize).Decode(unhex(t, block))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHuffman(t *testing.T) {
+	encoded := AppendHuffman(nil, "www.example.com")
+	assert.Equal(t, unhex(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff"), encoded)
+	assert.Equal(t, len(encoded), HuffmanEncodedLen("www.example.com"))
+
+	decoded, err := DecodeHuffman(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", decoded)
+
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	decoded, err = DecodeHuffman(AppendHuffman(nil, string(all)))
+	require.NoError(t, err)
+	assert.Equal(t, string(all), decoded)
+
+	// 'a' is 00011 (5 bits); padding with 0s instead of 1s is invalid
+	_, err = DecodeHuffman([]byte{0x18})
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+	// A full byte of padding is too long
+	_, err = DecodeHuffman([]byte{0x1f, 0xff})
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+}
@@ -0,0 +1,101 @@
+package hpack
+
+import "errors"
+
+// ErrInvalidHuffman is returned for Huffman data that is padded wrongly or contains EOS
+var ErrInvalidHuffman = errors.New("hpack: invalid Huffman-encoded data")
+
+// huffmanNode is a node of the binary decoding tree. Leaves have sym >= 0.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      int
+}
+
+// huffmanRoot is built once from the code table
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{sym: -1}
+	for sym := 0; sym < len(huffmanCodes); sym++ {
+		code, length := huffmanCodes[sym], huffmanCodeLens[sym]
+		n := root
+		for i := int(length) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{sym: -1}
+			}
+			n = n.children[bit]
+		}
+		n.sym = sym
+	}
+	return root
+}
+
+// HuffmanEncodedLen returns how many bytes s takes once Huffman-encoded
+func HuffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLens[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// AppendHuffman appends the Huffman encoding of s to dst. The last byte is
+// padded with the most significant bits of EOS, i.e. with 1s.
+func AppendHuffman(dst []byte, s string) []byte {
+	var acc uint64 // pending bits, right-aligned
+	var n uint     // number of pending bits
+
+	for i := 0; i < len(s); i++ {
+		acc = acc<<huffmanCodeLens[s[i]] | uint64(huffmanCodes[s[i]])
+		n += uint(huffmanCodeLens[s[i]])
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+
+	if n > 0 {
+		pad := 8 - n
+		dst = append(dst, byte(acc<<pad)|byte(0xff>>n))
+	}
+	return dst
+}
+
+// DecodeHuffman decodes Huffman-encoded data back into a string
+func DecodeHuffman(data []byte) (string, error) {
+	out := make([]byte, 0, len(data)*8/5)
+	n := huffmanRoot
+	// Bits consumed since the last complete symbol, and whether they were all 1s
+	pendingBits := 0
+	allOnes := true
+
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				return "", ErrInvalidHuffman
+			}
+			pendingBits++
+			allOnes = allOnes && bit == 1
+
+			if n.sym >= 0 {
+				if n.sym == 256 {
+					// EOS inside the string is a decoding error (RFC 7541 Section 5.2)
+					return "", ErrInvalidHuffman
+				}
+				out = append(out, byte(n.sym))
+				n = huffmanRoot
+				pendingBits = 0
+				allOnes = true
+			}
+		}
+	}
+
+	// Padding must be shorter than 8 bits and consist of the EOS prefix (all 1s)
+	if pendingBits > 7 || !allOnes {
+		return "", ErrInvalidHuffman
+	}
+	return string(out), nil
+}
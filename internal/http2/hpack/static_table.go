@@ -0,0 +1,67 @@
+package hpack
+
+// staticTable is the predefined table from RFC 7541 Appendix A.
+// HPACK indexes are 1-based, so entry i of the table is staticTable[i-1].
+var staticTable = [...]HeaderField{
+	{Name: ":authority", Value: ""},                   // 1
+	{Name: ":method", Value: "GET"},                   // 2
+	{Name: ":method", Value: "POST"},                  // 3
+	{Name: ":path", Value: "/"},                       // 4
+	{Name: ":path", Value: "/index.html"},             // 5
+	{Name: ":scheme", Value: "http"},                  // 6
+	{Name: ":scheme", Value: "https"},                 // 7
+	{Name: ":status", Value: "200"},                   // 8
+	{Name: ":status", Value: "204"},                   // 9
+	{Name: ":status", Value: "206"},                   // 10
+	{Name: ":status", Value: "304"},                   // 11
+	{Name: ":status", Value: "400"},                   // 12
+	{Name: ":status", Value: "404"},                   // 13
+	{Name: ":status", Value: "500"},                   // 14
+	{Name: "accept-charset", Value: ""},               // 15
+	{Name: "accept-encoding", Value: "gzip, deflate"}, // 16
+	{Name: "accept-language", Value: ""},              // 17
+	{Name: "accept-ranges", Value: ""},                // 18
+	{Name: "accept", Value: ""},                       // 19
+	{Name: "access-control-allow-origin", Value: ""},  // 20
+	{Name: "age", Value: ""},                          // 21
+	{Name: "allow", Value: ""},                        // 22
+	{Name: "authorization", Value: ""},                // 23
+	{Name: "cache-control", Value: ""},                // 24
+	{Name: "content-disposition", Value: ""},          // 25
+	{Name: "content-encoding", Value: ""},             // 26
+	{Name: "content-language", Value: ""},             // 27
+	{Name: "content-length", Value: ""},               // 28
+	{Name: "content-location", Value: ""},             // 29
+	{Name: "content-range", Value: ""},                // 30
+	{Name: "content-type", Value: ""},                 // 31
+	{Name: "cookie", Value: ""},                       // 32
+	{Name: "date", Value: ""},                         // 33
+	{Name: "etag", Value: ""},                         // 34
+	{Name: "expect", Value: ""},                       // 35
+	{Name: "expires", Value: ""},                      // 36
+	{Name: "from", Value: ""},                         // 37
+	{Name: "host", Value: ""},                         // 38
+	{Name: "if-match", Value: ""},                     // 39
+	{Name: "if-modified-since", Value: ""},            // 40
+	{Name: "if-none-match", Value: ""},                // 41
+	{Name: "if-range", Value: ""},                     // 42
+	{Name: "if-unmodified-since", Value: ""},          // 43
+	{Name: "last-modified", Value: ""},                // 44
+	{Name: "link", Value: ""},                         // 45
+	{Name: "location", Value: ""},                     // 46
+	{Name: "max-forwards", Value: ""},                 // 47
+	{Name: "proxy-authenticate", Value: ""},           // 48
+	{Name: "proxy-authorization", Value: ""},          // 49
+	{Name: "range", Value: ""},                        // 50
+	{Name: "referer", Value: ""},                      // 51
+	{Name: "refresh", Value: ""},                      // 52
+	{Name: "retry-after", Value: ""},                  // 53
+	{Name: "server", Value: ""},                       // 54
+	{Name: "set-cookie", Value: ""},                   // 55
+	{Name: "strict-transport-security", Value: ""},    // 56
+	{Name: "transfer-encoding", Value: ""},            // 57
+	{Name: "user-agent", Value: ""},                   // 58
+	{Name: "vary", Value: ""},                         // 59
+	{Name: "via", Value: ""},                          // 60
+	{Name: "www-authenticate", Value: ""},             // 61
+}
@@ -0,0 +1,123 @@
+package http2
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2/hpack"
+	"httpfromtcp/internal/request"
+)
+
+// requestFromFields builds a request from the decoded header block of a new stream,
+// rejecting the ones RFC 9113 Section 8.1.1 calls malformed
+func requestFromFields(fields []hpack.HeaderField) (*request.Request, error) {
+	var method, scheme, path, authority string
+	h := headers.NewHeaders()
+	sawRegular := false
+
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if sawRegular {
+				return nil, fmt.Errorf("pseudo-header %s after regular headers", f.Name)
+			}
+
+			var target *string
+			switch f.Name {
+			case ":method":
+				target = &method
+			case ":scheme":
+				target = &scheme
+			case ":path":
+				target = &path
+			case ":authority":
+				target = &authority
+			default:
+				return nil, fmt.Errorf("unknown pseudo-header %s", f.Name)
+			}
+			if *target != "" {
+				return nil, fmt.Errorf("duplicate pseudo-header %s", f.Name)
+			}
+			*target = f.Value
+			continue
+		}
+
+		sawRegular = true
+		if f.Name != strings.ToLower(f.Name) {
+			return nil, fmt.Errorf("header %q is not lowercase", f.Name)
+		}
+		if connectionHeaders[f.Name] {
+			return nil, fmt.Errorf("connection-specific header %s", f.Name)
+		}
+		if f.Name == "te" && f.Value != "trailers" {
+			return nil, errors.New(`te header other than "trailers"`)
+		}
+
+		// headers.Headers holds one value per name; the crumbs of a split
+		// cookie are joined with "; " (RFC 9113 Section 8.2.3), the rest with ", "
+		if prev, ok := h[f.Name]; ok {
+			sep := ", "
+			if f.Name == "cookie" {
+				sep = "; "
+			}
+			h[f.Name] = prev + sep + f.Value
+		} else {
+			h[f.Name] = f.Value
+		}
+	}
+
+	if method == "" || scheme == "" || path == "" {
+		return nil, errors.New("missing :method, :scheme or :path")
+	}
+	// Same methods as over HTTP/1.1, which also keeps the metrics' method label bounded
+	if !request.IsValidMethod(method) {
+		return nil, fmt.Errorf("invalid :method %q", method)
+	}
+	if _, ok := h["host"]; !ok && authority != "" {
+		h["host"] = authority
+	}
+
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   "2.0",
+			RequestTarget: path,
+			Method:        method,
+		},
+		Headers: h,
+	}, nil
+}
+
+// UpgradeSettings checks whether req asks to switch to h2c (RFC 7540 Section 3.2)
+// and returns the settings from its HTTP2-Settings header if so
+func UpgradeSettings(req *request.Request) ([]Setting, bool) {
+	if !strings.EqualFold(strings.TrimSpace(req.Headers["upgrade"]), "h2c") {
+		return nil, false
+	}
+
+	// The Connection header must list both Upgrade and HTTP2-Settings
+	var upgrade, settings bool
+	for _, token := range strings.Split(req.Headers["connection"], ",") {
+		switch strings.ToLower(strings.TrimSpace(token)) {
+		case "upgrade":
+			upgrade = true
+		case "http2-settings":
+			settings = true
+		}
+	}
+	encoded, ok := req.Headers["http2-settings"]
+	if !upgrade || !settings || !ok {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(encoded), "="))
+	if err != nil {
+		return nil, false
+	}
+	parsed, err := parseSettings(&Frame{Type: FrameSettings, Payload: payload})
+	if err != nil {
+		return nil, false
+	}
+	return parsed, true
+}
@@ -0,0 +1,713 @@
+package http2
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"httpfromtcp/internal/http2/hpack"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+const (
+	// defaultMaxConcurrentStreams is how many streams a client may have open at once
+	defaultMaxConcurrentStreams = 100
+
+	// initialWindowSize is the receive window we give each stream and the connection.
+	// Request bodies are read completely before the handler runs, so the window is
+	// handed back as soon as data arrives and only caps how much can be in flight.
+	initialWindowSize = 1 << 20
+
+	// maxRequestBody caps how much a single request body may buffer
+	maxRequestBody = 10 << 20
+
+	// maxHeaderBlock caps a header block spread over HEADERS and CONTINUATION frames
+	maxHeaderBlock = 1 << 20
+)
+
+// Handler serves one stream. It must write the whole response to w before it
+// returns; reset aborts the stream instead, e.g. after a handler panic left a
+// partial response behind.
+type Handler func(req *request.Request, w *response.Writer, reset func())
+
+// Server holds the HTTP/2 settings shared by all connections
+type Server struct {
+	Handler Handler
+
+	// MaxConcurrentStreams limits the streams a client may have open at once, 0 means 100
+	MaxConcurrentStreams uint32
+
+	// IdleTimeout closes connections that have had no open streams for this long, 0 means never
+	IdleTimeout time.Duration
+}
+
+// ConnOpts describes how a connection reached the HTTP/2 server
+type ConnOpts struct {
+	// Reader replaces conn for reading, e.g. a bufio.Reader that already peeked at the preface
+	Reader io.Reader
+
+	// TLS is the state of the TLS connection, or nil for h2c
+	TLS *tls.ConnectionState
+
+	// Upgrade is the HTTP/1.1 request of an h2c upgrade. It becomes stream 1,
+	// whose response goes out over HTTP/2. Settings holds its decoded HTTP2-Settings.
+	Upgrade         *request.Request
+	UpgradeSettings []Setting
+}
+
+// ServeConn speaks HTTP/2 on conn until the client goes away or breaks the protocol.
+// It returns once every stream handler has finished; closing conn is up to the caller.
+func (s *Server) ServeConn(conn net.Conn, opts ConnOpts) {
+	r := opts.Reader
+	if r == nil {
+		r = conn
+	}
+
+	maxStreams := s.MaxConcurrentStreams
+	if maxStreams == 0 {
+		maxStreams = defaultMaxConcurrentStreams
+	}
+
+	c := &serverConn{
+		server:            s,
+		conn:              conn,
+		framer:            NewFramer(conn, r),
+		opts:              opts,
+		encoder:           hpack.NewEncoder(),
+		decoder:           hpack.NewDecoder(hpack.DefaultTableSize),
+		streams:           make(map[uint32]*stream),
+		maxStreams:        maxStreams,
+		sendWindow:        DefaultWindowSize,
+		peerInitialWindow: DefaultWindowSize,
+		peerMaxFrameSize:  DefaultMaxFrameSize,
+		recvWindow:        DefaultWindowSize,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.decoder.MaxStringLength = maxHeaderBlock
+
+	c.serve()
+}
+
+// serverConn is the state of one HTTP/2 connection.
+// The read loop owns the frame reading and the stream table's lifecycle;
+// handler goroutines write their responses through the stream methods.
+type serverConn struct {
+	server *Server
+	conn   net.Conn
+	framer *Framer
+	opts   ConnOpts
+
+	// writeMu serializes frame writes and guards the encoder,
+	// whose dynamic table has to follow the order frames go out in
+	writeMu sync.Mutex
+	encoder *hpack.Encoder
+
+	// decoder is only used by the read loop
+	decoder *hpack.Decoder
+
+	// mu guards everything below; cond is signalled whenever a send window
+	// grows or a stream or the connection is torn down
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	maxStreams        uint32
+	sendWindow        int64 // connection-level window for DATA we send
+	peerInitialWindow int64 // initial send window of new streams
+	peerMaxFrameSize  uint32
+	recvWindow        int64 // connection-level window for DATA we receive
+
+	// headers being collected across CONTINUATION frames, read loop only
+	continuation *pendingHeaders
+
+	handlers sync.WaitGroup
+}
+
+// pendingHeaders is a header block that hasn't seen END_HEADERS yet
+type pendingHeaders struct {
+	streamID  uint32
+	endStream bool
+	block     []byte
+}
+
+func (c *serverConn) serve() {
+	defer c.shutdown()
+
+	if err := c.start(); err != nil {
+		c.fail(err)
+		return
+	}
+
+	for {
+		c.setIdleDeadline()
+		f, err := c.framer.ReadFrame()
+		if err == nil {
+			err = c.processFrame(f)
+		}
+
+		var se StreamError
+		switch {
+		case err == nil:
+		case errors.As(err, &se):
+			c.resetStream(se.StreamID, se.Code)
+		default:
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// start sends our SETTINGS and reads the client preface, serving the upgrade request in between
+func (c *serverConn) start() error {
+	c.writeMu.Lock()
+	err := c.framer.WriteSettings(
+		Setting{SettingMaxConcurrentStreams, c.maxStreams},
+		Setting{SettingInitialWindowSize, initialWindowSize},
+		Setting{SettingEnablePush, 0},
+	)
+	if err == nil {
+		// The connection window can only be raised with a WINDOW_UPDATE
+		err = c.framer.WriteWindowUpdate(0, initialWindowSize-DefaultWindowSize)
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.recvWindow = initialWindowSize
+	c.mu.Unlock()
+
+	if c.opts.Upgrade != nil {
+		if err := c.applySettings(c.opts.UpgradeSettings); err != nil {
+			return err
+		}
+		c.startUpgradeStream(c.opts.Upgrade)
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(c.framer.r, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return ErrBadPreface
+	}
+
+	// The preface is followed by the client's SETTINGS
+	f, err := c.framer.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if f.Type != FrameSettings || f.Flags.Has(FlagAck) {
+		return connError(ErrCodeProtocol, "expected SETTINGS after the preface, got %v", f.Type)
+	}
+	return c.processFrame(f)
+}
+
+// setIdleDeadline arms the idle timeout while no stream is open.
+// With open streams the read just waits, the streams have their own pace.
+func (c *serverConn) setIdleDeadline() {
+	c.mu.Lock()
+	idle := len(c.streams) == 0
+	c.mu.Unlock()
+
+	if idle && c.server.IdleTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.server.IdleTimeout))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// fail ends the connection after err, telling the client why if it broke the protocol
+func (c *serverConn) fail(err error) {
+	var ce ConnectionError
+	if errors.As(err, &ce) {
+		c.logError(err)
+		c.mu.Lock()
+		lastStreamID := c.lastStreamID
+		c.mu.Unlock()
+
+		c.writeMu.Lock()
+		c.framer.WriteGoAway(lastStreamID, ce.Code, []byte(ce.Reason))
+		c.writeMu.Unlock()
+		return
+	}
+
+	// The client hanging up or going quiet is how most connections end
+	var netErr net.Error
+	switch {
+	case err == io.EOF, errors.Is(err, net.ErrClosed), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNRESET):
+		return
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return
+	}
+	c.logError(err)
+}
+
+func (c *serverConn) logError(err error) {
+	log.Printf("HTTP/2 connection from %s: %v", c.conn.RemoteAddr(), err)
+}
+
+// shutdown wakes every handler still waiting for window, so they notice the
+// connection is gone, and waits for them to return
+func (c *serverConn) shutdown() {
+	c.mu.Lock()
+	for _, st := range c.streams {
+		st.markReset()
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	// Handlers blocked writing to a client that stopped reading only return
+	// once the connection is closed under them
+	c.conn.Close()
+	c.handlers.Wait()
+}
+
+func (c *serverConn) processFrame(f *Frame) error {
+	if c.continuation != nil && f.Type != FrameContinuation {
+		return connError(ErrCodeProtocol, "expected CONTINUATION for stream %d, got %v", c.continuation.streamID, f.Type)
+	}
+
+	switch f.Type {
+	case FrameData:
+		return c.processData(f)
+	case FrameHeaders:
+		return c.processHeaders(f)
+	case FrameContinuation:
+		return c.processContinuation(f)
+	case FramePriority:
+		if f.StreamID == 0 {
+			return connError(ErrCodeProtocol, "PRIORITY on stream 0")
+		}
+		if len(f.Payload) != 5 {
+			return streamError(f.StreamID, ErrCodeFrameSize, "PRIORITY length %d", len(f.Payload))
+		}
+		// Priorities are advisory and we serve streams as they come
+		return nil
+	case FrameRSTStream:
+		return c.processRSTStream(f)
+	case FrameSettings:
+		return c.processSettings(f)
+	case FramePushPromise:
+		return connError(ErrCodeProtocol, "clients can't push")
+	case FramePing:
+		return c.processPing(f)
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return connError(ErrCodeProtocol, "GOAWAY on stream %d", f.StreamID)
+		}
+		// The client won't open new streams but still reads the responses
+		// to the open ones, and closes the connection when it's done
+		return nil
+	case FrameWindowUpdate:
+		return c.processWindowUpdate(f)
+	default:
+		// Unknown frame types must be ignored (RFC 9113 Section 4.1)
+		return nil
+	}
+}
+
+func (c *serverConn) processSettings(f *Frame) error {
+	if f.StreamID != 0 {
+		return connError(ErrCodeProtocol, "SETTINGS on stream %d", f.StreamID)
+	}
+	if f.Flags.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS ACK with a payload")
+		}
+		return nil
+	}
+
+	settings, err := parseSettings(f)
+	if err != nil {
+		return err
+	}
+	if err := c.applySettings(settings); err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.framer.WriteSettingsAck()
+}
+
+func (c *serverConn) applySettings(settings []Setting) error {
+	for _, s := range settings {
+		switch s.ID {
+		case SettingHeaderTableSize:
+			c.writeMu.Lock()
+			c.encoder.SetMaxTableSize(min(s.Value, hpack.DefaultTableSize))
+			c.writeMu.Unlock()
+
+		case SettingEnablePush:
+			if s.Value > 1 {
+				return connError(ErrCodeProtocol, "ENABLE_PUSH of %d", s.Value)
+			}
+
+		case SettingInitialWindowSize:
+			if s.Value > maxWindowSize {
+				return connError(ErrCodeFlowControl, "INITIAL_WINDOW_SIZE of %d", s.Value)
+			}
+			// The change applies to every open stream (RFC 9113 Section 6.9.2)
+			c.mu.Lock()
+			delta := int64(s.Value) - c.peerInitialWindow
+			c.peerInitialWindow = int64(s.Value)
+			for _, st := range c.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					c.mu.Unlock()
+					return connError(ErrCodeFlowControl, "INITIAL_WINDOW_SIZE overflows stream %d", st.id)
+				}
+			}
+			c.cond.Broadcast()
+			c.mu.Unlock()
+
+		case SettingMaxFrameSize:
+			if s.Value < DefaultMaxFrameSize || s.Value > maxFrameSizeLimit {
+				return connError(ErrCodeProtocol, "MAX_FRAME_SIZE of %d", s.Value)
+			}
+			c.mu.Lock()
+			c.peerMaxFrameSize = s.Value
+			c.mu.Unlock()
+		}
+		// MAX_CONCURRENT_STREAMS only limits pushes, MAX_HEADER_LIST_SIZE is advisory,
+		// and unknown settings must be ignored
+	}
+	return nil
+}
+
+func (c *serverConn) processPing(f *Frame) error {
+	if f.StreamID != 0 {
+		return connError(ErrCodeProtocol, "PING on stream %d", f.StreamID)
+	}
+	if len(f.Payload) != 8 {
+		return connError(ErrCodeFrameSize, "PING length %d", len(f.Payload))
+	}
+	if f.Flags.Has(FlagAck) {
+		return nil
+	}
+
+	var data [8]byte
+	copy(data[:], f.Payload)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.framer.WritePing(true, data)
+}
+
+func (c *serverConn) processWindowUpdate(f *Frame) error {
+	if len(f.Payload) != 4 {
+		return connError(ErrCodeFrameSize, "WINDOW_UPDATE length %d", len(f.Payload))
+	}
+	increment := int64(binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0 on the connection")
+		}
+		c.sendWindow += increment
+		if c.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window overflow")
+		}
+		c.cond.Broadcast()
+		return nil
+	}
+
+	st, ok := c.streams[f.StreamID]
+	if !ok {
+		if f.StreamID > c.lastStreamID {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.StreamID)
+		}
+		// The stream is already closed, late updates are fine
+		return nil
+	}
+	if increment == 0 {
+		return streamError(f.StreamID, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError(f.StreamID, ErrCodeFlowControl, "stream window overflow")
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *serverConn) processRSTStream(f *Frame) error {
+	if f.StreamID == 0 {
+		return connError(ErrCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(f.Payload) != 4 {
+		return connError(ErrCodeFrameSize, "RST_STREAM length %d", len(f.Payload))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.StreamID > c.lastStreamID {
+		return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.StreamID)
+	}
+	if st, ok := c.streams[f.StreamID]; ok {
+		st.markReset()
+		delete(c.streams, st.id)
+		c.cond.Broadcast()
+	}
+	return nil
+}
+
+func (c *serverConn) processHeaders(f *Frame) error {
+	id := f.StreamID
+	if id == 0 || id%2 == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on stream %d", id)
+	}
+
+	block, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.Flags.Has(FlagPriority) {
+		if len(block) < 5 {
+			return connError(ErrCodeFrameSize, "HEADERS too short for its priority")
+		}
+		if binary.BigEndian.Uint32(block)&(1<<31-1) == id {
+			return streamError(id, ErrCodeProtocol, "stream depends on itself")
+		}
+		block = block[5:]
+	}
+
+	pending := &pendingHeaders{
+		streamID:  id,
+		endStream: f.Flags.Has(FlagEndStream),
+		block:     append([]byte(nil), block...),
+	}
+	if !f.Flags.Has(FlagEndHeaders) {
+		c.continuation = pending
+		return nil
+	}
+	return c.processHeaderBlock(pending)
+}
+
+func (c *serverConn) processContinuation(f *Frame) error {
+	pending := c.continuation
+	if pending == nil || f.StreamID != pending.streamID {
+		return connError(ErrCodeProtocol, "unexpected CONTINUATION on stream %d", f.StreamID)
+	}
+	if len(pending.block)+len(f.Payload) > maxHeaderBlock {
+		return connError(ErrCodeEnhanceYourCalm, "header block larger than %d bytes", maxHeaderBlock)
+	}
+
+	pending.block = append(pending.block, f.Payload...)
+	if !f.Flags.Has(FlagEndHeaders) {
+		return nil
+	}
+	c.continuation = nil
+	return c.processHeaderBlock(pending)
+}
+
+// processHeaderBlock handles a complete header block: a new request or the trailers of one
+func (c *serverConn) processHeaderBlock(h *pendingHeaders) error {
+	// Decode even if the stream is going to be refused, or our table gets out of sync
+	fields, err := c.decoder.Decode(h.block)
+	if err != nil {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+
+	c.mu.Lock()
+	st, exists := c.streams[h.streamID]
+	lastStreamID := c.lastStreamID
+	c.mu.Unlock()
+
+	if exists {
+		// Trailers: they must end the stream and are otherwise dropped,
+		// since request.Request has nowhere to put them
+		if st.remoteClosed {
+			return streamError(h.streamID, ErrCodeStreamClosed, "HEADERS after END_STREAM")
+		}
+		if !h.endStream {
+			return streamError(h.streamID, ErrCodeProtocol, "trailers without END_STREAM")
+		}
+		return c.endRequest(st)
+	}
+
+	if h.streamID <= lastStreamID {
+		return connError(ErrCodeStreamClosed, "HEADERS on closed stream %d", h.streamID)
+	}
+
+	c.mu.Lock()
+	c.lastStreamID = h.streamID
+	tooMany := uint32(len(c.streams)) >= c.maxStreams
+	c.mu.Unlock()
+	if tooMany {
+		return streamError(h.streamID, ErrCodeRefusedStream, "too many concurrent streams")
+	}
+
+	req, err := requestFromFields(fields)
+	if err != nil {
+		return streamError(h.streamID, ErrCodeProtocol, "%v", err)
+	}
+	req.RemoteAddr = c.conn.RemoteAddr().String()
+	req.TLS = c.opts.TLS
+
+	st = c.newStream(h.streamID, req)
+	if h.endStream {
+		return c.endRequest(st)
+	}
+	return nil
+}
+
+func (c *serverConn) processData(f *Frame) error {
+	id := f.StreamID
+	if id == 0 {
+		return connError(ErrCodeProtocol, "DATA on stream 0")
+	}
+
+	// Flow control counts the whole payload, padding included
+	length := int64(len(f.Payload))
+	c.mu.Lock()
+	if length > c.recvWindow {
+		c.mu.Unlock()
+		return connError(ErrCodeFlowControl, "DATA beyond the connection window")
+	}
+	c.recvWindow -= length
+	st, ok := c.streams[id]
+	lastStreamID := c.lastStreamID
+	c.mu.Unlock()
+
+	// The data is buffered or dropped right away, so the connection window can be handed back.
+	// The stream's window is handed back as long as the stream still wants data.
+	if err := c.returnWindow(0, length); err != nil {
+		return err
+	}
+
+	if !ok {
+		if id > lastStreamID {
+			return connError(ErrCodeProtocol, "DATA on idle stream %d", id)
+		}
+		return streamError(id, ErrCodeStreamClosed, "DATA on closed stream")
+	}
+	if st.remoteClosed {
+		return streamError(id, ErrCodeStreamClosed, "DATA after END_STREAM")
+	}
+	if length > st.recvWindow {
+		return streamError(id, ErrCodeFlowControl, "DATA beyond the stream window")
+	}
+	st.recvWindow -= length
+
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if st.body.Len()+len(data) > maxRequestBody {
+		return streamError(id, ErrCodeRefusedStream, "request body larger than %d bytes", maxRequestBody)
+	}
+	st.body.Write(data)
+
+	if f.Flags.Has(FlagEndStream) {
+		return c.endRequest(st)
+	}
+	if err := c.returnWindow(id, length); err != nil {
+		return err
+	}
+	st.recvWindow += length
+	return nil
+}
+
+// returnWindow hands n received bytes back to the client's send window
+func (c *serverConn) returnWindow(streamID uint32, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if streamID == 0 {
+		c.mu.Lock()
+		c.recvWindow += n
+		c.mu.Unlock()
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.framer.WriteWindowUpdate(streamID, uint32(n))
+}
+
+// endRequest runs the handler once the client has sent the whole request
+func (c *serverConn) endRequest(st *stream) error {
+	st.remoteClosed = true
+	st.req.Body = st.body.Bytes()
+
+	if cl, ok := st.req.Headers["content-length"]; ok && cl != strconv.Itoa(len(st.req.Body)) {
+		return streamError(st.id, ErrCodeProtocol, "content-length %s but %d body bytes", cl, len(st.req.Body))
+	}
+
+	c.runHandler(st)
+	return nil
+}
+
+// startUpgradeStream turns the request that asked for h2c into stream 1.
+// Its body was already read over HTTP/1.1, so it is half-closed from the start.
+func (c *serverConn) startUpgradeStream(req *request.Request) {
+	c.mu.Lock()
+	c.lastStreamID = 1
+	c.mu.Unlock()
+
+	req.RemoteAddr = c.conn.RemoteAddr().String()
+	st := c.newStream(1, req)
+	st.remoteClosed = true
+	c.runHandler(st)
+}
+
+func (c *serverConn) newStream(id uint32, req *request.Request) *stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := &stream{
+		id:         id,
+		conn:       c,
+		req:        req,
+		sendWindow: c.peerInitialWindow,
+		recvWindow: initialWindowSize,
+		gone:       make(chan struct{}),
+	}
+	c.streams[id] = st
+	return st
+}
+
+func (c *serverConn) runHandler(st *stream) {
+	c.handlers.Add(1)
+	go func() {
+		defer c.handlers.Done()
+
+		w := response.NewStreamWriter(st)
+		if st.req.RequestLine.Method == "HEAD" {
+			w.SuppressBody()
+		}
+		w.SetCloseNotifier(func() <-chan struct{} { return st.gone })
+		c.server.Handler(st.req, w, func() { st.close(ErrCodeInternal) })
+
+		// A handler that returned without finishing its response leaves the client waiting
+		st.close(ErrCodeInternal)
+	}()
+}
+
+// resetStream ends a stream with RST_STREAM after a stream error
+func (c *serverConn) resetStream(id uint32, code ErrCode) {
+	c.mu.Lock()
+	if st, ok := c.streams[id]; ok {
+		st.markReset()
+		delete(c.streams, id)
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.framer.WriteRSTStream(id, code)
+}
@@ -0,0 +1,458 @@
+package http2
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2/hpack"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// testClient speaks raw frames to a server connection
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	fr     *Framer
+	enc    *hpack.Encoder
+	dec    *hpack.Decoder
+	frames chan *Frame
+	done   chan struct{}
+}
+
+// flushing adapts a plain handler the way the server package does
+func flushing(handler func(req *request.Request, w *response.Writer)) Handler {
+	return func(req *request.Request, w *response.Writer, reset func()) {
+		handler(req, w)
+		w.Flush()
+	}
+}
+
+func newTestClient(t *testing.T, handler Handler, settings ...Setting) *testClient {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+
+	server := &Server{Handler: handler}
+	done := make(chan struct{})
+	go func() {
+		server.ServeConn(serverConn, ConnOpts{})
+		serverConn.Close()
+		close(done)
+	}()
+
+	c := &testClient{
+		t:      t,
+		conn:   clientConn,
+		fr:     NewFramer(clientConn, clientConn),
+		enc:    hpack.NewEncoder(),
+		dec:    hpack.NewDecoder(hpack.DefaultTableSize),
+		frames: make(chan *Frame, 100),
+		done:   done,
+	}
+	c.fr.MaxReadSize = maxFrameSizeLimit
+	go func() {
+		defer close(c.frames)
+		for {
+			f, err := c.fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			c.frames <- f
+		}
+	}()
+	t.Cleanup(func() {
+		clientConn.Close()
+		<-done
+	})
+
+	_, err := clientConn.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	require.NoError(t, c.fr.WriteSettings(settings...))
+
+	// The server's SETTINGS come first, then its connection WINDOW_UPDATE and our ACK
+	f := c.next()
+	require.Equal(t, FrameSettings, f.Type)
+	require.False(t, f.Flags.Has(FlagAck))
+	require.NoError(t, c.fr.WriteSettingsAck())
+	return c
+}
+
+// next returns the next frame from the server
+func (c *testClient) next() *Frame {
+	c.t.Helper()
+	select {
+	case f, ok := <-c.frames:
+		require.True(c.t, ok, "connection closed")
+		return f
+	case <-time.After(2 * time.Second):
+		c.t.Fatal("timed out waiting for a frame")
+		return nil
+	}
+}
+
+// waitFor skips connection housekeeping until a frame of type t arrives
+func (c *testClient) waitFor(t FrameType) *Frame {
+	c.t.Helper()
+	for {
+		f := c.next()
+		if f.Type == t {
+			return f
+		}
+	}
+}
+
+// closed waits for the server to end the connection
+func (c *testClient) closed() {
+	c.t.Helper()
+	select {
+	case <-c.done:
+	case <-time.After(2 * time.Second):
+		c.t.Fatal("server didn't close the connection")
+	}
+}
+
+func (c *testClient) writeHeaders(id uint32, endStream bool, fields ...string) {
+	c.t.Helper()
+	require.NoError(c.t, c.fr.WriteHeaders(id, endStream, c.encode(fields...), DefaultMaxFrameSize))
+}
+
+func (c *testClient) encode(fields ...string) []byte {
+	var hf []hpack.HeaderField
+	for i := 0; i < len(fields); i += 2 {
+		hf = append(hf, hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return c.enc.Encode(nil, hf)
+}
+
+func (c *testClient) get(id uint32, path string) {
+	c.t.Helper()
+	c.writeHeaders(id, true, ":method", "GET", ":scheme", "http", ":path", path, ":authority", "example.com")
+}
+
+type testResponse struct {
+	headers  map[string]string
+	body     string
+	trailers map[string]string
+}
+
+// readResponses collects the responses of the given streams, in whatever order their frames arrive
+func (c *testClient) readResponses(ids ...uint32) map[uint32]*testResponse {
+	c.t.Helper()
+	responses := make(map[uint32]*testResponse)
+	pending := make(map[uint32]bool)
+	for _, id := range ids {
+		responses[id] = &testResponse{}
+		pending[id] = true
+	}
+
+	var block []byte
+	for len(pending) > 0 {
+		f := c.next()
+		resp := responses[f.StreamID]
+
+		switch f.Type {
+		case FrameHeaders, FrameContinuation:
+			require.NotNil(c.t, resp, "unexpected %v", f)
+			block = append(block, f.Payload...)
+			if !f.Flags.Has(FlagEndHeaders) {
+				continue
+			}
+			fields, err := c.dec.Decode(block)
+			require.NoError(c.t, err)
+			block = nil
+
+			decoded := make(map[string]string)
+			for _, hf := range fields {
+				decoded[hf.Name] = hf.Value
+			}
+			if resp.headers == nil {
+				resp.headers = decoded
+			} else {
+				resp.trailers = decoded
+			}
+		case FrameData:
+			require.NotNil(c.t, resp, "unexpected %v", f)
+			resp.body += string(f.Payload)
+		case FrameRSTStream, FrameGoAway:
+			c.t.Fatalf("unexpected %v", f)
+		default:
+			continue
+		}
+
+		if f.Flags.Has(FlagEndStream) {
+			delete(pending, f.StreamID)
+		}
+	}
+	return responses
+}
+
+func TestServeRequest(t *testing.T) {
+	var got *request.Request
+	c := newTestClient(t, flushing(func(req *request.Request, w *response.Writer) {
+		got = req
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.Headers{"content-type": "text/plain", "connection": "close"})
+		w.WriteBody([]byte("hello over h2"))
+	}))
+
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "https", ":path", "/greet?x=1", ":authority", "example.com",
+		"cookie", "a=1", "cookie", "b=2", "user-agent", "test")
+	resp := c.readResponses(1)[1]
+
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.Equal(t, "text/plain", resp.headers["content-type"])
+	assert.Equal(t, "13", resp.headers["content-length"])
+	assert.NotContains(t, resp.headers, "connection", "connection-specific headers are not allowed in HTTP/2")
+	assert.Equal(t, "hello over h2", resp.body)
+
+	assert.Equal(t, "2.0", got.RequestLine.HttpVersion)
+	assert.Equal(t, "GET", got.RequestLine.Method)
+	assert.Equal(t, "/greet?x=1", got.RequestLine.RequestTarget)
+	assert.Equal(t, "example.com", got.Headers["host"])
+	assert.Equal(t, "a=1; b=2", got.Headers["cookie"])
+	assert.Equal(t, "test", got.Headers["user-agent"])
+}
+
+func TestMultiplexedStreamsWithBodies(t *testing.T) {
+	c := newTestClient(t, flushing(func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte(req.RequestLine.RequestTarget + ":" + string(req.Body)))
+	}))
+
+	// Stream 1 stays open while stream 3 is requested and answered
+	c.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/one", "content-length", "11")
+	c.get(3, "/three")
+	require.NoError(t, c.fr.WriteData(1, false, []byte("hello ")))
+	// Padded: pad length 3, data, 3 bytes of padding
+	require.NoError(t, c.fr.WriteFrame(FrameData, FlagPadded|FlagEndStream, 1, []byte("\x03world\x00\x00\x00")))
+
+	responses := c.readResponses(1, 3)
+	assert.Equal(t, "/one:hello world", responses[1].body)
+	assert.Equal(t, "/three:", responses[3].body)
+}
+
+func TestFlowControl(t *testing.T) {
+	c := newTestClient(t, flushing(func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte(strings.Repeat("x", 25)))
+	}), Setting{SettingInitialWindowSize, 10})
+
+	c.get(1, "/")
+	assert.Equal(t, FrameHeaders, c.waitFor(FrameHeaders).Type)
+
+	data := c.waitFor(FrameData)
+	assert.Len(t, data.Payload, 10)
+	assert.False(t, data.Flags.Has(FlagEndStream))
+
+	// Nothing more until the window opens
+	select {
+	case f := <-c.frames:
+		t.Fatalf("server ignored the window and sent %v", f)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, c.fr.WriteWindowUpdate(1, 20))
+	data = c.waitFor(FrameData)
+	assert.Len(t, data.Payload, 15)
+	assert.True(t, data.Flags.Has(FlagEndStream))
+}
+
+func TestInitialWindowSizeChangeAppliesToOpenStreams(t *testing.T) {
+	c := newTestClient(t, flushing(func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte("0123456789"))
+	}), Setting{SettingInitialWindowSize, 0})
+
+	c.get(1, "/")
+	c.waitFor(FrameHeaders)
+
+	require.NoError(t, c.fr.WriteSettings(Setting{SettingInitialWindowSize, 4}))
+	data := c.waitFor(FrameData)
+	assert.Equal(t, "0123", string(data.Payload))
+
+	require.NoError(t, c.fr.WriteWindowUpdate(1, 100))
+	data = c.waitFor(FrameData)
+	assert.Equal(t, "456789", string(data.Payload))
+	assert.True(t, data.Flags.Has(FlagEndStream))
+}
+
+func TestChunkedResponseWithTrailers(t *testing.T) {
+	c := newTestClient(t, flushing(func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.Headers{"transfer-encoding": "chunked", "trailer": "x-checksum"})
+		w.WriteChunkedBody([]byte("part one, "))
+		w.WriteChunkedBody([]byte("part two"))
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(headers.Headers{"x-checksum": "abc"})
+	}))
+
+	c.get(1, "/")
+	resp := c.readResponses(1)[1]
+	assert.Equal(t, "200", resp.headers[":status"])
+	assert.NotContains(t, resp.headers, "transfer-encoding")
+	assert.Equal(t, "part one, part two", resp.body)
+	assert.Equal(t, map[string]string{"x-checksum": "abc"}, resp.trailers)
+}
+
+func TestHeadRequestHasNoBody(t *testing.T) {
+	c := newTestClient(t, flushing(func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte("not sent"))
+	}))
+
+	c.writeHeaders(1, true, ":method", "HEAD", ":scheme", "http", ":path", "/")
+	f := c.waitFor(FrameHeaders)
+	assert.True(t, f.Flags.Has(FlagEndStream))
+}
+
+func TestHeaderBlockWithContinuation(t *testing.T) {
+	c := newTestClient(t, flushing(func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte(req.Headers["x-big"]))
+	}))
+
+	big := strings.Repeat("v", 40000)
+	block := c.encode(":method", "GET", ":scheme", "http", ":path", "/", "x-big", big)
+	require.NoError(t, c.fr.WriteHeaders(1, true, block, 1000))
+
+	assert.Equal(t, big, c.readResponses(1)[1].body)
+}
+
+func TestPingAndSettingsAreAcknowledged(t *testing.T) {
+	c := newTestClient(t, flushing(func(req *request.Request, w *response.Writer) {}))
+
+	require.NoError(t, c.fr.WritePing(false, [8]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+	f := c.waitFor(FramePing)
+	assert.True(t, f.Flags.Has(FlagAck))
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, f.Payload)
+
+	// SETTINGS ACK for the handshake may still be in the queue; take the next SETTINGS after ours
+	require.NoError(t, c.fr.WriteSettings(Setting{SettingMaxFrameSize, 32768}))
+	f = c.waitFor(FrameSettings)
+	assert.True(t, f.Flags.Has(FlagAck))
+}
+
+func TestStreamErrors(t *testing.T) {
+	c := newTestClient(t, flushing(func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+	}))
+
+	// Missing :path is a malformed request, it only costs that stream
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http")
+	f := c.waitFor(FrameRSTStream)
+	assert.Equal(t, uint32(1), f.StreamID)
+	assert.Equal(t, ErrCodeProtocol, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+
+	// Content-length that doesn't match the body
+	c.writeHeaders(3, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "5")
+	require.NoError(t, c.fr.WriteData(3, true, []byte("abc")))
+	f = c.waitFor(FrameRSTStream)
+	assert.Equal(t, uint32(3), f.StreamID)
+
+	// A method the server doesn't handle never reaches the handler or the metrics
+	c.writeHeaders(5, true, ":method", "X-RANDOM-12345", ":scheme", "http", ":path", "/")
+	f = c.waitFor(FrameRSTStream)
+	assert.Equal(t, uint32(5), f.StreamID)
+	assert.Equal(t, ErrCodeProtocol, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+
+	// The connection is still fine
+	c.get(7, "/")
+	assert.Equal(t, "200", c.readResponses(7)[7].headers[":status"])
+}
+
+func TestHandlerReset(t *testing.T) {
+	c := newTestClient(t, func(req *request.Request, w *response.Writer, reset func()) {
+		reset()
+	})
+
+	c.get(1, "/")
+	f := c.waitFor(FrameRSTStream)
+	assert.Equal(t, uint32(1), f.StreamID)
+	assert.Equal(t, ErrCodeInternal, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+}
+
+func TestConnectionErrors(t *testing.T) {
+	tests := map[string]struct {
+		send func(c *testClient)
+		code ErrCode
+	}{
+		"DATA on stream 0": {
+			send: func(c *testClient) { c.fr.WriteData(0, true, []byte("x")) },
+			code: ErrCodeProtocol,
+		},
+		"HEADERS on an even stream": {
+			send: func(c *testClient) { c.get(2, "/") },
+			code: ErrCodeProtocol,
+		},
+		"CONTINUATION without HEADERS": {
+			send: func(c *testClient) { c.fr.WriteFrame(FrameContinuation, FlagEndHeaders, 1, nil) },
+			code: ErrCodeProtocol,
+		},
+		"interleaved frame inside a header block": {
+			send: func(c *testClient) {
+				c.fr.WriteFrame(FrameHeaders, 0, 1, c.encode(":method", "GET"))
+				c.fr.WritePing(false, [8]byte{})
+			},
+			code: ErrCodeProtocol,
+		},
+		"frame larger than MAX_FRAME_SIZE": {
+			send: func(c *testClient) { c.fr.WriteData(1, false, make([]byte, DefaultMaxFrameSize+1)) },
+			code: ErrCodeFrameSize,
+		},
+		"bad header block": {
+			send: func(c *testClient) { c.fr.WriteHeaders(1, true, []byte{0xff}, DefaultMaxFrameSize) },
+			code: ErrCodeCompression,
+		},
+		"window overflow": {
+			send: func(c *testClient) { c.fr.WriteWindowUpdate(0, maxWindowSize) },
+			code: ErrCodeFlowControl,
+		},
+		"PING with a bad length": {
+			send: func(c *testClient) { c.fr.WriteFrame(FramePing, 0, 0, []byte{1}) },
+			code: ErrCodeFrameSize,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := newTestClient(t, flushing(func(req *request.Request, w *response.Writer) {}))
+			go tt.send(c)
+
+			f := c.waitFor(FrameGoAway)
+			assert.Equal(t, tt.code, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+			c.closed()
+		})
+	}
+}
+
+func TestUpgradeSettings(t *testing.T) {
+	req := &request.Request{Headers: headers.Headers{
+		"upgrade":        "h2c",
+		"connection":     "Upgrade, HTTP2-Settings",
+		"http2-settings": "AAMAAABkAAQAoAAAAAIAAAAA", // MAX_CONCURRENT_STREAMS 100, INITIAL_WINDOW_SIZE 10485760, ENABLE_PUSH 0
+	}}
+	settings, ok := UpgradeSettings(req)
+	require.True(t, ok)
+	assert.Equal(t, []Setting{
+		{SettingMaxConcurrentStreams, 100},
+		{SettingInitialWindowSize, 10485760},
+		{SettingEnablePush, 0},
+	}, settings)
+
+	delete(req.Headers, "http2-settings")
+	_, ok = UpgradeSettings(req)
+	assert.False(t, ok)
+}
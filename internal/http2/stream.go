@@ -0,0 +1,167 @@
+package http2
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2/hpack"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// ErrStreamClosed is returned when writing to a stream that was reset or has already ended
+var ErrStreamClosed = errors.New("http2: stream closed")
+
+// stream is one request/response exchange. The read loop fills in the request;
+// once it is complete the handler goroutine owns the response side.
+type stream struct {
+	id   uint32
+	conn *serverConn
+	req  *request.Request
+
+	// read loop only
+	body         bytes.Buffer
+	recvWindow   int64
+	remoteClosed bool // the client sent END_STREAM
+
+	// guarded by conn.mu
+	sendWindow int64
+	reset      bool          // RST_STREAM was sent or received, or the connection went away
+	done       bool          // we sent END_STREAM or RST_STREAM
+	gone       chan struct{} // closed once reset is set, see response.Writer.CloseNotify
+}
+
+// stream implements response.StreamWriter
+var _ response.StreamWriter = (*stream)(nil)
+
+// connectionHeaders only mean something to a single HTTP/1.1 hop and are
+// not allowed in HTTP/2 (RFC 9113 Section 8.2.2)
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// WriteHead sends the response status and headers in a HEADERS frame
+func (st *stream) WriteHead(status response.StatusCode, h headers.Headers, endStream bool) error {
+	fields := make([]hpack.HeaderField, 0, len(h)+1)
+	fields = append(fields, hpack.HeaderField{Name: ":status", Value: strconv.Itoa(int(status))})
+	return st.writeHeaders(appendFields(fields, h), endStream)
+}
+
+// WriteTrailers sends the trailers in a HEADERS frame that ends the stream
+func (st *stream) WriteTrailers(h headers.Headers) error {
+	return st.writeHeaders(appendFields(nil, h), true)
+}
+
+func appendFields(fields []hpack.HeaderField, h headers.Headers) []hpack.HeaderField {
+	for name, value := range h {
+		name = strings.ToLower(name)
+		if connectionHeaders[name] {
+			continue
+		}
+		fields = append(fields, hpack.HeaderField{Name: name, Value: value})
+	}
+	return fields
+}
+
+func (st *stream) writeHeaders(fields []hpack.HeaderField, endStream bool) error {
+	c := st.conn
+	c.mu.Lock()
+	if st.reset || st.done {
+		c.mu.Unlock()
+		return ErrStreamClosed
+	}
+	maxFrameSize := c.peerMaxFrameSize
+	if endStream {
+		st.finish()
+	}
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	block := c.encoder.Encode(nil, fields)
+	return c.framer.WriteHeaders(st.id, endStream, block, maxFrameSize)
+}
+
+// WriteData sends body bytes in DATA frames, waiting for the client to open
+// its flow-control windows whenever they run out
+func (st *stream) WriteData(p []byte, endStream bool) error {
+	c := st.conn
+	for {
+		c.mu.Lock()
+		for len(p) > 0 && (st.sendWindow <= 0 || c.sendWindow <= 0) && !st.reset && !st.done {
+			c.cond.Wait()
+		}
+		if st.reset || st.done {
+			c.mu.Unlock()
+			return ErrStreamClosed
+		}
+
+		n := min(int64(len(p)), st.sendWindow, c.sendWindow, int64(c.peerMaxFrameSize))
+		st.sendWindow -= n
+		c.sendWindow -= n
+		last := endStream && n == int64(len(p))
+		if last {
+			st.finish()
+		}
+		c.mu.Unlock()
+
+		if n == 0 && !last {
+			return nil
+		}
+
+		c.writeMu.Lock()
+		err := c.framer.WriteData(st.id, last, p[:n])
+		c.writeMu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		p = p[n:]
+		if len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+// finish marks the response as sent and forgets the stream. c.mu must be held.
+func (st *stream) finish() {
+	st.done = true
+	delete(st.conn.streams, st.id)
+}
+
+// markReset records that the stream is gone for the client. c.mu must be held.
+func (st *stream) markReset() {
+	if !st.reset {
+		st.reset = true
+		close(st.gone)
+	}
+}
+
+// close resets the stream with code unless the response has already ended
+func (st *stream) close(code ErrCode) {
+	c := st.conn
+	c.mu.Lock()
+	if st.done {
+		c.mu.Unlock()
+		return
+	}
+	alreadyReset := st.reset
+	st.markReset()
+	st.finish()
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if alreadyReset {
+		return
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.framer.WriteRSTStream(st.id, code)
+}
@@ -0,0 +1,463 @@
+// Package httpbin implements the common endpoints of httpbin.org on our own server,
+// so the proxy, the client and the tools can be tested without the internet.
+package httpbin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/router"
+)
+
+const (
+	// maxStream caps /stream/{n}
+	maxStream = 100
+	// maxBytes caps /bytes/{n} and /drip
+	maxBytes = 100 * 1024
+)
+
+// methods are the ones our request parser accepts, all of which /anything answers
+var methods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// Handler serves the httpbin endpoints: /get, /post, /put, /patch, /delete,
+// /anything, /status/{codes}, /headers, /ip, /user-agent, /stream/{n}, /bytes/{n},
+// /delay/{seconds}, /html, /drip, /redirect/{n} and /gzip
+type Handler struct {
+	// MaxDelay caps how long /delay and /drip take, 10 seconds by default
+	MaxDelay time.Duration
+
+	prefix string
+	router *router.Router
+}
+
+// New returns a handler for the endpoints under prefix, e.g. "/httpbin" when it is
+// mounted at "/httpbin/*path", or "" at the root
+func New(prefix string) *Handler {
+	h := &Handler{MaxDelay: 10 * time.Second, prefix: strings.TrimSuffix(prefix, "/")}
+	r := router.New()
+	g := r.Group(h.prefix)
+
+	g.Get("/get", func(req *request.Request, w *response.Writer) {
+		writeJSON(w, response.StatusOK, h.describe(req, false))
+	})
+	for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		g.Handle(method, "/"+strings.ToLower(method), func(req *request.Request, w *response.Writer) {
+			writeJSON(w, response.StatusOK, h.describe(req, true))
+		})
+	}
+	for _, method := range methods {
+		g.Handle(method, "/anything", h.anything)
+		g.Handle(method, "/anything/*path", h.anything)
+		g.Handle(method, "/status/{codes}", h.status)
+		g.Handle(method, "/delay/{seconds}", h.delay)
+	}
+	g.Get("/headers", func(req *request.Request, w *response.Writer) {
+		writeJSON(w, response.StatusOK, map[string]any{"headers": canonicalHeaders(req.Headers)})
+	})
+	g.Get("/ip", func(req *request.Request, w *response.Writer) {
+		writeJSON(w, response.StatusOK, map[string]any{"origin": origin(req)})
+	})
+	g.Get("/user-agent", func(req *request.Request, w *response.Writer) {
+		writeJSON(w, response.StatusOK, map[string]any{"user-agent": req.Headers["user-agent"]})
+	})
+	g.Get("/stream/{n}", h.stream)
+	g.Get("/bytes/{n}", h.bytes)
+	g.Get("/html", h.html)
+	g.Get("/drip", h.drip)
+	g.Get("/redirect/{n}", h.redirect)
+	g.Get("/gzip", h.gzip)
+
+	h.router = r
+	return h
+}
+
+// ServeHTTP answers the request if it is for one of the endpoints, with 404 otherwise
+func (h *Handler) ServeHTTP(req *request.Request, w *response.Writer) {
+	h.router.ServeHTTP(req, w)
+}
+
+// describe is what httpbin reports about a request: its query arguments, headers,
+// client address and URL, and with withBody what the body held
+func (h *Handler) describe(req *request.Request, withBody bool) map[string]any {
+	d := map[string]any{
+		"args":    flatten(req.Query()),
+		"headers": canonicalHeaders(req.Headers),
+		"origin":  origin(req),
+		"url":     requestURL(req),
+	}
+	if withBody {
+		data, form, files := parseBody(req)
+		d["data"] = data
+		d["form"] = form
+		d["files"] = files
+		var parsed any
+		if json.Unmarshal(req.Body, &parsed) != nil {
+			parsed = nil
+		}
+		d["json"] = parsed
+	}
+	return d
+}
+
+// anything echoes any request, body and method included
+func (h *Handler) anything(req *request.Request, w *response.Writer) {
+	d := h.describe(req, true)
+	d["method"] = req.RequestLine.Method
+	writeJSON(w, response.StatusOK, d)
+}
+
+// status answers with the code in the path, or one picked at random from a
+// comma-separated list of them
+func (h *Handler) status(req *request.Request, w *response.Writer) {
+	choices := strings.Split(req.PathValue("codes"), ",")
+	code, err := strconv.Atoi(strings.TrimSpace(choices[rand.Intn(len(choices))]))
+	if err != nil || code < 200 || code > 599 {
+		writeText(w, response.StatusBadRequest, "Invalid status code\n")
+		return
+	}
+
+	status := response.StatusCode(code)
+	w.WriteStatusLine(status)
+	extra := headers.NewHeaders()
+	switch code {
+	case 301, 302, 303, 305, 307, 308:
+		extra.Set("Location", h.prefix+"/redirect/1")
+	case 401:
+		extra.Set("WWW-Authenticate", `Basic realm="Fake Realm"`)
+	}
+	w.WriteHeaders(extra)
+}
+
+// delay answers like /anything after waiting the given number of seconds
+func (h *Handler) delay(req *request.Request, w *response.Writer) {
+	seconds, err := strconv.ParseFloat(req.PathValue("seconds"), 64)
+	if err != nil || seconds < 0 {
+		writeText(w, response.StatusBadRequest, "Invalid delay\n")
+		return
+	}
+	wait := min(time.Duration(seconds*float64(time.Second)), h.MaxDelay)
+	if !sleep(w, wait) {
+		return
+	}
+	writeJSON(w, response.StatusOK, h.describe(req, true))
+}
+
+// stream sends n JSON lines, one chunk each
+func (h *Handler) stream(req *request.Request, w *response.Writer) {
+	n, err := strconv.Atoi(req.PathValue("n"))
+	if err != nil || n < 0 {
+		writeText(w, response.StatusBadRequest, "Invalid count\n")
+		return
+	}
+	n = min(n, maxStream)
+
+	w.WriteStatusLine(response.StatusOK)
+	hdrs := headers.NewHeaders()
+	hdrs.Set("Content-Type", "application/json")
+	hdrs.Set("Transfer-Encoding", "chunked")
+	w.WriteHeaders(hdrs)
+	d := h.describe(req, false)
+	for i := 0; i < n; i++ {
+		d["id"] = i
+		line, _ := json.Marshal(d)
+		if _, err := w.WriteChunkedBody(append(line, '\n')); err != nil {
+			return
+		}
+	}
+	w.WriteChunkedBodyDone()
+}
+
+// bytes sends n random bytes; the seed query parameter makes them reproducible
+func (h *Handler) bytes(req *request.Request, w *response.Writer) {
+	n, err := strconv.Atoi(req.PathValue("n"))
+	if err != nil || n < 0 {
+		writeText(w, response.StatusBadRequest, "Invalid count\n")
+		return
+	}
+	seed := time.Now().UnixNano()
+	if s := req.Query().Get("seed"); s != "" {
+		if seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			writeText(w, response.StatusBadRequest, "Invalid seed\n")
+			return
+		}
+	}
+	data := make([]byte, min(n, maxBytes))
+	rand.New(rand.NewSource(seed)).Read(data)
+
+	w.WriteStatusLine(response.StatusOK)
+	hdrs := headers.NewHeaders()
+	hdrs.Set("Content-Type", "application/octet-stream")
+	w.WriteHeaders(hdrs)
+	w.WriteBody(data)
+}
+
+// drip sends numbytes asterisks spread evenly over duration seconds, after an
+// initial delay, with status code
+func (h *Handler) drip(req *request.Request, w *response.Writer) {
+	q := req.Query()
+	duration, err1 := queryFloat(q, "duration", 2)
+	delay, err2 := queryFloat(q, "delay", 0)
+	numBytes, err3 := queryFloat(q, "numbytes", 10)
+	code, err4 := queryFloat(q, "code", 200)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || duration < 0 || delay < 0 || numBytes < 1 || code < 200 || code > 599 {
+		writeText(w, response.StatusBadRequest, "Invalid drip parameters\n")
+		return
+	}
+	n := min(int(numBytes), maxBytes)
+	total := min(time.Duration((duration+delay)*float64(time.Second)), h.MaxDelay)
+	initial := min(time.Duration(delay*float64(time.Second)), total)
+	pause := (total - initial) / time.Duration(n)
+
+	if !sleep(w, initial) {
+		return
+	}
+	w.WriteStatusLine(response.StatusCode(code))
+	hdrs := headers.NewHeaders()
+	hdrs.Set("Content-Type", "application/octet-stream")
+	hdrs.Set("Transfer-Encoding", "chunked")
+	w.WriteHeaders(hdrs)
+	for i := 0; i < n; i++ {
+		if _, err := w.WriteChunkedBody([]byte("*")); err != nil {
+			return
+		}
+		if i < n-1 && !sleep(w, pause) {
+			return
+		}
+	}
+	w.WriteChunkedBodyDone()
+}
+
+// redirect sends the client through n redirects before landing on /get.
+// With absolute=true the Location headers are absolute URLs.
+func (h *Handler) redirect(req *request.Request, w *response.Writer) {
+	n, err := strconv.Atoi(req.PathValue("n"))
+	if err != nil || n < 1 {
+		writeText(w, response.StatusBadRequest, "Invalid redirect count\n")
+		return
+	}
+	location := h.prefix + "/get"
+	if n > 1 {
+		location = fmt.Sprintf("%s/redirect/%d", h.prefix, n-1)
+	}
+	if req.Query().Get("absolute") == "true" {
+		location = scheme(req) + "://" + host(req) + location
+		if n > 1 {
+			location += "?absolute=true"
+		}
+	}
+	w.WriteStatusLine(response.StatusFound)
+	hdrs := headers.NewHeaders()
+	hdrs.Set("Location", location)
+	w.WriteHeaders(hdrs)
+}
+
+// gzip answers like /get with a gzip-encoded body
+func (h *Handler) gzip(req *request.Request, w *response.Writer) {
+	d := h.describe(req, false)
+	d["gzipped"] = true
+	d["method"] = req.RequestLine.Method
+	body, _ := json.MarshalIndent(d, "", "  ")
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(append(body, '\n'))
+	zw.Close()
+
+	w.WriteStatusLine(response.StatusOK)
+	hdrs := headers.NewHeaders()
+	hdrs.Set("Content-Type", "application/json")
+	hdrs.Set("Content-Encoding", "gzip")
+	w.WriteHeaders(hdrs)
+	w.WriteBody(buf.Bytes())
+}
+
+func (h *Handler) html(req *request.Request, w *response.Writer) {
+	w.WriteStatusLine(response.StatusOK)
+	hdrs := headers.NewHeaders()
+	hdrs.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeaders(hdrs)
+	w.WriteBody([]byte(mobyDick))
+}
+
+// sleep waits for d, or until the client goes away, which it reports as false
+func sleep(w *response.Writer, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.CloseNotify():
+		return false
+	}
+}
+
+// parseBody splits the body the way httpbin does: form fields and uploaded files
+// for form content types, the raw data otherwise. Data that isn't text comes back
+// as a base64 data URL.
+func parseBody(req *request.Request) (data string, form, files map[string]any) {
+	form, files = map[string]any{}, map[string]any{}
+	mediaType, params, _ := mime.ParseMediaType(req.Headers["content-type"])
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(req.Body))
+		if err == nil {
+			return "", flatten(values), files
+		}
+	case "multipart/form-data":
+		mr := multipart.NewReader(bytes.NewReader(req.Body), params["boundary"])
+		fields := url.Values{}
+		uploads := url.Values{}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			content, _ := io.ReadAll(part)
+			if part.FileName() != "" {
+				uploads.Add(part.FormName(), textOrDataURL(content, part.Header.Get("Content-Type")))
+			} else {
+				fields.Add(part.FormName(), string(content))
+			}
+		}
+		return "", flatten(fields), flatten(uploads)
+	}
+	return textOrDataURL(req.Body, "application/octet-stream"), form, files
+}
+
+func textOrDataURL(data []byte, contentType string) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// flatten turns repeated values into a list and single ones into a string, like httpbin's args
+func flatten(values url.Values) map[string]any {
+	out := make(map[string]any, len(values))
+	for k, v := range values {
+		if len(v) == 1 {
+			out[k] = v[0]
+		} else {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// canonicalHeaders returns the request headers with their usual casing
+func canonicalHeaders(h headers.Headers) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		out[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	return out
+}
+
+// origin is the client address, or the chain of them when a proxy forwarded the request
+func origin(req *request.Request) string {
+	if xff := req.Headers["x-forwarded-for"]; xff != "" {
+		return xff
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// requestURL is the URL the client asked for, as far as the headers tell
+func requestURL(req *request.Request) string {
+	return scheme(req) + "://" + host(req) + req.RequestLine.RequestTarget
+}
+
+func scheme(req *request.Request) string {
+	if proto := req.Headers["x-forwarded-proto"]; proto != "" {
+		return proto
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func host(req *request.Request) string {
+	if fwd := req.Headers["x-forwarded-host"]; fwd != "" {
+		return fwd
+	}
+	return req.Headers["host"]
+}
+
+func queryFloat(q url.Values, name string, def float64) (float64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+func writeJSON(w *response.Writer, status response.StatusCode, v any) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeText(w, response.StatusServerError, "Internal Server Error\n")
+		return
+	}
+	w.WriteStatusLine(status)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "application/json")
+	w.WriteHeaders(h)
+	w.WriteBody(append(body, '\n'))
+}
+
+func writeText(w *response.Writer, status response.StatusCode, text string) {
+	w.WriteStatusLine(status)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(text))
+}
+
+// mobyDick is what httpbin's /html serves, the start of chapter 1
+const mobyDick = `<!DOCTYPE html>
+<html>
+  <head>
+  </head>
+  <body>
+      <h1>Herman Melville - Moby-Dick</h1>
+
+      <div>
+        <p>
+          Call me Ishmael. Some years ago—never mind how long precisely—having little or no money in my purse,
+          and nothing particular to interest me on shore, I thought I would sail about a little and see the watery
+          part of the world. It is a way I have of driving off the spleen and regulating the circulation. Whenever I
+          find myself growing grim about the mouth; whenever it is a damp, drizzly November in my soul; whenever I find
+          myself involuntarily pausing before coffin warehouses, and bringing up the rear of every funeral I meet; and
+          especially whenever my hypos get such an upper hand of me, that it requires a strong moral principle to
+          prevent me from deliberately stepping into the street, and methodically knocking people's hats off—then, I
+          account it high time to get to sea as soon as I can.
+        </p>
+      </div>
+  </body>
+</html>
+`
@@ -0,0 +1,293 @@
+package httpbin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/proxy"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// serve runs one request through h and parses what it wrote
+func serve(t *testing.T, h *Handler, method, target string, hdrs headers.Headers, body string) *response.Response {
+	t.Helper()
+	if hdrs == nil {
+		hdrs = headers.NewHeaders()
+	}
+	if _, ok := hdrs["host"]; !ok {
+		hdrs.Set("Host", "localhost:42069")
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     hdrs,
+		Body:        []byte(body),
+		RemoteAddr:  "192.0.2.1:54321",
+	}
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	h.ServeHTTP(req, w)
+	require.NoError(t, w.Flush())
+
+	resp, err := response.ResponseFromReaderForMethod(&buf, method)
+	require.NoError(t, err)
+	return resp
+}
+
+// decode parses a JSON response body
+func decode(t *testing.T, resp *response.Response) map[string]any {
+	t.Helper()
+	assert.Equal(t, "application/json", resp.Headers["content-type"])
+	var d map[string]any
+	require.NoError(t, json.Unmarshal(resp.Body, &d), string(resp.Body))
+	return d
+}
+
+func TestEcho(t *testing.T) {
+	h := New("")
+
+	hdrs := headers.NewHeaders()
+	hdrs.Set("User-Agent", "test/1.0")
+	hdrs.Set("X-Custom", "value")
+	resp := serve(t, h, "GET", "/get?a=1&a=2&b=3", hdrs, "")
+	require.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	d := decode(t, resp)
+	assert.Equal(t, map[string]any{"a": []any{"1", "2"}, "b": "3"}, d["args"])
+	assert.Equal(t, "value", d["headers"].(map[string]any)["X-Custom"])
+	assert.Equal(t, "test/1.0", d["headers"].(map[string]any)["User-Agent"])
+	assert.Equal(t, "192.0.2.1", d["origin"])
+	assert.Equal(t, "http://localhost:42069/get?a=1&a=2&b=3", d["url"])
+	assert.NotContains(t, d, "data")
+
+	// Behind a proxy, what the proxy says about the client wins
+	hdrs = headers.NewHeaders()
+	hdrs.Set("X-Forwarded-For", "198.51.100.7")
+	hdrs.Set("X-Forwarded-Proto", "https")
+	hdrs.Set("X-Forwarded-Host", "example.com")
+	d = decode(t, serve(t, h, "GET", "/get", hdrs, ""))
+	assert.Equal(t, "198.51.100.7", d["origin"])
+	assert.Equal(t, "https://example.com/get", d["url"])
+
+	d = decode(t, serve(t, h, "GET", "/headers", hdrs, ""))
+	assert.Equal(t, "example.com", d["headers"].(map[string]any)["X-Forwarded-Host"])
+	d = decode(t, serve(t, h, "GET", "/ip", hdrs, ""))
+	assert.Equal(t, map[string]any{"origin": "198.51.100.7"}, d)
+	d = decode(t, serve(t, h, "GET", "/user-agent", headers.Headers{"user-agent": "curl/8"}, ""))
+	assert.Equal(t, map[string]any{"user-agent": "curl/8"}, d)
+
+	// Each method has its endpoint
+	assert.Equal(t, response.StatusMethodNotAllowed, serve(t, h, "GET", "/post", nil, "").StatusLine.StatusCode)
+	assert.Equal(t, response.StatusMethodNotAllowed, serve(t, h, "POST", "/get", nil, "").StatusLine.StatusCode)
+	assert.Equal(t, response.StatusNotFound, serve(t, h, "GET", "/nope", nil, "").StatusLine.StatusCode)
+}
+
+func TestBodies(t *testing.T) {
+	h := New("")
+
+	t.Run("json", func(t *testing.T) {
+		d := decode(t, serve(t, h, "POST", "/post", headers.Headers{"content-type": "application/json"}, `{"name":"httpbin","n":1}`))
+		assert.Equal(t, `{"name":"httpbin","n":1}`, d["data"])
+		assert.Equal(t, map[string]any{"name": "httpbin", "n": float64(1)}, d["json"])
+		assert.Equal(t, map[string]any{}, d["form"])
+	})
+
+	t.Run("form", func(t *testing.T) {
+		d := decode(t, serve(t, h, "PUT", "/put", headers.Headers{"content-type": "application/x-www-form-urlencoded"}, "a=1&b=2&b=3"))
+		assert.Equal(t, "", d["data"])
+		assert.Equal(t, map[string]any{"a": "1", "b": []any{"2", "3"}}, d["form"])
+		assert.Nil(t, d["json"])
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("title", "notes")
+		fw, _ := mw.CreateFormFile("upload", "notes.txt")
+		fw.Write([]byte("file contents"))
+		mw.Close()
+		d := decode(t, serve(t, h, "PATCH", "/patch", headers.Headers{"content-type": mw.FormDataContentType()}, body.String()))
+		assert.Equal(t, map[string]any{"title": "notes"}, d["form"])
+		assert.Equal(t, map[string]any{"upload": "file contents"}, d["files"])
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		d := decode(t, serve(t, h, "DELETE", "/delete", nil, "\xff\xfe"))
+		assert.Equal(t, "data:application/octet-stream;base64,//4=", d["data"])
+	})
+
+	t.Run("anything", func(t *testing.T) {
+		for _, method := range []string{"GET", "POST", "OPTIONS"} {
+			d := decode(t, serve(t, h, method, "/anything/deep/path?x=1", nil, "hi"))
+			assert.Equal(t, method, d["method"])
+			assert.Equal(t, "hi", d["data"])
+			assert.Equal(t, map[string]any{"x": "1"}, d["args"])
+		}
+	})
+}
+
+func TestStatus(t *testing.T) {
+	h := New("/httpbin")
+
+	resp := serve(t, h, "GET", "/httpbin/status/418", nil, "")
+	assert.Equal(t, response.StatusCode(418), resp.StatusLine.StatusCode)
+	assert.Empty(t, resp.Body)
+
+	resp = serve(t, h, "DELETE", "/httpbin/status/302", nil, "")
+	assert.Equal(t, response.StatusFound, resp.StatusLine.StatusCode)
+	assert.Equal(t, "/httpbin/redirect/1", resp.Headers["location"])
+
+	resp = serve(t, h, "GET", "/httpbin/status/401", nil, "")
+	assert.Contains(t, resp.Headers["www-authenticate"], "Basic")
+
+	seen := map[response.StatusCode]bool{}
+	for i := 0; i < 50; i++ {
+		seen[serve(t, h, "GET", "/httpbin/status/201,404", nil, "").StatusLine.StatusCode] = true
+	}
+	assert.Equal(t, map[response.StatusCode]bool{response.StatusCreated: true, response.StatusNotFound: true}, seen)
+
+	for _, bad := range []string{"abc", "99", "600"} {
+		assert.Equal(t, response.StatusBadRequest, serve(t, h, "GET", "/httpbin/status/"+bad, nil, "").StatusLine.StatusCode, bad)
+	}
+
+	// The prefix is part of every route
+	assert.Equal(t, response.StatusNotFound, serve(t, h, "GET", "/status/200", nil, "").StatusLine.StatusCode)
+}
+
+func TestStreamAndBytes(t *testing.T) {
+	h := New("")
+
+	resp := serve(t, h, "GET", "/stream/3", nil, "")
+	assert.True(t, resp.Chunked)
+	lines := strings.Split(strings.TrimSpace(string(resp.Body)), "\n")
+	require.Len(t, lines, 3)
+	for i, line := range lines {
+		var d map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &d))
+		assert.Equal(t, float64(i), d["id"])
+		assert.Equal(t, "http://localhost:42069/stream/3", d["url"])
+	}
+	resp = serve(t, h, "GET", "/stream/1000", nil, "")
+	assert.Len(t, strings.Split(strings.TrimSpace(string(resp.Body)), "\n"), maxStream)
+
+	a := serve(t, h, "GET", "/bytes/64?seed=42", nil, "")
+	b := serve(t, h, "GET", "/bytes/64?seed=42", nil, "")
+	assert.Equal(t, "application/octet-stream", a.Headers["content-type"])
+	assert.Len(t, a.Body, 64)
+	assert.Equal(t, a.Body, b.Body)
+	assert.Len(t, serve(t, h, "GET", "/bytes/10000000", nil, "").Body, maxBytes)
+	assert.Equal(t, response.StatusBadRequest, serve(t, h, "GET", "/bytes/-1", nil, "").StatusLine.StatusCode)
+}
+
+func TestDelayAndDrip(t *testing.T) {
+	h := New("")
+
+	start := time.Now()
+	d := decode(t, serve(t, h, "POST", "/delay/0.05", nil, "late"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, "late", d["data"])
+
+	h.MaxDelay = 20 * time.Millisecond
+	start = time.Now()
+	serve(t, h, "GET", "/delay/10", nil, "")
+	assert.Less(t, time.Since(start), time.Second)
+
+	h.MaxDelay = 10 * time.Second
+	start = time.Now()
+	resp := serve(t, h, "GET", "/drip?numbytes=5&duration=0.1&code=201", nil, "")
+	assert.GreaterOrEqual(t, time.Since(start), 75*time.Millisecond)
+	assert.Equal(t, response.StatusCreated, resp.StatusLine.StatusCode)
+	assert.True(t, resp.Chunked)
+	assert.Equal(t, "*****", string(resp.Body))
+
+	assert.Equal(t, response.StatusBadRequest, serve(t, h, "GET", "/drip?numbytes=0", nil, "").StatusLine.StatusCode)
+	assert.Equal(t, response.StatusBadRequest, serve(t, h, "GET", "/delay/soon", nil, "").StatusLine.StatusCode)
+}
+
+func TestRedirectGzipHTML(t *testing.T) {
+	h := New("/httpbin")
+
+	resp := serve(t, h, "GET", "/httpbin/redirect/3", nil, "")
+	assert.Equal(t, response.StatusFound, resp.StatusLine.StatusCode)
+	assert.Equal(t, "/httpbin/redirect/2", resp.Headers["location"])
+	resp = serve(t, h, "GET", "/httpbin/redirect/1", nil, "")
+	assert.Equal(t, "/httpbin/get", resp.Headers["location"])
+	resp = serve(t, h, "GET", "/httpbin/redirect/2?absolute=true", nil, "")
+	assert.Equal(t, "http://localhost:42069/httpbin/redirect/1?absolute=true", resp.Headers["location"])
+	assert.Equal(t, response.StatusBadRequest, serve(t, h, "GET", "/httpbin/redirect/0", nil, "").StatusLine.StatusCode)
+
+	resp = serve(t, h, "GET", "/httpbin/gzip", nil, "")
+	assert.Equal(t, "gzip", resp.Headers["content-encoding"])
+	zr, err := gzip.NewReader(bytes.NewReader(resp.Body))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	var d map[string]any
+	require.NoError(t, json.Unmarshal(plain, &d))
+	assert.Equal(t, true, d["gzipped"])
+
+	resp = serve(t, h, "GET", "/httpbin/html", nil, "")
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers["content-type"])
+	assert.Contains(t, string(resp.Body), "Moby-Dick")
+
+	// HEAD gets the GET route without its body
+	resp = serve(t, h, "HEAD", "/httpbin/html", nil, "")
+	assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode)
+	assert.Empty(t, resp.Body)
+}
+
+// The proxy and the client against a local httpbin, no internet involved
+func TestBehindProxy(t *testing.T) {
+	backend := &server.Server{Handler: New("").ServeHTTP, DisableHTTP2: true}
+	require.NoError(t, backend.Start())
+	defer backend.Close()
+
+	p, err := proxy.New(fmt.Sprintf("http://127.0.0.1:%d", backend.Port))
+	require.NoError(t, err)
+	p.StripPrefix = "/httpbin"
+	front := &server.Server{Handler: p.ServeHTTP, DisableHTTP2: true}
+	require.NoError(t, front.Start())
+	defer front.Close()
+
+	c := &client.Client{}
+	defer c.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	base := fmt.Sprintf("http://127.0.0.1:%d/httpbin", front.Port)
+
+	resp, err := c.Get(ctx, base+"/stream/5")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.True(t, resp.Chunked)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	require.Len(t, lines, 5)
+	var d map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &d))
+	assert.Equal(t, "127.0.0.1", d["origin"])
+
+	req, err := client.NewRequest("POST", base+"/anything", strings.NewReader("through the proxy"))
+	require.NoError(t, err)
+	resp, err = c.Do(ctx, req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(body, &d))
+	assert.Equal(t, "POST", d["method"])
+	assert.Equal(t, "through the proxy", d["data"])
+}
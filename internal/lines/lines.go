@@ -0,0 +1,190 @@
+// Package lines splits a stream into lines as they arrive, which is what getLinesChannel
+// in the first version of cmd/tcplistener did. A line may end with "\n", "\r\n" or a lone
+// "\r", and the last one needs no ending at all. Reader works like bufio.Scanner; Channel
+// hands the lines out over a channel, with the error that stopped them.
+package lines
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxLength is the longest line allowed when no other limit is given
+const DefaultMaxLength = 64 << 10
+
+// ErrTooLong is returned for a line longer than the limit
+var ErrTooLong = errors.New("lines: line too long")
+
+// Reader reads lines from a stream. A lone "\r" ends a line right away rather than
+// waiting to see if "\n" follows, so an interactive stream doesn't lag a line behind.
+type Reader struct {
+	r   io.Reader
+	max int
+
+	buf        []byte
+	start, end int  // the buffered bytes not handed out yet
+	skipLF     bool // the last line ended with "\r"; a "\n" right after belongs to it
+	eof        bool
+	line       []byte
+	count      int
+	err        error
+}
+
+// NewReader returns a Reader of lines of up to maxLength bytes, DefaultMaxLength if 0
+func NewReader(r io.Reader, maxLength int) *Reader {
+	if maxLength <= 0 {
+		maxLength = DefaultMaxLength
+	}
+	return &Reader{r: r, max: maxLength, buf: make([]byte, min(4096, maxLength+1))}
+}
+
+// Next moves to the next line, and returns false at the end of the stream or on error
+func (r *Reader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	for {
+		if r.skipLF && r.start < r.end {
+			if r.buf[r.start] == '\n' {
+				r.start++
+			}
+			r.skipLF = false
+		}
+
+		if i := lineEnd(r.buf[r.start:r.end]); i >= 0 {
+			r.skipLF = r.buf[r.start+i] == '\r'
+			return r.emit(r.start+i, r.start+i+1)
+		}
+		if r.end-r.start > r.max {
+			r.err = fmt.Errorf("%w (line %d, limit %d bytes)", ErrTooLong, r.count+1, r.max)
+			return false
+		}
+		if r.eof {
+			if r.start < r.end {
+				return r.emit(r.end, r.end)
+			}
+			return false
+		}
+		if err := r.fill(); err != nil {
+			r.err = err
+			return false
+		}
+	}
+}
+
+// lineEnd finds the first "\r" or "\n", with IndexByte as it is much faster than IndexAny
+func lineEnd(data []byte) int {
+	lf := bytes.IndexByte(data, '\n')
+	if lf < 0 {
+		lf = len(data)
+	}
+	if cr := bytes.IndexByte(data[:lf], '\r'); cr >= 0 {
+		return cr
+	}
+	if lf == len(data) {
+		return -1
+	}
+	return lf
+}
+
+// emit hands out the buffered bytes up to end as a line, and goes on from next
+func (r *Reader) emit(end, next int) bool {
+	r.line = r.buf[r.start:end]
+	r.start = next
+	r.count++
+	if len(r.line) > r.max {
+		r.err = fmt.Errorf("%w (line %d, limit %d bytes)", ErrTooLong, r.count, r.max)
+		return false
+	}
+	return true
+}
+
+// fill reads more into the buffer, first making room by dropping what has been handed
+// out and, if that isn't enough, growing it up to one byte past the longest line
+func (r *Reader) fill() error {
+	if r.start > 0 {
+		r.end = copy(r.buf, r.buf[r.start:r.end])
+		r.start = 0
+	}
+	if r.end == len(r.buf) {
+		grown := make([]byte, min(2*len(r.buf), r.max+1))
+		copy(grown, r.buf[:r.end])
+		r.buf = grown
+	}
+	for empty := 0; empty < 100; empty++ {
+		n, err := r.r.Read(r.buf[r.end:])
+		r.end += n
+		if err == io.EOF {
+			r.eof = true
+			return nil
+		}
+		if err != nil || n > 0 {
+			return err
+		}
+	}
+	return io.ErrNoProgress
+}
+
+// Bytes returns the current line without its ending. It is only valid until the next
+// call to Next.
+func (r *Reader) Bytes() []byte {
+	return r.line
+}
+
+// Text returns the current line without its ending
+func (r *Reader) Text() string {
+	return string(r.line)
+}
+
+// Count is the number of lines read so far
+func (r *Reader) Count() int {
+	return r.count
+}
+
+// Err returns the error that ended the lines, nil at the end of the stream
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Line is a line from Channel, or the error that ended them
+type Line struct {
+	Text string
+	Err  error
+}
+
+// Channel reads the lines of r in a goroutine and sends them on the returned channel,
+// which is closed after the last one. A read error or a line longer than maxLength is
+// sent as a Line with Err set, before the channel is closed.
+//
+// When ctx is done the channel is closed without an error; the caller knows why. If r is
+// an io.Closer it is closed then, to stop a read that is waiting, and at the end too.
+func Channel(ctx context.Context, r io.Reader, maxLength int) <-chan Line {
+	ch := make(chan Line)
+	go func() {
+		defer close(ch)
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+			stop := context.AfterFunc(ctx, func() { c.Close() })
+			defer stop()
+		}
+
+		lr := NewReader(r, maxLength)
+		for lr.Next() {
+			select {
+			case ch <- Line{Text: lr.Text()}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := lr.Err(); err != nil && ctx.Err() == nil {
+			select {
+			case ch <- Line{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return ch
+}
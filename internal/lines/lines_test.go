@@ -0,0 +1,179 @@
+package lines
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkReader hands out its data a few bytes at a time, like a network connection
+type chunkReader struct {
+	data string
+	n    int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.data == "" {
+		return 0, io.EOF
+	}
+	n := copy(p, c.data[:min(c.n, len(c.data))])
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func readAll(t *testing.T, r *Reader) []string {
+	var got []string
+	for r.Next() {
+		got = append(got, r.Text())
+	}
+	return got
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"LF", "one\ntwo\n", []string{"one", "two"}},
+		{"CRLF", "one\r\ntwo\r\n", []string{"one", "two"}},
+		{"CR", "one\rtwo\r", []string{"one", "two"}},
+		{"Mixed", "one\r\ntwo\nthree\rfour", []string{"one", "two", "three", "four"}},
+		{"Empty lines", "\n\r\n\r\rx", []string{"", "", "", "", "x"}},
+		{"CR LF LF", "a\r\n\nb", []string{"a", "", "b"}},
+		{"No ending", "only", []string{"only"}},
+		{"Nothing", "", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Every read size, so that the endings get split between reads
+			for n := 1; n <= len(tc.data)+1; n++ {
+				r := NewReader(&chunkReader{data: tc.data, n: n}, 0)
+				assert.Equal(t, tc.want, readAll(t, r), "reading %d bytes at a time", n)
+				assert.NoError(t, r.Err())
+				assert.Equal(t, len(tc.want), r.Count())
+			}
+		})
+	}
+
+	t.Run("Long lines", func(t *testing.T) {
+		long := strings.Repeat("x", 10000)
+		r := NewReader(strings.NewReader(long+"\n"+long), 10000)
+		assert.Equal(t, []string{long, long}, readAll(t, r))
+		assert.NoError(t, r.Err())
+	})
+
+	t.Run("Too long", func(t *testing.T) {
+		for _, data := range []string{"short\n" + strings.Repeat("x", 11) + "\nafter\n", "short\n" + strings.Repeat("x", 11)} {
+			r := NewReader(&chunkReader{data: data, n: 3}, 10)
+			assert.Equal(t, []string{"short"}, readAll(t, r))
+			assert.ErrorIs(t, r.Err(), ErrTooLong)
+			assert.Contains(t, r.Err().Error(), "line 2")
+		}
+		// Exactly at the limit is fine
+		r := NewReader(strings.NewReader(strings.Repeat("x", 10)+"\r\n"), 10)
+		assert.Len(t, readAll(t, r), 1)
+		assert.NoError(t, r.Err())
+	})
+
+	t.Run("Read error", func(t *testing.T) {
+		boom := errors.New("connection reset")
+		r := NewReader(io.MultiReader(strings.NewReader("one\ntw"), &errReader{boom}), 0)
+		assert.Equal(t, []string{"one"}, readAll(t, r))
+		assert.ErrorIs(t, r.Err(), boom)
+	})
+}
+
+type errReader struct{ err error }
+
+func (e *errReader) Read([]byte) (int, error) { return 0, e.err }
+
+func TestChannel(t *testing.T) {
+	var got []string
+	for line := range Channel(context.Background(), strings.NewReader("a\r\nb\nc"), 0) {
+		require.NoError(t, line.Err)
+		got = append(got, line.Text)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, got)
+
+	t.Run("Error", func(t *testing.T) {
+		var last Line
+		for line := range Channel(context.Background(), strings.NewReader("ok\n"+strings.Repeat("x", 20)), 10) {
+			last = line
+		}
+		assert.ErrorIs(t, last.Err, ErrTooLong)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		// A pipe nobody writes to blocks until the context closes it
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := Channel(ctx, pr, 0)
+		go pw.Write([]byte("first\n"))
+		assert.Equal(t, Line{Text: "first"}, <-ch)
+
+		cancel()
+		select {
+		case line, ok := <-ch:
+			assert.False(t, ok, "got %+v", line)
+		case <-time.After(time.Second):
+			t.Fatal("channel not closed after cancel")
+		}
+		_, err := pw.Write([]byte("x"))
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	})
+}
+
+var benchData = func() string {
+	var b strings.Builder
+	for i := 0; b.Len() < 1<<20; i++ {
+		b.WriteString(strings.Repeat("GET /some/path HTTP/1.1 ", i%8))
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}()
+
+func BenchmarkReader(b *testing.B) {
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		r := NewReader(strings.NewReader(benchData), 0)
+		for r.Next() {
+		}
+	}
+}
+
+// BenchmarkReaderSmallReads reads the way getLinesChannel did, 8 bytes at a time
+func BenchmarkReaderSmallReads(b *testing.B) {
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		r := NewReader(&chunkReader{data: benchData, n: 8}, 0)
+		for r.Next() {
+		}
+	}
+}
+
+func BenchmarkChannel(b *testing.B) {
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		for range Channel(context.Background(), strings.NewReader(benchData), 0) {
+		}
+	}
+}
+
+// BenchmarkScanner is bufio.Scanner on the same data, for comparison
+func BenchmarkScanner(b *testing.B) {
+	b.SetBytes(int64(len(benchData)))
+	for i := 0; i < b.N; i++ {
+		s := bufio.NewScanner(strings.NewReader(benchData))
+		for s.Scan() {
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are latency buckets in seconds, from 5ms to 10s
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is anything the registry knows how to print in the text exposition format
+type collector interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// Registry holds a set of metrics and renders them for Prometheus to scrape
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.collectors[c.name()]; exists {
+		panic(fmt.Sprintf("metrics: %s registered twice", c.name()))
+	}
+	r.collectors[c.name()] = c
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition format (version 0.0.4),
+// sorted by name so consecutive scrapes are easy to diff
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, len(names))
+	for i, name := range names {
+		collectors[i] = r.collectors[name]
+	}
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// desc is the part every metric family shares
+type desc struct {
+	metricName string
+	help       string
+	kind       string // "counter", "gauge" or "histogram"
+	labelNames []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, escapeHelp(d.help), d.metricName, d.kind)
+	return err
+}
+
+// labels renders {a="x",b="y"} for the given values, plus any extra pair (used for "le")
+func (d *desc) labels(values []string, extraName, extraValue string) string {
+	if len(d.labelNames) == 0 && extraName == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("{")
+	for i, name := range d.labelNames {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabelValue(values[i]))
+	}
+	if extraName != "" {
+		if len(d.labelNames) > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extraName, extraValue)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// atomicFloat is a float64 that can be updated from many goroutines
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) Add(delta float64) {
+	for {
+		old := f.bits.Load()
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if f.bits.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	value atomicFloat
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add adds delta, which must not be negative, to the counter
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.value.Add(delta)
+}
+
+// Value returns the current count
+func (c *Counter) Value() float64 {
+	return c.value.Load()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value atomicFloat
+}
+
+// Set replaces the gauge value
+func (g *Gauge) Set(v float64) {
+	g.value.Set(v)
+}
+
+// Add adds delta (possibly negative) to the gauge
+func (g *Gauge) Add(delta float64) {
+	g.value.Add(delta)
+}
+
+// Inc adds one to the gauge
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+// Dec subtracts one from the gauge
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+// Value returns the current value
+func (g *Gauge) Value() float64 {
+	return g.value.Load()
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	upperBounds []float64
+	counts      []atomic.Uint64 // one per bucket, not cumulative
+	count       atomic.Uint64
+	sum         atomicFloat
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		upperBounds: buckets,
+		counts:      make([]atomic.Uint64, len(buckets)),
+	}
+}
+
+// Observe records one value, e.g. a request duration in seconds
+func (h *Histogram) Observe(v float64) {
+	// Values above the last bound only show up in the +Inf bucket, i.e. the count
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	if i < len(h.counts) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	h.sum.Add(v)
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// Sum returns the total of all observations
+func (h *Histogram) Sum() float64 {
+	return h.sum.Load()
+}
+
+// family is a metric with labels: one child per distinct combination of label values
+type family[T any] struct {
+	desc
+	newChild func() *T
+
+	mu       sync.RWMutex
+	children map[string]*child[T]
+}
+
+type child[T any] struct {
+	labelValues []string
+	metric      *T
+}
+
+// with returns the child for the label values, creating it on first use
+func (f *family[T]) with(values []string) *T {
+	if len(values) != len(f.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.metricName, len(f.labelNames), len(values)))
+	}
+
+	// \xff can't appear in valid UTF-8, so it is a safe separator for the map key
+	key := strings.Join(values, "\xff")
+
+	f.mu.RLock()
+	c, ok := f.children[key]
+	f.mu.RUnlock()
+	if ok {
+		return c.metric
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.children[key]; ok {
+		return c.metric
+	}
+	c = &child[T]{labelValues: append([]string(nil), values...), metric: f.newChild()}
+	f.children[key] = c
+	return c.metric
+}
+
+// sortedChildren returns the children ordered by their label values
+func (f *family[T]) sortedChildren() []*child[T] {
+	f.mu.RLock()
+	children := make([]*child[T], 0, len(f.children))
+	for _, c := range f.children {
+		children = append(children, c)
+	}
+	f.mu.RUnlock()
+
+	sort.Slice(children, func(i, j int) bool {
+		a, b := children[i].labelValues, children[j].labelValues
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+	return children
+}
+
+func newFamily[T any](name, help, kind string, labelNames []string, newChild func() *T) *family[T] {
+	return &family[T]{
+		desc:     desc{metricName: name, help: help, kind: kind, labelNames: labelNames},
+		newChild: newChild,
+		children: make(map[string]*child[T]),
+	}
+}
+
+// CounterVec is a family of counters partitioned by labels
+type CounterVec struct {
+	*family[Counter]
+}
+
+// WithLabelValues returns the counter for the given label values, in the order the labels were declared
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return v.with(values)
+}
+
+func (v *CounterVec) write(w io.Writer) error {
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+	for _, c := range v.sortedChildren() {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", v.metricName, v.labels(c.labelValues, "", ""), formatFloat(c.metric.Value())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GaugeVec is a family of gauges partitioned by labels
+type GaugeVec struct {
+	*family[Gauge]
+}
+
+// WithLabelValues returns the gauge for the given label values, in the order the labels were declared
+func (v *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return v.with(values)
+}
+
+func (v *GaugeVec) write(w io.Writer) error {
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+	for _, c := range v.sortedChildren() {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", v.metricName, v.labels(c.labelValues, "", ""), formatFloat(c.metric.Value())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HistogramVec is a family of histograms partitioned by labels
+type HistogramVec struct {
+	*family[Histogram]
+}
+
+// WithLabelValues returns the histogram for the given label values, in the order the labels were declared
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return v.with(values)
+}
+
+func (v *HistogramVec) write(w io.Writer) error {
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+	for _, c := range v.sortedChildren() {
+		h := c.metric
+		var cumulative uint64
+		for i, bound := range h.upperBounds {
+			cumulative += h.counts[i].Load()
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", v.metricName, v.labels(c.labelValues, "le", formatFloat(bound)), cumulative); err != nil {
+				return err
+			}
+		}
+		count := h.Count()
+		lines := fmt.Sprintf("%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			v.metricName, v.labels(c.labelValues, "le", "+Inf"), count,
+			v.metricName, v.labels(c.labelValues, "", ""), formatFloat(h.Sum()),
+			v.metricName, v.labels(c.labelValues, "", ""), count,
+		)
+		if _, err := io.WriteString(w, lines); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewCounter registers a counter without labels
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).WithLabelValues()
+}
+
+// NewCounterVec registers a counter family with the given label names
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{newFamily(name, help, "counter", labelNames, func() *Counter { return &Counter{} })}
+	r.register(v)
+	return v
+}
+
+// NewGauge registers a gauge without labels
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).WithLabelValues()
+}
+
+// NewGaugeVec registers a gauge family with the given label names
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	v := &GaugeVec{newFamily(name, help, "gauge", labelNames, func() *Gauge { return &Gauge{} })}
+	r.register(v)
+	return v
+}
+
+// NewHistogram registers a histogram without labels. Buckets are upper bounds in
+// increasing order; nil means DefaultBuckets.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).WithLabelValues()
+}
+
+// NewHistogramVec registers a histogram family with the given buckets and label names
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets for %s must be sorted", name))
+	}
+	v := &HistogramVec{newFamily(name, help, "histogram", labelNames, func() *Histogram { return newHistogram(buckets) })}
+	r.register(v)
+	return v
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
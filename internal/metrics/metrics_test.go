@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+func render(t *testing.T, reg *Registry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, reg.WritePrometheus(&buf))
+	return buf.String()
+}
+
+func TestCounterAndGauge(t *testing.T) {
+	reg := NewRegistry()
+	hits := reg.NewCounterVec("hits_total", "Hits by path.", "path")
+	temp := reg.NewGauge("temperature", "Current temperature.")
+
+	hits.WithLabelValues("/b").Inc()
+	hits.WithLabelValues("/a").Add(2)
+	hits.WithLabelValues(`/q"uote`).Inc()
+	temp.Set(21.5)
+	temp.Dec()
+
+	assert.Equal(t, `# HELP hits_total Hits by path.
+# TYPE hits_total counter
+hits_total{path="/a"} 2
+hits_total{path="/b"} 1
+hits_total{path="/q\"uote"} 1
+# HELP temperature Current temperature.
+# TYPE temperature gauge
+temperature 20.5
+`, render(t, reg))
+}
+
+func TestHistogram(t *testing.T) {
+	reg := NewRegistry()
+	latency := reg.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	h := latency.WithLabelValues("/x")
+	h.Observe(0.05)
+	h.Observe(0.1) // bounds are inclusive
+	h.Observe(0.5)
+	h.Observe(3)
+
+	assert.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/x",le="0.1"} 2
+latency_seconds_bucket{route="/x",le="1"} 3
+latency_seconds_bucket{route="/x",le="+Inf"} 4
+latency_seconds_sum{route="/x"} 3.65
+latency_seconds_count{route="/x"} 4
+`, render(t, reg))
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	reg := NewRegistry()
+	counter := reg.NewCounterVec("events_total", "Events.", "kind")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				counter.WithLabelValues("tick").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, float64(5000), counter.WithLabelValues("tick").Value())
+}
+
+func TestRegistrationErrors(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("dup_total", "")
+	assert.Panics(t, func() { reg.NewGauge("dup_total", "") })
+
+	vec := reg.NewCounterVec("labelled_total", "", "a", "b")
+	assert.Panics(t, func() { vec.WithLabelValues("only-one") })
+}
+
+func TestServerMetrics(t *testing.T) {
+	m := NewServerMetrics(NewRegistry())
+	done := m.InFlight()
+	m.RequestFinished("GET", "/users/{id}", response.StatusOK, 20*time.Millisecond)
+	m.RequestFinished("GET", "", response.StatusNotFound, time.Millisecond)
+	m.ParseError()
+
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	m.ServeHTTP(&request.Request{Headers: headers.NewHeaders()}, w)
+	require.NoError(t, w.Flush())
+	done()
+
+	body := buf.String()
+	assert.Contains(t, body, "content-type: text/plain; version=0.0.4; charset=utf-8\r\n")
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/users/{id}",status="200"} 1`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, body, "http_requests_in_flight 1\n")
+	assert.Contains(t, body, "http_request_parse_errors_total 1\n")
+	assert.True(t, strings.Contains(body, `http_request_duration_seconds_bucket{method="GET",route="/users/{id}",le="0.025"} 1`))
+
+	// A nil *ServerMetrics is a valid, silent recorder
+	var disabled *ServerMetrics
+	disabled.InFlight()()
+	disabled.RequestFinished("GET", "/", response.StatusOK, 0)
+	disabled.ParseError()
+}
+
+func TestProxyMetrics(t *testing.T) {
+	reg := NewRegistry()
+	m := NewProxyMetrics(reg)
+	done := m.UpstreamRequest("api", "10.0.0.1:80")
+	assert.Contains(t, render(t, reg), `proxy_upstream_requests_in_flight{pool="api",backend="10.0.0.1:80"} 1`)
+	done(200)
+	m.UpstreamRequest("api", "10.0.0.2:80")(0)
+	m.Retry("api")
+	m.Ejected("api", "10.0.0.2:80")
+	m.SetHealthy("api", "10.0.0.2:80", false)
+	m.HealthCheck("api", "10.0.0.1:80", true)
+
+	body := render(t, reg)
+	assert.Contains(t, body, `proxy_upstream_requests_in_flight{pool="api",backend="10.0.0.1:80"} 0`)
+	assert.Contains(t, body, `proxy_upstream_requests_total{pool="api",backend="10.0.0.1:80",status="200"} 1`)
+	assert.Contains(t, body, `proxy_upstream_requests_total{pool="api",backend="10.0.0.2:80",status="error"} 1`)
+	assert.Contains(t, body, `proxy_upstream_retries_total{pool="api"} 1`)
+	assert.Contains(t, body, `proxy_upstream_ejections_total{pool="api",backend="10.0.0.2:80"} 1`)
+	assert.Contains(t, body, `proxy_upstream_healthy{pool="api",backend="10.0.0.2:80"} 0`)
+	assert.Contains(t, body, `proxy_upstream_health_checks_total{pool="api",backend="10.0.0.1:80",result="ok"} 1`)
+
+	// A nil *ProxyMetrics records nothing, like a nil *ServerMetrics
+	var disabled *ProxyMetrics
+	disabled.UpstreamRequest("api", "b")(200)
+	disabled.Retry("api")
+	disabled.Ejected("api", "b")
+	disabled.SetHealthy("api", "b", true)
+	disabled.HealthCheck("api", "b", false)
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+)
+
+// ProxyMetrics is the set of metrics an upstream pool keeps up to date.
+// Like ServerMetrics, all methods are safe to call on a nil *ProxyMetrics.
+type ProxyMetrics struct {
+	requests     *CounterVec
+	duration     *HistogramVec
+	inFlight     *GaugeVec
+	healthy      *GaugeVec
+	ejections    *CounterVec
+	retries      *CounterVec
+	healthChecks *CounterVec
+}
+
+// NewProxyMetrics registers the proxy metrics on reg, usually the server's registry
+func NewProxyMetrics(reg *Registry) *ProxyMetrics {
+	return &ProxyMetrics{
+		requests:     reg.NewCounterVec("proxy_upstream_requests_total", "Requests sent upstream, by pool, backend and status code (\"error\" when there was no response).", "pool", "backend", "status"),
+		duration:     reg.NewHistogramVec("proxy_upstream_request_duration_seconds", "Time from sending a request upstream to relaying the last byte of its response.", nil, "pool", "backend"),
+		inFlight:     reg.NewGaugeVec("proxy_upstream_requests_in_flight", "Requests currently sent to a backend.", "pool", "backend"),
+		healthy:      reg.NewGaugeVec("proxy_upstream_healthy", "1 if the backend is taking requests, 0 if it failed its health check or was ejected.", "pool", "backend"),
+		ejections:    reg.NewCounterVec("proxy_upstream_ejections_total", "Times a backend was taken out after consecutive failures.", "pool", "backend"),
+		retries:      reg.NewCounterVec("proxy_upstream_retries_total", "Requests retried on another backend.", "pool"),
+		healthChecks: reg.NewCounterVec("proxy_upstream_health_checks_total", "Active health checks, by result (ok or fail).", "pool", "backend", "result"),
+	}
+}
+
+// UpstreamRequest counts a request as sent to backend until the returned function is
+// called with the response status, or 0 if the backend never answered
+func (m *ProxyMetrics) UpstreamRequest(pool, backend string) (done func(status int)) {
+	if m == nil {
+		return func(int) {}
+	}
+	start := time.Now()
+	inFlight := m.inFlight.WithLabelValues(pool, backend)
+	inFlight.Inc()
+	return func(status int) {
+		inFlight.Dec()
+		label := "error"
+		if status > 0 {
+			label = strconv.Itoa(status)
+		}
+		m.requests.WithLabelValues(pool, backend, label).Inc()
+		m.duration.WithLabelValues(pool, backend).Observe(time.Since(start).Seconds())
+	}
+}
+
+// SetHealthy records whether backend is taking requests
+func (m *ProxyMetrics) SetHealthy(pool, backend string, healthy bool) {
+	if m == nil {
+		return
+	}
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	m.healthy.WithLabelValues(pool, backend).Set(v)
+}
+
+// Ejected records a backend taken out after too many failures in a row
+func (m *ProxyMetrics) Ejected(pool, backend string) {
+	if m == nil {
+		return
+	}
+	m.ejections.WithLabelValues(pool, backend).Inc()
+}
+
+// Retry records a request sent to another backend after the first one failed
+func (m *ProxyMetrics) Retry(pool string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(pool).Inc()
+}
+
+// HealthCheck records the result of one active health check
+func (m *ProxyMetrics) HealthCheck(pool, backend string, ok bool) {
+	if m == nil {
+		return
+	}
+	result := "fail"
+	if ok {
+		result = "ok"
+	}
+	m.healthChecks.WithLabelValues(pool, backend, result).Inc()
+}
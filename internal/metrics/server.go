@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// ServerMetrics is the set of metrics the HTTP server keeps up to date.
+// All methods are safe to call on a nil *ServerMetrics, which records nothing,
+// so the server doesn't have to check whether metrics are enabled.
+type ServerMetrics struct {
+	Registry *Registry
+
+	requests        *CounterVec
+	duration        *HistogramVec
+	inFlight        *Gauge
+	openConnections *Gauge
+	bytesReceived   *Counter
+	bytesSent       *Counter
+	parseErrors     *Counter
+}
+
+// NewServerMetrics registers the server metrics on reg
+func NewServerMetrics(reg *Registry) *ServerMetrics {
+	return &ServerMetrics{
+		Registry:        reg,
+		requests:        reg.NewCounterVec("http_requests_total", "Requests handled, by method, route pattern and status code.", "method", "route", "status"),
+		duration:        reg.NewHistogramVec("http_request_duration_seconds", "Time from accepting the connection to finishing the response.", nil, "method", "route"),
+		inFlight:        reg.NewGauge("http_requests_in_flight", "Requests currently being handled."),
+		openConnections: reg.NewGauge("http_open_connections", "Client connections currently open."),
+		bytesReceived:   reg.NewCounter("http_received_bytes_total", "Bytes read from client connections."),
+		bytesSent:       reg.NewCounter("http_sent_bytes_total", "Bytes written to client connections."),
+		parseErrors:     reg.NewCounter("http_request_parse_errors_total", "Requests that could not be parsed."),
+	}
+}
+
+// ConnOpened records a newly accepted connection and returns it wrapped so the bytes
+// going through it are counted. Call ConnClosed when it is closed.
+func (m *ServerMetrics) ConnOpened(conn net.Conn) net.Conn {
+	if m == nil {
+		return conn
+	}
+	m.openConnections.Inc()
+	return &countingConn{Conn: conn, metrics: m}
+}
+
+// ConnClosed records that a connection has been closed
+func (m *ServerMetrics) ConnClosed() {
+	if m == nil {
+		return
+	}
+	m.openConnections.Dec()
+}
+
+// ParseError records a request that could not be parsed
+func (m *ServerMetrics) ParseError() {
+	if m == nil {
+		return
+	}
+	m.parseErrors.Inc()
+}
+
+// InFlight counts a request as being handled until the returned function is called
+func (m *ServerMetrics) InFlight() (done func()) {
+	if m == nil {
+		return func() {}
+	}
+	m.inFlight.Inc()
+	return m.inFlight.Dec
+}
+
+// RequestFinished records a completed request. The route is the pattern the router
+// matched, which keeps the number of series bounded unlike the raw path.
+func (m *ServerMetrics) RequestFinished(method, route string, status response.StatusCode, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	if route == "" {
+		route = "unmatched"
+	}
+	m.requests.WithLabelValues(method, route, strconv.Itoa(int(status))).Inc()
+	m.duration.WithLabelValues(method, route).Observe(elapsed.Seconds())
+}
+
+// ServeHTTP writes the registry in the Prometheus text format
+func (m *ServerMetrics) ServeHTTP(req *request.Request, w *response.Writer) {
+	var body bytes.Buffer
+	if err := m.Registry.WritePrometheus(&body); err != nil {
+		w.WriteStatusLine(response.StatusServerError)
+		w.WriteHeaders(headers.NewHeaders())
+		return
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	w.WriteBody(body.Bytes())
+}
+
+// countingConn adds the bytes read and written on a connection to the server totals
+type countingConn struct {
+	net.Conn
+	metrics *ServerMetrics
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.metrics.bytesReceived.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.metrics.bytesSent.Add(float64(n))
+	return n, err
+}
+
+// NetConn returns the wrapped connection, mirroring tls.Conn
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
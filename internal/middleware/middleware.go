@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// Middleware wraps a handler to run code before and/or after it
+type Middleware func(next server.Handler) server.Handler
+
+// Chain combines middlewares into one. The first middleware is the outermost,
+// so Chain(a, b)(h) runs a, then b, then h.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next server.Handler) server.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// Apply wraps handler with the middlewares, the first one being the outermost
+func Apply(handler server.Handler, middlewares ...Middleware) server.Handler {
+	return Chain(middlewares...)(handler)
+}
+
+// Logger logs one line per request with the final status code, body size and duration.
+// A nil logger uses the standard logger.
+func Logger(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(req *request.Request, w *response.Writer) {
+			start := time.Now()
+			next(req, w)
+			logger.Printf("%s %s -> %d (%d bytes) in %s",
+				req.RequestLine.Method,
+				req.RequestLine.RequestTarget,
+				w.StatusCode(),
+				w.BytesWritten(),
+				time.Since(start),
+			)
+		}
+	}
+}
+
+// Recoverer turns a panic in the wrapped handler into a 500 response.
+// If part of the response has already gone out the panic is only logged,
+// since there is no way to take those bytes back. server.ErrAbortHandler is
+// passed on to the server, which cuts the connection.
+//
+// The server recovers panics itself and reports them to Server.OnPanic, which
+// never sees the ones Recoverer catches, so it is for handlers run some other way.
+func Recoverer() Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(req *request.Request, w *response.Writer) {
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				if rec == server.ErrAbortHandler {
+					panic(rec)
+				}
+
+				log.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, rec, debug.Stack())
+
+				// Reset drops the headers set so far, including the Connection the server
+				// starts every response with
+				connection, hasConnection := w.Header()["connection"]
+				if err := w.Reset(); err != nil {
+					log.Printf("Cannot send error response: %v", err)
+					return
+				}
+				w.WriteStatusLine(response.StatusServerError)
+				h := headers.NewHeaders()
+				h.Set("Content-Type", "text/plain; charset=utf-8")
+				if hasConnection {
+					h.Set("Connection", connection)
+				}
+				w.WriteHeaders(h)
+				w.WriteBody([]byte("500 Internal Server Error\n"))
+			}()
+
+			next(req, w)
+		}
+	}
+}
+
+// DefaultHeaders sets the given headers on every response unless the handler sets them itself
+func DefaultHeaders(defaults headers.Headers) Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(req *request.Request, w *response.Writer) {
+			for k, v := range defaults {
+				w.Header().Set(k, v)
+			}
+			next(req, w)
+		}
+	}
+}
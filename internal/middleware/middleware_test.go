@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+func newRequest(method, target string) *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+}
+
+// run calls handler with a fresh writer and returns the flushed response
+func run(t *testing.T, handler server.Handler) (*response.Writer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	handler(newRequest("GET", "/thing"), w)
+	require.NoError(t, w.Flush())
+	return w, buf.String()
+}
+
+func ok(body string) server.Handler {
+	return func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(req *request.Request, w *response.Writer) {
+				calls = append(calls, name+" before")
+				next(req, w)
+				calls = append(calls, name+" after")
+			}
+		}
+	}
+
+	handler := Apply(ok("hi"), record("a"), record("b"))
+	run(t, handler)
+
+	assert.Equal(t, []string{"a before", "b before", "b after", "a after"}, calls)
+}
+
+func TestLoggerSeesStatusAndBytes(t *testing.T) {
+	var out bytes.Buffer
+	handler := Apply(ok("hello"), Logger(log.New(&out, "", 0)))
+
+	w, _ := run(t, handler)
+
+	assert.Equal(t, response.StatusOK, w.StatusCode())
+	assert.Equal(t, int64(5), w.BytesWritten())
+	assert.True(t, strings.HasPrefix(out.String(), "GET /thing -> 200 (5 bytes) in "))
+}
+
+func TestRecoverer(t *testing.T) {
+	t.Run("Replaces the response with a 500", func(t *testing.T) {
+		handler := Apply(func(req *request.Request, w *response.Writer) {
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(headers.NewHeaders())
+			panic("boom")
+		}, Recoverer())
+
+		w, resp := run(t, handler)
+		assert.Equal(t, response.StatusServerError, w.StatusCode())
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 500 Internal Server Error\r\n"))
+	})
+
+	t.Run("Keeps the Connection header", func(t *testing.T) {
+		handler := Apply(func(req *request.Request, w *response.Writer) {
+			panic("boom")
+		}, Recoverer())
+
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		w.Header().Set("Connection", "close")
+		handler(newRequest("GET", "/thing"), w)
+		require.NoError(t, w.Flush())
+		assert.Contains(t, buf.String(), "\r\nconnection: close\r\n")
+	})
+
+	t.Run("Passes through when nothing panics", func(t *testing.T) {
+		_, resp := run(t, Apply(ok("fine"), Recoverer()))
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	})
+
+	t.Run("Leaves ErrAbortHandler to the server", func(t *testing.T) {
+		handler := Apply(func(req *request.Request, w *response.Writer) {
+			panic(server.ErrAbortHandler)
+		}, Recoverer())
+
+		assert.PanicsWithValue(t, server.ErrAbortHandler, func() { run(t, handler) })
+	})
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	defaults := headers.NewHeaders()
+	defaults.Set("Connection", "close")
+	defaults.Set("Content-Type", "text/plain")
+
+	handler := Apply(func(req *request.Request, w *response.Writer) {
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/html")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+	}, DefaultHeaders(defaults))
+
+	_, resp := run(t, handler)
+	assert.Contains(t, resp, "connection: close\r\n")
+	assert.Contains(t, resp, "content-type: text/html\r\n")
+	assert.NotContains(t, resp, "content-type: text/plain\r\n")
+}
@@ -0,0 +1,208 @@
+package pcap
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// Assembler puts the segments of each TCP connection back in order. Retransmitted
+// data is dropped, overlapping segments are trimmed and segments that arrive early
+// wait for the ones before them.
+type Assembler struct {
+	conns map[connKey]*Conn
+	all   []*Conn
+}
+
+// Conn is one TCP connection in a capture
+type Conn struct {
+	Client *Stream // what the side that sent the SYN wrote
+	Server *Stream
+	Start  time.Time
+}
+
+// Stream is what one side of a connection wrote, in order
+type Stream struct {
+	Src, Dst netip.AddrPort
+	Data     []byte
+	Gaps     int  // holes skipped by Flush, because the capture missed segments
+	FIN      bool // the side closed its end
+	RST      bool
+
+	started bool
+	next    uint32 // sequence number of the byte after Data
+	pending []pending
+	marks   []timeMark
+}
+
+// pending is a segment that came before the data preceding it
+type pending struct {
+	seq     uint32
+	payload []byte
+	t       time.Time
+}
+
+// timeMark says when the data from offset on was captured
+type timeMark struct {
+	offset int
+	t      time.Time
+}
+
+// connKey has the lower address first, so both directions map to the same connection
+type connKey struct {
+	a, b netip.AddrPort
+}
+
+func keyOf(src, dst netip.AddrPort) connKey {
+	if c := src.Addr().Compare(dst.Addr()); c > 0 || (c == 0 && src.Port() > dst.Port()) {
+		src, dst = dst, src
+	}
+	return connKey{src, dst}
+}
+
+// NewAssembler returns an Assembler with no connections
+func NewAssembler() *Assembler {
+	return &Assembler{conns: make(map[connKey]*Conn)}
+}
+
+// Add adds a segment captured at t
+func (a *Assembler) Add(seg *Segment, t time.Time) {
+	key := keyOf(seg.Src, seg.Dst)
+	c := a.conns[key]
+	// The same ports can be used again once a connection is over
+	if c != nil && seg.SYN && !seg.ACK && c.closed() {
+		c = nil
+	}
+	if c == nil {
+		c = newConn(seg, t)
+		a.conns[key] = c
+		a.all = append(a.all, c)
+	}
+	if seg.Src == c.Client.Src {
+		c.Client.add(seg, t)
+	} else {
+		c.Server.add(seg, t)
+	}
+}
+
+// Flush hands out the connections, in the order they were first seen, after
+// skipping over any holes left in their streams
+func (a *Assembler) Flush() []*Conn {
+	for _, c := range a.all {
+		c.Client.flush()
+		c.Server.flush()
+	}
+	all := a.all
+	a.conns = make(map[connKey]*Conn)
+	a.all = nil
+	return all
+}
+
+// newConn works out which side is the client: the one that sent the SYN, or for a
+// connection whose start wasn't captured, the one with the higher port, as clients
+// usually have ephemeral ports
+func newConn(seg *Segment, t time.Time) *Conn {
+	client, server := seg.Src, seg.Dst
+	switch {
+	case seg.SYN && !seg.ACK:
+	case seg.SYN:
+		client, server = server, client
+	case client.Port() < server.Port():
+		client, server = server, client
+	}
+	return &Conn{
+		Client: &Stream{Src: client, Dst: server},
+		Server: &Stream{Src: server, Dst: client},
+		Start:  t,
+	}
+}
+
+func (c *Conn) closed() bool {
+	return c.Client.RST || c.Server.RST || (c.Client.FIN && c.Server.FIN)
+}
+
+// TimeAt returns when the byte at offset in Data was captured
+func (s *Stream) TimeAt(offset int) time.Time {
+	i := sort.Search(len(s.marks), func(i int) bool { return s.marks[i].offset > offset })
+	if i == 0 {
+		if len(s.marks) == 0 {
+			return time.Time{}
+		}
+		return s.marks[0].t
+	}
+	return s.marks[i-1].t
+}
+
+func (s *Stream) add(seg *Segment, t time.Time) {
+	seq := seg.Seq
+	if seg.SYN {
+		// The SYN takes up a sequence number of its own
+		seq++
+		if !s.started {
+			s.started, s.next = true, seq
+		}
+	}
+	if !s.started && len(seg.Payload) > 0 {
+		// The capture started in the middle of the connection
+		s.started, s.next = true, seq
+	}
+	s.FIN = s.FIN || seg.FIN
+	s.RST = s.RST || seg.RST
+	if len(seg.Payload) == 0 || !s.started {
+		return
+	}
+
+	// Compared as a signed difference, so sequence numbers can wrap around
+	if int32(seq-s.next) > 0 {
+		s.pending = append(s.pending, pending{seq, append([]byte(nil), seg.Payload...), t})
+		return
+	}
+	s.write(seq, seg.Payload, t)
+	s.drain()
+}
+
+// write appends what of payload, starting at seq, comes after the data already there
+func (s *Stream) write(seq uint32, payload []byte, t time.Time) {
+	behind := int(int32(s.next - seq))
+	if behind >= len(payload) {
+		return // a retransmission of data we have
+	}
+	payload = payload[max(behind, 0):]
+	if n := len(s.marks); n == 0 || !s.marks[n-1].t.Equal(t) {
+		s.marks = append(s.marks, timeMark{len(s.Data), t})
+	}
+	s.Data = append(s.Data, payload...)
+	s.next += uint32(len(payload))
+}
+
+// drain writes the pending segments that no longer have anything missing before them
+func (s *Stream) drain() {
+	for progress := true; progress; {
+		progress = false
+		kept := s.pending[:0]
+		for _, p := range s.pending {
+			if int32(p.seq-s.next) <= 0 {
+				s.write(p.seq, p.payload, p.t)
+				progress = true
+			} else {
+				kept = append(kept, p)
+			}
+		}
+		s.pending = kept
+	}
+}
+
+// flush gives up waiting for missing segments, and goes on from the earliest pending one
+func (s *Stream) flush() {
+	for len(s.pending) > 0 {
+		first := 0
+		for i, p := range s.pending {
+			if int32(p.seq-s.pending[first].seq) < 0 {
+				first = i
+			}
+		}
+		s.Gaps++
+		s.next = s.pending[first].seq
+		s.drain()
+	}
+}
@@ -0,0 +1,100 @@
+package pcap
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagRST = 0x04
+	flagACK = 0x10
+)
+
+// segment builds a segment of the test connection, sent by from
+func segment(from netip.AddrPort, seq uint32, flags byte, payload string) *Segment {
+	src, dst := client, server
+	if from == server {
+		src, dst = server, client
+	}
+	return &Segment{
+		Src: src, Dst: dst, Seq: seq,
+		SYN: flags&flagSYN != 0, ACK: flags&flagACK != 0, FIN: flags&flagFIN != 0, RST: flags&flagRST != 0,
+		Payload: []byte(payload),
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	t.Run("Out of order and retransmitted", func(t *testing.T) {
+		a := NewAssembler()
+		// The server's SYN-ACK is captured first, and the client still counts as the client
+		a.Add(segment(server, 500, flagSYN|flagACK, ""), at(0))
+		a.Add(segment(client, 100, flagSYN, ""), at(0))
+		a.Add(segment(client, 101, flagACK, "GET / "), at(1))
+		a.Add(segment(client, 115, flagACK, "\r\n\r\n"), at(3))   // early
+		a.Add(segment(client, 101, flagACK, "GET / "), at(4))     // retransmitted
+		a.Add(segment(client, 105, flagACK, "/ HTTP/1.1"), at(5)) // overlaps
+		a.Add(segment(server, 501, flagACK|flagFIN, "HTTP/1.1 200 OK\r\n\r\n"), at(6))
+
+		conns := a.Flush()
+		require.Len(t, conns, 1)
+		c := conns[0]
+		assert.Equal(t, client, c.Client.Src)
+		assert.Equal(t, at(0), c.Start)
+		assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", string(c.Client.Data))
+		assert.Equal(t, 0, c.Client.Gaps)
+		assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\n", string(c.Server.Data))
+		assert.True(t, c.Server.FIN)
+
+		assert.Equal(t, at(1), c.Client.TimeAt(0))
+		assert.Equal(t, at(5), c.Client.TimeAt(6))
+		assert.Equal(t, at(3), c.Client.TimeAt(14))
+		assert.Equal(t, at(6), c.Server.TimeAt(3))
+	})
+
+	t.Run("Sequence numbers wrap", func(t *testing.T) {
+		a := NewAssembler()
+		a.Add(segment(client, 0xfffffffd, flagSYN, ""), at(0))
+		a.Add(segment(client, 0x00000000, flagACK, "llo"), at(2))
+		a.Add(segment(client, 0xfffffffe, flagACK, "he"), at(1))
+		conns := a.Flush()
+		require.Len(t, conns, 1)
+		assert.Equal(t, "hello", string(conns[0].Client.Data))
+		assert.Equal(t, 0, conns[0].Client.Gaps)
+	})
+
+	t.Run("Missing segment", func(t *testing.T) {
+		a := NewAssembler()
+		// Picked up in the middle, so the higher port is taken for the client
+		a.Add(segment(server, 2000, flagACK, "abc"), at(0))
+		a.Add(segment(server, 2010, flagACK, "xyz"), at(1))
+		a.Add(segment(server, 2006, flagACK, "ghij"), at(2))
+		conns := a.Flush()
+		require.Len(t, conns, 1)
+		assert.Equal(t, client, conns[0].Client.Src)
+		assert.Equal(t, "abcghijxyz", string(conns[0].Server.Data))
+		assert.Equal(t, 1, conns[0].Server.Gaps)
+	})
+
+	t.Run("Ports reused", func(t *testing.T) {
+		a := NewAssembler()
+		a.Add(segment(client, 10, flagSYN, ""), at(0))
+		a.Add(segment(client, 11, flagACK, "one"), at(1))
+		a.Add(segment(server, 50, flagRST, ""), at(2))
+		a.Add(segment(client, 90, flagSYN, ""), at(3))
+		a.Add(segment(client, 91, flagACK, "two"), at(4))
+		conns := a.Flush()
+		require.Len(t, conns, 2)
+		assert.Equal(t, "one", string(conns[0].Client.Data))
+		assert.Equal(t, "two", string(conns[1].Client.Data))
+		assert.Equal(t, at(3), conns[1].Start)
+	})
+}
@@ -0,0 +1,183 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// Segment is a TCP segment taken from a captured packet
+type Segment struct {
+	Src, Dst netip.AddrPort
+	Seq      uint32
+	SYN      bool
+	ACK      bool
+	FIN      bool
+	RST      bool
+	Payload  []byte
+}
+
+// ErrNotTCP is returned by DecodeTCP for packets that don't carry TCP, or only part of it,
+// like IP fragments after the first. Captures are full of those, so it isn't a failure.
+var ErrNotTCP = errors.New("pcap: not a TCP segment")
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	protoTCP = 6
+)
+
+// DecodeTCP takes the link, IP and TCP headers off a packet. The payload is cut to the
+// length the IP header gives, so Ethernet padding doesn't end up in the stream.
+func DecodeTCP(p *Packet) (*Segment, error) {
+	data, etherType, err := linkLayer(p.LinkType, p.Data)
+	if err != nil {
+		return nil, err
+	}
+	// A header that doesn't say which IP version follows: look at the packet
+	if etherType == 0 && len(data) > 0 {
+		switch data[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	}
+
+	var src, dst netip.Addr
+	var payload []byte
+	switch etherType {
+	case etherTypeIPv4:
+		src, dst, payload, err = ipv4(data)
+	case etherTypeIPv6:
+		src, dst, payload, err = ipv6(data)
+	default:
+		return nil, ErrNotTCP
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) < 20 {
+		return nil, fmt.Errorf("%w: short TCP header", ErrFormat)
+	}
+	offset := int(payload[12]>>4) * 4
+	if offset < 20 || offset > len(payload) {
+		return nil, fmt.Errorf("%w: TCP data offset %d", ErrFormat, offset)
+	}
+	flags := payload[13]
+	return &Segment{
+		Src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload[0:])),
+		Dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(payload[2:])),
+		Seq:     binary.BigEndian.Uint32(payload[4:]),
+		FIN:     flags&0x01 != 0,
+		SYN:     flags&0x02 != 0,
+		RST:     flags&0x04 != 0,
+		ACK:     flags&0x10 != 0,
+		Payload: payload[offset:],
+	}, nil
+}
+
+// linkLayer returns what follows the link header and its EtherType, 0 if the header doesn't say
+func linkLayer(linkType LinkType, data []byte) ([]byte, uint16, error) {
+	switch linkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil, 0, fmt.Errorf("%w: short Ethernet header", ErrFormat)
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		// Skip 802.1Q and 802.1ad VLAN tags
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(data) < 4 {
+				return nil, 0, fmt.Errorf("%w: short VLAN tag", ErrFormat)
+			}
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+		return data, etherType, nil
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, 0, fmt.Errorf("%w: short Linux cooked header", ErrFormat)
+		}
+		return data[16:], binary.BigEndian.Uint16(data[14:]), nil
+	case LinkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return nil, 0, fmt.Errorf("%w: short Linux cooked v2 header", ErrFormat)
+		}
+		return data[20:], binary.BigEndian.Uint16(data[0:]), nil
+	case LinkTypeNull, LinkTypeLoop:
+		// The address family's value differs between systems; the IP version tells us enough
+		if len(data) < 4 {
+			return nil, 0, fmt.Errorf("%w: short loopback header", ErrFormat)
+		}
+		return data[4:], 0, nil
+	case LinkTypeRaw, 12, 14:
+		// 12 and 14 are raw IP on some BSDs
+		return data, 0, nil
+	}
+	return nil, 0, fmt.Errorf("pcap: unsupported link type %d", linkType)
+}
+
+func ipv4(data []byte) (src, dst netip.Addr, payload []byte, err error) {
+	if len(data) < 20 {
+		return src, dst, nil, fmt.Errorf("%w: short IPv4 header", ErrFormat)
+	}
+	headerLen := int(data[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(data[2:]))
+	if headerLen < 20 || totalLen < headerLen {
+		return src, dst, nil, fmt.Errorf("%w: IPv4 lengths %d and %d", ErrFormat, headerLen, totalLen)
+	}
+	if data[9] != protoTCP {
+		return src, dst, nil, ErrNotTCP
+	}
+	// Only the first fragment has the TCP header, and reassembling IP isn't worth it
+	// for TCP, which avoids fragmentation
+	fragment := binary.BigEndian.Uint16(data[6:])
+	if fragment&0x1fff != 0 || fragment&0x2000 != 0 {
+		return src, dst, nil, ErrNotTCP
+	}
+	// A capture cut short by the snap length has less than the header says
+	end := min(totalLen, len(data))
+	if headerLen > end {
+		return src, dst, nil, fmt.Errorf("%w: short IPv4 header", ErrFormat)
+	}
+	src = netip.AddrFrom4([4]byte(data[12:16]))
+	dst = netip.AddrFrom4([4]byte(data[16:20]))
+	return src, dst, data[headerLen:end], nil
+}
+
+func ipv6(data []byte) (src, dst netip.Addr, payload []byte, err error) {
+	if len(data) < 40 {
+		return src, dst, nil, fmt.Errorf("%w: short IPv6 header", ErrFormat)
+	}
+	end := min(40+int(binary.BigEndian.Uint16(data[4:])), len(data))
+	src = netip.AddrFrom16([16]byte(data[8:24]))
+	dst = netip.AddrFrom16([16]byte(data[24:40]))
+	next := data[6]
+	payload = data[40:end]
+
+	// Skip the extension headers that may come before TCP
+	for {
+		switch next {
+		case protoTCP:
+			return src, dst, payload, nil
+		case 0, 43, 60: // hop-by-hop options, routing, destination options
+			if len(payload) < 8 {
+				return src, dst, nil, fmt.Errorf("%w: short IPv6 extension header", ErrFormat)
+			}
+			length := (int(payload[1]) + 1) * 8
+			if length > len(payload) {
+				return src, dst, nil, fmt.Errorf("%w: short IPv6 extension header", ErrFormat)
+			}
+			next, payload = payload[0], payload[length:]
+		default:
+			// Fragments (44) and anything else
+			return src, dst, nil, ErrNotTCP
+		}
+	}
+}
@@ -0,0 +1,325 @@
+// Package pcap reads packet captures, as written by tcpdump or Wireshark, without
+// libpcap: classic pcap files and pcapng. DecodeTCP takes the TCP segment out of a
+// captured packet, and Assembler puts the segments of each connection back in order.
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// LinkType says what the captured data of a packet starts with, see
+// https://www.tcpdump.org/linktypes.html
+type LinkType uint32
+
+const (
+	LinkTypeNull      LinkType = 0   // BSD loopback, 4 byte address family in host order
+	LinkTypeEthernet  LinkType = 1   // Ethernet II, possibly with 802.1Q tags
+	LinkTypeRaw       LinkType = 101 // IPv4 or IPv6 without a link header
+	LinkTypeLoop      LinkType = 108 // OpenBSD loopback, address family in network order
+	LinkTypeLinuxSLL  LinkType = 113 // Linux "cooked" capture, as for tcpdump -i any
+	LinkTypeLinuxSLL2 LinkType = 276 // Linux cooked capture v2
+)
+
+// Packet is one captured packet
+type Packet struct {
+	Time     time.Time
+	LinkType LinkType
+	Data     []byte // the captured bytes, possibly cut short by the snapshot length
+	Length   int    // how long the packet was on the wire
+}
+
+// ErrFormat is returned for data that isn't a pcap or pcapng file, or is corrupt
+var ErrFormat = errors.New("pcap: invalid capture file")
+
+const (
+	magicMicro = 0xa1b2c3d4 // classic pcap, microsecond timestamps
+	magicNano  = 0xa1b23c4d // classic pcap, nanosecond timestamps
+
+	blockSectionHeader   = 0x0a0d0d0a
+	blockInterface       = 0x00000001
+	blockObsoletePacket  = 0x00000002
+	blockSimplePacket    = 0x00000003
+	blockEnhancedPacket  = 0x00000006
+	byteOrderMagic       = 0x1a2b3c4d
+	optionEnd            = 0
+	optionIfTimestampRes = 9
+	optionIfTimestampOff = 14
+
+	// maxBlock guards against allocating whatever a corrupt length field says
+	maxBlock = 64 << 20
+)
+
+// Reader reads packets from a capture file
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+
+	// classic pcap
+	linkType LinkType
+	nano     bool
+
+	// pcapng: the interfaces of the current section, in the order they were described
+	interfaces []iface
+}
+
+// iface is a pcapng interface description
+type iface struct {
+	linkType LinkType
+	snapLen  uint32
+	units    uint64 // timestamp units per second
+	offset   int64  // seconds added to every timestamp
+}
+
+// NewReader reads the file header from r and tells pcap from pcapng by it
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReaderSize(r, 64<<10)}
+	head, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+	if binary.LittleEndian.Uint32(head) == blockSectionHeader {
+		pr.ng = true
+		if err := pr.readSectionHeader(); err != nil {
+			return nil, err
+		}
+		return pr, nil
+	}
+	return pr, pr.readFileHeader()
+}
+
+// LinkType is the link type of a classic pcap file; pcapng files give one per packet
+func (r *Reader) LinkType() LinkType {
+	return r.linkType
+}
+
+func (r *Reader) readFileHeader() error {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return fmt.Errorf("%w: short file header", ErrFormat)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(hdr[:]) == magicMicro:
+		r.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[:]) == magicMicro:
+		r.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[:]) == magicNano:
+		r.order, r.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[:]) == magicNano:
+		r.order, r.nano = binary.BigEndian, true
+	default:
+		return fmt.Errorf("%w: unknown magic number %#x", ErrFormat, hdr[:4])
+	}
+	// The top bits of the link type field can carry FCS information
+	r.linkType = LinkType(r.order.Uint32(hdr[20:]) & 0x0fffffff)
+	return nil
+}
+
+// Next returns the next packet, or io.EOF at the end of the file
+func (r *Reader) Next() (*Packet, error) {
+	if r.ng {
+		return r.nextBlock()
+	}
+
+	var hdr [16]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("%w: short packet header", ErrFormat)
+	}
+	sec := r.order.Uint32(hdr[0:])
+	frac := r.order.Uint32(hdr[4:])
+	capLen := r.order.Uint32(hdr[8:])
+	origLen := r.order.Uint32(hdr[12:])
+	if capLen > maxBlock {
+		return nil, fmt.Errorf("%w: packet of %d bytes", ErrFormat, capLen)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, fmt.Errorf("%w: packet cut short", ErrFormat)
+	}
+	nsec := int64(frac) * 1000
+	if r.nano {
+		nsec = int64(frac)
+	}
+	return &Packet{
+		Time:     time.Unix(int64(sec), nsec).UTC(),
+		LinkType: r.linkType,
+		Data:     data,
+		Length:   int(origLen),
+	}, nil
+}
+
+// readBlock reads a whole pcapng block and returns its type and body
+func (r *Reader) readBlock() (uint32, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, fmt.Errorf("%w: short block header", ErrFormat)
+	}
+	blockType := r.order.Uint32(hdr[0:])
+	length := r.order.Uint32(hdr[4:])
+	if length < 12 || length%4 != 0 || length > maxBlock {
+		return 0, nil, fmt.Errorf("%w: block of %d bytes", ErrFormat, length)
+	}
+	block := make([]byte, length-8)
+	if _, err := io.ReadFull(r.r, block); err != nil {
+		return 0, nil, fmt.Errorf("%w: block cut short", ErrFormat)
+	}
+	// The length is repeated at the end of the block
+	if r.order.Uint32(block[len(block)-4:]) != length {
+		return 0, nil, fmt.Errorf("%w: block lengths don't match", ErrFormat)
+	}
+	return blockType, block[:len(block)-4], nil
+}
+
+// readSectionHeader starts a new pcapng section, whose byte order is given by the
+// byte-order magic that follows the block type and length
+func (r *Reader) readSectionHeader() error {
+	head, err := r.r.Peek(12)
+	if err != nil {
+		return fmt.Errorf("%w: short section header", ErrFormat)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(head[8:]) == byteOrderMagic:
+		r.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(head[8:]) == byteOrderMagic:
+		r.order = binary.BigEndian
+	default:
+		return fmt.Errorf("%w: unknown byte-order magic %#x", ErrFormat, head[8:12])
+	}
+	if _, _, err := r.readBlock(); err != nil {
+		return err
+	}
+	r.interfaces = r.interfaces[:0]
+	return nil
+}
+
+func (r *Reader) nextBlock() (*Packet, error) {
+	for {
+		head, err := r.r.Peek(4)
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrFormat, err)
+		}
+		// A section header can be read before its byte order is known
+		if binary.LittleEndian.Uint32(head) == blockSectionHeader {
+			if err := r.readSectionHeader(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		blockType, body, err := r.readBlock()
+		if err != nil {
+			return nil, err
+		}
+		switch blockType {
+		case blockInterface:
+			if err := r.addInterface(body); err != nil {
+				return nil, err
+			}
+		case blockEnhancedPacket:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("%w: short enhanced packet block", ErrFormat)
+			}
+			return r.packet(r.order.Uint32(body[0:]), body[4:12], body[12:16], body[16:20], body[20:])
+		case blockObsoletePacket:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("%w: short packet block", ErrFormat)
+			}
+			return r.packet(uint32(r.order.Uint16(body[0:])), body[4:12], body[12:16], body[16:20], body[20:])
+		case blockSimplePacket:
+			if len(body) < 4 || len(r.interfaces) == 0 {
+				return nil, fmt.Errorf("%w: simple packet block without an interface", ErrFormat)
+			}
+			// No timestamp and no captured length: the data is the packet up to the snap length
+			origLen := r.order.Uint32(body)
+			capLen := min(origLen, uint32(len(body)-4))
+			if snap := r.interfaces[0].snapLen; snap > 0 {
+				capLen = min(capLen, snap)
+			}
+			return &Packet{
+				LinkType: r.interfaces[0].linkType,
+				Data:     body[4 : 4+capLen],
+				Length:   int(origLen),
+			}, nil
+		}
+		// Name resolution, statistics and custom blocks are skipped
+	}
+}
+
+// packet builds a packet from the fields shared by enhanced and obsolete packet blocks
+func (r *Reader) packet(ifaceID uint32, ts, capField, origField, rest []byte) (*Packet, error) {
+	if int(ifaceID) >= len(r.interfaces) {
+		return nil, fmt.Errorf("%w: packet on undescribed interface %d", ErrFormat, ifaceID)
+	}
+	in := r.interfaces[ifaceID]
+	capLen := r.order.Uint32(capField)
+	if int(capLen) > len(rest) {
+		return nil, fmt.Errorf("%w: packet longer than its block", ErrFormat)
+	}
+	units := uint64(r.order.Uint32(ts[0:]))<<32 | uint64(r.order.Uint32(ts[4:]))
+	sec, rem := units/in.units, units%in.units
+	nsec := int64(rem * 1e9 / in.units)
+	if in.units > 1e9 {
+		// Finer than nanoseconds; rem * 1e9 could overflow
+		nsec = int64(float64(rem) / float64(in.units) * 1e9)
+	}
+	return &Packet{
+		Time:     time.Unix(int64(sec)+in.offset, nsec).UTC(),
+		LinkType: in.linkType,
+		Data:     rest[:capLen],
+		Length:   int(r.order.Uint32(origField)),
+	}, nil
+}
+
+func (r *Reader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("%w: short interface description", ErrFormat)
+	}
+	in := iface{
+		linkType: LinkType(r.order.Uint16(body[0:])),
+		snapLen:  r.order.Uint32(body[4:]),
+		units:    1e6,
+	}
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code := r.order.Uint16(opts[0:])
+		length := int(r.order.Uint16(opts[2:]))
+		if code == optionEnd || 4+length > len(opts) {
+			break
+		}
+		value := opts[4 : 4+length]
+		switch {
+		case code == optionIfTimestampRes && length == 1:
+			// The top bit picks a power of two instead of ten
+			exp := value[0] & 0x7f
+			if value[0]&0x80 != 0 && exp < 64 {
+				in.units = 1 << exp
+			} else if value[0]&0x80 == 0 && exp < 20 {
+				in.units = 1
+				for ; exp > 0; exp-- {
+					in.units *= 10
+				}
+			} else {
+				return fmt.Errorf("%w: timestamp resolution %#x", ErrFormat, value[0])
+			}
+		case code == optionIfTimestampOff && length == 8:
+			in.offset = int64(r.order.Uint64(value))
+		}
+		opts = opts[4+(length+3)&^3:]
+	}
+	r.interfaces = append(r.interfaces, in)
+	return nil
+}
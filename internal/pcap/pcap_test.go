@@ -0,0 +1,232 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	client = netip.MustParseAddrPort("10.0.0.1:51000")
+	server = netip.MustParseAddrPort("10.0.0.2:80")
+)
+
+// tcpPacket builds an Ethernet frame carrying an IPv4 TCP segment, with padding after
+// the IP packet as short frames have
+func tcpPacket(src, dst netip.AddrPort, seq uint32, flags byte, payload string) []byte {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	tcp = append(tcp, payload...)
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	ip[8] = 64
+	ip[9] = protoTCP
+	src4, dst4 := src.Addr().As4(), dst.Addr().As4()
+	copy(ip[12:], src4[:])
+	copy(ip[16:], dst4[:])
+	ip = append(ip, tcp...)
+
+	frame := make([]byte, 14, 14+len(ip)+6)
+	binary.BigEndian.PutUint16(frame[12:], etherTypeIPv4)
+	frame = append(frame, ip...)
+	return append(frame, make([]byte, 6)...)
+}
+
+func classicFile(order binary.ByteOrder, magic uint32, packets [][]byte, times []time.Time) []byte {
+	var buf bytes.Buffer
+	hdr := make([]byte, 24)
+	order.PutUint32(hdr[0:], magic)
+	order.PutUint16(hdr[4:], 2)
+	order.PutUint16(hdr[6:], 4)
+	order.PutUint32(hdr[16:], 65535)
+	order.PutUint32(hdr[20:], uint32(LinkTypeEthernet))
+	buf.Write(hdr)
+	for i, p := range packets {
+		rec := make([]byte, 16)
+		order.PutUint32(rec[0:], uint32(times[i].Unix()))
+		frac := times[i].Nanosecond() / 1000
+		if magic == magicNano {
+			frac = times[i].Nanosecond()
+		}
+		order.PutUint32(rec[4:], uint32(frac))
+		order.PutUint32(rec[8:], uint32(len(p)))
+		order.PutUint32(rec[12:], uint32(len(p)))
+		buf.Write(rec)
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+func ngBlock(blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	block := make([]byte, 8, len(body)+12)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], uint32(len(body)+12))
+	block = append(block, body...)
+	return binary.LittleEndian.AppendUint32(block, uint32(len(body)+12))
+}
+
+// ngFile writes a pcapng file with one interface whose timestamps are in units of 10^-tsresol
+// seconds, and a name resolution block that readers have to skip
+func ngFile(tsresol byte, packets [][]byte, times []time.Time) []byte {
+	shb := binary.LittleEndian.AppendUint32(nil, byteOrderMagic)
+	shb = append(shb, 1, 0, 0, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	out := ngBlock(blockSectionHeader, shb)
+
+	idb := []byte{byte(LinkTypeEthernet), 0, 0, 0}
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	idb = append(idb, optionIfTimestampRes, 0, 1, 0, tsresol, 0, 0, 0)
+	idb = append(idb, 0, 0, 0, 0)
+	out = append(out, ngBlock(blockInterface, idb)...)
+	out = append(out, ngBlock(4, []byte{0, 0, 0, 0})...)
+
+	units := uint64(1)
+	for i := byte(0); i < tsresol; i++ {
+		units *= 10
+	}
+	for i, p := range packets {
+		ts := uint64(times[i].Unix())*units + uint64(times[i].Nanosecond())*units/1e9
+		epb := binary.LittleEndian.AppendUint32(nil, 0)
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(len(p)))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(len(p)))
+		epb = append(epb, p...)
+		out = append(out, ngBlock(blockEnhancedPacket, epb)...)
+	}
+	return out
+}
+
+func readAll(t *testing.T, data []byte) []*Packet {
+	r, err := NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	var packets []*Packet
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			return packets
+		}
+		require.NoError(t, err)
+		packets = append(packets, p)
+	}
+}
+
+func TestReader(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	packets := [][]byte{
+		tcpPacket(client, server, 1000, 0x18, "GET / HTTP/1.1\r\n"),
+		tcpPacket(server, client, 5000, 0x18, "HTTP/1.1 200 OK\r\n"),
+	}
+	times := []time.Time{start, start.Add(1500 * time.Microsecond)}
+
+	tests := []struct {
+		name string
+		data []byte
+		step time.Duration // what the file can't tell apart
+	}{
+		{"pcap little endian", classicFile(binary.LittleEndian, magicMicro, packets, times), time.Microsecond},
+		{"pcap big endian", classicFile(binary.BigEndian, magicMicro, packets, times), time.Microsecond},
+		{"pcap nanoseconds", classicFile(binary.LittleEndian, magicNano, packets, times), time.Nanosecond},
+		{"pcapng", ngFile(6, packets, times), time.Microsecond},
+		{"pcapng nanoseconds", ngFile(9, packets, times), time.Nanosecond},
+		{"pcapng milliseconds", ngFile(3, packets, times), time.Millisecond},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := readAll(t, tc.data)
+			require.Len(t, got, 2)
+			for i, p := range got {
+				assert.Equal(t, LinkTypeEthernet, p.LinkType)
+				assert.Equal(t, packets[i], p.Data)
+				assert.Equal(t, len(packets[i]), p.Length)
+				assert.Equal(t, times[i].Truncate(tc.step), p.Time)
+			}
+		})
+	}
+
+	t.Run("Not a capture", func(t *testing.T) {
+		_, err := NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\nmore bytes here")))
+		assert.ErrorIs(t, err, ErrFormat)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		data := classicFile(binary.LittleEndian, magicMicro, packets, times)
+		r, err := NewReader(bytes.NewReader(data[:len(data)-5]))
+		require.NoError(t, err)
+		_, err = r.Next()
+		require.NoError(t, err)
+		_, err = r.Next()
+		assert.ErrorIs(t, err, ErrFormat)
+	})
+}
+
+func TestDecodeTCP(t *testing.T) {
+	p := &Packet{LinkType: LinkTypeEthernet, Data: tcpPacket(client, server, 1000, 0x18, "hello")}
+	seg, err := DecodeTCP(p)
+	require.NoError(t, err)
+	assert.Equal(t, client, seg.Src)
+	assert.Equal(t, server, seg.Dst)
+	assert.Equal(t, uint32(1000), seg.Seq)
+	assert.True(t, seg.ACK)
+	assert.False(t, seg.SYN)
+	// The Ethernet padding is left out
+	assert.Equal(t, []byte("hello"), seg.Payload)
+
+	t.Run("VLAN tag", func(t *testing.T) {
+		frame := tcpPacket(client, server, 1, 0x02, "")
+		tagged := append([]byte{}, frame[:12]...)
+		tagged = append(tagged, 0x81, 0x00, 0x00, 0x0a)
+		tagged = append(tagged, frame[12:]...)
+		seg, err := DecodeTCP(&Packet{LinkType: LinkTypeEthernet, Data: tagged})
+		require.NoError(t, err)
+		assert.True(t, seg.SYN)
+		assert.Empty(t, seg.Payload)
+	})
+
+	t.Run("Raw IP", func(t *testing.T) {
+		seg, err := DecodeTCP(&Packet{LinkType: LinkTypeRaw, Data: tcpPacket(client, server, 7, 0x11, "x")[14:]})
+		require.NoError(t, err)
+		assert.True(t, seg.FIN)
+		assert.Equal(t, []byte("x"), seg.Payload)
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		// Reuse the TCP header of an IPv4 packet, behind an IPv6 header and a hop-by-hop option
+		tcp := tcpPacket(client, server, 9, 0x18, "hi")[34:56]
+		ip := make([]byte, 40, 40+8+len(tcp))
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:], uint16(8+len(tcp)))
+		ip[6] = 0 // hop-by-hop options
+		ip[23], ip[39] = 1, 2
+		ip = append(ip, protoTCP, 0, 1, 4, 0, 0, 0, 0)
+		ip = append(ip, tcp...)
+
+		seg, err := DecodeTCP(&Packet{LinkType: LinkTypeRaw, Data: ip})
+		require.NoError(t, err)
+		assert.Equal(t, "[::1]:51000", seg.Src.String())
+		assert.Equal(t, "[::2]:80", seg.Dst.String())
+		assert.Equal(t, []byte("hi"), seg.Payload)
+	})
+
+	t.Run("UDP", func(t *testing.T) {
+		frame := tcpPacket(client, server, 1, 0x18, "x")
+		frame[14+9] = 17
+		_, err := DecodeTCP(&Packet{LinkType: LinkTypeEthernet, Data: frame})
+		assert.ErrorIs(t, err, ErrNotTCP)
+	})
+}
@@ -0,0 +1,376 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/metrics"
+	"httpfromtcp/internal/request"
+)
+
+// ringReplicas is how many points each backend gets on the consistent hash ring.
+// More points spread the keys more evenly.
+const ringReplicas = 100
+
+// Policy decides which backend of a pool gets the next request
+type Policy int
+
+const (
+	// RoundRobin takes the backends in turn
+	RoundRobin Policy = iota
+	// LeastConnections takes the backend with the fewest requests in flight
+	LeastConnections
+	// ConsistentHash sends the same client (by IP, or by Pool.HashHeader) to the
+	// same backend, and only moves a few clients when backends come and go
+	ConsistentHash
+)
+
+// ParsePolicy turns a command line value into a Policy
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "round-robin":
+		return RoundRobin, nil
+	case "least-conn":
+		return LeastConnections, nil
+	case "hash":
+		return ConsistentHash, nil
+	}
+	return 0, fmt.Errorf("unknown balancing policy %q (want round-robin, least-conn or hash)", s)
+}
+
+// Backend is one upstream server of a pool
+type Backend struct {
+	URL *url.URL
+
+	active atomic.Int64
+
+	mu           sync.Mutex
+	unhealthy    bool // failed its last active health check
+	failures     int  // consecutive failed requests
+	ejectedUntil time.Time
+}
+
+// ActiveRequests returns the number of requests currently sent to the backend
+func (b *Backend) ActiveRequests() int64 {
+	return b.active.Load()
+}
+
+// Pool spreads requests over a set of backends, leaving out those that fail
+// their health checks or too many requests in a row
+type Pool struct {
+	// Name labels the pool's metrics; empty means "default"
+	Name string
+
+	Policy Policy
+
+	// HashHeader is the request header ConsistentHash keys on; empty, or missing
+	// from the request, means the client IP
+	HashHeader string
+
+	// Retries is how many other backends an idempotent request is tried on when
+	// its backend can't be reached, unless its body was being streamed. Any request
+	// is retried if the connection was refused, as nothing was sent.
+	Retries int
+
+	// MaxFails consecutive connection errors or timeouts eject a backend for
+	// FailTimeout. 0 turns passive ejection off.
+	MaxFails    int
+	FailTimeout time.Duration
+
+	// HealthCheckTimeout bounds one active health check; 0 means 5 seconds
+	HealthCheckTimeout time.Duration
+
+	// Client makes the health check requests; nil means the shared default client
+	Client *client.Client
+
+	// Metrics receives the pool's request, health and retry counts; nil records nothing
+	Metrics *metrics.ProxyMetrics
+
+	backends []*Backend
+	ring     []ringPoint
+	next     atomic.Uint64
+}
+
+// ringPoint is a position on the consistent hash ring owned by a backend
+type ringPoint struct {
+	hash    uint32
+	backend *Backend
+}
+
+// NewPool creates a round-robin pool of the given upstreams, each like a New target.
+// Requests are retried on up to 2 other backends, and a backend is ejected for
+// 30 seconds after 3 failures in a row.
+func NewPool(targets ...string) (*Pool, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("proxy pool: no backends")
+	}
+	p := &Pool{
+		Policy:      RoundRobin,
+		Retries:     2,
+		MaxFails:    3,
+		FailTimeout: 30 * time.Second,
+	}
+	for _, target := range targets {
+		single, err := New(target)
+		if err != nil {
+			return nil, err
+		}
+		b := &Backend{URL: single.Target}
+		p.backends = append(p.backends, b)
+		for i := 0; i < ringReplicas; i++ {
+			key := b.URL.Host + "#" + strconv.Itoa(i)
+			p.ring = append(p.ring, ringPoint{crc32.ChecksumIEEE([]byte(key)), b})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	return p, nil
+}
+
+// Backends returns the pool's backends in the order they were given
+func (p *Pool) Backends() []*Backend {
+	return p.backends
+}
+
+// Available reports whether b is taking requests: it passed its last health
+// check and isn't ejected
+func (p *Pool) Available(b *Backend) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return p.availableLocked(b, time.Now())
+}
+
+func (p *Pool) availableLocked(b *Backend, now time.Time) bool {
+	if !b.ejectedUntil.IsZero() {
+		if now.Before(b.ejectedUntil) {
+			return false
+		}
+		// The ejection is over, give it another chance
+		b.ejectedUntil = time.Time{}
+		p.Metrics.SetHealthy(p.name(), b.URL.Host, !b.unhealthy)
+	}
+	return !b.unhealthy
+}
+
+// pick chooses the backend for req among the available ones not yet tried,
+// or returns nil if there are none
+func (p *Pool) pick(req *request.Request, tried []*Backend) *Backend {
+	now := time.Now()
+	usable := func(b *Backend) bool {
+		for _, t := range tried {
+			if t == b {
+				return false
+			}
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return p.availableLocked(b, now)
+	}
+
+	switch p.Policy {
+	case ConsistentHash:
+		h := crc32.ChecksumIEEE([]byte(p.hashKey(req)))
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		// Walk clockwise to the first backend that can take it
+		for i := range p.ring {
+			b := p.ring[(start+i)%len(p.ring)].backend
+			if usable(b) {
+				return b
+			}
+		}
+		return nil
+
+	case LeastConnections:
+		// Start where round-robin would, so ties are shared out
+		n := len(p.backends)
+		start := int(p.next.Add(1) - 1)
+		var best *Backend
+		for i := 0; i < n; i++ {
+			b := p.backends[(start+i)%n]
+			if usable(b) && (best == nil || b.ActiveRequests() < best.ActiveRequests()) {
+				best = b
+			}
+		}
+		return best
+
+	default:
+		n := len(p.backends)
+		start := int(p.next.Add(1) - 1)
+		for i := 0; i < n; i++ {
+			if b := p.backends[(start+i)%n]; usable(b) {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+// hashKey is what ConsistentHash maps to a backend
+func (p *Pool) hashKey(req *request.Request) string {
+	if p.HashHeader != "" {
+		if v := req.Headers[strings.ToLower(p.HashHeader)]; v != "" {
+			return v
+		}
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// begin counts a request as sent to b until the returned function is called
+// with the response status, or 0 and the error if b couldn't be reached
+func (p *Pool) begin(b *Backend) (done func(status int, err error)) {
+	b.active.Add(1)
+	recorded := p.Metrics.UpstreamRequest(p.name(), b.URL.Host)
+	return func(status int, err error) {
+		b.active.Add(-1)
+		recorded(status)
+		p.report(b, err)
+	}
+}
+
+// report updates b's run of failures, ejecting it when it reaches MaxFails
+func (p *Pool) report(b *Backend, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if p.MaxFails > 0 && b.failures >= p.MaxFails && b.ejectedUntil.IsZero() {
+		b.failures = 0
+		b.ejectedUntil = time.Now().Add(p.FailTimeout)
+		log.Printf("proxy: ejecting %s for %s after %d failures: %v", b.URL.Host, p.FailTimeout, p.MaxFails, err)
+		p.Metrics.Ejected(p.name(), b.URL.Host)
+		p.Metrics.SetHealthy(p.name(), b.URL.Host, false)
+	}
+}
+
+// retryable reports whether a request that failed with err may go to another backend
+func (p *Pool) retryable(req *request.Request, tried int, err error) bool {
+	if tried > p.Retries || tried >= len(p.backends) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	// Past the dial, some of a streamed body may have gone to the failed backend
+	if req.BodyReader != nil {
+		return false
+	}
+	switch req.RequestLine.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// StartHealthChecks sends GET path to every backend now and then every interval.
+// A backend that doesn't answer with a 2xx or 3xx status gets no requests until it
+// passes again; passing also ends an ejection early. Call stop to end the checks.
+func (p *Pool) StartHealthChecks(path string, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		p.checkAll(path)
+		for {
+			select {
+			case <-ticker.C:
+				p.checkAll(path)
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// checkAll health checks the backends in parallel and waits for the results
+func (p *Pool) checkAll(path string) {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			p.check(b, path)
+		}(b)
+	}
+	wg.Wait()
+}
+
+// check runs one health check against b and records the result
+func (p *Pool) check(b *Backend, path string) {
+	err := p.probe(b, path)
+	p.Metrics.HealthCheck(p.name(), b.URL.Host, err == nil)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		if !b.unhealthy {
+			log.Printf("proxy: %s failed its health check: %v", b.URL.Host, err)
+		}
+		b.unhealthy = true
+	} else {
+		if b.unhealthy || !b.ejectedUntil.IsZero() {
+			log.Printf("proxy: %s is healthy again", b.URL.Host)
+		}
+		b.unhealthy = false
+		b.failures = 0
+		b.ejectedUntil = time.Time{}
+	}
+	p.Metrics.SetHealthy(p.name(), b.URL.Host, err == nil)
+}
+
+// probe sends the health check request, returning an error unless the status is 2xx or 3xx
+func (p *Pool) probe(b *Backend, path string) error {
+	timeout := p.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	u := *b.URL
+	u.Path = joinPath(b.URL.Path, path)
+	u.RawPath = ""
+	upstream := p.Client
+	if upstream == nil {
+		upstream = defaultClient
+	}
+	resp, err := upstream.Get(ctx, u.String())
+	if err != nil {
+		return err
+	}
+	// Read the body so the connection can be used for the next check
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *Pool) name() string {
+	if p.Name == "" {
+		return "default"
+	}
+	return p.Name
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/metrics"
+	"httpfromtcp/internal/request"
+)
+
+// startBackend serves a backend that answers every request with its name
+func startBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// deadAddr returns an address nothing listens on
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// body sends a GET through the proxy at addr and returns the response body
+func body(t *testing.T, addr, method string) string {
+	t.Helper()
+	resp, err := rawRequest(t, addr, method+" / HTTP/1.1\r\nHost: front\r\n\r\n")
+	require.NoError(t, err)
+	_, b, _ := strings.Cut(resp, "\r\n\r\n")
+	return b
+}
+
+func clientRequest(remoteAddr string) *request.Request {
+	req := &request.Request{Headers: headers.NewHeaders(), RemoteAddr: remoteAddr}
+	req.RequestLine.Method = "GET"
+	return req
+}
+
+func TestParsePolicy(t *testing.T) {
+	for s, want := range map[string]Policy{"round-robin": RoundRobin, "least-conn": LeastConnections, "hash": ConsistentHash} {
+		got, err := ParsePolicy(s)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := ParsePolicy("random")
+	assert.Error(t, err)
+}
+
+func TestNewPool(t *testing.T) {
+	_, err := NewPool()
+	assert.Error(t, err)
+	_, err = NewPool("http://a", "ftp://b")
+	assert.Error(t, err)
+
+	pool, err := NewPool("http://a:1", "http://b:2")
+	require.NoError(t, err)
+	assert.Len(t, pool.Backends(), 2)
+	assert.Len(t, pool.ring, 2*ringReplicas)
+}
+
+func TestRoundRobin(t *testing.T) {
+	pool, err := NewPool(startBackend(t, "a").URL, startBackend(t, "b").URL, startBackend(t, "c").URL)
+	require.NoError(t, err)
+	addr := startProxy(t, &ReverseProxy{Pool: pool})
+
+	counts := map[string]int{}
+	for i := 0; i < 9; i++ {
+		counts[body(t, addr, "GET")]++
+	}
+	assert.Equal(t, map[string]int{"a": 3, "b": 3, "c": 3}, counts)
+}
+
+func TestLeastConnections(t *testing.T) {
+	pool, err := NewPool("http://a:1", "http://b:2", "http://c:3")
+	require.NoError(t, err)
+	pool.Policy = LeastConnections
+	a, b, c := pool.backends[0], pool.backends[1], pool.backends[2]
+	a.active.Add(3)
+	b.active.Add(1)
+	c.active.Add(2)
+
+	req := clientRequest("192.0.2.1:1234")
+	for i := 0; i < 3; i++ {
+		assert.Same(t, b, pool.pick(req, nil))
+	}
+	assert.Same(t, c, pool.pick(req, []*Backend{b}))
+
+	// Ties are shared out
+	b.active.Add(1)
+	seen := map[*Backend]bool{}
+	for i := 0; i < 6; i++ {
+		seen[pool.pick(req, []*Backend{a})] = true
+	}
+	assert.Len(t, seen, 2)
+}
+
+func TestConsistentHash(t *testing.T) {
+	pool, err := NewPool("http://a:1", "http://b:2", "http://c:3", "http://d:4")
+	require.NoError(t, err)
+	pool.Policy = ConsistentHash
+
+	// The same client always lands on the same backend
+	for i := 0; i < 20; i++ {
+		req := clientRequest(fmt.Sprintf("198.51.100.%d:%d", i, 1000+i))
+		first := pool.pick(req, nil)
+		req.RemoteAddr = fmt.Sprintf("198.51.100.%d:%d", i, 2000+i)
+		assert.Same(t, first, pool.pick(req, nil))
+	}
+
+	// Keys spread over every backend, and losing one only moves its own keys
+	before := map[string]*Backend{}
+	used := map[*Backend]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		b := pool.pick(clientRequest(key+":80"), nil)
+		before[key] = b
+		used[b]++
+	}
+	assert.Len(t, used, 4)
+	for b, n := range used {
+		assert.Greater(t, n, 100, b.URL.Host)
+	}
+
+	gone := pool.backends[1]
+	gone.ejectedUntil = time.Now().Add(time.Minute)
+	for key, was := range before {
+		now := pool.pick(clientRequest(key+":80"), nil)
+		if was == gone {
+			assert.NotSame(t, gone, now)
+		} else {
+			assert.Same(t, was, now, key)
+		}
+	}
+
+	t.Run("by header", func(t *testing.T) {
+		pool.HashHeader = "X-User"
+		req := clientRequest("192.0.2.1:1")
+		req.Headers.Set("X-User", "alice")
+		alice := pool.pick(req, nil)
+		req.RemoteAddr = "192.0.2.2:1"
+		assert.Same(t, alice, pool.pick(req, nil))
+	})
+}
+
+func TestPassiveEjectionAndRetries(t *testing.T) {
+	reg := metrics.NewRegistry()
+	pool, err := NewPool("http://"+deadAddr(t), startBackend(t, "live").URL)
+	require.NoError(t, err)
+	pool.Name = "web"
+	pool.MaxFails = 2
+	pool.FailTimeout = time.Minute
+	pool.Metrics = metrics.NewProxyMetrics(reg)
+	dead := pool.backends[0]
+	addr := startProxy(t, &ReverseProxy{Pool: pool, ErrorLog: discardLog()})
+
+	// Whenever the dead backend's turn comes the request moves on to the live one.
+	// A refused POST is safe to retry too, as nothing was sent.
+	for _, method := range []string{"POST", "GET", "GET", "GET"} {
+		assert.Equal(t, "live", body(t, addr, method), method)
+	}
+	assert.False(t, pool.Available(dead))
+
+	var out bytes.Buffer
+	require.NoError(t, reg.WritePrometheus(&out))
+	text := out.String()
+	deadHost := dead.URL.Host
+	assert.Contains(t, text, fmt.Sprintf(`proxy_upstream_requests_total{pool="web",backend=%q,status="error"} 2`, deadHost))
+	assert.Contains(t, text, `proxy_upstream_retries_total{pool="web"} 2`)
+	assert.Contains(t, text, fmt.Sprintf(`proxy_upstream_ejections_total{pool="web",backend=%q} 1`, deadHost))
+	assert.Contains(t, text, fmt.Sprintf(`proxy_upstream_healthy{pool="web",backend=%q} 0`, deadHost))
+	assert.Contains(t, text, fmt.Sprintf(`proxy_upstream_requests_total{pool="web",backend=%q,status="200"} 4`, pool.backends[1].URL.Host))
+
+	t.Run("ejection ends after FailTimeout", func(t *testing.T) {
+		dead.mu.Lock()
+		dead.ejectedUntil = time.Now().Add(-time.Second)
+		dead.mu.Unlock()
+		assert.True(t, pool.Available(dead))
+	})
+
+	t.Run("no backend left is a 503", func(t *testing.T) {
+		for _, b := range pool.backends {
+			b.mu.Lock()
+			b.ejectedUntil = time.Now().Add(time.Minute)
+			b.mu.Unlock()
+		}
+		resp, err := rawRequest(t, addr, "GET / HTTP/1.1\r\nHost: front\r\n\r\n")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 503 Service Unavailable\r\n"), resp)
+	})
+}
+
+func TestRetryable(t *testing.T) {
+	pool, err := NewPool("http://a:1", "http://b:2", "http://c:3", "http://d:4")
+	require.NoError(t, err)
+	pool.Retries = 2
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	get, post := clientRequest(""), clientRequest("")
+	post.RequestLine.Method = "POST"
+
+	assert.True(t, pool.retryable(get, 1, reset))
+	assert.True(t, pool.retryable(get, 2, reset))
+	assert.False(t, pool.retryable(get, 3, reset), "out of retries")
+	assert.False(t, pool.retryable(post, 1, reset), "POST may have been processed")
+	assert.True(t, pool.retryable(post, 1, refused))
+
+	pool.Retries = 10
+	assert.False(t, pool.retryable(get, 4, reset), "every backend tried")
+}
+
+func TestHealthChecks(t *testing.T) {
+	var sick atomic.Bool
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/base/healthz" && sick.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "flaky")
+	}))
+	defer flaky.Close()
+
+	reg := metrics.NewRegistry()
+	pool, err := NewPool(flaky.URL+"/base", startBackend(t, "steady").URL)
+	require.NoError(t, err)
+	pool.Metrics = metrics.NewProxyMetrics(reg)
+	backend := pool.backends[0]
+	addr := startProxy(t, &ReverseProxy{Pool: pool})
+
+	sick.Store(true)
+	stop := pool.StartHealthChecks("/healthz", 10*time.Millisecond)
+	defer stop()
+	require.Eventually(t, func() bool { return !pool.Available(backend) }, 2*time.Second, 5*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "steady", body(t, addr, "GET"))
+	}
+
+	sick.Store(false)
+	require.Eventually(t, func() bool { return pool.Available(backend) }, 2*time.Second, 5*time.Millisecond)
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[body(t, addr, "GET")] = true
+	}
+	assert.Equal(t, map[string]bool{"flaky": true, "steady": true}, seen)
+
+	var out bytes.Buffer
+	require.NoError(t, reg.WritePrometheus(&out))
+	assert.Contains(t, out.String(), fmt.Sprintf(`proxy_upstream_health_checks_total{pool="default",backend=%q,result="fail"}`, backend.URL.Host))
+	assert.Contains(t, out.String(), fmt.Sprintf(`proxy_upstream_healthy{pool="default",backend=%q} 1`, backend.URL.Host))
+}
@@ -0,0 +1,490 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// DefaultTimeout bounds the wait for the upstream's response head unless ReverseProxy.Timeout says otherwise
+const DefaultTimeout = 30 * time.Second
+
+// DefaultIdleTimeout bounds the silences in a response body unless ReverseProxy.IdleTimeout says otherwise
+const DefaultIdleTimeout = 60 * time.Second
+
+// errIdleTimeout ends a response body the upstream stopped sending. It counts as a
+// deadline, so the client gets a 504 if nothing has been sent yet.
+var errIdleTimeout = fmt.Errorf("upstream went quiet: %w", context.DeadlineExceeded)
+
+// bufferLimit is the largest upstream body passed on with its Content-Length.
+// Bigger bodies, and those of unknown length, are streamed as they arrive.
+const bufferLimit = 1 << 20
+
+// hopHeaders only apply to a single connection, so a proxy must not forward them (RFC 9110 Section 7.6.1)
+var hopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"proxy-connection",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// ReverseProxy forwards requests to an upstream server and relays its responses.
+// Responses are streamed. Request bodies are too when the server hands them over
+// as Request.BodyReader (see server.Server.StreamBody), with their Content-Length or
+// chunked; a body already read into Request.Body is sent in one piece.
+type ReverseProxy struct {
+	// Target is the upstream; its path is put in front of the request path
+	Target *url.URL
+
+	// Pool, when set, spreads the requests over its backends instead of Target
+	Pool *Pool
+
+	// StripPrefix is removed from the request path first, e.g. "/api" when
+	// the proxy is mounted at "/api/*path"
+	StripPrefix string
+
+	// PreserveHost sends the client's Host header upstream instead of Target's host
+	PreserveHost bool
+
+	// Timeout bounds the upstream exchange from connecting to the response head.
+	// An upstream that hasn't answered in time gets the client a 504. 0 means DefaultTimeout.
+	Timeout time.Duration
+
+	// IdleTimeout bounds each wait for more of the response body. The body as a whole
+	// has no limit, so event streams and long downloads go on as long as data flows.
+	// 0 means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	// ChecksumTrailers streams every response body in chunks and follows it with
+	// X-Content-SHA256 and X-Content-Length trailers, computed over what was relayed
+	ChecksumTrailers bool
+
+	// Client makes the upstream requests; nil means the shared default client
+	Client *client.Client
+
+	// ErrorLog receives upstream errors; nil logs to the standard logger
+	ErrorLog *log.Logger
+}
+
+// defaultClient is shared by proxies without their own, so idle
+// upstream connections are reused across them
+var defaultClient = &client.Client{
+	DialTimeout:         5 * time.Second,
+	MaxIdleConnsPerHost: 32,
+}
+
+// New creates a proxy to the upstream at target, e.g. "http://127.0.0.1:8080" or "https://httpbin.org/anything"
+func New(target string) (*ReverseProxy, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("proxy target %q: scheme must be http or https", target)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy target %q: missing host", target)
+	}
+	return &ReverseProxy{Target: u}, nil
+}
+
+// ServeHTTP forwards req to the upstream and copies the answer to w
+func (p *ReverseProxy) ServeHTTP(req *request.Request, w *response.Writer) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	upstream := p.Client
+	if upstream == nil {
+		upstream = defaultClient
+	}
+
+	var tried []*Backend
+	for {
+		target := p.Target
+		done := func(int, error) {}
+		if p.Pool != nil {
+			backend := p.Pool.pick(req, tried)
+			if backend == nil {
+				p.logf("no backend available for %s", req.RequestLine.RequestTarget)
+				writeError(w, response.StatusServiceUnavailable)
+				return
+			}
+			tried = append(tried, backend)
+			target = backend.URL
+			done = p.Pool.begin(backend)
+		}
+
+		// Each attempt gets the whole timeout, so a retry isn't cut short by the one before.
+		// It is stopped once the head is in; the body is watched by idleReader.
+		ctx, cancel := context.WithCancelCause(context.Background())
+		headTimer := time.AfterFunc(timeout, func() { cancel(context.DeadlineExceeded) })
+		outReq, err := p.outgoingRequest(req, target)
+		if err != nil {
+			headTimer.Stop()
+			cancel(nil)
+			done(0, nil)
+			p.logf("building upstream request for %s: %v", req.RequestLine.RequestTarget, err)
+			writeError(w, response.StatusBadGateway)
+			return
+		}
+
+		resp, err := upstream.Do(ctx, outReq)
+		if !headTimer.Stop() && err == nil {
+			// The head came in just as the time ran out
+			resp.Body.Close()
+			err = context.DeadlineExceeded
+		}
+		if err != nil {
+			err = timeoutCause(ctx, err)
+			cancel(nil)
+			done(0, err)
+			p.logf("upstream %s: %v", outReq.URL.Redacted(), err)
+			if p.Pool != nil && p.Pool.retryable(req, len(tried), err) {
+				p.Pool.Metrics.Retry(p.Pool.name())
+				continue
+			}
+			writeError(w, errorStatus(err))
+			return
+		}
+
+		body := newIdleReader(resp.Body, p.idleTimeout(), cancel)
+		resp.Body = body
+		err = copyResponse(w, resp, req.RequestLine.Method, p.ChecksumTrailers)
+		body.Close()
+		if err != nil {
+			err = timeoutCause(ctx, err)
+		}
+		cancel(nil)
+		done(int(resp.StatusCode), nil)
+		if err != nil {
+			p.logf("relaying response from %s: %v", outReq.URL.Redacted(), err)
+			if !w.Committed() {
+				w.Reset()
+				writeError(w, errorStatus(err))
+				return
+			}
+			// Part of the response is out already; make sure the client can't take it as complete
+			panic(server.ErrAbortHandler)
+		}
+		return
+	}
+}
+
+func (p *ReverseProxy) idleTimeout() time.Duration {
+	if p.IdleTimeout > 0 {
+		return p.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// timeoutCause puts the timeout that cancelled ctx in front of err, which only
+// says the context was cancelled
+func timeoutCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, context.DeadlineExceeded) && !errors.Is(err, cause) {
+		return fmt.Errorf("%w (%w)", cause, err)
+	}
+	return err
+}
+
+// idleReader cancels the exchange when a read of the body waits longer than timeout
+type idleReader struct {
+	body  io.ReadCloser
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func newIdleReader(body io.ReadCloser, idle time.Duration, cancel context.CancelCauseFunc) *idleReader {
+	timer := time.AfterFunc(idle, func() { cancel(errIdleTimeout) })
+	timer.Stop()
+	return &idleReader{body: body, timer: timer, idle: idle}
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.idle)
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+// outgoingRequest builds the upstream request for req
+func (p *ReverseProxy) outgoingRequest(req *request.Request, target *url.URL) (*client.Request, error) {
+	u := *target
+	path := strings.TrimPrefix(req.Path(), p.StripPrefix)
+	u.Path = joinPath(target.Path, path)
+	u.RawPath = ""
+	if _, rawQuery, ok := strings.Cut(req.RequestLine.RequestTarget, "?"); ok {
+		if u.RawQuery != "" {
+			u.RawQuery += "&" + rawQuery
+		} else {
+			u.RawQuery = rawQuery
+		}
+	}
+	// The request path is still percent-encoded, keep it as the client sent it
+	if unescaped, err := url.PathUnescape(u.Path); err == nil {
+		u.RawPath = u.Path
+		u.Path = unescaped
+	}
+
+	outReq, err := client.NewRequest(req.RequestLine.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case req.BodyReader != nil:
+		// Sent as it arrives, so it can't be sent again if the attempt fails
+		outReq.Body = req.BodyReader
+		outReq.ContentLength = -1
+		if cl, ok := req.Headers["content-length"]; ok {
+			if outReq.ContentLength, err = headers.ParseContentLength(cl); err != nil {
+				return nil, err
+			}
+		}
+	case len(req.Body) > 0:
+		body := req.Body
+		outReq.Body = bytes.NewReader(body)
+		outReq.ContentLength = int64(len(body))
+		outReq.GetBody = func() (io.Reader, error) { return bytes.NewReader(body), nil }
+	}
+
+	for name, value := range req.Headers {
+		outReq.Header[name] = value
+	}
+	removeHopHeaders(outReq.Header)
+	// The client sets these itself
+	delete(outReq.Header, "host")
+	delete(outReq.Header, "content-length")
+
+	clientHost := req.Headers["host"]
+	if p.PreserveHost && clientHost != "" {
+		outReq.Host = clientHost
+	}
+	addForwardedHeaders(outReq.Header, req, clientHost)
+	return outReq, nil
+}
+
+// addForwardedHeaders tells the upstream who the client is, appending to what
+// earlier proxies sent, in both the X-Forwarded-* and the RFC 7239 form
+func addForwardedHeaders(h headers.Headers, req *request.Request, clientHost string) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	clientIP := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		clientIP = host
+	}
+
+	if clientIP != "" {
+		if prior := h["x-forwarded-for"]; prior != "" {
+			h.Set("X-Forwarded-For", prior+", "+clientIP)
+		} else {
+			h.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	if clientHost != "" && h["x-forwarded-host"] == "" {
+		h.Set("X-Forwarded-Host", clientHost)
+	}
+	if h["x-forwarded-proto"] == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+
+	var fwd []string
+	if clientIP != "" {
+		fwd = append(fwd, "for="+forwardedNode(clientIP))
+	}
+	if clientHost != "" {
+		fwd = append(fwd, "host="+forwardedValue(clientHost))
+	}
+	fwd = append(fwd, "proto="+proto)
+	element := strings.Join(fwd, ";")
+	if prior := h["forwarded"]; prior != "" {
+		element = prior + ", " + element
+	}
+	h.Set("Forwarded", element)
+}
+
+// forwardedNode formats an IP for Forwarded: IPv6 addresses are bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes a value unless it is a plain token
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.ReplaceAll(strings.ReplaceAll(v, `\`, `\\`), `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
+
+// copyResponse relays the upstream response. Small bodies of known length are
+// sent with a Content-Length; everything else is streamed in chunks as it arrives,
+// followed by the upstream's trailers, and with checksum by the body's own.
+func copyResponse(w *response.Writer, resp *client.Response, method string, checksum bool) error {
+	h := headers.NewHeaders()
+	for name, value := range resp.Header {
+		h[name] = value
+	}
+	// Trailer is a hop-by-hop header, but the trailers it announces are passed on
+	announced := resp.Header["trailer"]
+	removeHopHeaders(h)
+
+	w.WriteStatusLine(resp.StatusCode)
+
+	// The answer to HEAD and a 304 have no body, but keep the upstream's Content-Length:
+	// it is the length of the body they stand for
+	if method == "HEAD" || resp.StatusCode == response.StatusNotModified || resp.StatusCode == response.StatusNoContent {
+		if method == "HEAD" {
+			w.SuppressBody()
+		}
+		return w.WriteHeaders(h)
+	}
+	delete(h, "content-length")
+
+	if resp.ContentLength >= 0 && resp.ContentLength <= bufferLimit && announced == "" && !checksum {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		w.WriteHeaders(h)
+		_, err = w.WriteBody(body)
+		return err
+	}
+
+	h.Set("Transfer-Encoding", "chunked")
+	if checksum {
+		if announced != "" {
+			announced += ", "
+		}
+		announced += "X-Content-SHA256, X-Content-Length"
+	}
+	if announced != "" {
+		h.Set("Trailer", announced)
+	}
+	w.WriteHeaders(h)
+	// Send the head right away, the body may take a while (e.g. an event stream)
+	if _, err := w.WriteChunkedBody(nil); err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	var length int64
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
+				return werr
+			}
+			if checksum {
+				hasher.Write(buf[:n])
+				length += int64(n)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	trailers := headers.NewHeaders()
+	for name, value := range resp.Trailer {
+		trailers[name] = value
+	}
+	if checksum {
+		trailers.Set("X-Content-SHA256", hex.EncodeToString(hasher.Sum(nil)))
+		trailers.Set("X-Content-Length", strconv.FormatInt(length, 10))
+	}
+	if len(trailers) > 0 {
+		return w.WriteTrailers(trailers)
+	}
+	return nil
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, including those the Connection header names
+func removeHopHeaders(h headers.Headers) {
+	for _, token := range strings.Split(h["connection"], ",") {
+		delete(h, strings.ToLower(strings.TrimSpace(token)))
+	}
+	for _, name := range hopHeaders {
+		delete(h, name)
+	}
+}
+
+// joinPath joins the target's base path and the request path with a single slash
+func joinPath(base, path string) string {
+	if base == "" {
+		if path == "" {
+			return "/"
+		}
+		return path
+	}
+	if path == "" {
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// errorStatus maps an upstream error to 504 for timeouts and 502 for the rest
+func errorStatus(err error) response.StatusCode {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return response.StatusGatewayTimeout
+	}
+	return response.StatusBadGateway
+}
+
+func (p *ReverseProxy) logf(format string, args ...any) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf("proxy: "+format, args...)
+}
+
+// writeError writes a short text/plain response for the given status code
+func writeError(w *response.Writer, code response.StatusCode) {
+	w.WriteStatusLine(code)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(fmt.Sprintf("%d %s\n", code, response.StatusText(code))))
+}
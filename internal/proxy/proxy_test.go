@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/server"
+)
+
+// startProxy serves p on a free port and returns its address
+func startProxy(t *testing.T, p *ReverseProxy) string {
+	t.Helper()
+	s := &server.Server{Handler: p.ServeHTTP, DisableHTTP2: true}
+	require.NoError(t, s.Start())
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("127.0.0.1:%d", s.Port)
+}
+
+// newProxy points a proxy at upstream
+func newProxy(t *testing.T, upstream string) *ReverseProxy {
+	t.Helper()
+	p, err := New(upstream)
+	require.NoError(t, err)
+	return p
+}
+
+// rawRequest sends raw to addr and returns everything that comes back, and the read error
+func rawRequest(t *testing.T, addr, raw string) (string, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	resp, err := io.ReadAll(conn)
+	return string(resp), err
+}
+
+func TestNew(t *testing.T) {
+	for _, target := range []string{"ftp://example.com", "/relative", "http://", "http://%zz"} {
+		_, err := New(target)
+		assert.Error(t, err, target)
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	type seen struct {
+		method, uri, host, body string
+		header                  http.Header
+	}
+	requests := make(chan seen, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- seen{r.Method, r.RequestURI, r.Host, string(body), r.Header}
+		w.Header().Set("X-Upstream", "yes")
+		w.Header().Set("Connection", "X-Secret")
+		w.Header().Set("X-Secret", "hop")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short and stout")
+	}))
+	defer upstream.Close()
+
+	p := newProxy(t, upstream.URL+"/base/")
+	p.StripPrefix = "/api"
+	addr := startProxy(t, p)
+
+	resp, err := rawRequest(t, addr, "PUT /api/items/a%2Fb?x=1&y=2 HTTP/1.1\r\n"+
+		"Host: front.example\r\n"+
+		"Content-Length: 11\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Connection: close, X-Drop-Me\r\n"+
+		"X-Drop-Me: hop\r\n"+
+		"Proxy-Authorization: Basic Zm9vOmJhcg==\r\n"+
+		"X-Forwarded-For: 203.0.113.9\r\n"+
+		"Authorization: Bearer token\r\n"+
+		"\r\n"+
+		"hello world")
+	require.NoError(t, err)
+
+	got := <-requests
+	assert.Equal(t, "PUT", got.method)
+	assert.Equal(t, "/base/items/a%2Fb?x=1&y=2", got.uri)
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), got.host)
+	assert.Equal(t, "hello world", got.body)
+	assert.Equal(t, "text/plain", got.header.Get("Content-Type"))
+	assert.Equal(t, "Bearer token", got.header.Get("Authorization"))
+	assert.Empty(t, got.header.Get("X-Drop-Me"))
+	assert.Empty(t, got.header.Get("Proxy-Authorization"))
+	assert.Equal(t, "203.0.113.9, 127.0.0.1", got.header.Get("X-Forwarded-For"))
+	assert.Equal(t, "front.example", got.header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", got.header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "for=127.0.0.1;host=front.example;proto=http", got.header.Get("Forwarded"))
+
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 418 "), resp)
+	assert.Contains(t, resp, "x-upstream: yes\r\n")
+	assert.Contains(t, resp, "content-length: 15\r\n")
+	assert.NotContains(t, resp, "x-secret")
+	assert.NotContains(t, resp, "keep-alive")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nshort and stout"))
+
+	t.Run("preserve host", func(t *testing.T) {
+		p.PreserveHost = true
+		defer func() { p.PreserveHost = false }()
+		_, err := rawRequest(t, addr, "GET /api/ HTTP/1.1\r\nHost: front.example\r\n\r\n")
+		require.NoError(t, err)
+		got := <-requests
+		assert.Equal(t, "front.example", got.host)
+		assert.Equal(t, "/base/", got.uri)
+	})
+}
+
+func TestStreaming(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: second\n\n")
+		w.Header().Set("X-Checksum", "abc123")
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	addr := startProxy(t, newProxy(t, upstream.URL))
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: front\r\n\r\n"))
+	require.NoError(t, err)
+
+	// The first event must arrive while the upstream is still holding the second back
+	br := bufio.NewReader(conn)
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if strings.Contains(line, "data: first") {
+			break
+		}
+	}
+	assert.Contains(t, head.String(), "transfer-encoding: chunked\r\n")
+	assert.Contains(t, head.String(), "trailer: X-Checksum\r\n")
+
+	release <- struct{}{}
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Contains(t, string(rest), "data: second")
+	assert.True(t, strings.HasSuffix(string(rest), "0\r\nx-checksum: abc123\r\n\r\n"), string(rest))
+}
+
+func TestStreamingUpload(t *testing.T) {
+	firstPart := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 5)
+		n, _ := io.ReadFull(r.Body, buf)
+		firstPart <- string(buf[:n])
+		rest, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %v %s%s", r.ContentLength, r.TransferEncoding, buf[:n], rest)
+	}))
+	defer upstream.Close()
+
+	s := &server.Server{
+		Handler:      newProxy(t, upstream.URL).ServeHTTP,
+		StreamBody:   func(*request.Request) bool { return true },
+		DisableHTTP2: true,
+	}
+	require.NoError(t, s.Start())
+	defer s.Close()
+	addr := fmt.Sprintf("127.0.0.1:%d", s.Port)
+
+	for name, parts := range map[string][2]string{
+		"Chunked":        {"Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n", "6\r\n world\r\n0\r\n\r\n"},
+		"Content-Length": {"Content-Length: 11\r\n\r\nhello", " world"},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("PUT /upload HTTP/1.1\r\nHost: front\r\n" + parts[0]))
+		require.NoError(t, err)
+
+		// The upstream has the start of the body while the client is still sending
+		select {
+		case part := <-firstPart:
+			assert.Equal(t, "hello", part, name)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: upstream did not get the start of the body", name)
+		}
+		_, err = conn.Write([]byte(parts[1]))
+		require.NoError(t, err)
+		resp, err := io.ReadAll(conn)
+		conn.Close()
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 200 OK\r\n"), name)
+		if name == "Chunked" {
+			assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\n-1 [chunked] hello world"), string(resp))
+		} else {
+			assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\n11 [] hello world"), string(resp))
+		}
+	}
+}
+
+func TestUpstreamFailures(t *testing.T) {
+	t.Run("connection refused is a 502", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		closedAddr := ln.Addr().String()
+		ln.Close()
+
+		p := newProxy(t, "http://"+closedAddr)
+		p.ErrorLog = discardLog()
+		resp, err := rawRequest(t, startProxy(t, p), "GET / HTTP/1.1\r\nHost: front\r\n\r\n")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 502 Bad Gateway\r\n"), resp)
+	})
+
+	t.Run("slow upstream is a 504", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}))
+		defer upstream.Close()
+
+		p := newProxy(t, upstream.URL)
+		p.Timeout = 100 * time.Millisecond
+		p.ErrorLog = discardLog()
+		resp, err := rawRequest(t, startProxy(t, p), "GET / HTTP/1.1\r\nHost: front\r\n\r\n")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 504 Gateway Timeout\r\n"), resp)
+	})
+
+	t.Run("upstream dying mid-body aborts the response", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "100")
+			io.WriteString(w, "partial")
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}))
+		defer upstream.Close()
+
+		p := newProxy(t, upstream.URL)
+		p.ErrorLog = discardLog()
+		// Content-Length 100 is under the buffer limit, so nothing has been sent
+		// when the body breaks and the client gets a clean 502
+		resp, err := rawRequest(t, startProxy(t, p), "GET / HTTP/1.1\r\nHost: front\r\n\r\n")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 502 Bad Gateway\r\n"), resp)
+	})
+
+	t.Run("upstream dying mid-stream resets the client", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "partial")
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}))
+		defer upstream.Close()
+
+		p := newProxy(t, upstream.URL)
+		p.ErrorLog = discardLog()
+		resp, _ := rawRequest(t, startProxy(t, p), "GET / HTTP/1.1\r\nHost: front\r\n\r\n")
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+		assert.Contains(t, resp, "partial")
+		assert.NotContains(t, resp, "0\r\n\r\n", "a truncated body must not be terminated")
+	})
+}
+
+func TestChecksumTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	p := newProxy(t, upstream.URL)
+	p.ChecksumTrailers = true
+	resp, err := rawRequest(t, startProxy(t, p), "GET / HTTP/1.1\r\nHost: front\r\n\r\n")
+	require.NoError(t, err)
+	assert.Contains(t, resp, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, resp, "trailer: X-Content-SHA256, X-Content-Length\r\n")
+	assert.Contains(t, resp, "5\r\nhello\r\n")
+	// sha256("hello")
+	assert.Contains(t, resp, "x-content-length: 5\r\n")
+	assert.Contains(t, resp, "x-content-sha256: 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"), resp)
+}
+
+func TestBodilessResponses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", "1234")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == "GET" {
+			io.WriteString(w, strings.Repeat("x", 1234))
+		}
+	}))
+	defer upstream.Close()
+	addr := startProxy(t, newProxy(t, upstream.URL))
+
+	resp, err := rawRequest(t, addr, "HEAD /file HTTP/1.1\r\nHost: front\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "content-length: 1234\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"), resp)
+
+	// net/http leaves Content-Length off its 304s; the proxy mustn't make up one of 0
+	resp, err = rawRequest(t, addr, "GET /file HTTP/1.1\r\nHost: front\r\nIf-None-Match: \"v1\"\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 304 Not Modified\r\n"), resp)
+	assert.Contains(t, resp, "etag: \"v1\"\r\n")
+	assert.NotContains(t, resp, "content-length")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"), resp)
+}
+
+func TestTimeouts(t *testing.T) {
+	// The body trickles in, each piece well within IdleTimeout, but all of it takes longer than Timeout
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(w, "tick %d\n", i)
+			w.(http.Flusher).Flush()
+			if r.URL.Path == "/hang" && i == 1 {
+				<-r.Context().Done()
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	p := newProxy(t, upstream.URL)
+	p.Timeout = 150 * time.Millisecond
+	p.IdleTimeout = time.Second
+	p.ErrorLog = discardLog()
+	addr := startProxy(t, p)
+
+	t.Run("a long body outlives Timeout", func(t *testing.T) {
+		resp, err := rawRequest(t, addr, "GET /slow HTTP/1.1\r\nHost: front\r\n\r\n")
+		require.NoError(t, err)
+		assert.Contains(t, resp, "tick 3\n")
+		assert.True(t, strings.HasSuffix(resp, "0\r\n\r\n"), resp)
+	})
+
+	t.Run("a quiet body is cut after IdleTimeout", func(t *testing.T) {
+		p.IdleTimeout = 200 * time.Millisecond
+		start := time.Now()
+		resp, _ := rawRequest(t, addr, "GET /hang HTTP/1.1\r\nHost: front\r\n\r\n")
+		assert.Less(t, time.Since(start), 2*time.Second)
+		assert.Contains(t, resp, "tick 1\n")
+		assert.NotContains(t, resp, "0\r\n\r\n", "a truncated body must not be terminated")
+	})
+}
+
+func TestJoinPath(t *testing.T) {
+	tests := []struct{ base, path, want string }{
+		{"", "", "/"},
+		{"", "/a", "/a"},
+		{"/base", "", "/base"},
+		{"/base", "/a", "/base/a"},
+		{"/base/", "/a/", "/base/a/"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, joinPath(tc.base, tc.path))
+	}
+}
+
+func TestForwardedValues(t *testing.T) {
+	assert.Equal(t, `"[2001:db8::1]"`, forwardedNode("2001:db8::1"))
+	assert.Equal(t, "192.0.2.1", forwardedNode("192.0.2.1"))
+	assert.Equal(t, `"example.com:8080"`, forwardedValue("example.com:8080"))
+	assert.Equal(t, "example.com", forwardedValue("example.com"))
+}
+
+func discardLog() *log.Logger {
+	return log.New(io.Discard, "", 0)
+}
@@ -0,0 +1,71 @@
+package request
+
+import (
+	"io"
+	"slices"
+)
+
+// bodyReader hands out the body of a request read by RequestHeadFromReader, parsing
+// it from the stream as it is read
+type bodyReader struct {
+	r       *Request
+	src     io.Reader
+	buf     []byte // read from src, not parsed yet
+	pending []byte // parsed body bytes not handed out yet
+	off     int    // how much of pending has been handed out
+	err     error  // what Read returns once pending is empty
+}
+
+// start takes over from readRequest once the headers are parsed, with the bytes it
+// read past them. BodyReader is only set if there is a body.
+func (b *bodyReader) start(r *Request, src io.Reader, buffered []byte) {
+	b.r = r
+	b.src = src
+	b.buf = append(make([]byte, 0, max(len(buffered), 32<<10)), buffered...)
+	if r.state != StateDone || r.bodyRead > 0 || r.chunked {
+		r.BodyReader = b
+	}
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	for b.off == len(b.pending) {
+		b.pending, b.off = b.pending[:0], 0
+		if b.r.state == StateDone {
+			return 0, io.EOF
+		}
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.fill()
+	}
+	n := copy(p, b.pending[b.off:])
+	b.off += n
+	return n, nil
+}
+
+// fill reads from the stream once and parses what arrived
+func (b *bodyReader) fill() {
+	if len(b.buf) == cap(b.buf) {
+		b.buf = slices.Grow(b.buf, len(b.buf))
+	}
+	n, err := b.src.Read(b.buf[len(b.buf):cap(b.buf)])
+	b.buf = b.buf[:len(b.buf)+n]
+
+	consumed, parseErr := b.r.parseAndUpdateState(b.buf)
+	if parseErr != nil {
+		b.err = &ParseError{Offset: b.r.offset + consumed, State: b.r.state, Err: parseErr}
+		return
+	}
+	b.buf = b.buf[:copy(b.buf, b.buf[consumed:])]
+	b.r.offset += consumed
+
+	switch {
+	case b.r.state == StateDone:
+	case err == io.EOF && b.r.chunked:
+		b.err = b.r.incomplete(len(b.buf), "incomplete chunked body")
+	case err == io.EOF:
+		b.err = b.r.incomplete(len(b.buf), "Body shorter than reported content length")
+	case err != nil:
+		b.err = err
+	}
+}
@@ -0,0 +1,26 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+)
+
+// RequestFromDatagram parses an HTTPU request: HTTP over UDP, as SSDP uses it, where
+// a datagram holds one whole request. On top of what RequestFromReader accepts it
+// allows the M-SEARCH and NOTIFY methods and the "*" request target.
+//
+// The datagram ends the request, so a body without a Content-Length is empty and
+// the blank line after the headers may be left out, as some devices do.
+func RequestFromDatagram(data []byte) (*Request, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty datagram")
+	}
+	if !bytes.Contains(data, []byte("\r\n\r\n")) && bytes.HasSuffix(data, []byte("\r\n")) {
+		data = append(data[:len(data):len(data)], "\r\n"...)
+	}
+	return readRequest(bytes.NewReader(data), &Request{state: StateInitialized, httpu: true})
+}
+
+func isHTTPUMethod(method string) bool {
+	return method == "M-SEARCH" || method == "NOTIFY"
+}
@@ -1,9 +1,12 @@
 package request
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -28,18 +31,130 @@ type Request struct {
 	Headers     headers.Headers
 	Body        []byte
 	state       int // Parser state
+
+	offset int                     // bytes of the stream consumed by the parser so far
+	trace  func(state, offset int) // called on every state change, may be nil
+	httpu  bool                    // parsing a datagram, see RequestFromDatagram
+
+	chunked   bool        // the body has chunked transfer coding
+	chunkStep int         // where in a chunked body the parser is, see parseChunked
+	chunkLeft int64       // bytes left in the current chunk
+	bodyRead  int         // body bytes parsed so far
+	stream    *bodyReader // where the body goes instead of Body, see RequestHeadFromReader
+
+	// BodyReader streams the body of a request read by RequestHeadFromReader, which
+	// leaves Body nil. Trailers are filled in once it has returned io.EOF.
+	BodyReader io.Reader
+
+	// Trailers are the fields after a chunked body, parsed by RequestFromReader and
+	// sent by WriteTo; nil means none
+	Trailers headers.Headers
+
+	// Pattern is the route pattern that matched this request, e.g. "/users/{id}".
+	// It is set by the router and is empty until then.
+	Pattern string
+
+	// PathParams holds the values captured by the {name} and *name segments of Pattern
+	PathParams map[string]string
+
+	// RemoteAddr is the "ip:port" of the client, filled in by the server
+	RemoteAddr string
+
+	// TLS describes the TLS connection the request arrived on, including any
+	// verified client certificates in PeerCertificates. It is nil for plaintext.
+	TLS *tls.ConnectionState
 }
 
 type RequestLine struct {
 	HttpVersion   string // "1.1"
 	RequestTarget string // "/coffee"
-	Method        string // "GET", "POST", "PATCH", "PUT", or "DELETE"
+	Method        string // "GET", "HEAD", "POST", "PATCH", "PUT", "DELETE" or "OPTIONS"
+}
+
+// Path returns the request target without its query string
+func (r *Request) Path() string {
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
+
+// Query returns the parsed query string of the request target
+func (r *Request) Query() url.Values {
+	_, rawQuery, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	// ParseQuery keeps every well-formed pair even when it reports an error
+	values, _ := url.ParseQuery(rawQuery)
+	return values
+}
+
+// PathValue returns the value of the named path parameter, or "" if there is none
+func (r *Request) PathValue(name string) string {
+	return r.PathParams[name]
+}
+
+// SetPathValue sets the named path parameter, allocating the map if needed
+func (r *Request) SetPathValue(name, value string) {
+	if r.PathParams == nil {
+		r.PathParams = make(map[string]string)
+	}
+	r.PathParams[name] = value
+}
+
+// ParseError is returned by RequestFromReader for a malformed or incomplete request.
+// Offset is the position in the stream of the first byte the parser could not accept,
+// and State what it was parsing at the time.
+type ParseError struct {
+	Offset int
+	State  int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// StateName returns a short description of a parser state, e.g. "headers"
+func StateName(state int) string {
+	switch state {
+	case StateInitialized:
+		return "initialized"
+	case StateParsingRequestLine:
+		return "request line"
+	case StateParsingHeaders:
+		return "headers"
+	case StateParsingBody:
+		return "body"
+	case StateDone:
+		return "done"
+	}
+	return fmt.Sprintf("state %d", state)
 }
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	request := &Request{state: StateInitialized}
+	return RequestFromReaderTrace(reader, nil)
+}
+
+// RequestFromReaderTrace is RequestFromReader, calling trace each time the parser moves
+// to a new state with the number of bytes of the stream consumed before it. The last
+// call, for StateDone, gives the length of the request even if more was read.
+func RequestFromReaderTrace(reader io.Reader, trace func(state, offset int)) (*Request, error) {
+	return readRequest(reader, &Request{state: StateInitialized, trace: trace})
+}
+
+// RequestHeadFromReader parses the request line and headers, and leaves the body to be
+// read from BodyReader as it arrives instead of waiting for all of it. BodyReader is
+// nil if the request has no body.
+func RequestHeadFromReader(reader io.Reader) (*Request, error) {
+	request := &Request{state: StateInitialized, stream: &bodyReader{}}
+	return readRequest(reader, request)
+}
+
+func readRequest(reader io.Reader, request *Request) (*Request, error) {
 	buf := make([]byte, bufferSize)
 	readToIndex := 0
+	streaming := request.stream != nil
 
 	for {
 		// If the buffer is full, grow it
@@ -56,15 +171,16 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 		// Parse what we have so far, even if we hit EOF
 		consumed, parseErr := request.parseAndUpdateState(buf[:readToIndex])
 		if parseErr != nil {
-			return nil, parseErr
+			return nil, &ParseError{Offset: request.offset + consumed, State: request.state, Err: parseErr}
 		}
 
 		// Remove parsed data from the buffer
 		copy(buf, buf[consumed:])
 		readToIndex -= consumed
+		request.offset += consumed
 
 		// If parsing is done, return the request
-		if request.state == StateDone {
+		if request.state == StateDone || streaming && request.state == StateParsingBody {
 			break
 		}
 
@@ -72,20 +188,23 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 		if err == io.EOF {
 			// We hit EOF but parsing isn't done - this means incomplete request
 			// Check if we're in the body parsing phase and have a Content-Length header
+			if request.state == StateParsingBody && request.chunked {
+				return nil, request.incomplete(readToIndex, "incomplete chunked body")
+			}
 			if request.state == StateParsingBody {
 				contentLengthStr, ok := request.Headers["content-length"]
 				if ok {
 					contentLength, convErr := strconv.Atoi(contentLengthStr)
 					// Only check for short body if Content-Length > 0
-					if convErr == nil && contentLength > 0 && (request.Body == nil || len(request.Body) < contentLength) {
-						return nil, errors.New("Body shorter than reported content length")
+					if convErr == nil && contentLength > 0 && request.bodyRead < contentLength {
+						return nil, request.incomplete(readToIndex, "Body shorter than reported content length")
 					}
 				}
 				// If we have no Content-Length header or the body is complete, we're done
-				request.state = StateDone
+				request.setState(StateDone, request.offset)
 				break
 			}
-			return nil, errors.New("incomplete request")
+			return nil, request.incomplete(readToIndex, "incomplete request")
 		} else if err != nil {
 			// Handle other errors
 			return nil, err
@@ -97,27 +216,58 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 		}
 	}
 
+	if streaming {
+		request.stream.start(request, reader, buf[:readToIndex])
+	}
 	return request, nil
 }
 
+// incomplete reports a request cut short, after the buffered bytes the parser was waiting on
+func (r *Request) incomplete(buffered int, msg string) error {
+	return &ParseError{Offset: r.offset + buffered, State: r.state, Err: errors.New(msg)}
+}
+
+// setState moves the parser to state, telling the trace function if there is one
+func (r *Request) setState(state, offset int) {
+	if r.state == state {
+		return
+	}
+	r.state = state
+	if r.trace != nil {
+		r.trace(state, offset)
+	}
+}
+
+// parseAndUpdateState parses as much of data as it can. On error the count is the offset
+// in data of the bytes that were rejected.
 func (r *Request) parseAndUpdateState(data []byte) (int, error) {
 	if r.state == StateDone {
 		return 0, errors.New("error: trying to read data in a done state")
 	}
+	if r.state == StateInitialized {
+		r.setState(StateParsingRequestLine, r.offset)
+	}
 
 	totalBytesParsed := 0
 	for r.state != StateDone {
+		// The parse functions move r.state themselves; report the change here,
+		// where the offset in the stream is known
+		prev := r.state
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
-			return totalBytesParsed, err
+			return totalBytesParsed + n, err
+		}
+		totalBytesParsed += n
+
+		if next := r.state; next != prev {
+			r.state = prev
+			r.setState(next, r.offset+totalBytesParsed)
 		}
 
 		if n == 0 {
 			// Need more data
 			break
 		}
-
-		totalBytesParsed += n
 	}
 
 	return totalBytesParsed, nil
@@ -157,20 +307,20 @@ func (r *Request) parseRequestLine(data []byte) (int, error) {
 
 	// Validate the HTTP method
 	method := parts[0]
-	if !isValidMethod(method) {
-		return 0, errors.New("invalid method: expected GET, POST, PATCH, PUT, or DELETE")
+	if !IsValidMethod(method) && !(r.httpu && isHTTPUMethod(method)) {
+		return 0, errors.New("invalid method: expected GET, HEAD, POST, PATCH, PUT, DELETE, or OPTIONS")
 	}
 
 	// Validate the request target
 	requestTarget := parts[1]
-	if requestTarget == "" || !strings.HasPrefix(requestTarget, "/") {
-		return 0, errors.New("invalid request target: must start with '/'")
+	if !strings.HasPrefix(requestTarget, "/") && !(r.httpu && requestTarget == "*") {
+		return len(method) + 1, errors.New("invalid request target: must start with '/'")
 	}
 
 	// Validate the HTTP version
 	httpVersion, err := parseHttpVersion(parts[2])
 	if err != nil {
-		return 0, err
+		return len(method) + len(requestTarget) + 2, err
 	}
 
 	// Update the request state and request line
@@ -199,7 +349,7 @@ func (r *Request) parseHeaders(data []byte) (int, error) {
 		for bytesParsed < len(data) {
 			n, done, err := r.Headers.Parse(data[bytesParsed:])
 			if err != nil {
-				return 0, fmt.Errorf("error parsing headers: %w", err)
+				return bytesParsed, fmt.Errorf("error parsing headers: %w", err)
 			}
 
 			if n == 0 && !done {
@@ -225,7 +375,7 @@ func (r *Request) parseHeaders(data []byte) (int, error) {
 		for totalBytesParsed < len(headerData) {
 			n, done, err := r.Headers.Parse(headerData[totalBytesParsed:])
 			if err != nil {
-				return 0, fmt.Errorf("error parsing headers: %w", err)
+				return totalBytesParsed, fmt.Errorf("error parsing headers: %w", err)
 			}
 
 			totalBytesParsed += n
@@ -235,14 +385,33 @@ func (r *Request) parseHeaders(data []byte) (int, error) {
 			}
 		}
 
+		// The empty line found may be in the body, if the headers ended at the start of data
 		r.state = StateParsingBody
-		return emptyLinePos + 4, nil
+		return totalBytesParsed, nil
 	}
 }
 
 func (r *Request) parseBody(data []byte) (int, error) {
-	if len(data) == 0 {
-		return 0, nil
+	if r.chunked {
+		return r.parseChunked(data)
+	}
+
+	// Decide whether there is a body before waiting for data, otherwise a
+	// bodiless request on a live connection would block until the client hangs up
+	if te, ok := r.Headers["transfer-encoding"]; ok {
+		// A request body is delimited by chunked or nothing (RFC 9112 Section 6.3), and
+		// a Content-Length next to it could mean someone along the way framed it differently
+		if !headers.IsChunked(te) {
+			return 0, errors.New("invalid Transfer-Encoding: must end in chunked")
+		}
+		if _, ok := r.Headers["content-length"]; ok {
+			return 0, errors.New("invalid request: both Transfer-Encoding and Content-Length")
+		}
+		r.chunked = true
+		if r.stream == nil {
+			r.Body = []byte{}
+		}
+		return r.parseChunked(data)
 	}
 
 	contentLengthStr, ok := r.Headers["content-length"]
@@ -251,18 +420,28 @@ func (r *Request) parseBody(data []byte) (int, error) {
 		return 0, nil // No Content-Length is ok, just means no body
 	}
 
-	contentLength, err := strconv.Atoi(contentLengthStr)
+	n, err := headers.ParseContentLength(contentLengthStr)
 	if err != nil {
 		return 0, fmt.Errorf("invalid Content-Length: %w", err)
 	}
+	contentLength := int(n)
+
+	if contentLength == 0 {
+		r.state = StateDone
+		return 0, nil
+	}
+
+	if len(data) == 0 {
+		return 0, nil
+	}
 
 	// If we haven't initialized the body yet, do so now
-	if r.Body == nil {
+	if r.Body == nil && r.stream == nil {
 		r.Body = make([]byte, 0, contentLength)
 	}
 
 	// Calculate how many bytes we still need
-	bytesNeeded := contentLength - len(r.Body)
+	bytesNeeded := contentLength - r.bodyRead
 
 	// Calculate how many bytes we can read from the data
 	bytesToCopy := len(data)
@@ -271,12 +450,11 @@ func (r *Request) parseBody(data []byte) (int, error) {
 	}
 
 	// Copy the available bytes
-	r.Body = append(r.Body, data[:bytesToCopy]...)
+	r.appendBody(data[:bytesToCopy])
 
 	// If we've read the full body, mark as done
-	if len(r.Body) == contentLength {
+	if r.bodyRead == contentLength {
 		r.state = StateDone
-		fmt.Printf("Successfully processed the entire length of the data %d\n", bytesToCopy)
 		return bytesToCopy, nil
 	}
 
@@ -284,9 +462,88 @@ func (r *Request) parseBody(data []byte) (int, error) {
 	return bytesToCopy, nil
 }
 
-func isValidMethod(method string) bool {
+// appendBody adds parsed body bytes to Body, or to what BodyReader hands out next
+func (r *Request) appendBody(p []byte) {
+	r.bodyRead += len(p)
+	if r.stream != nil {
+		r.stream.pending = append(r.stream.pending, p...)
+		return
+	}
+	r.Body = append(r.Body, p...)
+}
+
+// Steps through a chunked body
+const (
+	chunkSize     = iota // waiting for a chunk-size line
+	chunkData            // inside a chunk
+	chunkEnd             // waiting for the CRLF after a chunk's data
+	chunkTrailers        // after the last chunk
+)
+
+// parseChunked takes one step through a chunked body, appending the chunks to Body and
+// collecting the trailer fields in Trailers
+func (r *Request) parseChunked(data []byte) (int, error) {
+	switch r.chunkStep {
+	case chunkSize:
+		lineEnd := bytes.Index(data, []byte("\r\n"))
+		if lineEnd == -1 {
+			return 0, nil // Need more data
+		}
+		size, err := headers.ParseChunkSize(string(data[:lineEnd]))
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			r.chunkStep = chunkTrailers
+		} else {
+			r.chunkLeft = size
+			r.chunkStep = chunkData
+		}
+		return lineEnd + 2, nil
+
+	case chunkData:
+		n := int(min(int64(len(data)), r.chunkLeft))
+		r.appendBody(data[:n])
+		if r.chunkLeft -= int64(n); r.chunkLeft == 0 {
+			r.chunkStep = chunkEnd
+		}
+		return n, nil
+
+	case chunkEnd:
+		if len(data) < 2 {
+			return 0, nil // Need more data
+		}
+		if data[0] != '\r' || data[1] != '\n' {
+			return 0, errors.New("invalid chunked body: chunk data longer than its size")
+		}
+		r.chunkStep = chunkSize
+		return 2, nil
+	}
+
+	if r.Trailers == nil {
+		r.Trailers = headers.NewHeaders()
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	n, done, err := r.Trailers.Parse(data)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing trailers: %w", err)
+	}
+	if done {
+		if len(r.Trailers) == 0 {
+			r.Trailers = nil
+		}
+		r.state = StateDone
+	}
+	return n, nil
+}
+
+// IsValidMethod reports whether the server handles method. Anything else is refused
+// before it reaches a handler, or the metrics, whichever protocol it came over.
+func IsValidMethod(method string) bool {
 	switch method {
-	case "GET", "POST", "PATCH", "PUT", "DELETE":
+	case "GET", "HEAD", "POST", "PATCH", "PUT", "DELETE", "OPTIONS":
 		return true
 	default:
 		return false
@@ -1,12 +1,16 @@
 package request
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
 )
 
 func TestRequestLineParse(t *testing.T) {
@@ -227,6 +231,265 @@ func TestRequestBody(t *testing.T) {
 	assert.Nil(t, r.Body)
 }
 
+func TestRequestChunkedBody(t *testing.T) {
+	data := "POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Trailer: X-Checksum\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n" +
+		"7;name=value\r\n world!\r\n" +
+		"0\r\n" +
+		"X-Checksum: abc\r\n" +
+		"\r\n"
+	next := "GET /next HTTP/1.1\r\n\r\n"
+
+	for _, perRead := range []int{1, 3, 8, len(data + next)} {
+		// The request ends after its trailers, leaving the next one on the stream
+		var length int
+		r, err := RequestFromReaderTrace(&chunkReader{data: data + next, numBytesPerRead: perRead}, func(state, offset int) {
+			length = offset
+		})
+		require.NoError(t, err, "reading %d bytes at a time", perRead)
+		assert.Equal(t, "hello world!", string(r.Body))
+		assert.Equal(t, headers.Headers{"x-checksum": "abc"}, r.Trailers)
+		assert.Equal(t, len(data), length)
+	}
+
+	t.Run("Does not wait past the last chunk", func(t *testing.T) {
+		r, err := RequestFromReader(&liveConnReader{data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n"})
+		require.NoError(t, err)
+		assert.Equal(t, "hi", string(r.Body))
+		assert.Nil(t, r.Trailers)
+	})
+
+	t.Run("Empty body", func(t *testing.T) {
+		r, err := RequestFromReader(&liveConnReader{data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"})
+		require.NoError(t, err)
+		assert.Empty(t, r.Body)
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		head := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"
+		for name, raw := range map[string]string{
+			"not chunked":     "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\nabc",
+			"with a length":   "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 2\r\n\r\n2\r\nhi\r\n0\r\n\r\n",
+			"bad chunk size":  head + "zz\r\nhi\r\n0\r\n\r\n",
+			"chunk overrun":   head + "2\r\nhello\r\n0\r\n\r\n",
+			"bad trailer":     head + "0\r\nno colon\r\n\r\n",
+			"truncated chunk": head + "a\r\nhello",
+			"no last chunk":   head + "2\r\nhi\r\n",
+		} {
+			_, err := RequestFromReader(&chunkReader{data: raw, numBytesPerRead: 3})
+			var parseErr *ParseError
+			require.ErrorAs(t, err, &parseErr, name)
+			assert.Equal(t, StateParsingBody, parseErr.State, name)
+		}
+	})
+}
+
+func TestRequestHeadFromReader(t *testing.T) {
+	for name, data := range map[string]string{
+		"Content-Length": "POST /upload HTTP/1.1\r\nContent-Length: 12\r\n\r\nhello world!",
+		"Chunked":        "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n7;x=y\r\n world!\r\n0\r\nX-Checksum: abc\r\n\r\n",
+	} {
+		for _, perRead := range []int{1, 3, 8, len(data)} {
+			r, err := RequestHeadFromReader(&chunkReader{data: data, numBytesPerRead: perRead})
+			require.NoError(t, err, name)
+			assert.Nil(t, r.Body, name)
+			require.NotNil(t, r.BodyReader, name)
+			body, err := io.ReadAll(r.BodyReader)
+			require.NoError(t, err, name)
+			assert.Equal(t, "hello world!", string(body), name)
+			if r.Headers["transfer-encoding"] != "" {
+				assert.Equal(t, headers.Headers{"x-checksum": "abc"}, r.Trailers, name)
+			}
+		}
+	}
+
+	t.Run("Returns before the body arrives", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		go pw.Write([]byte("PUT /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"))
+		r, err := RequestHeadFromReader(pr)
+		require.NoError(t, err)
+		assert.Equal(t, "/upload", r.RequestLine.RequestTarget)
+
+		buf := make([]byte, 16)
+		for _, part := range []string{"first", "second"} {
+			go fmt.Fprintf(pw, "%x\r\n%s\r\n", len(part), part)
+			n, err := io.ReadAtLeast(r.BodyReader, buf, len(part))
+			require.NoError(t, err)
+			assert.Equal(t, part, string(buf[:n]))
+		}
+		go pw.Write([]byte("0\r\n\r\n"))
+		n, err := r.BodyReader.Read(buf)
+		assert.Equal(t, 0, n)
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("No body", func(t *testing.T) {
+		for _, data := range []string{
+			"GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+			"POST / HTTP/1.1\r\nContent-Length: 0\r\n\r\n",
+		} {
+			r, err := RequestHeadFromReader(&liveConnReader{data: data})
+			require.NoError(t, err)
+			assert.Nil(t, r.BodyReader)
+		}
+	})
+
+	t.Run("Malformed body", func(t *testing.T) {
+		head := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"
+		for name, raw := range map[string]string{
+			"short body":     "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello",
+			"bad chunk size": head + "zz\r\nhi\r\n0\r\n\r\n",
+			"no last chunk":  head + "2\r\nhi\r\n",
+		} {
+			r, err := RequestHeadFromReader(&chunkReader{data: raw, numBytesPerRead: 3})
+			require.NoError(t, err, name)
+			_, err = io.ReadAll(r.BodyReader)
+			var parseErr *ParseError
+			require.ErrorAs(t, err, &parseErr, name)
+			assert.Equal(t, StateParsingBody, parseErr.State, name)
+		}
+
+		// Framing errors are found with the headers, before anything is handed to a handler
+		_, err := RequestHeadFromReader(&chunkReader{data: "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\nabc", numBytesPerRead: 3})
+		assert.Error(t, err)
+	})
+}
+
+// liveConnReader hands out its data and then fails instead of returning EOF,
+// like a client that keeps the connection open waiting for a response
+type liveConnReader struct {
+	data string
+	pos  int
+}
+
+func (lr *liveConnReader) Read(p []byte) (int, error) {
+	if lr.pos >= len(lr.data) {
+		return 0, errors.New("read past the end of the request")
+	}
+	n := copy(p, lr.data[lr.pos:])
+	lr.pos += n
+	return n, nil
+}
+
+func TestRequestDoesNotWaitForMissingBody(t *testing.T) {
+	t.Run("No Content-Length", func(t *testing.T) {
+		reader := &liveConnReader{data: "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "/", r.RequestLine.RequestTarget)
+		assert.Nil(t, r.Body)
+	})
+
+	t.Run("Zero Content-Length", func(t *testing.T) {
+		reader := &liveConnReader{data: "POST /submit HTTP/1.1\r\nContent-Length: 0\r\n\r\n"}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Empty(t, r.Body)
+	})
+
+	t.Run("HEAD and OPTIONS are accepted", func(t *testing.T) {
+		for _, method := range []string{"HEAD", "OPTIONS"} {
+			reader := &liveConnReader{data: method + " /coffee HTTP/1.1\r\n\r\n"}
+			r, err := RequestFromReader(reader)
+			require.NoError(t, err)
+			assert.Equal(t, method, r.RequestLine.Method)
+		}
+	})
+}
+
+func TestRequestTrace(t *testing.T) {
+	type step struct{ state, offset int }
+	trace := func(data string, perRead int) ([]step, *Request, error) {
+		var steps []step
+		r, err := RequestFromReaderTrace(&chunkReader{data: data, numBytesPerRead: perRead}, func(state, offset int) {
+			steps = append(steps, step{state, offset})
+		})
+		return steps, r, err
+	}
+
+	t.Run("Offsets of every state change", func(t *testing.T) {
+		data := "POST /submit HTTP/1.1\r\nContent-Length: 5\r\n\r\nhelloGET / HTTP/1.1\r\n"
+		want := []step{
+			{StateParsingRequestLine, 0},
+			{StateParsingHeaders, 23},
+			{StateParsingBody, 44},
+			{StateDone, 49},
+		}
+		for _, perRead := range []int{1, 3, 8, len(data)} {
+			steps, r, err := trace(data, perRead)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(r.Body))
+			assert.Equal(t, want, steps, "reading %d bytes at a time", perRead)
+		}
+	})
+
+	t.Run("Request without a body", func(t *testing.T) {
+		steps, _, err := trace("GET / HTTP/1.1\r\nHost: x\r\n\r\n", 4)
+		require.NoError(t, err)
+		assert.Equal(t, step{StateDone, 27}, steps[len(steps)-1])
+	})
+
+	t.Run("Errors point at the bad bytes", func(t *testing.T) {
+		cases := []struct {
+			data   string
+			offset int
+			state  int
+		}{
+			{"BREW /pot HTTP/1.1\r\n\r\n", 0, StateParsingRequestLine},
+			{"GET pot HTTP/1.1\r\n\r\n", 4, StateParsingRequestLine},
+			{"GET / HTTP/1.0\r\n\r\n", 6, StateParsingRequestLine},
+			{"GET / HTTP/1.1\r\nHost: x\r\nBad Header: y\r\n\r\n", 25, StateParsingHeaders},
+			{"GET / HTTP/1.1\r\nHost: x\r\n", 25, StateParsingHeaders},
+			{"POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc", 42, StateParsingBody},
+		}
+		for _, c := range cases {
+			for _, perRead := range []int{1, 7, len(c.data)} {
+				_, r, err := trace(c.data, perRead)
+				assert.Nil(t, r)
+				var perr *ParseError
+				require.ErrorAs(t, err, &perr, "%q", c.data)
+				assert.Equal(t, c.offset, perr.Offset, "%q reading %d bytes at a time", c.data, perRead)
+				assert.Equal(t, c.state, perr.State, "%q", c.data)
+			}
+		}
+	})
+}
+
+func TestRequestFromDatagram(t *testing.T) {
+	r, err := RequestFromDatagram([]byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: ssdp:all\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "M-SEARCH", r.RequestLine.Method)
+	assert.Equal(t, "*", r.RequestLine.RequestTarget)
+	assert.Equal(t, "\"ssdp:discover\"", r.Headers["man"])
+	assert.Equal(t, "ssdp:all", r.Headers["st"])
+
+	// Without the blank line at the end
+	r, err = RequestFromDatagram([]byte("NOTIFY * HTTP/1.1\r\nNT: upnp:rootdevice\r\nNTS: ssdp:byebye\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "NOTIFY", r.RequestLine.Method)
+	assert.Equal(t, "ssdp:byebye", r.Headers["nts"])
+
+	// Plain requests work as well
+	r, err = RequestFromDatagram([]byte("POST /echo HTTP/1.1\r\nContent-Length: 2\r\n\r\nhi"))
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(r.Body))
+
+	_, err = RequestFromDatagram([]byte("M-SEARCH * HTTP/1.1\r\nST: ssdp:all"))
+	assert.Error(t, err)
+	_, err = RequestFromDatagram(nil)
+	assert.Error(t, err)
+
+	// Over TCP neither is allowed
+	_, err = RequestFromReader(strings.NewReader("M-SEARCH / HTTP/1.1\r\n\r\n"))
+	assert.Error(t, err)
+	_, err = RequestFromReader(strings.NewReader("GET * HTTP/1.1\r\n\r\n"))
+	assert.Error(t, err)
+}
+
 type chunkReader struct {
 	data            string // The test data we want to simulate
 	numBytesPerRead int    // Simulate reading chunks of specific size
@@ -0,0 +1,131 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+)
+
+// WriteTo serializes the request to w in canonical wire format: the request line,
+// Host first, the other headers sorted with their usual casing, the framing headers
+// (Content-Length, or Transfer-Encoding and Trailer) and the body.
+//
+// The body goes out chunked, followed by Trailers, when Transfer-Encoding ends in
+// chunked or there are trailers to send. Otherwise it is framed by a Content-Length
+// computed from Body, whatever the headers said. Parsing the output with
+// RequestFromReader gives back the same request line, body and trailers, with the
+// framing headers WriteTo chose.
+func (r *Request) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	if err := r.write(&buf); err != nil {
+		return 0, err
+	}
+	return buf.WriteTo(w)
+}
+
+func (r *Request) write(buf *bytes.Buffer) error {
+	line := r.RequestLine
+	if !IsValidMethod(line.Method) {
+		return fmt.Errorf("invalid method %q", line.Method)
+	}
+	if !strings.HasPrefix(line.RequestTarget, "/") || strings.ContainsAny(line.RequestTarget, " \r\n") {
+		return fmt.Errorf("invalid request target %q", line.RequestTarget)
+	}
+	version := line.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+	fmt.Fprintf(buf, "%s %s HTTP/%s\r\n", line.Method, line.RequestTarget, version)
+
+	chunked := len(r.Trailers) > 0
+	if te, ok := r.Headers["transfer-encoding"]; ok {
+		chunked = chunked || headers.IsChunked(te)
+	}
+
+	if host, ok := r.Headers["host"]; ok {
+		if err := writeField(buf, "host", host); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedNames(r.Headers) {
+		switch name {
+		case "host", "content-length", "transfer-encoding", "trailer":
+			continue
+		}
+		if err := writeField(buf, name, r.Headers[name]); err != nil {
+			return err
+		}
+	}
+
+	if !chunked {
+		if _, ok := r.Headers["content-length"]; ok || len(r.Body) > 0 {
+			fmt.Fprintf(buf, "Content-Length: %d\r\n", len(r.Body))
+		}
+		buf.WriteString("\r\n")
+		buf.Write(r.Body)
+		return nil
+	}
+
+	te := r.Headers["transfer-encoding"]
+	if te == "" {
+		te = "chunked"
+	} else if !headers.IsChunked(te) {
+		te += ", chunked"
+	}
+	buf.WriteString("Transfer-Encoding: " + te + "\r\n")
+	// Announce the trailers unless the headers already do
+	if trailer, ok := r.Headers["trailer"]; ok {
+		if err := writeField(buf, "trailer", trailer); err != nil {
+			return err
+		}
+	} else if len(r.Trailers) > 0 {
+		names := sortedNames(r.Trailers)
+		for i, name := range names {
+			names[i] = textproto.CanonicalMIMEHeaderKey(name)
+		}
+		buf.WriteString("Trailer: " + strings.Join(names, ", ") + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	if len(r.Body) > 0 {
+		fmt.Fprintf(buf, "%x\r\n", len(r.Body))
+		buf.Write(r.Body)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("0\r\n")
+	for _, name := range sortedNames(r.Trailers) {
+		if err := writeField(buf, name, r.Trailers[name]); err != nil {
+			return err
+		}
+	}
+	buf.WriteString("\r\n")
+	return nil
+}
+
+// writeField writes one header line, refusing values that would split it in two
+func writeField(buf *bytes.Buffer, name, value string) error {
+	if name == "" || strings.ContainsAny(name, " :\r\n") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return errors.New("invalid value for header " + name)
+	}
+	buf.WriteString(textproto.CanonicalMIMEHeaderKey(name) + ": " + value + "\r\n")
+	return nil
+}
+
+// sortedNames returns the keys of h in order, so the same request is always written the same way
+func sortedNames(h map[string]string) []string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,176 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"math/rand"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+)
+
+func TestRequestWriteTo(t *testing.T) {
+	t.Run("Content-Length body", func(t *testing.T) {
+		r := &Request{
+			RequestLine: RequestLine{Method: "POST", RequestTarget: "/coffee?size=large", HttpVersion: "1.1"},
+			Headers: headers.Headers{
+				"user-agent":     "curl/7.81.0",
+				"host":           "localhost:42069",
+				"x-request-id":   "abc",
+				"content-length": "999", // recomputed from Body
+			},
+			Body: []byte("hello world!\n"),
+		}
+		var buf bytes.Buffer
+		n, err := r.WriteTo(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, int64(buf.Len()), n)
+		assert.Equal(t, "POST /coffee?size=large HTTP/1.1\r\n"+
+			"Host: localhost:42069\r\n"+
+			"User-Agent: curl/7.81.0\r\n"+
+			"X-Request-Id: abc\r\n"+
+			"Content-Length: 13\r\n"+
+			"\r\n"+
+			"hello world!\n", buf.String())
+	})
+
+	t.Run("No body", func(t *testing.T) {
+		r := &Request{RequestLine: RequestLine{Method: "GET", RequestTarget: "/"}, Headers: headers.Headers{"host": "example.com"}}
+		var buf bytes.Buffer
+		_, err := r.WriteTo(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", buf.String())
+	})
+
+	t.Run("Chunked body with trailers", func(t *testing.T) {
+		r := &Request{
+			RequestLine: RequestLine{Method: "PUT", RequestTarget: "/upload", HttpVersion: "1.1"},
+			Headers:     headers.Headers{"host": "example.com", "transfer-encoding": "gzip"},
+			Body:        []byte("compressed bytes"),
+			Trailers:    headers.Headers{"x-checksum": "abc123", "content-md5": "xyz"},
+		}
+		var buf bytes.Buffer
+		_, err := r.WriteTo(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, "PUT /upload HTTP/1.1\r\n"+
+			"Host: example.com\r\n"+
+			"Transfer-Encoding: gzip, chunked\r\n"+
+			"Trailer: Content-Md5, X-Checksum\r\n"+
+			"\r\n"+
+			"10\r\ncompressed bytes\r\n"+
+			"0\r\n"+
+			"Content-Md5: xyz\r\n"+
+			"X-Checksum: abc123\r\n"+
+			"\r\n", buf.String())
+	})
+
+	t.Run("Chunked without a body", func(t *testing.T) {
+		r := &Request{
+			RequestLine: RequestLine{Method: "POST", RequestTarget: "/"},
+			Headers:     headers.Headers{"transfer-encoding": "chunked", "trailer": "X-Sum"},
+		}
+		var buf bytes.Buffer
+		_, err := r.WriteTo(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n0\r\n\r\n", buf.String())
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		for name, r := range map[string]*Request{
+			"method":       {RequestLine: RequestLine{Method: "BREW", RequestTarget: "/"}},
+			"target":       {RequestLine: RequestLine{Method: "GET", RequestTarget: "/a b"}},
+			"header name":  {RequestLine: RequestLine{Method: "GET", RequestTarget: "/"}, Headers: headers.Headers{"bad name": "x"}},
+			"header value": {RequestLine: RequestLine{Method: "GET", RequestTarget: "/"}, Headers: headers.Headers{"x-evil": "a\r\nHost: evil"}},
+			"trailer":      {RequestLine: RequestLine{Method: "GET", RequestTarget: "/"}, Trailers: headers.Headers{"x-evil": "a\r\n"}},
+		} {
+			var buf bytes.Buffer
+			_, err := r.WriteTo(&buf)
+			assert.Error(t, err, name)
+			assert.Zero(t, buf.Len(), name)
+		}
+	})
+}
+
+// Parsing what WriteTo wrote gives back the request, and writing that gives back the same bytes
+func TestRequestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	methods := []string{"GET", "HEAD", "POST", "PATCH", "PUT", "DELETE", "OPTIONS"}
+	const tokenChars = "abcdefghijklmnopqrstuvwxyz0123456789-"
+	const valueChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 ;=/,.*\"()"
+
+	randString := func(chars string, min, max int) string {
+		b := make([]byte, min+rng.Intn(max-min+1))
+		for i := range b {
+			b[i] = chars[rng.Intn(len(chars))]
+		}
+		return string(b)
+	}
+
+	for i := 0; i < 500; i++ {
+		r := &Request{
+			RequestLine: RequestLine{
+				Method:        methods[rng.Intn(len(methods))],
+				RequestTarget: "/" + randString(tokenChars+"/", 0, 20),
+				HttpVersion:   "1.1",
+			},
+			Headers: headers.NewHeaders(),
+		}
+		r.Headers.Set("Host", "example.com")
+		for j := rng.Intn(6); j > 0; j-- {
+			// Values are trimmed when parsed, so don't start or end them with spaces
+			value := strings.TrimSpace(randString(valueChars, 1, 30))
+			r.Headers.Set("x-"+randString(tokenChars, 1, 10), value)
+		}
+		// No body, a Content-Length body, a chunked one, or a chunked one with trailers
+		framing := rng.Intn(4)
+		if framing > 0 {
+			r.Body = []byte(randString(valueChars+"\r\n", 0, 200))
+		}
+		switch framing {
+		case 1:
+			r.Headers.Set("Content-Length", fmt.Sprint(len(r.Body)))
+		case 2:
+			r.Headers.Set("Transfer-Encoding", "chunked")
+		case 3:
+			r.Trailers = headers.NewHeaders()
+			for j := 1 + rng.Intn(3); j > 0; j-- {
+				r.Trailers.Set("x-trailer-"+randString(tokenChars, 1, 10), strings.TrimSpace(randString(valueChars, 1, 30)))
+			}
+		}
+
+		var wire bytes.Buffer
+		_, err := r.WriteTo(&wire)
+		require.NoError(t, err)
+
+		parsed, err := RequestFromReader(&chunkReader{data: wire.String(), numBytesPerRead: 1 + rng.Intn(wire.Len())})
+		require.NoError(t, err, wire.String())
+		assert.Equal(t, r.RequestLine, parsed.RequestLine)
+		assert.Equal(t, string(r.Body), string(parsed.Body))
+		assert.Equal(t, r.Trailers, parsed.Trailers)
+		// The headers come back as they were, with the framing WriteTo chose
+		want := maps.Clone(r.Headers)
+		switch framing {
+		case 1:
+			want["content-length"] = fmt.Sprint(len(r.Body))
+		case 3:
+			want["transfer-encoding"] = "chunked"
+			names := sortedNames(r.Trailers)
+			for i, name := range names {
+				names[i] = textproto.CanonicalMIMEHeaderKey(name)
+			}
+			want["trailer"] = strings.Join(names, ", ")
+		}
+		assert.Equal(t, want, parsed.Headers)
+
+		var again bytes.Buffer
+		_, err = parsed.WriteTo(&again)
+		require.NoError(t, err)
+		assert.Equal(t, wire.String(), again.String())
+	}
+}
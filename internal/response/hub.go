@@ -0,0 +1,150 @@
+package response
+
+import (
+	"strconv"
+	"sync"
+)
+
+// subscriberBuffer is how many events may queue up for a slow subscriber
+// before the Hub gives up on it
+const subscriberBuffer = 64
+
+// Hub broadcasts events to every EventStream subscribed to it. It remembers the
+// most recent events so a client that reconnects with Last-Event-ID gets what it missed.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	history     []Event
+	historySize int
+	nextID      uint64
+	closed      bool
+}
+
+type subscriber struct {
+	events  chan Event
+	dropped chan struct{} // closed when the Hub removes the subscriber
+}
+
+// NewHub creates a hub that keeps the last historySize events for replay
+func NewHub(historySize int) *Hub {
+	return &Hub{
+		subscribers: make(map[*subscriber]struct{}),
+		historySize: historySize,
+	}
+}
+
+// Publish sends ev to every subscriber. Events without an ID are numbered by
+// the hub so they can be replayed. A subscriber too slow to keep up is dropped,
+// its client reconnects and catches up from the history.
+func (h *Hub) Publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+
+	h.nextID++
+	if ev.ID == "" {
+		ev.ID = strconv.FormatUint(h.nextID, 10)
+	}
+	if h.historySize > 0 {
+		if len(h.history) == h.historySize {
+			h.history = append(h.history[:0], h.history[1:]...)
+		}
+		h.history = append(h.history, ev)
+	}
+
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- ev:
+		default:
+			h.drop(sub)
+		}
+	}
+}
+
+// Serve subscribes s and relays events to it until the stream ends or the hub
+// is closed. lastEventID is the request's Last-Event-ID header; the events
+// published after it are sent first. It returns the error that ended the stream,
+// and closes s in any case, so its heartbeat stops before the handler returns.
+func (h *Hub) Serve(s *EventStream, lastEventID string) error {
+	defer s.Close()
+	sub, backlog := h.subscribe(lastEventID)
+	if sub == nil {
+		return ErrEventStreamClosed
+	}
+	defer h.unsubscribe(sub)
+
+	for _, ev := range backlog {
+		if err := s.Send(ev); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case ev := <-sub.events:
+			if err := s.Send(ev); err != nil {
+				return err
+			}
+		case <-sub.dropped:
+			return ErrEventStreamClosed
+		case <-s.Done():
+			return s.Err()
+		}
+	}
+}
+
+// Subscribers returns the number of streams currently subscribed
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+// Close drops every subscriber; Serve returns for each of them
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subscribers {
+		h.drop(sub)
+	}
+}
+
+// subscribe registers a subscriber and returns the history it missed since
+// lastEventID. An unknown ID replays nothing, as we can't tell what the client saw.
+func (h *Hub) subscribe(lastEventID string) (*subscriber, []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil
+	}
+
+	var backlog []Event
+	if lastEventID != "" {
+		for i, ev := range h.history {
+			if ev.ID == lastEventID {
+				backlog = append(backlog, h.history[i+1:]...)
+				break
+			}
+		}
+	}
+
+	sub := &subscriber{events: make(chan Event, subscriberBuffer), dropped: make(chan struct{})}
+	h.subscribers[sub] = struct{}{}
+	return sub, backlog
+}
+
+func (h *Hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[sub]; ok {
+		h.drop(sub)
+	}
+}
+
+// drop removes sub. h.mu must be held.
+func (h *Hub) drop(sub *subscriber) {
+	delete(h.subscribers, sub)
+	close(sub.dropped)
+}
@@ -0,0 +1,407 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+)
+
+// Parser states, in the order a response goes through them
+const (
+	parseStatusLine = iota
+	parseHeaders
+	parseBody      // Content-Length body
+	parseUntilEOF  // body delimited by the connection closing
+	parseChunkSize // waiting for a chunk-size line
+	parseChunkData // inside a chunk
+	parseChunkEnd  // waiting for the CRLF after a chunk's data
+	parseTrailers  // after the last chunk
+	parseDone
+)
+
+const parseBufferSize = 8 // Initial buffer size for reading data
+
+// ErrMalformedResponse is returned by ResponseFromReader, and by the client in internal/client,
+// for anything that isn't a valid HTTP/1.x response
+var ErrMalformedResponse = errors.New("malformed response")
+
+// Response is a parsed HTTP response, the counterpart of request.Request
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Body       []byte
+
+	// Trailers holds the fields sent after a chunked body, nil if there were none
+	Trailers headers.Headers
+
+	// Chunked reports whether the body came with chunked transfer coding
+	Chunked bool
+
+	state      int
+	method     string
+	contentLen int // body bytes expected in parseBody, or left in the chunk in parseChunkData
+}
+
+type StatusLine struct {
+	HttpVersion  string     // "1.1"
+	StatusCode   StatusCode // 200
+	ReasonPhrase string     // "OK", may be empty
+}
+
+// ResponseFromReader parses a response to a GET (or any request but HEAD) from reader
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	return ResponseFromReaderForMethod(reader, "GET")
+}
+
+// ResponseFromReaderForMethod parses a response to a request with the given method.
+// Responses to HEAD have no body whatever their headers say.
+//
+// The parser may read past the end of the response. Given a *bufio.Reader it takes
+// exactly the bytes of the response and leaves the rest buffered, so responses to
+// pipelined requests can be read one after another.
+func ResponseFromReaderForMethod(reader io.Reader, method string) (*Response, error) {
+	response := &Response{state: parseStatusLine, method: method}
+	if br, ok := reader.(*bufio.Reader); ok {
+		if err := response.readBuffered(br); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+	buf := make([]byte, parseBufferSize)
+	readToIndex := 0
+
+	for {
+		// If the buffer is full, grow it
+		if readToIndex == len(buf) {
+			newBuf := make([]byte, len(buf)*2)
+			copy(newBuf, buf)
+			buf = newBuf
+		}
+
+		n, err := reader.Read(buf[readToIndex:])
+		readToIndex += n
+
+		// Parse what we have so far, even if we hit EOF
+		consumed, parseErr := response.parseAndUpdateState(buf[:readToIndex])
+		if parseErr != nil {
+			return nil, parseErr
+		}
+
+		// Remove parsed data from the buffer
+		copy(buf, buf[consumed:])
+		readToIndex -= consumed
+
+		if response.state == parseDone {
+			break
+		}
+
+		if err == io.EOF {
+			if err := response.endOfInput(); err != nil {
+				return nil, err
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if n == 0 && consumed == 0 {
+			return nil, errors.New("no progress in reading or parsing")
+		}
+	}
+
+	return response, nil
+}
+
+// readBuffered parses straight from br's buffer, discarding only what it has parsed
+func (r *Response) readBuffered(br *bufio.Reader) error {
+	var err error
+	for {
+		data, _ := br.Peek(br.Buffered())
+		consumed, parseErr := r.parseAndUpdateState(data)
+		if parseErr != nil {
+			return parseErr
+		}
+		br.Discard(consumed)
+
+		if r.state == parseDone {
+			return nil
+		}
+		if err == io.EOF {
+			return r.endOfInput()
+		} else if err != nil {
+			return err
+		}
+
+		// Wait for more than what is buffered
+		_, err = br.Peek(br.Buffered() + 1)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return fmt.Errorf("%w: line longer than the %d byte read buffer", ErrMalformedResponse, br.Size())
+		}
+	}
+}
+
+// endOfInput finishes a response whose connection has closed: a body without a
+// length ends there, anything else was cut short
+func (r *Response) endOfInput() error {
+	switch r.state {
+	case parseUntilEOF:
+		r.state = parseDone
+		return nil
+	case parseBody:
+		return errors.New("body shorter than reported content length")
+	case parseChunkSize, parseChunkData, parseChunkEnd, parseTrailers:
+		return errors.New("incomplete chunked body")
+	}
+	return errors.New("incomplete response")
+}
+
+func (r *Response) parseAndUpdateState(data []byte) (int, error) {
+	if r.state == parseDone {
+		return 0, errors.New("error: trying to read data in a done state")
+	}
+
+	totalBytesParsed := 0
+	for r.state != parseDone {
+		n, err := r.parseSingle(data[totalBytesParsed:])
+		if err != nil {
+			return totalBytesParsed, err
+		}
+		if n == 0 {
+			// Need more data
+			break
+		}
+		totalBytesParsed += n
+	}
+
+	return totalBytesParsed, nil
+}
+
+func (r *Response) parseSingle(data []byte) (int, error) {
+	switch r.state {
+	case parseStatusLine:
+		return r.parseStatusLine(data)
+	case parseHeaders:
+		return r.parseHeaders(data)
+	case parseBody:
+		return r.parseBody(data)
+	case parseUntilEOF:
+		r.Body = append(r.Body, data...)
+		return len(data), nil
+	case parseChunkSize:
+		return r.parseChunkSize(data)
+	case parseChunkData:
+		return r.parseChunkData(data)
+	case parseChunkEnd:
+		return r.parseChunkEnd(data)
+	case parseTrailers:
+		return r.parseTrailers(data)
+	default:
+		return 0, fmt.Errorf("invalid state: %d", r.state)
+	}
+}
+
+func (r *Response) parseStatusLine(data []byte) (int, error) {
+	lineEnd := bytes.Index(data, []byte("\r\n"))
+	if lineEnd == -1 {
+		return 0, nil // Need more data
+	}
+
+	statusLine, err := ParseStatusLine(string(data[:lineEnd]))
+	if err != nil {
+		return 0, err
+	}
+	r.StatusLine = statusLine
+	r.Headers = headers.NewHeaders()
+	r.state = parseHeaders
+	return lineEnd + 2, nil
+}
+
+// ParseStatusLine parses a status line without its CRLF, e.g. "HTTP/1.1 404 Not Found".
+// The reason phrase may be empty.
+func ParseStatusLine(line string) (StatusLine, error) {
+	version, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return StatusLine{}, fmt.Errorf("%w: invalid status line %q", ErrMalformedResponse, line)
+	}
+	httpVersion, ok := strings.CutPrefix(version, "HTTP/")
+	if !ok || (httpVersion != "1.1" && httpVersion != "1.0") {
+		return StatusLine{}, fmt.Errorf("%w: invalid HTTP version %q", ErrMalformedResponse, version)
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+	statusCode, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 || statusCode < 100 {
+		return StatusLine{}, fmt.Errorf("%w: invalid status code %q", ErrMalformedResponse, code)
+	}
+	return StatusLine{HttpVersion: httpVersion, StatusCode: StatusCode(statusCode), ReasonPhrase: reason}, nil
+}
+
+// ParseContentLength is headers.ParseContentLength, failing with ErrMalformedResponse
+func ParseContentLength(value string) (int64, error) {
+	n, err := headers.ParseContentLength(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+	}
+	return n, nil
+}
+
+// ParseChunkSize is headers.ParseChunkSize, failing with ErrMalformedResponse
+func ParseChunkSize(line string) (int64, error) {
+	size, err := headers.ParseChunkSize(line)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+	}
+	return size, nil
+}
+
+func (r *Response) parseHeaders(data []byte) (int, error) {
+	totalBytesParsed := 0
+	for {
+		n, done, err := r.Headers.Parse(data[totalBytesParsed:])
+		if errors.Is(err, headers.ErrInvalidData) {
+			// Nothing left to parse yet
+			return totalBytesParsed, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: error parsing headers: %w", ErrMalformedResponse, err)
+		}
+		if n == 0 {
+			return totalBytesParsed, nil // Need more data
+		}
+		totalBytesParsed += n
+		if done {
+			break
+		}
+	}
+
+	// 1xx responses are interim, the real one follows (101 ends HTTP on the connection)
+	code := r.StatusLine.StatusCode
+	if code >= 100 && code < 200 && code != StatusSwitchingProtocols {
+		r.state = parseStatusLine
+		return totalBytesParsed, nil
+	}
+	if err := r.startBody(); err != nil {
+		return 0, err
+	}
+	return totalBytesParsed, nil
+}
+
+// startBody picks the body framing from the headers (RFC 9112 Section 6.3)
+func (r *Response) startBody() error {
+	code := r.StatusLine.StatusCode
+	if r.method == "HEAD" || code < 200 || code == StatusNoContent || code == StatusNotModified {
+		r.state = parseDone
+		return nil
+	}
+
+	if te, ok := r.Headers["transfer-encoding"]; ok {
+		if headers.IsChunked(te) {
+			r.Chunked = true
+			r.Body = []byte{}
+			r.state = parseChunkSize
+		} else {
+			r.state = parseUntilEOF
+		}
+		return nil
+	}
+
+	contentLengthStr, ok := r.Headers["content-length"]
+	if !ok {
+		r.state = parseUntilEOF
+		return nil
+	}
+	contentLength, err := ParseContentLength(contentLengthStr)
+	if err != nil {
+		return err
+	}
+	if contentLength == 0 {
+		r.Body = []byte{}
+		r.state = parseDone
+		return nil
+	}
+	r.contentLen = int(contentLength)
+	r.Body = make([]byte, 0, contentLength)
+	r.state = parseBody
+	return nil
+}
+
+func (r *Response) parseBody(data []byte) (int, error) {
+	bytesToCopy := min(len(data), r.contentLen-len(r.Body))
+	r.Body = append(r.Body, data[:bytesToCopy]...)
+	if len(r.Body) == r.contentLen {
+		r.state = parseDone
+	}
+	return bytesToCopy, nil
+}
+
+func (r *Response) parseChunkSize(data []byte) (int, error) {
+	lineEnd := bytes.Index(data, []byte("\r\n"))
+	if lineEnd == -1 {
+		return 0, nil // Need more data
+	}
+	size, err := ParseChunkSize(string(data[:lineEnd]))
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		r.state = parseTrailers
+	} else {
+		r.contentLen = int(size)
+		r.state = parseChunkData
+	}
+	return lineEnd + 2, nil
+}
+
+func (r *Response) parseChunkData(data []byte) (int, error) {
+	bytesToCopy := min(len(data), r.contentLen)
+	r.Body = append(r.Body, data[:bytesToCopy]...)
+	r.contentLen -= bytesToCopy
+	if r.contentLen == 0 {
+		r.state = parseChunkEnd
+	}
+	return bytesToCopy, nil
+}
+
+func (r *Response) parseChunkEnd(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, nil // Need more data
+	}
+	if data[0] != '\r' || data[1] != '\n' {
+		return 0, fmt.Errorf("%w: chunk data longer than its size", ErrMalformedResponse)
+	}
+	r.state = parseChunkSize
+	return 2, nil
+}
+
+func (r *Response) parseTrailers(data []byte) (int, error) {
+	if r.Trailers == nil {
+		r.Trailers = headers.NewHeaders()
+	}
+	totalBytesParsed := 0
+	for {
+		n, done, err := r.Trailers.Parse(data[totalBytesParsed:])
+		if errors.Is(err, headers.ErrInvalidData) {
+			return totalBytesParsed, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: error parsing trailers: %w", ErrMalformedResponse, err)
+		}
+		if n == 0 {
+			return totalBytesParsed, nil // Need more data
+		}
+		totalBytesParsed += n
+		if done {
+			break
+		}
+	}
+	if len(r.Trailers) == 0 {
+		r.Trailers = nil
+	}
+	r.state = parseDone
+	return totalBytesParsed, nil
+}
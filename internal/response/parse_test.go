@@ -0,0 +1,282 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+)
+
+// chunkReader hands out data numBytesPerRead bytes at a time, like request_test.go's
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+// parseAtEverySize parses data with every read size from 1 byte to all of it,
+// so each state sees its input split at every possible boundary
+func parseAtEverySize(t *testing.T, data, method string) []*Response {
+	t.Helper()
+	var responses []*Response
+	for size := 1; size <= len(data); size++ {
+		r, err := ResponseFromReaderForMethod(&chunkReader{data: data, numBytesPerRead: size}, method)
+		require.NoError(t, err, "reading %d bytes at a time", size)
+		responses = append(responses, r)
+	}
+	return responses
+}
+
+func TestStatusLineParse(t *testing.T) {
+	for _, r := range parseAtEverySize(t, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n", "GET") {
+		assert.Equal(t, "1.1", r.StatusLine.HttpVersion)
+		assert.Equal(t, StatusNotFound, r.StatusLine.StatusCode)
+		assert.Equal(t, "Not Found", r.StatusLine.ReasonPhrase)
+	}
+
+	// The reason phrase is optional, and HTTP/1.0 servers are still around
+	for _, r := range parseAtEverySize(t, "HTTP/1.0 200 \r\nContent-Length: 0\r\n\r\n", "GET") {
+		assert.Equal(t, "1.0", r.StatusLine.HttpVersion)
+		assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+		assert.Empty(t, r.StatusLine.ReasonPhrase)
+	}
+
+	for _, bad := range []string{
+		"HTTP/1.1\r\n\r\n",
+		"HTTP/1.1 20 OK\r\n\r\n",
+		"HTTP/1.1 abc OK\r\n\r\n",
+		"HTTP/2 200 OK\r\n\r\n",
+		"200 OK HTTP/1.1\r\n\r\n",
+	} {
+		_, err := ResponseFromReader(&chunkReader{data: bad, numBytesPerRead: 1})
+		assert.ErrorIs(t, err, ErrMalformedResponse, bad)
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	t.Run("Standard Headers", func(t *testing.T) {
+		for _, r := range parseAtEverySize(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nX-Thing: a\r\nX-Thing: b\r\nContent-Length: 0\r\n\r\n", "GET") {
+			assert.Equal(t, "text/plain", r.Headers["content-type"])
+			assert.Equal(t, "a, b", r.Headers["x-thing"])
+		}
+	})
+
+	t.Run("Malformed Header", func(t *testing.T) {
+		_, err := ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nContent-Type text/plain\r\n\r\n", numBytesPerRead: 3})
+		assert.ErrorIs(t, err, ErrMalformedResponse)
+	})
+
+	t.Run("Missing End of Headers", func(t *testing.T) {
+		_, err := ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n", numBytesPerRead: 3})
+		assert.Error(t, err)
+	})
+
+	t.Run("Interim responses are skipped", func(t *testing.T) {
+		data := "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </style.css>\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+		for _, r := range parseAtEverySize(t, data, "GET") {
+			assert.Equal(t, StatusOK, r.StatusLine.StatusCode)
+			assert.NotContains(t, r.Headers, "link")
+			assert.Equal(t, "ok", string(r.Body))
+		}
+	})
+}
+
+func TestResponseBody(t *testing.T) {
+	t.Run("Content-Length", func(t *testing.T) {
+		for _, r := range parseAtEverySize(t, "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nhello world!\n", "GET") {
+			assert.Equal(t, "hello world!\n", string(r.Body))
+			assert.False(t, r.Chunked)
+		}
+	})
+
+	t.Run("Chunked with extensions and trailers", func(t *testing.T) {
+		data := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+			"5;name=value\r\nhello\r\n" +
+			"7\r\n, world\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n"
+		for _, r := range parseAtEverySize(t, data, "GET") {
+			assert.True(t, r.Chunked)
+			assert.Equal(t, "hello, world", string(r.Body))
+			assert.Equal(t, headers.Headers{"x-checksum": "abc123"}, r.Trailers)
+		}
+	})
+
+	t.Run("Chunked without trailers", func(t *testing.T) {
+		for _, r := range parseAtEverySize(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", "GET") {
+			assert.Equal(t, "abc", string(r.Body))
+			assert.Nil(t, r.Trailers)
+		}
+	})
+
+	t.Run("Chunked wins over Content-Length", func(t *testing.T) {
+		for _, r := range parseAtEverySize(t, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", "GET") {
+			assert.Equal(t, "abc", string(r.Body))
+		}
+	})
+
+	t.Run("Delimited by the connection closing", func(t *testing.T) {
+		for _, r := range parseAtEverySize(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nall of this, until EOF", "GET") {
+			assert.Equal(t, "all of this, until EOF", string(r.Body))
+		}
+	})
+
+	t.Run("No body for HEAD, 204 and 304", func(t *testing.T) {
+		// A live connection: anything read past the response would be a bug
+		for _, tc := range []struct{ method, data string }{
+			{"HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"},
+			{"GET", "HTTP/1.1 204 No Content\r\n\r\n"},
+			{"GET", "HTTP/1.1 304 Not Modified\r\nContent-Length: 100\r\n\r\n"},
+			{"GET", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+		} {
+			r, err := ResponseFromReaderForMethod(&liveConnReader{data: tc.data}, tc.method)
+			require.NoError(t, err, tc.data)
+			assert.Empty(t, r.Body, tc.data)
+		}
+	})
+
+	t.Run("Body shorter than reported content length", func(t *testing.T) {
+		_, err := ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\npartial content", numBytesPerRead: 3})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "body shorter than reported content length")
+	})
+
+	t.Run("Bad chunked bodies", func(t *testing.T) {
+		for name, data := range map[string]string{
+			"truncated chunk":    "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\nshort",
+			"missing last chunk": "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n",
+			"bad size":           "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nok\r\n0\r\n\r\n",
+			"chunk overrun":      "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nokay\r\n0\r\n\r\n",
+			"bad trailer":        "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nno colon\r\n\r\n",
+		} {
+			_, err := ResponseFromReader(&chunkReader{data: data, numBytesPerRead: 2})
+			assert.Error(t, err, name)
+		}
+	})
+
+	t.Run("Conflicting Content-Length", func(t *testing.T) {
+		_, err := ResponseFromReader(&chunkReader{data: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 3\r\n\r\nok", numBytesPerRead: 3})
+		assert.ErrorIs(t, err, ErrMalformedResponse)
+	})
+}
+
+// liveConnReader hands out its data and then fails instead of returning EOF,
+// like a server that keeps the connection open for the next request
+type liveConnReader struct {
+	data string
+	pos  int
+}
+
+func (lr *liveConnReader) Read(p []byte) (int, error) {
+	if lr.pos >= len(lr.data) {
+		return 0, io.ErrNoProgress
+	}
+	n := copy(p, lr.data[lr.pos:])
+	lr.pos += n
+	return n, nil
+}
+
+// Given a *bufio.Reader, the parser leaves the next response where it is
+func TestPipelinedResponses(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nfirst" +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nsecond\r\n0\r\nX-Part: 2\r\n\r\n" +
+		"HTTP/1.1 204 No Content\r\n\r\n" +
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\n\r\nthe rest, until EOF"
+
+	for size := 1; size <= len(data); size++ {
+		br := bufio.NewReaderSize(&chunkReader{data: data, numBytesPerRead: size}, 64)
+		var bodies []string
+		for i := 0; i < 4; i++ {
+			r, err := ResponseFromReader(br)
+			require.NoError(t, err, "response %d, reading %d bytes at a time", i, size)
+			bodies = append(bodies, string(r.Body))
+			if i == 1 {
+				assert.Equal(t, "2", r.Trailers["x-part"])
+			}
+		}
+		assert.Equal(t, []string{"first", "second", "", "the rest, until EOF"}, bodies)
+	}
+
+	t.Run("A buffered response doesn't wait for more", func(t *testing.T) {
+		br := bufio.NewReader(&liveConnReader{data: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"})
+		r, err := ResponseFromReader(br)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", string(r.Body))
+	})
+
+	t.Run("Lines longer than the buffer", func(t *testing.T) {
+		br := bufio.NewReaderSize(&chunkReader{data: "HTTP/1.1 200 OK\r\nX-Long: " + strings.Repeat("a", 100) + "\r\n\r\n", numBytesPerRead: 7}, 16)
+		_, err := ResponseFromReader(br)
+		assert.ErrorIs(t, err, ErrMalformedResponse)
+	})
+
+	t.Run("Cut short", func(t *testing.T) {
+		br := bufio.NewReaderSize(&chunkReader{data: "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\npartial", numBytesPerRead: 3}, 64)
+		_, err := ResponseFromReader(br)
+		assert.EqualError(t, err, "body shorter than reported content length")
+	})
+}
+
+// What the Writer produces, the parser reads back
+func TestWriterRoundTrip(t *testing.T) {
+	t.Run("fixed body", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		require.NoError(t, w.WriteStatusLine(StatusCreated))
+		require.NoError(t, w.WriteHeaders(h))
+		_, err := w.WriteBody([]byte("made it"))
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+
+		for _, r := range parseAtEverySize(t, buf.String(), "GET") {
+			assert.Equal(t, StatusCreated, r.StatusLine.StatusCode)
+			assert.Equal(t, "Created", r.StatusLine.ReasonPhrase)
+			assert.Equal(t, "text/plain", r.Headers["content-type"])
+			assert.Equal(t, "made it", string(r.Body))
+		}
+	})
+
+	t.Run("chunked body with trailers", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Count")
+		require.NoError(t, w.WriteStatusLine(StatusOK))
+		require.NoError(t, w.WriteHeaders(h))
+		for _, part := range []string{"one ", "two ", "three"} {
+			_, err := w.WriteChunkedBody([]byte(part))
+			require.NoError(t, err)
+		}
+		_, err := w.WriteChunkedBodyDone()
+		require.NoError(t, err)
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Count", "3")
+		require.NoError(t, w.WriteTrailers(trailers))
+
+		for _, r := range parseAtEverySize(t, buf.String(), "GET") {
+			assert.True(t, r.Chunked)
+			assert.Equal(t, "one two three", string(r.Body))
+			assert.Equal(t, "3", r.Trailers["x-count"])
+		}
+	})
+}
@@ -1,10 +1,12 @@
 package response
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"time"
 
 	"httpfromtcp/internal/headers"
@@ -14,11 +16,51 @@ type StatusCode int
 
 // fake ENUM in Golang
 const (
-	StatusOK          StatusCode = 200
-	StatusBadRequest  StatusCode = 400
-	StatusServerError StatusCode = 500
+	StatusSwitchingProtocols StatusCode = 101
+	StatusOK                 StatusCode = 200
+	StatusCreated            StatusCode = 201
+	StatusNoContent          StatusCode = 204
+	StatusMovedPermanently   StatusCode = 301
+	StatusFound              StatusCode = 302
+	StatusNotModified        StatusCode = 304
+	StatusBadRequest         StatusCode = 400
+	StatusForbidden          StatusCode = 403
+	StatusNotFound           StatusCode = 404
+	StatusMethodNotAllowed   StatusCode = 405
+	StatusUpgradeRequired    StatusCode = 426
+	StatusServerError        StatusCode = 500
+	StatusNotImplemented     StatusCode = 501
+	StatusBadGateway         StatusCode = 502
+	StatusServiceUnavailable StatusCode = 503
+	StatusGatewayTimeout     StatusCode = 504
 )
 
+// reasonPhrases maps the status codes we know about to their standard reason phrase
+var reasonPhrases = map[StatusCode]string{
+	StatusSwitchingProtocols: "Switching Protocols",
+	StatusOK:                 "OK",
+	StatusCreated:            "Created",
+	StatusNoContent:          "No Content",
+	StatusMovedPermanently:   "Moved Permanently",
+	StatusFound:              "Found",
+	StatusNotModified:        "Not Modified",
+	StatusBadRequest:         "Bad Request",
+	StatusForbidden:          "Forbidden",
+	StatusNotFound:           "Not Found",
+	StatusMethodNotAllowed:   "Method Not Allowed",
+	StatusUpgradeRequired:    "Upgrade Required",
+	StatusServerError:        "Internal Server Error",
+	StatusNotImplemented:     "Not Implemented",
+	StatusBadGateway:         "Bad Gateway",
+	StatusServiceUnavailable: "Service Unavailable",
+	StatusGatewayTimeout:     "Gateway Timeout",
+}
+
+// StatusText returns the reason phrase for the status code, or "" if it is unknown
+func StatusText(code StatusCode) string {
+	return reasonPhrases[code]
+}
+
 // Writer state enum
 const (
 	stateInitialized = iota
@@ -33,6 +75,20 @@ const (
 // ErrInvalidWriteState is returned when methods are called in the wrong order
 var ErrInvalidWriteState = errors.New("invalid state: operations must be called in order (status, headers, body)")
 
+// ErrResponseCommitted is returned by Reset once part of the response has been sent
+var ErrResponseCommitted = errors.New("response already committed: bytes have been sent to the client")
+
+// ErrNotHijackable is returned by Hijack when the transport can't hand over its
+// connection, e.g. an HTTP/2 stream that shares it with other requests
+var ErrNotHijackable = errors.New("connection can't be hijacked")
+
+// ErrHijacked is returned by every write once the connection has been hijacked
+var ErrHijacked = errors.New("connection has been hijacked")
+
+// Hijacker hands the connection over to the handler; see Writer.Hijack.
+// The ReadWriter holds any bytes the server already read past the request.
+type Hijacker func() (net.Conn, *bufio.ReadWriter, error)
+
 // Writer encapsulates an HTTP response with methods for sending the
 // status line, headers, and body in the correct order
 type Writer struct {
@@ -43,6 +99,25 @@ type Writer struct {
 	state      int
 	chunked    bool
 	trailers   headers.Headers
+	omitBody   bool
+	written    int64 // body bytes accepted so far, chunked or not
+	committed  bool  // status line and headers have been sent
+	stream     StreamWriter
+	hijacker   Hijacker
+	hijacked   bool
+	notifier   func() <-chan struct{}
+}
+
+// StreamWriter carries a response over a framed transport such as an HTTP/2 stream
+// instead of HTTP/1.1 text. The Writer keeps its usual buffering and ordering rules
+// and hands the transport the finished pieces.
+type StreamWriter interface {
+	// WriteHead sends the status and headers; endStream means no body follows
+	WriteHead(status StatusCode, h headers.Headers, endStream bool) error
+	// WriteData sends body bytes; endStream marks the last of them
+	WriteData(p []byte, endStream bool) error
+	// WriteTrailers sends the trailers, which end the response
+	WriteTrailers(h headers.Headers) error
 }
 
 // NewWriter creates a new response writer
@@ -56,8 +131,128 @@ func NewWriter(w io.Writer) *Writer {
 	}
 }
 
+// NewStreamWriter creates a response writer that sends the response through s
+func NewStreamWriter(s StreamWriter) *Writer {
+	w := NewWriter(io.Discard)
+	w.stream = s
+	return w
+}
+
+// SetHijacker makes the connection available to Hijack; the server calls it for HTTP/1.1 connections
+func (w *Writer) SetHijacker(h Hijacker) {
+	w.hijacker = h
+}
+
+// Hijack lets the handler take over the connection, e.g. to speak WebSocket on it.
+// A status line and headers written before are sent first, so a handler can answer
+// 101 Switching Protocols and continue on the raw connection. Afterwards the Writer
+// is done: the server sends nothing more, and closing the connection is up to the handler.
+func (w *Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	if w.committed {
+		return nil, nil, ErrResponseCommitted
+	}
+
+	conn, rw, err := w.hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if w.state >= stateStatusWritten {
+		w.writer = rw.Writer
+		if err := w.writeHead(false); err != nil {
+			return nil, nil, err
+		}
+		if err := rw.Flush(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	w.hijacked = true
+	w.committed = true
+	w.writer = io.Discard
+	return conn, rw, nil
+}
+
+// SetCloseNotifier provides the channel CloseNotify returns; the server calls it
+func (w *Writer) SetCloseNotifier(f func() <-chan struct{}) {
+	w.notifier = f
+}
+
+// CloseNotify returns a channel that is closed once the client goes away, so a
+// long-running handler can stop. It is nil, and never fires, when the transport
+// can't tell. Don't combine it with Hijack: both want to read the connection.
+func (w *Writer) CloseNotify() <-chan struct{} {
+	if w.notifier == nil {
+		return nil
+	}
+	return w.notifier()
+}
+
+// Hijacked reports whether the handler took over the connection
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// SuppressBody makes Flush send the status line and headers, including the
+// Content-Length the body would have had, but not the body itself.
+// This is what a response to a HEAD request looks like on the wire.
+func (w *Writer) SuppressBody() {
+	w.omitBody = true
+}
+
+// Header returns the headers that will be sent with the response.
+// Values set here before WriteHeaders act as defaults: WriteHeaders merges
+// the handler's headers on top, replacing any with the same key.
+func (w *Writer) Header() headers.Headers {
+	return w.headers
+}
+
+// StatusCode returns the status code passed to WriteStatusLine, or 0 if none has been written yet
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns the number of body bytes written so far,
+// not counting the status line, headers or chunk framing
+func (w *Writer) BytesWritten() int64 {
+	return w.written
+}
+
+// Committed reports whether the status line and headers have already been sent.
+// Until then the whole response only lives in memory and can still be replaced.
+func (w *Writer) Committed() bool {
+	return w.committed
+}
+
+// Reset discards everything written so far so the response can be started again,
+// e.g. to replace a half-built response with an error page.
+// It fails with ErrResponseCommitted once bytes have gone out to the client.
+func (w *Writer) Reset() error {
+	if w.committed {
+		return ErrResponseCommitted
+	}
+
+	w.statusCode = 0
+	w.headers = headers.NewHeaders()
+	w.body.Reset()
+	w.state = stateInitialized
+	w.chunked = false
+	w.trailers = headers.NewHeaders()
+	w.written = 0
+	return nil
+}
+
 // WriteStatusLine writes the HTTP status line with the provided status code
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
 	if w.state != stateInitialized {
 		return ErrInvalidWriteState
 	}
@@ -69,6 +264,9 @@ func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 
 // WriteHeaders writes the provided headers to the response
 func (w *Writer) WriteHeaders(h headers.Headers) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
 	if w.state != stateStatusWritten {
 		return ErrInvalidWriteState
 	}
@@ -89,11 +287,15 @@ func (w *Writer) WriteHeaders(h headers.Headers) error {
 
 // WriteBody writes the provided bytes to the response body
 func (w *Writer) WriteBody(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 	if w.state != stateHeadersWritten {
 		return 0, ErrInvalidWriteState
 	}
 
 	n, err := w.body.Write(p)
+	w.written += int64(n)
 	if err != nil {
 		return n, err
 	}
@@ -137,6 +339,10 @@ Never go full Java
 // Each chunk is prefixed with the chunk size in hexadecimal followed by CRLF
 // and is terminated with CRLF
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+
 	// We can start chunked body mode either right after setting headers
 	// or after having written previous chunks
 	if w.state != stateHeadersWritten && w.state != stateChunkedBodyStarted {
@@ -147,11 +353,34 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	w.chunked = true
 	w.state = stateChunkedBodyStarted
 
+	// The status line and headers have to go out before the first chunk
+	if !w.committed {
+		delete(w.headers, "content-length")
+		w.headers["transfer-encoding"] = "chunked"
+		if err := w.writeHead(w.omitBody); err != nil {
+			return 0, err
+		}
+	}
+
+	// Responses to HEAD stop after the headers
+	if w.omitBody {
+		return len(p), nil
+	}
+
 	// If there's no data to write, don't create a chunk
 	if len(p) == 0 {
 		return 0, nil
 	}
 
+	// Framed transports have their own chunking
+	if w.stream != nil {
+		if err := w.stream.WriteData(p, false); err != nil {
+			return 0, err
+		}
+		w.written += int64(len(p))
+		return len(p), nil
+	}
+
 	// Write chunk size in hex followed by CRLF
 	chunkSizeHex := fmt.Sprintf("%x", len(p))
 	_, err := fmt.Fprintf(w.writer, "%s\r\n", chunkSizeHex)
@@ -161,6 +390,7 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 
 	// Write the actual chunk data
 	n, err := w.writer.Write(p)
+	w.written += int64(n)
 	if err != nil {
 		return n, err
 	}
@@ -180,13 +410,18 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 		return 0, ErrInvalidWriteState
 	}
 
+	w.state = stateChunkedBodyDone
+	if w.omitBody || w.stream != nil {
+		// A stream is ended by the trailers or by Flush
+		return 0, nil
+	}
+
 	// Write the final chunk with zero size
 	_, err := fmt.Fprint(w.writer, "0\r\n")
 	if err != nil {
 		return 0, err
 	}
 
-	w.state = stateChunkedBodyDone
 	return 0, nil
 }
 
@@ -196,6 +431,14 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 		return ErrInvalidWriteState
 	}
 
+	w.state = stateTrailersWritten
+	if w.omitBody {
+		return nil
+	}
+	if w.stream != nil {
+		return w.stream.WriteTrailers(h)
+	}
+
 	// Write trailers as headers
 	for key, value := range h {
 		_, err := fmt.Fprintf(w.writer, "%s: %s\r\n", key, value)
@@ -206,16 +449,15 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 
 	// Write the final empty line
 	_, err := fmt.Fprint(w.writer, "\r\n")
-	if err != nil {
-		return err
-	}
-
-	w.state = stateTrailersWritten
-	return nil
+	return err
 }
 
 // Flush finalizes and sends the complete HTTP response to the underlying writer
 func (w *Writer) Flush() error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+
 	// Ensure we've at least set a status code and headers
 	if w.state < stateStatusWritten {
 		return errors.New("cannot flush response: status code not set")
@@ -226,81 +468,99 @@ func (w *Writer) Flush() error {
 		w.WriteHeaders(headers.NewHeaders())
 	}
 
-	// Skip further processing if we're already in chunked mode with trailers
-	if w.state == stateTrailersWritten {
-		return nil
-	}
+	// A chunked response has already sent its head; just terminate the body
+	if w.committed {
+		var terminator string
+		switch w.state {
+		case stateChunkedBodyStarted:
+			// The handler never called WriteChunkedBodyDone, so finish for it
+			terminator = "0\r\n\r\n"
+		case stateChunkedBodyDone:
+			// No trailers were written, write the final CRLF
+			terminator = "\r\n"
+		default:
+			return nil
+		}
 
-	// If we're in chunked mode but no trailers were written, write the final CRLF
-	if w.state == stateChunkedBodyDone {
-		_, err := fmt.Fprint(w.writer, "\r\n")
+		w.state = stateTrailersWritten
+		if w.omitBody {
+			return nil
+		}
+		if w.stream != nil {
+			return w.stream.WriteData(nil, true)
+		}
+		_, err := fmt.Fprint(w.writer, terminator)
 		return err
 	}
 
 	// Get the body as bytes
 	bodyBytes := w.body.Bytes()
 
-	// Add or update content-length header based on body size (only if not chunked)
-	if !w.chunked {
+	// Add or update content-length header based on body size (only if not chunked).
+	// 1xx and 204 have none; a 304 or an answer to HEAD keeps the one its handler
+	// set, which is the length of the body it would have had.
+	_, hasLength := w.headers["content-length"]
+	switch {
+	case w.chunked, w.statusCode == StatusNotModified:
+	case w.statusCode < 200 || w.statusCode == StatusNoContent:
+		delete(w.headers, "content-length")
+	case w.omitBody && hasLength:
+	default:
 		w.headers["content-length"] = fmt.Sprintf("%d", len(bodyBytes))
 	}
 
-	// Write status line
-	var reasonPhrase string
-	switch w.statusCode {
-	case StatusOK:
-		reasonPhrase = "OK"
-	case StatusBadRequest:
-		reasonPhrase = "Bad Request"
-	case StatusServerError:
-		reasonPhrase = "Internal Server Error"
+	noBody := w.chunked || w.omitBody || len(bodyBytes) == 0
+	if err := w.writeHead(noBody); err != nil {
+		return err
 	}
 
-	_, err := fmt.Fprintf(w.writer, "HTTP/1.1 %d %s\r\n", w.statusCode, reasonPhrase)
-	if err != nil {
-		return err
+	if w.stream != nil && !noBody {
+		return w.stream.WriteData(bodyBytes, true)
 	}
 
-	// Write headers
-	for key, value := range w.headers {
-		_, err := fmt.Fprintf(w.writer, "%s: %s\r\n", key, value)
+	// Write body if present and not chunked
+	if !w.chunked && !w.omitBody && len(bodyBytes) > 0 {
+		_, err := w.writer.Write(bodyBytes)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Write empty line to separate headers from body
-	_, err = fmt.Fprint(w.writer, "\r\n")
+	return nil
+}
+
+// writeHead sends the status line and headers, after which the response is committed.
+// final tells a stream transport that nothing else will follow.
+func (w *Writer) writeHead(final bool) error {
+	w.committed = true
+
+	if w.stream != nil {
+		return w.stream.WriteHead(w.statusCode, w.headers, final)
+	}
+
+	// Write status line
+	_, err := fmt.Fprintf(w.writer, "HTTP/1.1 %d %s\r\n", w.statusCode, StatusText(w.statusCode))
 	if err != nil {
 		return err
 	}
 
-	// Write body if present and not chunked
-	if !w.chunked && len(bodyBytes) > 0 {
-		_, err = w.writer.Write(bodyBytes)
+	// Write headers
+	for key, value := range w.headers {
+		_, err := fmt.Fprintf(w.writer, "%s: %s\r\n", key, value)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	// Write empty line to separate headers from body
+	_, err = fmt.Fprint(w.writer, "\r\n")
+	return err
 }
 
 // WriteStatusLine writes the HTTP status line to the provided writer
 // Legacy function maintained for backward compatibility
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	var reasonPhrase string
-
-	switch statusCode {
-	case StatusOK:
-		reasonPhrase = "OK"
-	case StatusBadRequest:
-		reasonPhrase = "Bad Request"
-	case StatusServerError:
-		reasonPhrase = "Internal Server Error"
-	}
-
-	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase)
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", statusCode, StatusText(statusCode))
 	return err
 }
 
@@ -0,0 +1,248 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+)
+
+func TestWriterFlush(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	_, err := w.WriteBody([]byte("missing"))
+	require.NoError(t, err)
+
+	// Nothing reaches the wire before Flush
+	assert.False(t, w.Committed())
+	assert.Equal(t, 0, buf.Len())
+
+	require.NoError(t, w.Flush())
+	assert.True(t, w.Committed())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, buf.String(), "content-length: 7\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nmissing"))
+	assert.Equal(t, int64(7), w.BytesWritten())
+}
+
+func TestWriterOrder(t *testing.T) {
+	w := NewWriter(new(bytes.Buffer))
+	assert.Equal(t, ErrInvalidWriteState, w.WriteHeaders(headers.NewHeaders()))
+	_, err := w.WriteBody([]byte("too early"))
+	assert.Equal(t, ErrInvalidWriteState, err)
+}
+
+func TestWriterChunked(t *testing.T) {
+	t.Run("Head goes out before the first chunk", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		_, err := w.WriteChunkedBody([]byte("hello"))
+		require.NoError(t, err)
+
+		assert.True(t, w.Committed())
+		assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+		assert.Contains(t, buf.String(), "transfer-encoding: chunked\r\n")
+		assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nhello\r\n"))
+
+		_, err = w.WriteChunkedBodyDone()
+		require.NoError(t, err)
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Done", "yes")
+		require.NoError(t, w.WriteTrailers(trailers))
+		require.NoError(t, w.Flush())
+		assert.True(t, strings.HasSuffix(buf.String(), "5\r\nhello\r\n0\r\nx-done: yes\r\n\r\n"))
+	})
+
+	t.Run("Flush terminates an unfinished body once", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteChunkedBody([]byte("abc"))
+		require.NoError(t, w.Flush())
+		require.NoError(t, w.Flush())
+		assert.True(t, strings.HasSuffix(buf.String(), "3\r\nabc\r\n0\r\n\r\n"))
+	})
+
+	t.Run("Reset fails once committed", func(t *testing.T) {
+		w := NewWriter(new(bytes.Buffer))
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteChunkedBody([]byte("abc"))
+		assert.Equal(t, ErrResponseCommitted, w.Reset())
+	})
+}
+
+func TestWriterSuppressBody(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SuppressBody()
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteBody([]byte("not sent"))
+	require.NoError(t, w.Flush())
+
+	assert.Contains(t, buf.String(), "content-length: 8\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+}
+
+func TestWriterContentLength(t *testing.T) {
+	flush := func(code StatusCode, length string, suppress bool) string {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		if suppress {
+			w.SuppressBody()
+		}
+		w.WriteStatusLine(code)
+		h := headers.NewHeaders()
+		if length != "" {
+			h.Set("Content-Length", length)
+		}
+		w.WriteHeaders(h)
+		require.NoError(t, w.Flush())
+		return buf.String()
+	}
+
+	assert.NotContains(t, flush(StatusNotModified, "", false), "content-length")
+	assert.Contains(t, flush(StatusNotModified, "1234", false), "content-length: 1234\r\n")
+	assert.NotContains(t, flush(StatusNoContent, "5", false), "content-length")
+	// A HEAD handler can tell the length of the body it doesn't send
+	assert.Contains(t, flush(StatusOK, "1234", true), "content-length: 1234\r\n")
+	assert.Contains(t, flush(StatusOK, "", true), "content-length: 0\r\n")
+	assert.Contains(t, flush(StatusOK, "1234", false), "content-length: 0\r\n")
+}
+
+func TestWriterReset(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteStatusLine(StatusOK)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteBody([]byte("draft"))
+
+	require.NoError(t, w.Reset())
+	assert.Equal(t, StatusCode(0), w.StatusCode())
+	assert.Equal(t, int64(0), w.BytesWritten())
+
+	w.WriteStatusLine(StatusServerError)
+	w.WriteHeaders(headers.NewHeaders())
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.NotContains(t, buf.String(), "draft")
+}
+
+// recordingStream is a StreamWriter that logs every call
+type recordingStream struct {
+	calls []string
+}
+
+func (s *recordingStream) WriteHead(status StatusCode, h headers.Headers, endStream bool) error {
+	s.calls = append(s.calls, fmt.Sprintf("head %d te=%q end=%v", status, h["transfer-encoding"], endStream))
+	return nil
+}
+
+func (s *recordingStream) WriteData(p []byte, endStream bool) error {
+	s.calls = append(s.calls, fmt.Sprintf("data %q end=%v", p, endStream))
+	return nil
+}
+
+func (s *recordingStream) WriteTrailers(h headers.Headers) error {
+	s.calls = append(s.calls, fmt.Sprintf("trailers %v", h))
+	return nil
+}
+
+func TestStreamWriter(t *testing.T) {
+	t.Run("Buffered body", func(t *testing.T) {
+		s := &recordingStream{}
+		w := NewStreamWriter(s)
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte("hello"))
+		require.NoError(t, w.Flush())
+		assert.Equal(t, []string{`head 200 te="" end=false`, `data "hello" end=true`}, s.calls)
+	})
+
+	t.Run("Empty body ends with the headers", func(t *testing.T) {
+		s := &recordingStream{}
+		w := NewStreamWriter(s)
+		w.WriteStatusLine(StatusNoContent)
+		require.NoError(t, w.Flush())
+		assert.Equal(t, []string{`head 204 te="" end=true`}, s.calls)
+	})
+
+	t.Run("Chunks and trailers", func(t *testing.T) {
+		s := &recordingStream{}
+		w := NewStreamWriter(s)
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteChunkedBody([]byte("a"))
+		w.WriteChunkedBody([]byte("b"))
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(headers.Headers{"x-sum": "2"})
+		require.NoError(t, w.Flush())
+		assert.Equal(t, []string{
+			`head 200 te="chunked" end=false`,
+			`data "a" end=false`,
+			`data "b" end=false`,
+			`trailers map[x-sum:2]`,
+		}, s.calls)
+		assert.Equal(t, int64(2), w.BytesWritten())
+	})
+
+	t.Run("Unfinished chunks are ended by Flush", func(t *testing.T) {
+		s := &recordingStream{}
+		w := NewStreamWriter(s)
+		w.WriteStatusLine(StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteChunkedBody([]byte("a"))
+		require.NoError(t, w.Flush())
+		assert.Equal(t, `data "" end=true`, s.calls[len(s.calls)-1])
+	})
+}
+
+func TestWriterHijack(t *testing.T) {
+	w := NewWriter(io.Discard)
+	_, _, err := w.Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	w.SetHijacker(func() (net.Conn, *bufio.ReadWriter, error) {
+		return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+	})
+	w.WriteStatusLine(StatusSwitchingProtocols)
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "test")
+	w.WriteHeaders(h)
+
+	head := make(chan string)
+	go func() {
+		buf := make([]byte, 1024)
+		n, _ := client.Read(buf)
+		head <- string(buf[:n])
+	}()
+	conn, _, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, server, conn)
+	assert.True(t, w.Hijacked())
+	got := <-head
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 101 Switching Protocols\r\n"), got)
+	assert.Contains(t, got, "upgrade: test\r\n")
+
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, ErrHijacked)
+	_, err = w.WriteBody([]byte("late"))
+	assert.ErrorIs(t, err, ErrHijacked)
+	assert.ErrorIs(t, w.Flush(), ErrHijacked)
+}
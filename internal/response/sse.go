@@ -0,0 +1,199 @@
+package response
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/headers"
+)
+
+// ErrInvalidEvent is returned by Send for an event that can't be encoded,
+// e.g. an ID or event name that contains a line break
+var ErrInvalidEvent = errors.New("invalid server-sent event")
+
+// ErrEventStreamClosed is returned by Send once the event stream has ended
+var ErrEventStreamClosed = errors.New("event stream closed")
+
+// Event is one message of a text/event-stream
+type Event struct {
+	ID    string        // sent as id:, the client reports the last one in Last-Event-ID when it reconnects
+	Event string        // sent as event:, the type the browser dispatches; "" means "message"
+	Data  string        // may span several lines, each is sent as its own data: field
+	Retry time.Duration // sent as retry:, how long the client waits before reconnecting; 0 leaves it out
+}
+
+// appendEvent encodes ev in the text/event-stream format (HTML Living Standard, 9.2.5)
+func appendEvent(b []byte, ev Event) ([]byte, error) {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") || strings.ContainsAny(ev.Event, "\r\n") {
+		return b, ErrInvalidEvent
+	}
+
+	if ev.ID != "" {
+		b = append(b, "id: "...)
+		b = append(b, ev.ID...)
+		b = append(b, '\n')
+	}
+	if ev.Event != "" {
+		b = append(b, "event: "...)
+		b = append(b, ev.Event...)
+		b = append(b, '\n')
+	}
+	if ev.Retry > 0 {
+		b = append(b, "retry: "...)
+		b = strconv.AppendInt(b, ev.Retry.Milliseconds(), 10)
+		b = append(b, '\n')
+	}
+
+	// Any of CRLF, LF and CR ends a line in the stream, so each piece becomes a data: field
+	data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b = append(b, "data: "...)
+		b = append(b, line...)
+		b = append(b, '\n')
+	}
+
+	// A blank line dispatches the event
+	return append(b, '\n'), nil
+}
+
+// EventStream sends server-sent events over a chunked response. Every event goes out
+// as its own chunk, so the client sees it right away. The methods are safe to call
+// from several goroutines, e.g. a handler and a Hub.
+type EventStream struct {
+	mu     sync.Mutex
+	w      *Writer
+	err    error // the first write error, after which the stream is closed
+	closed bool
+	done   chan struct{}
+}
+
+// NewEventStream starts a 200 text/event-stream response on w and sends its head.
+// Headers set on w.Header() beforehand are sent along.
+func NewEventStream(w *Writer) (*EventStream, error) {
+	if err := w.WriteStatusLine(StatusOK); err != nil {
+		return nil, err
+	}
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Cache-Control", "no-cache")
+	// Keep reverse proxies such as nginx from buffering the stream
+	h.Set("X-Accel-Buffering", "no")
+	h.Set("Transfer-Encoding", "chunked")
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	// An empty chunk only sends the head
+	if _, err := w.WriteChunkedBody(nil); err != nil {
+		return nil, err
+	}
+
+	s := &EventStream{w: w, done: make(chan struct{})}
+	if notify := w.CloseNotify(); notify != nil {
+		go func() {
+			select {
+			case <-notify:
+				s.fail(ErrEventStreamClosed)
+			case <-s.done:
+			}
+		}()
+	}
+	return s, nil
+}
+
+// Send writes one event
+func (s *EventStream) Send(ev Event) error {
+	b, err := appendEvent(nil, ev)
+	if err != nil {
+		return err
+	}
+	return s.write(b)
+}
+
+// Comment writes a comment line, which clients ignore. It is useful to keep
+// idle connections open through proxies and to notice clients that went away.
+func (s *EventStream) Comment(text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return ErrInvalidEvent
+	}
+	return s.write([]byte(": " + text + "\n\n"))
+}
+
+// Heartbeat sends a comment every interval until the stream is closed. A client
+// that disconnected is noticed by the next heartbeat at the latest.
+func (s *EventStream) Heartbeat(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if s.Comment("heartbeat") != nil {
+					return
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// Done is closed when the stream ends: after Close, or when the client went away
+func (s *EventStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the stream ended, or nil while it is open and after Close
+func (s *EventStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the stream. The handler should return afterwards so the response is finished.
+func (s *EventStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.end()
+	_, err := s.w.WriteChunkedBodyDone()
+	return err
+}
+
+func (s *EventStream) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		if s.err != nil {
+			return s.err
+		}
+		return ErrEventStreamClosed
+	}
+	if _, err := s.w.WriteChunkedBody(b); err != nil {
+		s.err = err
+		s.end()
+		return err
+	}
+	return nil
+}
+
+// fail ends the stream with err unless it has already ended
+func (s *EventStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.err = err
+		s.end()
+	}
+}
+
+// end marks the stream closed, which also stops the heartbeat. s.mu must be held.
+func (s *EventStream) end() {
+	s.closed = true
+	close(s.done)
+}
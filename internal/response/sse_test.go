@@ -0,0 +1,187 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   Event
+		want string
+	}{
+		{"data only", Event{Data: "hello"}, "data: hello\n\n"},
+		{"empty data", Event{}, "data: \n\n"},
+		{"all fields", Event{ID: "7", Event: "update", Data: "x", Retry: 3 * time.Second}, "id: 7\nevent: update\nretry: 3000\ndata: x\n\n"},
+		{"multi-line data", Event{Data: "a\nb\r\nc\rd"}, "data: a\ndata: b\ndata: c\ndata: d\n\n"},
+		{"trailing newline", Event{Data: "a\n"}, "data: a\ndata: \n\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := appendEvent(nil, tc.ev)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, string(got))
+		})
+	}
+
+	_, err := appendEvent(nil, Event{ID: "1\n2"})
+	assert.ErrorIs(t, err, ErrInvalidEvent)
+	_, err = appendEvent(nil, Event{Event: "a\rb"})
+	assert.ErrorIs(t, err, ErrInvalidEvent)
+}
+
+// syncBuffer lets the test read what a heartbeat goroutine writes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestEventStream(t *testing.T) {
+	var buf syncBuffer
+	w := NewWriter(&buf)
+	s, err := NewEventStream(w)
+	require.NoError(t, err)
+
+	head := buf.String()
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+	assert.Contains(t, head, "content-type: text/event-stream; charset=utf-8\r\n")
+	assert.Contains(t, head, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, head, "cache-control: no-cache\r\n")
+
+	require.NoError(t, s.Send(Event{ID: "1", Data: "first"}))
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n13\r\nid: 1\ndata: first\n\n\r\n"), buf.String())
+
+	s.Heartbeat(10 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), ": heartbeat\n\n")
+	}, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, s.Close())
+	assert.NoError(t, s.Err())
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("Done not closed after Close")
+	}
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrEventStreamClosed)
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\n\r\n"))
+}
+
+func TestEventStreamClientGone(t *testing.T) {
+	gone := make(chan struct{})
+	w := NewWriter(&syncBuffer{})
+	w.SetCloseNotifier(func() <-chan struct{} { return gone })
+	s, err := NewEventStream(w)
+	require.NoError(t, err)
+
+	close(gone)
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream not ended after the client went away")
+	}
+	assert.ErrorIs(t, s.Err(), ErrEventStreamClosed)
+}
+
+// readEvents collects the data fields the stream has sent so far
+func readEvents(buf *syncBuffer) []string {
+	var data []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, value)
+		}
+	}
+	return data
+}
+
+func TestHub(t *testing.T) {
+	hub := NewHub(3)
+	for _, data := range []string{"a", "b", "c", "d"} {
+		hub.Publish(Event{Data: data})
+	}
+
+	serve := func(lastEventID string) (*syncBuffer, chan error) {
+		var buf syncBuffer
+		s, err := NewEventStream(NewWriter(&buf))
+		require.NoError(t, err)
+		errc := make(chan error, 1)
+		go func() { errc <- hub.Serve(s, lastEventID) }()
+		return &buf, errc
+	}
+
+	// "b" is ID 2: the client missed c and d. ID 1 fell out of the history, so nothing is replayed.
+	replayed, replayedErr := serve("2")
+	fresh, freshErr := serve("1")
+	assert.Eventually(t, func() bool { return hub.Subscribers() == 2 }, time.Second, 5*time.Millisecond)
+
+	hub.Publish(Event{Data: "e"})
+	assert.Eventually(t, func() bool { return len(readEvents(replayed)) == 3 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"c", "d", "e"}, readEvents(replayed))
+	assert.Eventually(t, func() bool { return len(readEvents(fresh)) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Contains(t, fresh.String(), "id: 5\n")
+
+	hub.Close()
+	assert.ErrorIs(t, <-replayedErr, ErrEventStreamClosed)
+	assert.ErrorIs(t, <-freshErr, ErrEventStreamClosed)
+	// Serve ended the streams: the last chunk has been sent
+	assert.True(t, strings.HasSuffix(replayed.String(), "\r\n0\r\n"), replayed.String())
+	assert.True(t, strings.HasSuffix(fresh.String(), "\r\n0\r\n"), fresh.String())
+	assert.Equal(t, 0, hub.Subscribers())
+}
+
+// gatedWriter blocks every write while its gate is held
+type gatedWriter struct {
+	gate sync.Mutex
+}
+
+func (g *gatedWriter) Write(p []byte) (int, error) {
+	g.gate.Lock()
+	defer g.gate.Unlock()
+	return len(p), nil
+}
+
+func TestHubDropsSlowSubscriber(t *testing.T) {
+	hub := NewHub(0)
+	gw := &gatedWriter{}
+	s, err := NewEventStream(NewWriter(gw))
+	require.NoError(t, err)
+
+	errc := make(chan error, 1)
+	go func() { errc <- hub.Serve(s, "") }()
+	assert.Eventually(t, func() bool { return hub.Subscribers() == 1 }, time.Second, 5*time.Millisecond)
+
+	// The client stops reading: one event is stuck in a write, the buffer fills up behind it
+	gw.gate.Lock()
+	for i := 0; i < subscriberBuffer+2; i++ {
+		hub.Publish(Event{Data: "flood"})
+	}
+	assert.Equal(t, 0, hub.Subscribers())
+
+	gw.gate.Unlock()
+	assert.ErrorIs(t, <-errc, ErrEventStreamClosed)
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("stream of the dropped subscriber not closed")
+	}
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"strings"
+
+	"httpfromtcp/internal/middleware"
+	"httpfromtcp/internal/server"
+)
+
+// Group registers routes on its router with a shared path prefix,
+// e.g. a group with prefix "/api" turns "/users/{id}" into "/api/users/{id}"
+type Group struct {
+	router      *Router
+	prefix      string
+	middlewares []middleware.Middleware
+}
+
+// Group returns a nested group whose prefix is appended to this one.
+// The nested group starts with a copy of this group's middlewares.
+func (g *Group) Group(prefix string) *Group {
+	return &Group{
+		router:      g.router,
+		prefix:      g.prefix + strings.TrimSuffix(prefix, "/"),
+		middlewares: append([]middleware.Middleware(nil), g.middlewares...),
+	}
+}
+
+// Use adds middlewares that wrap the routes registered on this group afterwards
+func (g *Group) Use(middlewares ...middleware.Middleware) {
+	g.middlewares = append(g.middlewares, middlewares...)
+}
+
+// Handle registers handler for method on the group's prefix followed by pattern
+func (g *Group) Handle(method, pattern string, handler server.Handler) {
+	full := g.prefix + pattern
+	if pattern == "/" && g.prefix != "" {
+		// "/api" + "/" should register "/api", not "/api/"
+		full = g.prefix
+	}
+	g.router.Handle(method, full, middleware.Apply(handler, g.middlewares...))
+}
+
+// Get registers a handler for GET requests (and HEAD requests without their own route)
+func (g *Group) Get(pattern string, handler server.Handler) {
+	g.Handle("GET", pattern, handler)
+}
+
+// Head registers a handler for HEAD requests
+func (g *Group) Head(pattern string, handler server.Handler) {
+	g.Handle("HEAD", pattern, handler)
+}
+
+// Post registers a handler for POST requests
+func (g *Group) Post(pattern string, handler server.Handler) {
+	g.Handle("POST", pattern, handler)
+}
+
+// Put registers a handler for PUT requests
+func (g *Group) Put(pattern string, handler server.Handler) {
+	g.Handle("PUT", pattern, handler)
+}
+
+// Patch registers a handler for PATCH requests
+func (g *Group) Patch(pattern string, handler server.Handler) {
+	g.Handle("PATCH", pattern, handler)
+}
+
+// Delete registers a handler for DELETE requests
+func (g *Group) Delete(pattern string, handler server.Handler) {
+	g.Handle("DELETE", pattern, handler)
+}
+
+// Options registers a handler for OPTIONS requests
+func (g *Group) Options(pattern string, handler server.Handler) {
+	g.Handle("OPTIONS", pattern, handler)
+}
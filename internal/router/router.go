@@ -0,0 +1,326 @@
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/middleware"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+/*
+Patterns are made of "/"-separated segments. Each segment is one of:
+
+	users   a static segment, matched literally
+	{id}    a parameter, matches exactly one non-empty segment
+	*path   a wildcard, matches the rest of the path (possibly empty); must be last
+
+When several routes could match the same path, static segments win over
+parameters and parameters win over wildcards, so "/users/new" and
+"/users/{id}" can live side by side.
+*/
+
+// Router dispatches requests to handlers registered by method and path pattern.
+// Its ServeHTTP method has the server.Handler signature, so a Router can be
+// passed straight to server.Serve.
+type Router struct {
+	root *node
+
+	// middlewares wrap the whole dispatch, including 404 and 405 responses
+	middlewares []middleware.Middleware
+	dispatch    server.Handler
+
+	// NotFound is called when no route matches the request path.
+	// If nil, a plain text 404 response is written.
+	NotFound server.Handler
+}
+
+// node is one segment of the routing tree
+type node struct {
+	static    map[string]*node
+	param     *node
+	paramName string
+	wildcard  *node
+	wildName  string
+
+	// pattern and handlers are only set on nodes where a route ends
+	pattern  string
+	handlers map[string]server.Handler
+}
+
+// New creates an empty router
+func New() *Router {
+	r := &Router{root: newNode()}
+	r.dispatch = r.route
+	return r
+}
+
+// Use adds middlewares that run for every request the router sees,
+// whether or not a route matches. The first one added is the outermost.
+func (r *Router) Use(middlewares ...middleware.Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+	r.dispatch = middleware.Apply(r.route, r.middlewares...)
+}
+
+func newNode() *node {
+	return &node{
+		static:   make(map[string]*node),
+		handlers: make(map[string]server.Handler),
+	}
+}
+
+// Handle registers handler for requests with the given method whose path matches pattern.
+// It panics if the pattern is malformed or the method and pattern are already registered,
+// since both are programming errors that should surface at startup.
+func (r *Router) Handle(method, pattern string, handler server.Handler) {
+	if !strings.HasPrefix(pattern, "/") {
+		panic(fmt.Sprintf("router: pattern %q must start with '/'", pattern))
+	}
+	if handler == nil {
+		panic(fmt.Sprintf("router: nil handler for %s %s", method, pattern))
+	}
+
+	n := r.root
+	segments := splitPath(pattern)
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}"):
+			name := segment[1 : len(segment)-1]
+			if name == "" {
+				panic(fmt.Sprintf("router: empty parameter name in %q", pattern))
+			}
+			if n.param == nil {
+				n.param = newNode()
+				n.paramName = name
+			} else if n.paramName != name {
+				panic(fmt.Sprintf("router: parameter {%s} in %q conflicts with existing {%s}", name, pattern, n.paramName))
+			}
+			n = n.param
+
+		case strings.HasPrefix(segment, "*"):
+			name := segment[1:]
+			if name == "" {
+				panic(fmt.Sprintf("router: empty wildcard name in %q", pattern))
+			}
+			if i != len(segments)-1 {
+				panic(fmt.Sprintf("router: wildcard must be the last segment in %q", pattern))
+			}
+			if n.wildcard == nil {
+				n.wildcard = newNode()
+				n.wildName = name
+			} else if n.wildName != name {
+				panic(fmt.Sprintf("router: wildcard *%s in %q conflicts with existing *%s", name, pattern, n.wildName))
+			}
+			n = n.wildcard
+
+		default:
+			child, ok := n.static[segment]
+			if !ok {
+				child = newNode()
+				n.static[segment] = child
+			}
+			n = child
+		}
+	}
+
+	if _, exists := n.handlers[method]; exists {
+		panic(fmt.Sprintf("router: duplicate route %s %s", method, pattern))
+	}
+	n.handlers[method] = handler
+	n.pattern = pattern
+}
+
+// Get registers a handler for GET requests (and HEAD requests without their own route)
+func (r *Router) Get(pattern string, handler server.Handler) {
+	r.Handle("GET", pattern, handler)
+}
+
+// Head registers a handler for HEAD requests
+func (r *Router) Head(pattern string, handler server.Handler) {
+	r.Handle("HEAD", pattern, handler)
+}
+
+// Post registers a handler for POST requests
+func (r *Router) Post(pattern string, handler server.Handler) {
+	r.Handle("POST", pattern, handler)
+}
+
+// Put registers a handler for PUT requests
+func (r *Router) Put(pattern string, handler server.Handler) {
+	r.Handle("PUT", pattern, handler)
+}
+
+// Patch registers a handler for PATCH requests
+func (r *Router) Patch(pattern string, handler server.Handler) {
+	r.Handle("PATCH", pattern, handler)
+}
+
+// Delete registers a handler for DELETE requests
+func (r *Router) Delete(pattern string, handler server.Handler) {
+	r.Handle("DELETE", pattern, handler)
+}
+
+// Options registers a handler for OPTIONS requests
+func (r *Router) Options(pattern string, handler server.Handler) {
+	r.Handle("OPTIONS", pattern, handler)
+}
+
+// Group returns a group whose routes are all registered under prefix
+func (r *Router) Group(prefix string) *Group {
+	return &Group{router: r, prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// ServeHTTP finds the route for the request and calls its handler, wrapped in the
+// router's middlewares. It answers 404 when no pattern matches the path and 405
+// with an Allow header when patterns match but none of them accepts the method.
+func (r *Router) ServeHTTP(req *request.Request, w *response.Writer) {
+	r.dispatch(req, w)
+}
+
+// route is the innermost handler of the router: it does the actual matching
+func (r *Router) route(req *request.Request, w *response.Writer) {
+	method := req.RequestLine.Method
+	matches := r.root.match(splitPath(req.Path()), nil, nil)
+
+	// The first match in priority order that accepts the method wins
+	for _, m := range matches {
+		handler, ok := m.node.handlers[method]
+		if !ok && method == "HEAD" {
+			// Fall back to the GET route, but don't send its body
+			handler, ok = m.node.handlers["GET"]
+			if ok {
+				w.SuppressBody()
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		req.Pattern = m.node.pattern
+		for _, p := range m.params {
+			req.SetPathValue(p.name, p.value)
+		}
+		handler(req, w)
+		return
+	}
+
+	if len(matches) == 0 {
+		if r.NotFound != nil {
+			r.NotFound(req, w)
+			return
+		}
+		writePlainError(req, w, response.StatusNotFound, nil)
+		return
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Allow", strings.Join(allowedMethods(matches), ", "))
+	writePlainError(req, w, response.StatusMethodNotAllowed, h)
+}
+
+// param is a single captured path parameter
+type param struct {
+	name  string
+	value string
+}
+
+// match is a node whose pattern matches the path, with the parameters it captured
+type match struct {
+	node   *node
+	params []param
+}
+
+// match walks the tree and returns every route node that matches segments,
+// ordered by priority (static, then parameter, then wildcard at each level)
+func (n *node) match(segments []string, params []param, matches []match) []match {
+	if len(segments) == 0 {
+		if len(n.handlers) > 0 {
+			matches = append(matches, match{node: n, params: params})
+		}
+		// A wildcard may also match an empty remainder
+		if n.wildcard != nil && len(n.wildcard.handlers) > 0 {
+			matches = append(matches, match{node: n.wildcard, params: withParam(params, n.wildName, "")})
+		}
+		return matches
+	}
+
+	segment, rest := segments[0], segments[1:]
+
+	if child, ok := n.static[segment]; ok {
+		matches = child.match(rest, params, matches)
+	}
+
+	if n.param != nil && segment != "" {
+		value, err := url.PathUnescape(segment)
+		if err == nil {
+			matches = n.param.match(rest, withParam(params, n.paramName, value), matches)
+		}
+	}
+
+	if n.wildcard != nil && len(n.wildcard.handlers) > 0 {
+		value, err := url.PathUnescape(strings.Join(segments, "/"))
+		if err == nil {
+			matches = append(matches, match{node: n.wildcard, params: withParam(params, n.wildName, value)})
+		}
+	}
+
+	return matches
+}
+
+// withParam appends to a copy of params so sibling branches don't share state
+func withParam(params []param, name, value string) []param {
+	out := make([]param, len(params), len(params)+1)
+	copy(out, params)
+	return append(out, param{name: name, value: value})
+}
+
+// allowedMethods collects the methods accepted by any of the matching routes
+func allowedMethods(matches []match) []string {
+	seen := make(map[string]bool)
+	for _, m := range matches {
+		for method := range m.node.handlers {
+			seen[method] = true
+		}
+		// HEAD is implicitly allowed wherever GET is
+		if _, ok := m.node.handlers["GET"]; ok {
+			seen["HEAD"] = true
+		}
+	}
+
+	methods := make([]string, 0, len(seen))
+	for method := range seen {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// splitPath turns "/a/b/" into ["a", "b"]; the root path has no segments
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// writePlainError writes a short text/plain response for the given status code,
+// without the body if the request was HEAD
+func writePlainError(req *request.Request, w *response.Writer, code response.StatusCode, extra headers.Headers) {
+	if req.RequestLine.Method == "HEAD" {
+		w.SuppressBody()
+	}
+	w.WriteStatusLine(code)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	for k, v := range extra {
+		h[k] = v
+	}
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(fmt.Sprintf("%d %s\n", code, response.StatusText(code))))
+}
@@ -0,0 +1,235 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/middleware"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// serve runs a request for method and target through the router and returns the raw response
+func serve(t *testing.T, r *Router, method, target string) (*request.Request, string) {
+	t.Helper()
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	r.ServeHTTP(req, w)
+	require.NoError(t, w.Flush())
+	return req, buf.String()
+}
+
+// text returns a handler that answers 200 with the given body
+func text(body string) func(*request.Request, *response.Writer) {
+	return func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestRouterMatching(t *testing.T) {
+	r := New()
+	r.Get("/", text("root"))
+	r.Get("/users/new", text("new user form"))
+	r.Get("/users/{id}", text("user"))
+	r.Get("/users/{id}/posts/{post}", text("post"))
+	r.Get("/static/*path", text("static"))
+
+	t.Run("Root", func(t *testing.T) {
+		_, resp := serve(t, r, "GET", "/")
+		assert.Contains(t, resp, "HTTP/1.1 200 OK\r\n")
+		assert.Contains(t, resp, "root")
+	})
+
+	t.Run("Static beats parameter", func(t *testing.T) {
+		req, resp := serve(t, r, "GET", "/users/new")
+		assert.Contains(t, resp, "new user form")
+		assert.Equal(t, "/users/new", req.Pattern)
+		assert.Empty(t, req.PathValue("id"))
+	})
+
+	t.Run("Path parameters", func(t *testing.T) {
+		req, resp := serve(t, r, "GET", "/users/42/posts/hello%20world")
+		assert.Contains(t, resp, "post")
+		assert.Equal(t, "/users/{id}/posts/{post}", req.Pattern)
+		assert.Equal(t, "42", req.PathValue("id"))
+		assert.Equal(t, "hello world", req.PathValue("post"))
+	})
+
+	t.Run("Query string is ignored for matching", func(t *testing.T) {
+		req, resp := serve(t, r, "GET", "/users/7?verbose=1")
+		assert.Contains(t, resp, "user")
+		assert.Equal(t, "7", req.PathValue("id"))
+		assert.Equal(t, "1", req.Query().Get("verbose"))
+	})
+
+	t.Run("Wildcard captures the rest of the path", func(t *testing.T) {
+		req, _ := serve(t, r, "GET", "/static/css/site.css")
+		assert.Equal(t, "css/site.css", req.PathValue("path"))
+
+		req, _ = serve(t, r, "GET", "/static/")
+		assert.Equal(t, "/static/*path", req.Pattern)
+		assert.Equal(t, "", req.PathValue("path"))
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		_, resp := serve(t, r, "GET", "/nope")
+		assert.Contains(t, resp, "HTTP/1.1 404 Not Found\r\n")
+	})
+
+	t.Run("Custom not found", func(t *testing.T) {
+		custom := New()
+		custom.NotFound = text("custom 404")
+		_, resp := serve(t, custom, "GET", "/nope")
+		assert.Contains(t, resp, "custom 404")
+	})
+}
+
+func TestRouterMethods(t *testing.T) {
+	r := New()
+	r.Get("/items/{id}", text("get item"))
+	r.Delete("/items/{id}", text("delete item"))
+	r.Post("/items", text("create item"))
+
+	t.Run("Method selects the handler", func(t *testing.T) {
+		_, resp := serve(t, r, "DELETE", "/items/3")
+		assert.Contains(t, resp, "delete item")
+	})
+
+	t.Run("Method not allowed lists the allowed methods", func(t *testing.T) {
+		_, resp := serve(t, r, "PUT", "/items/3")
+		assert.Contains(t, resp, "HTTP/1.1 405 Method Not Allowed\r\n")
+		assert.Contains(t, resp, "allow: DELETE, GET, HEAD\r\n")
+	})
+
+	t.Run("HEAD falls back to GET without a body", func(t *testing.T) {
+		_, resp := serve(t, r, "HEAD", "/items/3")
+		assert.Contains(t, resp, "HTTP/1.1 200 OK\r\n")
+		assert.Contains(t, resp, "content-length: 8\r\n")
+		assert.NotContains(t, resp, "get item")
+	})
+
+	t.Run("HEAD errors have no body", func(t *testing.T) {
+		_, resp := serve(t, r, "HEAD", "/nowhere")
+		assert.Contains(t, resp, "HTTP/1.1 404 Not Found\r\n")
+		assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"), resp)
+
+		_, resp = serve(t, r, "HEAD", "/items")
+		assert.Contains(t, resp, "HTTP/1.1 405 Method Not Allowed\r\n")
+		assert.Contains(t, resp, "allow: POST\r\n")
+		assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"), resp)
+	})
+
+	t.Run("Explicit HEAD route wins", func(t *testing.T) {
+		withHead := New()
+		withHead.Get("/x", text("get"))
+		withHead.Head("/x", text("head"))
+		_, resp := serve(t, withHead, "HEAD", "/x")
+		assert.Contains(t, resp, "head")
+	})
+}
+
+func TestRouterGroups(t *testing.T) {
+	r := New()
+	api := r.Group("/api")
+	api.Get("/", text("api index"))
+	v1 := api.Group("/v1/")
+	v1.Get("/users/{id}", text("v1 user"))
+
+	req, resp := serve(t, r, "GET", "/api/v1/users/9")
+	assert.Contains(t, resp, "v1 user")
+	assert.Equal(t, "/api/v1/users/{id}", req.Pattern)
+	assert.Equal(t, "9", req.PathValue("id"))
+
+	_, resp = serve(t, r, "GET", "/api")
+	assert.Contains(t, resp, "api index")
+}
+
+func TestRouterRegistrationPanics(t *testing.T) {
+	assert.Panics(t, func() { New().Get("no-slash", text("")) })
+	assert.Panics(t, func() { New().Get("/files/*path/more", text("")) })
+	assert.Panics(t, func() {
+		r := New()
+		r.Get("/a", text(""))
+		r.Get("/a", text(""))
+	})
+	assert.Panics(t, func() {
+		r := New()
+		r.Get("/users/{id}", text(""))
+		r.Get("/users/{name}/posts", text(""))
+	})
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	var seen []string
+	tag := func(name string) middleware.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(req *request.Request, w *response.Writer) {
+				seen = append(seen, name)
+				next(req, w)
+			}
+		}
+	}
+
+	r := New()
+	r.Use(tag("router"))
+	admin := r.Group("/admin")
+	admin.Use(tag("admin"))
+	admin.Get("/stats", text("stats"))
+	r.Get("/public", text("public"))
+
+	serve(t, r, "GET", "/admin/stats")
+	assert.Equal(t, []string{"router", "admin"}, seen)
+
+	seen = nil
+	serve(t, r, "GET", "/public")
+	assert.Equal(t, []string{"router"}, seen)
+
+	// Router middlewares also see requests that don't match any route
+	seen = nil
+	_, resp := serve(t, r, "GET", "/missing")
+	assert.Equal(t, []string{"router"}, seen)
+	assert.Contains(t, resp, "404")
+}
+
+// A panic in a routed handler goes through the router to the server, which answers
+// 500 and tells OnPanic
+func TestRouterPanicReachesServer(t *testing.T) {
+	r := New()
+	r.Get("/explode/{id}", func(req *request.Request, w *response.Writer) {
+		panic("boom " + req.PathValue("id"))
+	})
+
+	events := make(chan server.PanicEvent, 1)
+	s := &server.Server{Handler: r.ServeHTTP, OnPanic: func(e server.PanicEvent) { events <- e }}
+	require.NoError(t, s.Start())
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.Port))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET /explode/7 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 500 Internal Server Error\r\n"), string(resp))
+	assert.Contains(t, strings.ToLower(string(resp)), "\r\nconnection: close\r\n")
+
+	event := <-events
+	assert.Equal(t, "boom 7", event.Value)
+	assert.Equal(t, "/explode/{id}", event.Request.Pattern)
+}
@@ -0,0 +1,592 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"httpfromtcp/internal/accesslog"
+	"httpfromtcp/internal/har"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/metrics"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// Handler is a function type that processes an HTTP request and writes a response
+type Handler func(req *request.Request, w *response.Writer)
+
+// Server struct definition remains the same
+type Server struct {
+	Addr     string
+	Port     int
+	Listener net.Listener
+	State    atomic.Bool
+	Handler  Handler
+
+	// OnPanic, if set, receives every handler panic after it has been recovered
+	// and logged, e.g. to forward it to an error tracker. It must be set before Start.
+	OnPanic func(PanicEvent)
+
+	// AccessLog, if set, gets one entry per request, including the ones that
+	// failed to parse. It must be set before Start.
+	AccessLog *accesslog.Logger
+
+	// Metrics, if set, is kept up to date with request, connection and traffic counts,
+	// and served in Prometheus format on MetricsPath (when not empty) ahead of Handler.
+	Metrics     *metrics.ServerMetrics
+	MetricsPath string
+
+	// Capture, if set, records every HTTP/1.1 request with the response sent for it
+	// and its timings, for a HAR file. It must be set before Start.
+	Capture *har.Recorder
+
+	// TLSConfig, if set, makes the server speak HTTPS on Port. It must be set before Start.
+	TLSConfig *tls.Config
+
+	// StreamBody, if set, is asked about each HTTP/1.1 request with a body once its
+	// headers are in, before RemoteAddr and TLS are filled in. Returning true hands the
+	// body to the handler as Request.BodyReader, to read as it arrives, instead of
+	// reading all of it into Request.Body first. It must be set before Start.
+	StreamBody func(req *request.Request) bool
+
+	// DisableHTTP2 turns off HTTP/2, which is otherwise offered via ALPN on TLS
+	// and accepted as h2c (prior knowledge or Upgrade) on plaintext connections
+	DisableHTTP2 bool
+}
+
+// http2IdleTimeout closes HTTP/2 connections that have had no streams for a while
+const http2IdleTimeout = 2 * time.Minute
+
+// ErrAbortHandler is a sentinel panic value for handlers that need to give up on a
+// response they have already started, e.g. a proxy whose upstream broke off mid-body.
+// The server cuts the connection without logging the panic or reporting it to OnPanic.
+var ErrAbortHandler = errors.New("server: abort handler")
+
+// PanicEvent describes a handler panic recovered by the server
+type PanicEvent struct {
+	Value      any              // the value passed to panic
+	Stack      []byte           // stack trace of the panicking goroutine
+	Request    *request.Request // the request being handled
+	RemoteAddr string           // address of the client
+	Committed  bool             // part of the response had already been sent, so the connection was aborted
+}
+
+// Serve starts a server for handler on 127.0.0.1:port
+func Serve(port int, handler Handler) (*Server, error) {
+	server := &Server{
+		Addr:    "localhost",
+		Port:    port,
+		Handler: handler,
+	}
+	if err := server.Start(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// Start binds the listener and starts accepting connections in the background.
+// Configure the exported fields before calling it. Port 0 picks a free port,
+// which is then stored back in Port.
+func (s *Server) Start() error {
+	addr := fmt.Sprintf("127.0.0.1:%d", s.Port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start listener: %w", err)
+	}
+
+	s.Port = listener.Addr().(*net.TCPAddr).Port
+	if s.TLSConfig != nil {
+		config := s.TLSConfig
+		if !s.DisableHTTP2 && len(config.NextProtos) == 0 {
+			config = config.Clone()
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+		listener = tls.NewListener(listener, config)
+	}
+	s.Listener = listener
+	s.State.Store(true)
+
+	// Start listening in a goroutine
+	go s.listen()
+
+	return nil
+}
+
+func (s *Server) Close() error {
+	s.State.Store(false)
+	if s.Listener != nil {
+		return s.Listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) listen() {
+	for s.State.Load() {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			// Check if server is closed before logging error
+			if !s.State.Load() {
+				return
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+
+		// Handle each connection in a goroutine
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	// A handler that hijacked the connection closes it itself
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			conn.Close()
+		}
+	}()
+	start := time.Now()
+
+	// Finish the TLS handshake up front so a failed one is logged as such
+	// and the connection state is known before the request is parsed
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	conn = s.Metrics.ConnOpened(conn)
+	defer s.Metrics.ConnClosed()
+
+	if tlsState != nil && tlsState.NegotiatedProtocol == "h2" {
+		s.serveHTTP2(conn, http2.ConnOpts{TLS: tlsState})
+		return
+	}
+
+	// set a read timeout for the connection
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// A plaintext client that knows we speak HTTP/2 starts with the preface right away
+	reader := bufio.NewReader(conn)
+	if tlsState == nil && !s.DisableHTTP2 && hasPreface(reader) {
+		s.serveHTTP2(conn, http2.ConnOpts{Reader: reader})
+		return
+	}
+
+	// Capture the raw request so we can still find the path if parsing fails
+	var requestData bytes.Buffer
+	teeReader := &rawTee{r: reader, raw: &requestData}
+
+	// Parse the HTTP request, leaving the body on the connection if the handler streams it
+	req, err := request.RequestHeadFromReader(teeReader)
+	var body *streamedBody
+	if err == nil && req.BodyReader != nil {
+		if s.StreamBody != nil && s.StreamBody(req) {
+			teeReader.raw = nil
+			body = s.streamBody(req, conn)
+			defer body.finish()
+		} else {
+			req.Body, err = io.ReadAll(req.BodyReader)
+			req.BodyReader = nil
+		}
+	}
+	if err != nil {
+		log.Printf("Error parsing request from %s: %v", conn.RemoteAddr(), err)
+		s.Metrics.ParseError()
+
+		// Attempt to handle specific error cases based on path if possible
+		path := extractPathFromRawRequest(requestData.String())
+		if path != "" {
+			minimalReq := &request.Request{
+				RequestLine: request.RequestLine{
+					RequestTarget: path,
+					Method:        "GET", // Assume GET for error handling
+					HttpVersion:   "1.1",
+				},
+				Headers:    make(map[string]string),
+				Body:       nil,
+				RemoteAddr: conn.RemoteAddr().String(),
+				TLS:        tlsState,
+			}
+
+			parsed := time.Now()
+			out, capture := s.captureOutput(conn)
+			respWriter := newResponseWriter(out)
+			s.serveRequest(minimalReq, respWriter, func() { abort(conn) })
+			s.finishRequest(start, minimalReq, respWriter)
+			s.record(capture, start, parsed, minimalReq, respWriter)
+			return
+		}
+
+		// Generic bad request if path extraction failed or wasn't applicable
+		respWriter := newResponseWriter(conn)
+		respWriter.WriteStatusLine(response.StatusBadRequest)
+
+		// Set headers
+		headers := headers.NewHeaders()
+		headers.Set("Content-Type", "text/html; charset=utf-8")
+		respWriter.WriteHeaders(headers)
+
+		// Write body
+		respWriter.WriteBody([]byte("Invalid request format\n"))
+
+		// Flush response
+		if err := respWriter.Flush(); err != nil {
+			log.Printf("Error flushing response: %v", err)
+		}
+		s.finishRequest(start, &request.Request{RemoteAddr: conn.RemoteAddr().String()}, respWriter)
+		return
+	}
+
+	parsed := time.Now()
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.TLS = tlsState
+
+	// The client may ask to continue in h2c, with this request as stream 1
+	if tlsState == nil && !s.DisableHTTP2 && body == nil {
+		if settings, ok := http2.UpgradeSettings(req); ok {
+			if err := writeSwitchingProtocols(conn); err != nil {
+				log.Printf("Error upgrading %s to h2c: %v", conn.RemoteAddr(), err)
+				return
+			}
+			s.serveHTTP2(conn, http2.ConnOpts{Reader: reader, Upgrade: req, UpgradeSettings: settings})
+			return
+		}
+	}
+
+	out, capture := s.captureOutput(conn)
+	respWriter := newResponseWriter(out)
+	respWriter.SetHijacker(func() (net.Conn, *bufio.ReadWriter, error) {
+		hijacked = true
+		conn.SetDeadline(time.Time{})
+		return conn, bufio.NewReadWriter(reader, bufio.NewWriter(conn)), nil
+	})
+	var watchOnce sync.Once
+	gone := make(chan struct{})
+	respWriter.SetCloseNotifier(func() <-chan struct{} {
+		// The request has been read, so the client only sends more when it
+		// pipelines; EOF or an error means it hung up. A streamed body is
+		// the handler's to read, so the watch starts after it.
+		watchOnce.Do(func() {
+			go func() {
+				if body != nil {
+					<-body.done
+				}
+				conn.SetReadDeadline(time.Time{})
+				io.Copy(io.Discard, reader)
+				close(gone)
+			}()
+		})
+		return gone
+	})
+	s.serveRequest(req, respWriter, func() {
+		// A handler that panicked can't be trusted to close what it hijacked
+		abort(conn)
+		hijacked = false
+	})
+	s.finishRequest(start, req, respWriter)
+	if body != nil && capture != nil {
+		// The HAR entry gets what the handler read of the body
+		recorded := *req
+		recorded.Body = body.capture.Bytes()
+		req = &recorded
+	}
+	s.record(capture, start, parsed, req, respWriter)
+}
+
+// rawTee copies what the parser reads to raw, unless raw is nil
+type rawTee struct {
+	r   io.Reader
+	raw *bytes.Buffer
+}
+
+func (t *rawTee) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if t.raw != nil {
+		t.raw.Write(p[:n])
+	}
+	return n, err
+}
+
+// bodyReadTimeout is how long a streamed request body may go quiet
+const bodyReadTimeout = 5 * time.Second
+
+// streamedBody is a request body the handler reads from the connection. Each read
+// gets bodyReadTimeout, and with Capture set a copy is kept for the HAR entry.
+type streamedBody struct {
+	r        io.Reader
+	conn     net.Conn
+	capture  *bytes.Buffer
+	done     chan struct{} // closed once the body has been read, or the handler is done
+	doneOnce sync.Once
+}
+
+func (s *Server) streamBody(req *request.Request, conn net.Conn) *streamedBody {
+	b := &streamedBody{r: req.BodyReader, conn: conn, done: make(chan struct{})}
+	if s.Capture != nil {
+		b.capture = &bytes.Buffer{}
+	}
+	req.BodyReader = b
+	return b
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	b.conn.SetReadDeadline(time.Now().Add(bodyReadTimeout))
+	n, err := b.r.Read(p)
+	if b.capture != nil {
+		b.capture.Write(p[:min(n, maxCapture-b.capture.Len())])
+	}
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *streamedBody) finish() {
+	b.doneOnce.Do(func() { close(b.done) })
+}
+
+// newResponseWriter starts an HTTP/1.1 response on conn. The connection is closed
+// after one request, so every response says so unless its handler sets Connection itself.
+func newResponseWriter(conn io.Writer) *response.Writer {
+	w := response.NewWriter(conn)
+	w.Header().Set("Connection", "close")
+	return w
+}
+
+// maxCapture is how much of a response is kept for Capture; the rest of a bigger one
+// is still sent, but only noted in the HAR entry
+const maxCapture = 8 << 20
+
+// captureWriter passes a response through to the connection and keeps a copy of it
+type captureWriter struct {
+	w         io.Writer
+	buf       bytes.Buffer
+	first     time.Time
+	truncated bool
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if c.first.IsZero() {
+		c.first = time.Now()
+	}
+	keep := min(len(p), maxCapture-c.buf.Len())
+	c.buf.Write(p[:keep])
+	c.truncated = c.truncated || keep < len(p)
+	return c.w.Write(p)
+}
+
+// captureOutput returns what a response on conn should be written to: conn itself,
+// or with Capture set a captureWriter that keeps a copy for record
+func (s *Server) captureOutput(conn net.Conn) (io.Writer, *captureWriter) {
+	if s.Capture == nil {
+		return conn, nil
+	}
+	c := &captureWriter{w: conn}
+	return c, c
+}
+
+// record adds a finished exchange to Capture
+func (s *Server) record(c *captureWriter, start, parsed time.Time, req *request.Request, w *response.Writer) {
+	if c == nil {
+		return
+	}
+	s.Capture.Record(har.Exchange{
+		Request:   req,
+		Response:  c.buf.Bytes(),
+		Status:    int(w.StatusCode()),
+		Truncated: c.truncated,
+		Start:     start,
+		Parsed:    parsed,
+		FirstByte: c.first,
+		End:       time.Now(),
+	})
+}
+
+// hasPreface reports whether the connection starts with the HTTP/2 client preface.
+// It peeks one more byte at a time and gives up at the first mismatch, so an
+// HTTP/1.1 request shorter than the preface doesn't leave us waiting for more.
+func hasPreface(r *bufio.Reader) bool {
+	for n := 1; n <= len(http2.ClientPreface); n++ {
+		peeked, err := r.Peek(n)
+		if err != nil || peeked[n-1] != http2.ClientPreface[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSwitchingProtocols accepts an h2c upgrade; HTTP/2 frames follow right after it
+func writeSwitchingProtocols(conn net.Conn) error {
+	if err := response.WriteStatusLine(conn, response.StatusSwitchingProtocols); err != nil {
+		return err
+	}
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "h2c")
+	return response.WriteHeaders(conn, h)
+}
+
+// serveHTTP2 serves conn as HTTP/2. Every stream goes through the same
+// handler, panic recovery, metrics and access log as an HTTP/1.1 request.
+func (s *Server) serveHTTP2(conn net.Conn, opts http2.ConnOpts) {
+	h2 := &http2.Server{
+		Handler: func(req *request.Request, w *response.Writer, reset func()) {
+			start := time.Now()
+			s.serveRequest(req, w, reset)
+			s.finishRequest(start, req, w)
+		},
+		IdleTimeout: http2IdleTimeout,
+	}
+	h2.ServeConn(conn, opts)
+}
+
+// finishRequest records a finished request in the metrics and the access log
+func (s *Server) finishRequest(start time.Time, req *request.Request, w *response.Writer) {
+	s.Metrics.RequestFinished(req.RequestLine.Method, req.Pattern, w.StatusCode(), time.Since(start))
+
+	if s.AccessLog == nil {
+		return
+	}
+
+	entry := accesslog.Entry{
+		Time:       start,
+		RemoteAddr: req.RemoteAddr,
+		Method:     req.RequestLine.Method,
+		Target:     req.RequestLine.RequestTarget,
+		Status:     int(w.StatusCode()),
+		Bytes:      w.BytesWritten(),
+		Duration:   time.Since(start),
+		Referer:    req.Headers["referer"],
+		UserAgent:  req.Headers["user-agent"],
+	}
+	if req.RequestLine.HttpVersion != "" {
+		entry.Proto = "HTTP/" + req.RequestLine.HttpVersion
+	}
+	s.AccessLog.Log(entry)
+}
+
+// serveRequest runs the handler for req and flushes its response to w.
+// A panicking handler is recovered so it can't take the whole process down;
+// abort cuts off a response that was already partly sent.
+func (s *Server) serveRequest(req *request.Request, w *response.Writer, abort func()) {
+	defer s.Metrics.InFlight()()
+
+	// The metrics endpoint is answered by the server itself
+	handler := s.Handler
+	if s.Metrics != nil && s.MetricsPath != "" && req.Path() == s.MetricsPath {
+		handler = s.Metrics.ServeHTTP
+		req.Pattern = s.MetricsPath
+	}
+
+	if !s.callHandler(handler, req, w, abort) || w.Hijacked() {
+		return
+	}
+
+	// Flush the response to send it
+	if err := w.Flush(); err != nil {
+		log.Printf("Error flushing response: %v", err)
+	}
+}
+
+// callHandler calls the handler and reports whether the response can still be flushed.
+// After a panic it replaces the response with a 500 if nothing has been sent yet;
+// otherwise the client already has a partial response, so it is aborted.
+func (s *Server) callHandler(handler Handler, req *request.Request, w *response.Writer, abort func()) (ok bool) {
+	defer func() {
+		rec := recover()
+		if rec == nil {
+			return
+		}
+		if rec == ErrAbortHandler {
+			if w.Committed() {
+				abort()
+			}
+			ok = false
+			return
+		}
+
+		event := PanicEvent{
+			Value:      rec,
+			Stack:      debug.Stack(),
+			Request:    req,
+			RemoteAddr: req.RemoteAddr,
+			Committed:  w.Committed(),
+		}
+		log.Printf("panic serving %s %s for %s: %v\n%s",
+			req.RequestLine.Method, req.RequestLine.RequestTarget, event.RemoteAddr, rec, event.Stack)
+
+		if s.OnPanic != nil {
+			s.OnPanic(event)
+		}
+
+		if event.Committed {
+			abort()
+			ok = false
+			return
+		}
+
+		w.Reset()
+		w.WriteStatusLine(response.StatusServerError)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("Connection", "close")
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("500 Internal Server Error\n"))
+		ok = true
+	}()
+
+	handler(req, w)
+	return true
+}
+
+// abort makes the close of conn reset the TCP connection instead of ending it cleanly,
+// so the client can't mistake a truncated response for a complete one
+func abort(conn net.Conn) {
+	// Look through wrappers such as the metrics byte counter
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+}
+
+// extractPathFromRawRequest is a helper function to get the path from a raw HTTP request
+func extractPathFromRawRequest(rawRequest string) string {
+	lines := strings.Split(rawRequest, "\n")
+	if len(lines) == 0 {
+		return ""
+	}
+
+	// Parse the first line which should be like "GET /path HTTP/1.1"
+	parts := strings.Split(lines[0], " ")
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return parts[1]
+}
@@ -0,0 +1,524 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/accesslog"
+	"httpfromtcp/internal/certs"
+	"httpfromtcp/internal/har"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/http2/hpack"
+	"httpfromtcp/internal/metrics"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// startServer starts s on a free port and closes it when the test ends
+func startServer(t *testing.T, s *Server) {
+	t.Helper()
+	require.NoError(t, s.Start())
+	t.Cleanup(func() { s.Close() })
+}
+
+// roundTrip sends a raw request and returns everything the server sent back
+func roundTrip(t *testing.T, port int, raw string) (string, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+
+	resp, err := io.ReadAll(conn)
+	return string(resp), err
+}
+
+func TestServeRequest(t *testing.T) {
+	s := &Server{Handler: func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte("hello " + req.RequestLine.RequestTarget))
+	}}
+	startServer(t, s)
+
+	resp, err := roundTrip(t, s.Port, "GET /world HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nhello /world"))
+	// One request per connection, and the client is told so
+	assert.Contains(t, resp, "\r\nconnection: close\r\n")
+}
+
+// syncBuffer is a bytes.Buffer that can be written by the server and read by the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	logBuf := &syncBuffer{}
+	s := &Server{
+		Handler: func(req *request.Request, w *response.Writer) {
+			w.WriteStatusLine(response.StatusNotFound)
+			w.WriteHeaders(headers.NewHeaders())
+			w.WriteBody([]byte("nope"))
+		},
+		AccessLog: accesslog.New(logBuf, accesslog.FormatCombined),
+	}
+	startServer(t, s)
+
+	_, err := roundTrip(t, s.Port, "GET /missing HTTP/1.1\r\nUser-Agent: test-agent\r\n\r\n")
+	require.NoError(t, err)
+	_, err = roundTrip(t, s.Port, "garbage\r\n\r\n")
+	require.NoError(t, err)
+
+	// The entry is written after the response, so give the connection goroutine a moment
+	require.Eventually(t, func() bool { return strings.Count(logBuf.String(), "\n") == 2 }, time.Second, 10*time.Millisecond)
+	lines := strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+	assert.Contains(t, lines[0], `"GET /missing HTTP/1.1" 404 4 "-" "test-agent"`)
+	assert.Contains(t, lines[1], `"-" 400 23`)
+}
+
+func TestCapture(t *testing.T) {
+	s := &Server{
+		Handler: func(req *request.Request, w *response.Writer) {
+			w.WriteStatusLine(response.StatusOK)
+			h := headers.NewHeaders()
+			h.Set("Content-Type", "text/plain")
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("got "))
+			w.WriteChunkedBody(req.Body)
+			w.WriteChunkedBodyDone()
+		},
+		Capture: har.NewRecorder(),
+	}
+	startServer(t, s)
+
+	_, err := roundTrip(t, s.Port, "POST /echo?x=1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+
+	// The exchange is recorded after the response, so give the connection goroutine a moment
+	require.Eventually(t, func() bool { return len(s.Capture.File().Log.Entries) == 1 }, time.Second, 10*time.Millisecond)
+	entry := s.Capture.File().Log.Entries[0]
+	assert.Equal(t, "POST", entry.Request.Method)
+	assert.Equal(t, "http://example.com/echo?x=1", entry.Request.URL)
+	assert.Equal(t, []har.NameValue{{Name: "x", Value: "1"}}, entry.Request.QueryString)
+	require.NotNil(t, entry.Request.PostData)
+	assert.Equal(t, "hello", entry.Request.PostData.Text)
+
+	// The chunked body is recorded decoded, its framing counted in BodySize
+	assert.Equal(t, 200, entry.Response.Status)
+	assert.Equal(t, "got hello", entry.Response.Content.Text)
+	assert.Equal(t, "text/plain", entry.Response.Content.MimeType)
+	assert.Greater(t, entry.Response.BodySize, len("got hello"))
+	assert.InDelta(t, entry.Time, entry.Timings.Send+entry.Timings.Wait+entry.Timings.Receive, 0.001)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	s := &Server{
+		Handler: func(req *request.Request, w *response.Writer) {
+			req.Pattern = "/hello"
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(headers.NewHeaders())
+			w.WriteBody([]byte("hi"))
+		},
+		Metrics:     metrics.NewServerMetrics(metrics.NewRegistry()),
+		MetricsPath: "/metrics",
+	}
+	startServer(t, s)
+
+	_, err := roundTrip(t, s.Port, "GET /hello HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	_, err = roundTrip(t, s.Port, "nonsense\r\n\r\n")
+	require.NoError(t, err)
+
+	resp, err := roundTrip(t, s.Port, "GET /metrics HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.Contains(t, resp, `http_requests_total{method="GET",route="/hello",status="200"} 1`)
+	assert.Contains(t, resp, "http_request_parse_errors_total 1\n")
+	// The scrape itself is in flight and its connection is open while rendering
+	assert.Contains(t, resp, "http_requests_in_flight 1\n")
+	assert.Contains(t, resp, "http_open_connections 1\n")
+	assert.Regexp(t, `http_received_bytes_total [1-9]`, resp)
+}
+
+func TestTLSWithClientCertificates(t *testing.T) {
+	store, ca, err := certs.DevStore()
+	require.NoError(t, err)
+	clientCert, err := ca.IssueClient("integration-test")
+	require.NoError(t, err)
+
+	s := &Server{
+		Handler: func(req *request.Request, w *response.Writer) {
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(headers.NewHeaders())
+			w.WriteBody([]byte("hello " + req.TLS.PeerCertificates[0].Subject.CommonName))
+		},
+		TLSConfig: certs.ServerConfig(store, ca.Pool()),
+	}
+	startServer(t, s)
+
+	dial := func(certificates []tls.Certificate) (string, error) {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.Port), &tls.Config{
+			RootCAs:      ca.Pool(),
+			ServerName:   "localhost",
+			Certificates: certificates,
+		})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+			return "", err
+		}
+		resp, err := io.ReadAll(conn)
+		return string(resp), err
+	}
+
+	resp, err := dial([]tls.Certificate{clientCert})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(resp, "hello integration-test"))
+
+	// Without a client certificate the handshake is rejected
+	_, err = dial(nil)
+	assert.Error(t, err)
+}
+
+// readH2Response reads frames until stream 1 ends and returns its status and body
+func readH2Response(t *testing.T, fr *http2.Framer) (status, body string) {
+	t.Helper()
+	dec := hpack.NewDecoder(hpack.DefaultTableSize)
+	for {
+		f, err := fr.ReadFrame()
+		require.NoError(t, err)
+		if f.StreamID != 1 {
+			continue
+		}
+
+		switch f.Type {
+		case http2.FrameHeaders:
+			fields, err := dec.Decode(f.Payload)
+			require.NoError(t, err)
+			for _, field := range fields {
+				if field.Name == ":status" {
+					status = field.Value
+				}
+			}
+		case http2.FrameData:
+			body += string(f.Payload)
+		default:
+			t.Fatalf("unexpected %v", f)
+		}
+		if f.Flags.Has(http2.FlagEndStream) {
+			return status, body
+		}
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	handler := func(req *request.Request, w *response.Writer) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.Headers{"connection": "close"})
+		w.WriteBody([]byte("HTTP/" + req.RequestLine.HttpVersion + " " + req.RequestLine.RequestTarget))
+	}
+
+	t.Run("h2 negotiated with ALPN", func(t *testing.T) {
+		store, ca, err := certs.DevStore()
+		require.NoError(t, err)
+		logBuf := &syncBuffer{}
+		s := &Server{
+			Handler:   handler,
+			TLSConfig: certs.ServerConfig(store, nil),
+			AccessLog: accesslog.New(logBuf, accesslog.FormatCommon),
+		}
+		startServer(t, s)
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: ca.Pool()},
+				ForceAttemptHTTP2: true,
+			},
+			Timeout: 5 * time.Second,
+		}
+		defer client.CloseIdleConnections()
+
+		// Several requests at once share one connection as separate streams
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := client.Get(fmt.Sprintf("https://localhost:%d/stream/%d", s.Port, i))
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				assert.NoError(t, err)
+				assert.Equal(t, 2, resp.ProtoMajor)
+				assert.Equal(t, fmt.Sprintf("HTTP/2.0 /stream/%d", i), string(body))
+			}(i)
+		}
+		wg.Wait()
+
+		// Entries are written once the response is out, so they may trail the client a little
+		assert.Eventually(t, func() bool {
+			return strings.Contains(logBuf.String(), `"GET /stream/0 HTTP/2.0" 200 18`)
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("h2c with prior knowledge", func(t *testing.T) {
+		s := &Server{Handler: handler}
+		startServer(t, s)
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.Port))
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		fr := http2.NewFramer(conn, conn)
+		_, err = conn.Write([]byte(http2.ClientPreface))
+		require.NoError(t, err)
+		require.NoError(t, fr.WriteSettings())
+		block := hpack.NewEncoder().Encode(nil, []hpack.HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/prior"},
+			{Name: ":authority", Value: "localhost"},
+		})
+		require.NoError(t, fr.WriteHeaders(1, true, block, http2.DefaultMaxFrameSize))
+
+		status, body := readH2Response(t, fr)
+		assert.Equal(t, "200", status)
+		assert.Equal(t, "HTTP/2.0 /prior", body)
+	})
+
+	t.Run("h2c upgrade from HTTP/1.1", func(t *testing.T) {
+		s := &Server{Handler: handler}
+		startServer(t, s)
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.Port))
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		_, err = conn.Write([]byte("GET /upgraded HTTP/1.1\r\nHost: localhost\r\n" +
+			"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABk\r\n\r\n"))
+		require.NoError(t, err)
+
+		reader := bufio.NewReader(conn)
+		statusLine, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\r\n" {
+				break
+			}
+		}
+
+		// The response to the upgrade request arrives on stream 1
+		fr := http2.NewFramer(conn, reader)
+		_, err = conn.Write([]byte(http2.ClientPreface))
+		require.NoError(t, err)
+		require.NoError(t, fr.WriteSettings())
+
+		status, body := readH2Response(t, fr)
+		assert.Equal(t, "200", status)
+		assert.Equal(t, "HTTP/1.1 /upgraded", body)
+	})
+
+	t.Run("Disabled HTTP/2 ignores upgrades", func(t *testing.T) {
+		s := &Server{Handler: handler, DisableHTTP2: true}
+		startServer(t, s)
+
+		resp, err := roundTrip(t, s.Port, "GET / HTTP/1.1\r\nHost: localhost\r\n"+
+			"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABk\r\n\r\n")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	})
+}
+
+func TestPanicRecovery(t *testing.T) {
+	t.Run("Panic before anything is sent becomes a 500", func(t *testing.T) {
+		events := make(chan PanicEvent, 1)
+		s := &Server{
+			Handler: func(req *request.Request, w *response.Writer) {
+				w.WriteStatusLine(response.StatusOK)
+				panic("boom")
+			},
+			OnPanic: func(e PanicEvent) { events <- e },
+		}
+		startServer(t, s)
+
+		resp, err := roundTrip(t, s.Port, "GET /explode HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 500 Internal Server Error\r\n"))
+
+		event := <-events
+		assert.Equal(t, "boom", event.Value)
+		assert.Equal(t, "/explode", event.Request.RequestLine.RequestTarget)
+		assert.False(t, event.Committed)
+		assert.Contains(t, string(event.Stack), "TestPanicRecovery")
+		assert.NotEmpty(t, event.RemoteAddr)
+	})
+
+	t.Run("Panic mid-stream aborts the connection", func(t *testing.T) {
+		events := make(chan PanicEvent, 1)
+		s := &Server{
+			Handler: func(req *request.Request, w *response.Writer) {
+				w.WriteStatusLine(response.StatusOK)
+				w.WriteHeaders(headers.NewHeaders())
+				w.WriteChunkedBody([]byte("partial"))
+				panic("halfway")
+			},
+			OnPanic: func(e PanicEvent) { events <- e },
+		}
+		startServer(t, s)
+
+		resp, _ := roundTrip(t, s.Port, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+		assert.Contains(t, resp, "partial")
+		// The terminating zero-size chunk must never be sent
+		assert.NotContains(t, resp, "0\r\n\r\n")
+
+		event := <-events
+		assert.True(t, event.Committed)
+	})
+
+	t.Run("Server keeps serving after a panic", func(t *testing.T) {
+		s := &Server{Handler: func(req *request.Request, w *response.Writer) {
+			if req.RequestLine.RequestTarget == "/panic" {
+				panic("boom")
+			}
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(headers.NewHeaders())
+		}}
+		startServer(t, s)
+
+		roundTrip(t, s.Port, "GET /panic HTTP/1.1\r\n\r\n")
+		resp, err := roundTrip(t, s.Port, "GET /fine HTTP/1.1\r\n\r\n")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	})
+}
+
+func TestCloseNotify(t *testing.T) {
+	gone := make(chan struct{})
+	s := &Server{Handler: func(req *request.Request, w *response.Writer) {
+		stream, err := response.NewEventStream(w)
+		if err != nil {
+			return
+		}
+		stream.Send(response.Event{Data: "hello"})
+		<-stream.Done()
+		close(gone)
+	}}
+	startServer(t, s)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.Port))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\nAccept: text/event-stream\r\n\r\n"))
+	require.NoError(t, err)
+
+	// Wait for the event, then hang up; the handler must notice without writing again
+	br := bufio.NewReader(conn)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "data: hello\n" {
+			break
+		}
+	}
+	conn.Close()
+
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler not told that the client went away")
+	}
+}
+
+func TestStreamBody(t *testing.T) {
+	firstPart := make(chan string, 1)
+	s := &Server{
+		Handler: func(req *request.Request, w *response.Writer) {
+			var body []byte
+			if req.BodyReader != nil {
+				buf := make([]byte, 5)
+				n, _ := io.ReadFull(req.BodyReader, buf)
+				firstPart <- string(buf[:n])
+				rest, _ := io.ReadAll(req.BodyReader)
+				body = append(buf[:n], rest...)
+			} else {
+				body = req.Body
+			}
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(headers.NewHeaders())
+			w.WriteBody([]byte(fmt.Sprintf("%s %q %v", req.RequestLine.RequestTarget, body, req.Trailers)))
+		},
+		StreamBody: func(req *request.Request) bool { return req.Path() == "/stream" },
+		Capture:    har.NewRecorder(),
+	}
+	startServer(t, s)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", s.Port))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("POST /stream HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"))
+	require.NoError(t, err)
+
+	// The handler has the start of the body while the client is still sending
+	select {
+	case part := <-firstPart:
+		assert.Equal(t, "hello", part)
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not get the start of the body")
+	}
+	_, err = conn.Write([]byte("6\r\n world\r\n0\r\nX-Sum: 11\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\n/stream \"hello world\" map[x-sum:11]"), string(resp))
+
+	require.Eventually(t, func() bool { return len(s.Capture.File().Log.Entries) == 1 }, time.Second, 10*time.Millisecond)
+	require.NotNil(t, s.Capture.File().Log.Entries[0].Request.PostData)
+	assert.Equal(t, "hello world", s.Capture.File().Log.Entries[0].Request.PostData.Text)
+
+	// Other requests are read whole before the handler runs
+	resp2, err := roundTrip(t, s.Port, "POST /whole HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(resp2, "\r\n\r\n/whole \"hi\" map[]"), resp2)
+}
@@ -0,0 +1,174 @@
+package ssdp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/request"
+)
+
+// Advertiser makes services discoverable: it answers M-SEARCH requests for them and
+// announces them with NOTIFY, ssdp:alive on Start and every Interval after, and
+// ssdp:byebye on Close.
+type Advertiser struct {
+	// Addr is where searches are listened for, MulticastAddr if empty
+	Addr string
+
+	// NotifyAddr is where announcements go, Addr if empty. With a unicast Addr
+	// this is where the listeners are.
+	NotifyAddr string
+
+	// Interface is the network interface for multicast, nil for the system's choice
+	Interface *net.Interface
+
+	Services []Service
+
+	// Interval is the time between alive announcements. If zero it is a third
+	// of the shortest MaxAge, so that one lost announcement doesn't expire anything.
+	Interval time.Duration
+
+	conn      *net.UDPConn
+	notify    *net.UDPAddr
+	host      string // the HOST field of announcements
+	multicast bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// Start opens the socket, sends the first announcements and starts answering searches
+func (a *Advertiser) Start() error {
+	if len(a.Services) == 0 {
+		return errors.New("ssdp: no services to advertise")
+	}
+	conn, addr, err := listen(a.Addr, a.Interface)
+	if err != nil {
+		return err
+	}
+	a.conn = conn
+	a.multicast = addr.IP.IsMulticast()
+	a.notify = addr
+	if a.NotifyAddr != "" {
+		if a.notify, err = net.ResolveUDPAddr("udp", a.NotifyAddr); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	a.host = a.notify.String()
+	a.done = make(chan struct{})
+
+	a.announce(notifyAlive)
+	a.wg.Add(2)
+	go a.serve()
+	go a.repeat()
+	return nil
+}
+
+// LocalAddr is the address searches are answered on
+func (a *Advertiser) LocalAddr() net.Addr {
+	return a.conn.LocalAddr()
+}
+
+// Close says goodbye for every service and stops answering searches
+func (a *Advertiser) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.announce(notifyByebye)
+		err = a.conn.Close()
+		a.wg.Wait()
+	})
+	return err
+}
+
+func (a *Advertiser) announce(format func(host string, s Service) []byte) {
+	for _, s := range a.Services {
+		// A lost announcement is made up for by the next one
+		a.conn.WriteToUDP(format(a.host, s), a.notify)
+	}
+}
+
+func (a *Advertiser) repeat() {
+	defer a.wg.Done()
+	interval := a.Interval
+	if interval <= 0 {
+		shortest := time.Duration(0)
+		for _, s := range a.Services {
+			age := time.Duration(s.maxAgeSeconds()) * time.Second
+			if shortest == 0 || age < shortest {
+				shortest = age
+			}
+		}
+		interval = max(shortest/3, time.Second)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.announce(notifyAlive)
+		}
+	}
+}
+
+func (a *Advertiser) serve() {
+	defer a.wg.Done()
+	buf := make([]byte, 8<<10)
+	for {
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			// Closed
+			return
+		}
+		// Anything that isn't a valid search, including other devices' NOTIFYs, is ignored
+		req, err := request.RequestFromDatagram(buf[:n])
+		if err != nil || req.RequestLine.Method != "M-SEARCH" || req.Headers["man"] != `"ssdp:discover"` {
+			continue
+		}
+		a.answer(req, from)
+	}
+}
+
+// answer sends a response for every service the search is for. Searches to the group
+// are answered after a random delay of up to MX seconds, so that a network full of
+// devices doesn't reply all at once; unicast searches are answered right away.
+func (a *Advertiser) answer(req *request.Request, from *net.UDPAddr) {
+	target := req.Headers["st"]
+	var matches []Service
+	for _, s := range a.Services {
+		if target == All || target == s.Type {
+			matches = append(matches, s)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+
+	send := func() {
+		now := time.Now()
+		for _, s := range matches {
+			a.conn.WriteToUDP(searchResponse(s, now), from)
+		}
+	}
+	mx, _ := strconv.Atoi(req.Headers["mx"])
+	if !a.multicast || mx <= 0 {
+		send()
+		return
+	}
+	delay := time.Duration(rand.Int63n(int64(min(mx, 5)) * int64(time.Second)))
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		select {
+		case <-a.done:
+		case <-time.After(delay):
+			send()
+		}
+	}()
+}
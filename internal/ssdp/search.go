@@ -0,0 +1,92 @@
+package ssdp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// responseGrace is how long after MX a search still waits, for responses on their way
+const responseGrace = 500 * time.Millisecond
+
+// Search sends an M-SEARCH for target to addr, MulticastAddr if empty, and returns the
+// services that answer within mx. Each USN is returned once, in the order the answers
+// came. Search returns early, with what it has, when ctx is done.
+func Search(ctx context.Context, addr, target string, mx time.Duration) ([]Service, error) {
+	if addr == "" {
+		addr = MulticastAddr
+	}
+	if target == "" {
+		target = All
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// UPnP allows 1 to 5 seconds
+	seconds := min(max(int(mx/time.Second), 1), 5)
+	if _, err := conn.WriteToUDP(searchRequest(raddr.String(), target, seconds), raddr); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(mx + responseGrace))
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	var found []Service
+	seen := make(map[string]bool)
+	buf := make([]byte, 8<<10)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return found, nil
+			}
+			return found, err
+		}
+		s, err := ParseResponse(buf[:n])
+		if err != nil || seen[s.USN] {
+			continue
+		}
+		seen[s.USN] = true
+		found = append(found, *s)
+	}
+}
+
+// Listen calls fn for every NOTIFY that arrives on addr, MulticastAddr if empty, until
+// ctx is done. ifi picks the interface for multicast, nil for the system's choice.
+func Listen(ctx context.Context, addr string, ifi *net.Interface, fn func(*Notification)) error {
+	conn, _, err := listen(addr, ifi)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, 8<<10)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		// Searches from others arrive on the group as well
+		note, err := ParseNotify(buf[:n])
+		if err != nil {
+			continue
+		}
+		note.From = from
+		fn(note)
+	}
+}
@@ -0,0 +1,202 @@
+// Package ssdp implements the Simple Service Discovery Protocol that UPnP devices use to
+// find each other: M-SEARCH requests and their responses, and NOTIFY announcements that
+// a service is alive or going away. The messages are HTTPU, HTTP over UDP with one
+// message per datagram, read with request.RequestFromDatagram and the response parser.
+//
+// SSDP runs on the multicast group 239.255.255.250:1900. Every function here also takes
+// a plain unicast address instead, such as 127.0.0.1:1900, for tests and simulated
+// networks where multicast isn't routed.
+package ssdp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+const (
+	// MulticastAddr is where SSDP searches and announcements go by default
+	MulticastAddr = "239.255.255.250:1900"
+
+	// All is the search target that every service answers
+	All = "ssdp:all"
+
+	// RootDevice is the type every UPnP root device announces itself with
+	RootDevice = "upnp:rootdevice"
+
+	// DefaultMaxAge is how long announcements hold when a Service doesn't say
+	DefaultMaxAge = 30 * time.Minute
+)
+
+// dateFormat is the IMF-fixdate layout of the DATE field in search responses
+const dateFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Service is something announced or found over SSDP
+type Service struct {
+	Type     string        // NT in announcements, ST in search responses, e.g. "upnp:rootdevice"
+	USN      string        // unique service name, e.g. "uuid:0b1c...::upnp:rootdevice"
+	Location string        // URL of the device description
+	Server   string        // "OS/version UPnP/1.1 product/version"
+	MaxAge   time.Duration // how long the announcement holds, DefaultMaxAge if zero
+}
+
+// Notification is a NOTIFY message: a service announcing itself or saying goodbye
+type Notification struct {
+	Service
+	Alive bool     // ssdp:alive or ssdp:update; false for ssdp:byebye
+	From  net.Addr // who sent it, nil if not known
+}
+
+// ParseNotify reads a NOTIFY datagram
+func ParseNotify(data []byte) (*Notification, error) {
+	req, err := request.RequestFromDatagram(data)
+	if err != nil {
+		return nil, err
+	}
+	if req.RequestLine.Method != "NOTIFY" {
+		return nil, fmt.Errorf("ssdp: %s is not a NOTIFY", req.RequestLine.Method)
+	}
+	n := &Notification{Service: serviceFrom(req.Headers, "nt")}
+	switch nts := req.Headers["nts"]; nts {
+	case "ssdp:alive", "ssdp:update":
+		n.Alive = true
+	case "ssdp:byebye":
+	default:
+		return nil, fmt.Errorf("ssdp: unknown NTS %q", nts)
+	}
+	if n.Type == "" || n.USN == "" {
+		return nil, errors.New("ssdp: NOTIFY without NT or USN")
+	}
+	return n, nil
+}
+
+// ParseResponse reads the response to an M-SEARCH
+func ParseResponse(data []byte) (*Service, error) {
+	resp, err := response.ResponseFromReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusLine.StatusCode != response.StatusOK {
+		return nil, fmt.Errorf("ssdp: search response with status %d", resp.StatusLine.StatusCode)
+	}
+	s := serviceFrom(resp.Headers, "st")
+	if s.Type == "" || s.USN == "" {
+		return nil, errors.New("ssdp: search response without ST or USN")
+	}
+	return &s, nil
+}
+
+// serviceFrom takes a service from the fields of a message; typeField is "nt" or "st"
+func serviceFrom(h headers.Headers, typeField string) Service {
+	return Service{
+		Type:     h[typeField],
+		USN:      h["usn"],
+		Location: h["location"],
+		Server:   h["server"],
+		MaxAge:   maxAge(h["cache-control"]),
+	}
+}
+
+// maxAge finds the max-age directive of a Cache-Control field, 0 if there is none
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, ok := strings.Cut(directive, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "max-age") {
+			continue
+		}
+		if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return 0
+}
+
+func (s Service) maxAgeSeconds() int {
+	if s.MaxAge <= 0 {
+		return int(DefaultMaxAge / time.Second)
+	}
+	return int(s.MaxAge / time.Second)
+}
+
+// message formats a datagram from its start line and field name and value pairs.
+// Names are written in capitals, as the UPnP specification and most devices do.
+func message(startLine string, fields ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString(startLine + "\r\n")
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(&b, "%s: %s\r\n", fields[i], fields[i+1])
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func notifyAlive(host string, s Service) []byte {
+	return message("NOTIFY * HTTP/1.1",
+		"HOST", host,
+		"CACHE-CONTROL", fmt.Sprintf("max-age=%d", s.maxAgeSeconds()),
+		"LOCATION", s.Location,
+		"NT", s.Type,
+		"NTS", "ssdp:alive",
+		"SERVER", s.Server,
+		"USN", s.USN,
+	)
+}
+
+func notifyByebye(host string, s Service) []byte {
+	return message("NOTIFY * HTTP/1.1",
+		"HOST", host,
+		"NT", s.Type,
+		"NTS", "ssdp:byebye",
+		"USN", s.USN,
+	)
+}
+
+func searchRequest(host, target string, mx int) []byte {
+	return message("M-SEARCH * HTTP/1.1",
+		"HOST", host,
+		"MAN", `"ssdp:discover"`,
+		"MX", strconv.Itoa(mx),
+		"ST", target,
+	)
+}
+
+func searchResponse(s Service, now time.Time) []byte {
+	return message("HTTP/1.1 200 OK",
+		"CACHE-CONTROL", fmt.Sprintf("max-age=%d", s.maxAgeSeconds()),
+		"DATE", now.UTC().Format(dateFormat),
+		"EXT", "",
+		"LOCATION", s.Location,
+		"SERVER", s.Server,
+		"ST", s.Type,
+		"USN", s.USN,
+	)
+}
+
+// listen opens a socket on addr, joining the group if it is a multicast address
+func listen(addr string, ifi *net.Interface) (*net.UDPConn, *net.UDPAddr, error) {
+	if addr == "" {
+		addr = MulticastAddr
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var conn *net.UDPConn
+	if udpAddr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", ifi, udpAddr)
+	} else {
+		conn, err = net.ListenUDP("udp", udpAddr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, udpAddr, nil
+}
@@ -0,0 +1,146 @@
+package ssdp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testServices = []Service{
+	{
+		Type:     RootDevice,
+		USN:      "uuid:4d696e69-444c-164e-9d41-b827eb54e9f5::upnp:rootdevice",
+		Location: "http://127.0.0.1:42069/device.xml",
+		Server:   "Linux/6.1 UPnP/1.1 httpfromtcp/1.0",
+		MaxAge:   10 * time.Minute,
+	},
+	{
+		Type:     "urn:schemas-upnp-org:device:MediaServer:1",
+		USN:      "uuid:4d696e69-444c-164e-9d41-b827eb54e9f5::urn:schemas-upnp-org:device:MediaServer:1",
+		Location: "http://127.0.0.1:42069/device.xml",
+		Server:   "Linux/6.1 UPnP/1.1 httpfromtcp/1.0",
+	},
+}
+
+func TestMessages(t *testing.T) {
+	n, err := ParseNotify(notifyAlive(MulticastAddr, testServices[0]))
+	require.NoError(t, err)
+	assert.True(t, n.Alive)
+	assert.Equal(t, testServices[0], n.Service)
+
+	n, err = ParseNotify(notifyByebye(MulticastAddr, testServices[1]))
+	require.NoError(t, err)
+	assert.False(t, n.Alive)
+	assert.Equal(t, testServices[1].USN, n.USN)
+
+	s, err := ParseResponse(searchResponse(testServices[1], time.Now()))
+	require.NoError(t, err)
+	assert.Equal(t, testServices[1].Type, s.Type)
+	assert.Equal(t, DefaultMaxAge, s.MaxAge)
+
+	// As a device might send it
+	s, err = ParseResponse([]byte("HTTP/1.1 200 OK\r\nCache-Control: no-cache, max-age = 120\r\nExt:\r\nST: upnp:rootdevice\r\nUSN: uuid:1::upnp:rootdevice\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, s.MaxAge)
+
+	_, err = ParseNotify(searchRequest(MulticastAddr, All, 1))
+	assert.Error(t, err)
+	_, err = ParseNotify([]byte("NOTIFY * HTTP/1.1\r\nNT: upnp:rootdevice\r\nNTS: ssdp:gone\r\nUSN: uuid:1\r\n\r\n"))
+	assert.Error(t, err)
+	_, err = ParseResponse([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+	assert.Error(t, err)
+}
+
+func TestAdvertiser(t *testing.T) {
+	// A listener where the announcements go, which is where a group would be on a real network
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	notifyAddr := probe.LocalAddr().String()
+	probe.Close()
+
+	var mu sync.Mutex
+	var notes []*Notification
+	listening := make(chan error, 1)
+	go func() {
+		listening <- Listen(ctx, notifyAddr, nil, func(n *Notification) {
+			mu.Lock()
+			notes = append(notes, n)
+			mu.Unlock()
+		})
+	}()
+	received := func() []*Notification {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*Notification(nil), notes...)
+	}
+	// Give Listen time to bind before anything is announced
+	time.Sleep(50 * time.Millisecond)
+
+	a := &Advertiser{Addr: "127.0.0.1:0", NotifyAddr: notifyAddr, Services: testServices, Interval: 100 * time.Millisecond}
+	require.NoError(t, a.Start())
+	addr := a.LocalAddr().String()
+
+	found, err := Search(ctx, addr, All, time.Second)
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+	assert.Equal(t, testServices[0].USN, found[0].USN)
+	assert.Equal(t, testServices[0].Location, found[0].Location)
+	assert.Equal(t, testServices[1].USN, found[1].USN)
+
+	found, err = Search(ctx, addr, "urn:schemas-upnp-org:device:MediaServer:1", time.Second)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, testServices[1].Type, found[0].Type)
+
+	// Nothing answers, so the search waits it out
+	start := time.Now()
+	found, err = Search(ctx, addr, "urn:schemas-upnp-org:device:Printer:1", time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+
+	// The first announcements and at least one repeat
+	require.Eventually(t, func() bool { return len(received()) >= 4 }, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, a.Close())
+	require.Eventually(t, func() bool {
+		notes := received()
+		return !notes[len(notes)-1].Alive
+	}, time.Second, 10*time.Millisecond)
+
+	var alive, byebye int
+	for _, n := range received() {
+		if n.Alive {
+			alive++
+		} else {
+			byebye++
+		}
+		assert.Equal(t, "127.0.0.1", n.From.(*net.UDPAddr).IP.String())
+	}
+	assert.GreaterOrEqual(t, alive, 4)
+	assert.Equal(t, 2, byebye)
+
+	cancel()
+	assert.NoError(t, <-listening)
+}
+
+func TestSearchCanceled(t *testing.T) {
+	// Something that never answers
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	found, err := Search(ctx, conn.LocalAddr().String(), All, 5*time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+	assert.Less(t, time.Since(start), time.Second)
+}
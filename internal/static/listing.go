@@ -0,0 +1,124 @@
+package static
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// listingEntry is one line of a directory listing, and its JSON form
+type listingEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+}
+
+// serveListing lists the directory name as HTML, or as JSON when the client
+// asks for application/json or adds ?format=json
+func (s *FileServer) serveListing(req *request.Request, w *response.Writer, name string, info fs.FileInfo) {
+	dirEntries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+
+	entries := make([]listingEntry, 0, len(dirEntries))
+	for _, de := range dirEntries {
+		entryInfo, err := de.Info()
+		if err != nil {
+			continue
+		}
+		// A symlink out of the root would only lead to a 404, so don't show it
+		if de.Type()&fs.ModeSymlink != 0 {
+			target, err := s.stat(path.Join(name, de.Name()))
+			if err != nil {
+				continue
+			}
+			entryInfo = target
+		}
+		entries = append(entries, listingEntry{
+			Name:    de.Name(),
+			IsDir:   entryInfo.IsDir(),
+			Size:    entryInfo.Size(),
+			ModTime: entryInfo.ModTime().UTC(),
+		})
+	}
+	// Directories first, then by name
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	h := headers.NewHeaders()
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Vary", "Accept")
+	if !info.ModTime().IsZero() {
+		h.Set("Last-Modified", info.ModTime().UTC().Format(httpTimeFormat))
+	}
+
+	var body []byte
+	if wantsJSON(req) {
+		h.Set("Content-Type", "application/json")
+		body, err = json.Marshal(entries)
+		if err != nil {
+			writeError(w, response.StatusServerError)
+			return
+		}
+		body = append(body, '\n')
+	} else {
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		body = []byte(listingHTML(req.Path(), entries))
+	}
+
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func wantsJSON(req *request.Request) bool {
+	if req.Query().Get("format") == "json" {
+		return true
+	}
+	accept := req.Headers["accept"]
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// listingHTML renders entries as a page of relative links
+func listingHTML(urlPath string, entries []listingEntry) string {
+	title := html.EscapeString("Index of " + urlPath)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!doctype html>\n<html>\n<head><meta charset=\"utf-8\"><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<table>\n", title, title)
+	b.WriteString("<tr><th>Name</th><th>Size</th><th>Modified</th></tr>\n")
+	if urlPath != "/" {
+		b.WriteString("<tr><td><a href=\"../\">../</a></td><td></td><td></td></tr>\n")
+	}
+	for _, e := range entries {
+		name, size, modified := e.Name, fmt.Sprint(e.Size), ""
+		if e.IsDir {
+			name, size = name+"/", "-"
+		}
+		if !e.ModTime.IsZero() {
+			modified = e.ModTime.Format(time.RFC3339)
+		}
+		// "./" keeps a name with a colon from being read as a URL scheme
+		href := "./" + (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&b, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(href), html.EscapeString(name), size, modified)
+	}
+	b.WriteString("</table>\n</body>\n</html>\n")
+	return b.String()
+}
@@ -0,0 +1,345 @@
+package static
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// httpTimeFormat is the IMF-fixdate layout of Last-Modified and If-Modified-Since
+const httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// bufferLimit is the largest file sent with a Content-Length; bigger ones are
+// streamed in chunks instead of being read into memory whole
+const bufferLimit = 1 << 20
+
+// chunkSize is the read size when streaming a file
+const chunkSize = 32 << 10
+
+// errOutsideRoot is returned when a path resolves, through a symlink, to outside the root directory
+var errOutsideRoot = errors.New("path escapes the root directory")
+
+// FileServer serves the files of a directory tree
+type FileServer struct {
+	fsys fs.FS
+	root string // the directory behind fsys, "" for other file systems
+
+	// Prefix is stripped from the request path before looking up the file,
+	// e.g. "/static" when the server is mounted at "/static/*path"
+	Prefix string
+
+	// Index is the file served for a directory, "index.html" by default
+	Index string
+
+	// Listing serves an HTML or JSON listing for directories without an index file.
+	// Otherwise they are answered with 403.
+	Listing bool
+
+	// Precompressed serves "name.gz" instead of "name" when it exists and the client accepts gzip
+	Precompressed bool
+
+	// MaxAge sets Cache-Control: public, max-age=... ; 0 sends no-cache, so clients
+	// revalidate every time using the ETag and Last-Modified headers
+	MaxAge time.Duration
+}
+
+// Dir serves the directory root. Symlinks inside it are followed, but only as
+// long as they point to something inside root as well.
+func Dir(root string) *FileServer {
+	return &FileServer{fsys: os.DirFS(root), root: root}
+}
+
+// FS serves fsys, e.g. an embed.FS
+func FS(fsys fs.FS) *FileServer {
+	return &FileServer{fsys: fsys}
+}
+
+// ServeHTTP serves the file named by the request path
+func (s *FileServer) ServeHTTP(req *request.Request, w *response.Writer) {
+	urlPath := req.Path()
+	if !strings.HasPrefix(urlPath, s.Prefix) {
+		writeError(w, response.StatusNotFound)
+		return
+	}
+	decoded, err := url.PathUnescape(strings.TrimPrefix(urlPath, s.Prefix))
+	if err != nil || strings.ContainsRune(decoded, 0) {
+		writeError(w, response.StatusBadRequest)
+		return
+	}
+	name, ok := cleanPath(decoded)
+	if !ok {
+		writeError(w, response.StatusBadRequest)
+		return
+	}
+
+	// Directories are only served under their canonical path with a trailing slash,
+	// so relative links in index pages and listings resolve correctly
+	if info, err := s.stat(name); err == nil && info.IsDir() && !strings.HasSuffix(urlPath, "/") {
+		target := urlPath + "/"
+		if query := req.Query().Encode(); query != "" {
+			target += "?" + query
+		}
+		redirect(w, target)
+		return
+	}
+	s.ServeFile(req, w, name)
+}
+
+// ServeFile serves the file name, a slash-separated path relative to the root
+// like "videos/intro.mp4", regardless of the request path
+func (s *FileServer) ServeFile(req *request.Request, w *response.Writer, name string) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, response.StatusMethodNotAllowed)
+		return
+	}
+	if method == "HEAD" {
+		w.SuppressBody()
+	}
+
+	name, ok := cleanPath(name)
+	if !ok {
+		writeError(w, response.StatusBadRequest)
+		return
+	}
+	info, err := s.stat(name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+
+	if info.IsDir() {
+		index := s.Index
+		if index == "" {
+			index = "index.html"
+		}
+		indexName := path.Join(name, index)
+		if indexInfo, err := s.stat(indexName); err == nil && !indexInfo.IsDir() {
+			name, info = indexName, indexInfo
+		} else if s.Listing {
+			s.serveListing(req, w, name, info)
+			return
+		} else {
+			writeError(w, response.StatusForbidden)
+			return
+		}
+	}
+
+	s.serveContent(req, w, name, info)
+}
+
+// serveContent answers with the file, a precompressed sibling or 304 Not Modified
+func (s *FileServer) serveContent(req *request.Request, w *response.Writer, name string, info fs.FileInfo) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", s.contentType(name))
+	h.Set("Cache-Control", s.cacheControl())
+
+	sendName, sendInfo := name, info
+	if s.Precompressed {
+		h.Set("Vary", "Accept-Encoding")
+		if acceptsGzip(req.Headers["accept-encoding"]) {
+			if gzInfo, err := s.stat(name + ".gz"); err == nil && !gzInfo.IsDir() {
+				sendName, sendInfo = name+".gz", gzInfo
+				h.Set("Content-Encoding", "gzip")
+			}
+		}
+	}
+
+	etag := makeETag(sendInfo, sendName != name)
+	h.Set("ETag", etag)
+	if !sendInfo.ModTime().IsZero() {
+		h.Set("Last-Modified", sendInfo.ModTime().UTC().Format(httpTimeFormat))
+	}
+
+	if notModified(req.Headers, etag, sendInfo.ModTime()) {
+		delete(h, "content-type")
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(h)
+		return
+	}
+
+	f, err := s.fsys.Open(sendName)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	defer f.Close()
+
+	if sendInfo.Size() <= bufferLimit {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			writeError(w, response.StatusServerError)
+			return
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody(data)
+		return
+	}
+
+	h.Set("Transfer-Encoding", "chunked")
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Ending the chunks now would pass a truncated file off as complete
+			panic(server.ErrAbortHandler)
+		}
+	}
+	w.WriteChunkedBodyDone()
+}
+
+// stat looks name up, making sure a directory root isn't left through a symlink
+func (s *FileServer) stat(name string) (fs.FileInfo, error) {
+	if s.root != "" {
+		if err := s.checkSymlinks(name); err != nil {
+			return nil, err
+		}
+	}
+	return fs.Stat(s.fsys, name)
+}
+
+// checkSymlinks resolves every symlink on the way to name and fails if the
+// result is outside the root directory
+func (s *FileServer) checkSymlinks(name string) error {
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(s.root, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return errOutsideRoot
+	}
+	return nil
+}
+
+func (s *FileServer) cacheControl() string {
+	if s.MaxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", int64(s.MaxAge.Seconds()))
+}
+
+// cleanPath turns a URL path into an fs.FS name. ".." can't climb above the root:
+// cleaning "/../etc/passwd" gives "/etc/passwd", i.e. "etc/passwd" inside the root.
+func cleanPath(p string) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, fs.ValidPath(name)
+}
+
+// makeETag derives a weak validator from the size and modification time
+func makeETag(info fs.FileInfo, gzipped bool) string {
+	tag := strconv.FormatInt(info.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(info.Size(), 36)
+	if gzipped {
+		tag += "-gz"
+	}
+	return `W/"` + tag + `"`
+}
+
+// notModified evaluates the conditional headers; If-None-Match takes precedence
+// over If-Modified-Since (RFC 9110 Section 13.2.2)
+func notModified(h headers.Headers, etag string, modTime time.Time) bool {
+	if inm, ok := h["if-none-match"]; ok {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			// Weak comparison: W/"x" matches "x"
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, ok := h["if-modified-since"]; ok && !modTime.IsZero() {
+		t, err := time.Parse(httpTimeFormat, ims)
+		return err == nil && !modTime.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.TrimSpace(coding)
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// redirect sends a 301 to target
+func redirect(w *response.Writer, target string) {
+	w.WriteStatusLine(response.StatusMovedPermanently)
+	h := headers.NewHeaders()
+	h.Set("Location", target)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte("Moved Permanently: " + target + "\n"))
+}
+
+// writeFSError maps a file system error to 404, 403 or 500
+func writeFSError(w *response.Writer, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, errOutsideRoot):
+		// A path outside the root doesn't exist as far as the client is concerned
+		writeError(w, response.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission):
+		writeError(w, response.StatusForbidden)
+	default:
+		writeError(w, response.StatusServerError)
+	}
+}
+
+// writeError writes a short text/plain response for the given status code
+func writeError(w *response.Writer, code response.StatusCode) {
+	w.WriteStatusLine(code)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(fmt.Sprintf("%d %s\n", code, response.StatusText(code))))
+}
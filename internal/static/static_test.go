@@ -0,0 +1,361 @@
+package static
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// result is a parsed response, enough for these tests
+type result struct {
+	status  int
+	headers headers.Headers
+	body    string
+}
+
+// serve runs one request through fsrv and parses what it wrote
+func serve(t *testing.T, fsrv *FileServer, method, target string, h headers.Headers) result {
+	t.Helper()
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     h,
+	}
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	fsrv.ServeHTTP(req, w)
+	require.NoError(t, w.Flush())
+
+	head, body, ok := strings.Cut(buf.String(), "\r\n\r\n")
+	require.True(t, ok, buf.String())
+	lines := strings.Split(head, "\r\n")
+	var res result
+	_, err := fmt.Sscanf(lines[0], "HTTP/1.1 %d", &res.status)
+	require.NoError(t, err)
+	res.headers = headers.NewHeaders()
+	for _, line := range lines[1:] {
+		name, value, _ := strings.Cut(line, ": ")
+		res.headers[strings.ToLower(name)] = value
+	}
+	res.body = body
+	return res
+}
+
+var modTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"index.html":         {Data: []byte("<h1>home</h1>"), ModTime: modTime},
+		"app.js":             {Data: []byte("console.log(1)"), ModTime: modTime},
+		"app.js.gz":          {Data: gzipped("console.log(1)"), ModTime: modTime},
+		"docs/readme":        {Data: []byte("plain words\n"), ModTime: modTime},
+		"docs/logo":          {Data: []byte("\x89PNG\r\n\x1a\n...."), ModTime: modTime},
+		"docs/a b.txt":       {Data: []byte("spaced"), ModTime: modTime},
+		"docs/sub/deep.json": {Data: []byte("{}"), ModTime: modTime},
+		"empty/.keep":        {Data: nil, ModTime: modTime},
+	}
+}
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestServeFiles(t *testing.T) {
+	fsrv := FS(testFS())
+
+	tests := []struct {
+		name        string
+		target      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"index at the root", "/", 200, "text/html; charset=utf-8", "<h1>home</h1>"},
+		{"file by extension", "/app.js", 200, "text/javascript; charset=utf-8", "console.log(1)"},
+		{"sniffed text", "/docs/readme", 200, "text/plain; charset=utf-8", "plain words\n"},
+		{"sniffed image", "/docs/logo", 200, "image/png", "\x89PNG\r\n\x1a\n...."},
+		{"escaped name", "/docs/a%20b.txt", 200, "text/plain; charset=utf-8", "spaced"},
+		{"missing", "/nope.css", 404, "text/plain; charset=utf-8", "404 Not Found\n"},
+		{"traversal", "/../../etc/passwd", 404, "text/plain; charset=utf-8", "404 Not Found\n"},
+		{"encoded traversal", "/docs/%2e%2e/%2e%2e/app.js", 200, "text/javascript; charset=utf-8", "console.log(1)"},
+		{"directory without index", "/empty/", 403, "text/plain; charset=utf-8", "403 Forbidden\n"},
+		{"bad escape", "/%zz", 400, "text/plain; charset=utf-8", "400 Bad Request\n"},
+		{"nul byte", "/app.js%00.png", 400, "text/plain; charset=utf-8", "400 Bad Request\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := serve(t, fsrv, "GET", tc.target, nil)
+			assert.Equal(t, tc.status, res.status)
+			assert.Equal(t, tc.contentType, res.headers["content-type"])
+			assert.Equal(t, tc.body, res.body)
+		})
+	}
+
+	t.Run("directory redirect keeps the query", func(t *testing.T) {
+		res := serve(t, fsrv, "GET", "/docs?x=1", nil)
+		assert.Equal(t, 301, res.status)
+		assert.Equal(t, "/docs/?x=1", res.headers["location"])
+	})
+
+	t.Run("HEAD", func(t *testing.T) {
+		res := serve(t, fsrv, "HEAD", "/app.js", nil)
+		assert.Equal(t, 200, res.status)
+		assert.Equal(t, "14", res.headers["content-length"])
+		assert.Empty(t, res.body)
+	})
+
+	t.Run("POST", func(t *testing.T) {
+		res := serve(t, fsrv, "POST", "/app.js", nil)
+		assert.Equal(t, 405, res.status)
+		assert.Equal(t, "GET, HEAD", res.headers["allow"])
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		mounted := FS(testFS())
+		mounted.Prefix = "/static"
+		assert.Equal(t, "console.log(1)", serve(t, mounted, "GET", "/static/app.js", nil).body)
+		assert.Equal(t, 404, serve(t, mounted, "GET", "/app.js", nil).status)
+	})
+}
+
+func TestCaching(t *testing.T) {
+	fsrv := FS(testFS())
+	fsrv.MaxAge = time.Hour
+
+	res := serve(t, fsrv, "GET", "/app.js", nil)
+	etag := res.headers["etag"]
+	assert.True(t, strings.HasPrefix(etag, `W/"`), etag)
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", res.headers["last-modified"])
+	assert.Equal(t, "public, max-age=3600", res.headers["cache-control"])
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"matching etag", "If-None-Match", etag, 304},
+		{"strong form of the etag", "If-None-Match", strings.TrimPrefix(etag, "W/"), 304},
+		{"etag in a list", "If-None-Match", `"other", ` + etag, 304},
+		{"other etag", "If-None-Match", `"other"`, 200},
+		{"not modified since", "If-Modified-Since", "Wed, 01 May 2024 12:00:00 GMT", 304},
+		{"modified since", "If-Modified-Since", "Wed, 01 May 2024 11:59:59 GMT", 200},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := headers.NewHeaders()
+			h.Set(tc.header, tc.value)
+			res := serve(t, fsrv, "GET", "/app.js", h)
+			assert.Equal(t, tc.status, res.status)
+			if tc.status == 304 {
+				assert.Empty(t, res.body)
+				assert.NotContains(t, res.headers, "content-length")
+				assert.Equal(t, etag, res.headers["etag"])
+			}
+		})
+	}
+}
+
+func TestPrecompressed(t *testing.T) {
+	fsrv := FS(testFS())
+	fsrv.Precompressed = true
+
+	h := headers.NewHeaders()
+	h.Set("Accept-Encoding", "br, gzip;q=0.8")
+	res := serve(t, fsrv, "GET", "/app.js", h)
+	assert.Equal(t, "gzip", res.headers["content-encoding"])
+	assert.Equal(t, "text/javascript; charset=utf-8", res.headers["content-type"])
+	assert.Equal(t, "Accept-Encoding", res.headers["vary"])
+	assert.Equal(t, string(gzipped("console.log(1)")), res.body)
+
+	plain := serve(t, fsrv, "GET", "/app.js", nil)
+	assert.Empty(t, plain.headers["content-encoding"])
+	assert.Equal(t, "console.log(1)", plain.body)
+	assert.NotEqual(t, res.headers["etag"], plain.headers["etag"])
+
+	h.Set("Accept-Encoding", "gzip;q=0")
+	assert.Equal(t, "console.log(1)", serve(t, fsrv, "GET", "/app.js", h).body)
+
+	// Without a .gz sibling the original is sent
+	h.Set("Accept-Encoding", "gzip")
+	assert.Equal(t, "plain words\n", serve(t, fsrv, "GET", "/docs/readme", h).body)
+}
+
+func TestListing(t *testing.T) {
+	fsrv := FS(testFS())
+	fsrv.Listing = true
+
+	res := serve(t, fsrv, "GET", "/docs/", nil)
+	assert.Equal(t, 200, res.status)
+	assert.Equal(t, "text/html; charset=utf-8", res.headers["content-type"])
+	assert.Contains(t, res.body, `<a href="./sub/">sub/</a>`)
+	assert.Contains(t, res.body, `<a href="./a%20b.txt">a b.txt</a>`)
+	assert.Contains(t, res.body, `<a href="../">../</a>`)
+	assert.Less(t, strings.Index(res.body, "sub/"), strings.Index(res.body, "a b.txt"), "directories come first")
+
+	for _, tc := range []struct {
+		target string
+		accept string
+	}{
+		{"/docs/?format=json", ""},
+		{"/docs/", "application/json"},
+	} {
+		h := headers.NewHeaders()
+		if tc.accept != "" {
+			h.Set("Accept", tc.accept)
+		}
+		res := serve(t, fsrv, "GET", tc.target, h)
+		assert.Equal(t, "application/json", res.headers["content-type"])
+		var entries []listingEntry
+		require.NoError(t, json.Unmarshal([]byte(res.body), &entries))
+		require.Len(t, entries, 4)
+		assert.Equal(t, listingEntry{Name: "sub", IsDir: true, ModTime: entries[0].ModTime}, entries[0])
+		assert.Equal(t, "a b.txt", entries[1].Name)
+		assert.Equal(t, int64(6), entries[1].Size)
+	}
+
+	// An index file wins over the listing
+	assert.Equal(t, "<h1>home</h1>", serve(t, fsrv, "GET", "/", nil).body)
+}
+
+func TestDirSymlinks(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "public.txt"), []byte("public"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "escape.txt")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape-dir")))
+	require.NoError(t, os.Symlink("public.txt", filepath.Join(root, "alias.txt")))
+
+	fsrv := Dir(root)
+	fsrv.Listing = true
+
+	assert.Equal(t, "public", serve(t, fsrv, "GET", "/public.txt", nil).body)
+	assert.Equal(t, "public", serve(t, fsrv, "GET", "/alias.txt", nil).body)
+	assert.Equal(t, 404, serve(t, fsrv, "GET", "/escape.txt", nil).status)
+	assert.Equal(t, 404, serve(t, fsrv, "GET", "/escape-dir/secret.txt", nil).status)
+	assert.Equal(t, 404, serve(t, fsrv, "GET", "/escape-dir/", nil).status)
+
+	listing := serve(t, fsrv, "GET", "/", nil).body
+	assert.Contains(t, listing, "alias.txt")
+	assert.NotContains(t, listing, "escape")
+}
+
+func TestLargeFileIsStreamed(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), bufferLimit/16+1)
+	fsrv := FS(fstest.MapFS{"big": {Data: data, ModTime: modTime}})
+
+	res := serve(t, fsrv, "GET", "/big", nil)
+	assert.Equal(t, 200, res.status)
+	assert.Equal(t, "chunked", res.headers["transfer-encoding"])
+	assert.Empty(t, res.headers["content-length"])
+	assert.Equal(t, "text/plain; charset=utf-8", res.headers["content-type"])
+
+	// Undo the chunked framing
+	var body bytes.Buffer
+	rest := res.body
+	for {
+		sizeLine, after, ok := strings.Cut(rest, "\r\n")
+		require.True(t, ok)
+		var size int
+		_, err := fmt.Sscanf(sizeLine, "%x", &size)
+		require.NoError(t, err)
+		if size == 0 {
+			break
+		}
+		body.WriteString(after[:size])
+		rest = after[size+2:]
+	}
+	assert.Equal(t, data, body.Bytes())
+}
+
+// failingFS serves its files but fails reading them after limit bytes
+type failingFS struct {
+	fstest.MapFS
+	limit int
+}
+
+func (f failingFS) Open(name string) (fs.File, error) {
+	file, err := f.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &failingFile{File: file, left: f.limit}, nil
+}
+
+type failingFile struct {
+	fs.File
+	left int
+}
+
+func (f *failingFile) Read(p []byte) (int, error) {
+	if f.left == 0 {
+		return 0, errors.New("input/output error")
+	}
+	n, err := f.File.Read(p[:min(len(p), f.left)])
+	f.left -= n
+	return n, err
+}
+
+func TestReadErrorAbortsStream(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), bufferLimit+1)
+	fsrv := FS(failingFS{MapFS: fstest.MapFS{"big": {Data: data, ModTime: modTime}}, limit: 3 * chunkSize})
+
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/big", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	assert.PanicsWithValue(t, server.ErrAbortHandler, func() { fsrv.ServeHTTP(req, w) })
+	assert.Contains(t, buf.String(), "transfer-encoding: chunked")
+	assert.NotContains(t, buf.String(), "\r\n0\r\n")
+
+	t.Run("Small file", func(t *testing.T) {
+		fsrv := FS(failingFS{MapFS: testFS(), limit: 2})
+		res := serve(t, fsrv, "GET", "/app.js", nil)
+		assert.Equal(t, 500, res.status)
+	})
+}
+
+func TestSniff(t *testing.T) {
+	tests := map[string]string{
+		"<!DOCTYPE html><p>":          "text/html; charset=utf-8",
+		"  <html>":                    "text/html; charset=utf-8",
+		"<?xml version=\"1.0\"?>":     "text/xml; charset=utf-8",
+		"GIF89a....":                  "image/gif",
+		"\x00\x00\x00\x18ftypmp42":    "video/mp4",
+		"RIFF\x00\x00\x00\x00WEBPVP8": "image/webp",
+		"%PDF-1.7":                    "application/pdf",
+		"héllo wörld":                 "text/plain; charset=utf-8",
+		"\x00\x01\x02\x03":            "application/octet-stream",
+		"\xff\xfe\xfd":                "application/octet-stream",
+		"":                            "text/plain; charset=utf-8",
+	}
+	for data, want := range tests {
+		assert.Equal(t, want, sniff([]byte(data)), "%q", data)
+	}
+}
@@ -0,0 +1,322 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The cases below follow the numbering of the Autobahn|Testsuite fuzzing client,
+// so a failure here can be compared against the matching case there. Each one
+// sends raw frames to an echo server and checks the frames that come back.
+
+// frame is a raw frame as it goes over the wire, before masking
+type frame struct {
+	fin     bool
+	rsv     byte // RSV1-3 in the high bits, as they sit in the first byte
+	op      Opcode
+	payload []byte
+}
+
+func text(s string) frame            { return frame{fin: true, op: OpText, payload: []byte(s)} }
+func data(n int) frame               { return frame{fin: true, op: OpBinary, payload: bytes.Repeat([]byte{0xfe}, n)} }
+func ping(s string) frame            { return frame{fin: true, op: OpPing, payload: []byte(s)} }
+func pong(s string) frame            { return frame{fin: true, op: OpPong, payload: []byte(s)} }
+func part(op Opcode, s string) frame { return frame{op: op, payload: []byte(s)} }
+func last(s string) frame            { return frame{fin: true, op: OpContinuation, payload: []byte(s)} }
+
+// compressed marks a frame the server is expected to send with RSV1, compared after inflating
+func compressed(f frame) frame {
+	f.rsv = 0x40
+	return f
+}
+
+func closeFrame(code int, reason string) frame {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return frame{fin: true, op: OpClose, payload: append(payload, reason...)}
+}
+
+// rawClient speaks frames to the server without any of Conn's checks
+type rawClient struct {
+	t  *testing.T
+	nc net.Conn
+	c  *Conn // used for the handshake and to parse the server's frame headers
+}
+
+func dialRaw(t *testing.T, addr string, compression bool) *rawClient {
+	t.Helper()
+	c := dial(t, addr, ClientOptions{Compression: compression})
+	return &rawClient{t: t, nc: c.conn, c: c}
+}
+
+// send writes frames in one go, so a server failing on the first one finds the rest
+// already read instead of unread in the socket (which would turn its close into a reset)
+func (r *rawClient) send(frames ...frame) {
+	r.t.Helper()
+	var wire []byte
+	for _, f := range frames {
+		wire = appendMasked(wire, f)
+	}
+	_, err := r.nc.Write(wire)
+	require.NoError(r.t, err)
+}
+
+func appendMasked(header []byte, f frame) []byte {
+	b0 := f.rsv | byte(f.op)
+	if f.fin {
+		b0 |= 0x80
+	}
+	header = append(header, b0)
+	switch n := len(f.payload); {
+	case n <= 125:
+		header = append(header, 0x80|byte(n))
+	case n <= 0xffff:
+		header = binary.BigEndian.AppendUint16(append(header, 0x80|126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 0x80|127), uint64(n))
+	}
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	header = append(header, mask[:]...)
+	payload := append([]byte(nil), f.payload...)
+	maskBytes(mask, payload)
+
+	return append(header, payload...)
+}
+
+func (r *rawClient) recv() (frame, error) {
+	h, err := r.c.readFrameHeader()
+	if err != nil {
+		return frame{}, err
+	}
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(r.c.br, payload); err != nil {
+		return frame{}, err
+	}
+	f := frame{fin: h.fin, op: h.opcode, payload: payload}
+	if h.rsv1 {
+		f.rsv |= 0x40
+	}
+	return f, nil
+}
+
+// recvMessage reads the next control frame or whole message. A message comes back
+// as one final frame with the RSV bits of its first frame, inflated if it was compressed.
+func (r *rawClient) recvMessage() (frame, error) {
+	msg, err := r.recv()
+	for err == nil && !msg.fin && !msg.op.IsControl() {
+		var next frame
+		if next, err = r.recv(); err == nil {
+			require.Equal(r.t, OpContinuation, next.op)
+			msg.payload = append(msg.payload, next.payload...)
+			msg.fin = next.fin
+		}
+	}
+	if err == nil && msg.rsv&0x40 != 0 {
+		msg.payload, err = decompress(msg.payload, DefaultReadLimit)
+	}
+	return msg, err
+}
+
+// expectClosed reads the server's close frame, checks its code (CloseNoStatus
+// for an empty one) and waits for the server to drop the TCP connection
+func (r *rawClient) expectClosed(code int) {
+	r.t.Helper()
+	f, err := r.recv()
+	require.NoError(r.t, err)
+	require.Equal(r.t, OpClose, f.op, "expected a close frame, got %v", f.op)
+	if code == CloseNoStatus {
+		assert.Empty(r.t, f.payload)
+	} else {
+		require.GreaterOrEqual(r.t, len(f.payload), 2)
+		assert.Equal(r.t, code, int(binary.BigEndian.Uint16(f.payload)), "close reason %q", f.payload[2:])
+	}
+
+	_, err = r.recv()
+	assert.True(r.t, errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET), "server kept the connection open: %v", err)
+}
+
+type autobahnCase struct {
+	id     string
+	send   []frame
+	want   []frame // frames the server answers with before closing
+	closed int     // the code of the server's close frame, 0 if it stays open
+}
+
+func runCases(t *testing.T, addr string, compression bool, cases []autobahnCase) {
+	for _, tc := range cases {
+		t.Run(tc.id, func(t *testing.T) {
+			r := dialRaw(t, addr, compression)
+			r.send(tc.send...)
+			for _, want := range tc.want {
+				got, err := r.recvMessage()
+				require.NoError(t, err)
+				assert.Equal(t, want.op, got.op)
+				assert.Equal(t, want.fin, got.fin)
+				assert.Equal(t, want.rsv, got.rsv)
+				assert.Equal(t, len(want.payload), len(got.payload))
+				assert.True(t, bytes.Equal(want.payload, got.payload), "payload differs")
+			}
+			if tc.closed != 0 {
+				r.expectClosed(tc.closed)
+				return
+			}
+			// Nothing else must come back before our own close is echoed
+			r.send(closeFrame(CloseNormal, ""))
+			r.expectClosed(CloseNormal)
+		})
+	}
+}
+
+func TestAutobahn(t *testing.T) {
+	addr := startEcho(t, &Upgrader{EnableCompression: true})
+	long := strings.Repeat("*", 125)
+
+	// Our echo server answers a message with a single frame of the same opcode
+	cases := []autobahnCase{
+		// 1 Framing: payload lengths around the 7, 16 and 64-bit length encodings
+		{id: "1.1.1", send: []frame{text("")}, want: []frame{text("")}},
+		{id: "1.1.2", send: []frame{text(long)}, want: []frame{text(long)}},
+		{id: "1.1.3", send: []frame{text(long + "*")}, want: []frame{text(long + "*")}},
+		{id: "1.1.4", send: []frame{text(long + "**")}, want: []frame{text(long + "**")}},
+		{id: "1.2.5", send: []frame{data(65535)}, want: []frame{data(65535)}},
+		{id: "1.2.6", send: []frame{data(65536)}, want: []frame{data(65536)}},
+
+		// 2 Pings and pongs
+		{id: "2.1", send: []frame{ping("")}, want: []frame{pong("")}},
+		{id: "2.3", send: []frame{{fin: true, op: OpPing, payload: []byte{0x00, 0xff, 0xfe, 0xfd}}}, want: []frame{{fin: true, op: OpPong, payload: []byte{0x00, 0xff, 0xfe, 0xfd}}}},
+		{id: "2.4", send: []frame{ping(long)}, want: []frame{pong(long)}},
+		{id: "2.5", send: []frame{ping(long + "*")}, closed: CloseProtocolError},
+		{id: "2.7", send: []frame{pong("unsolicited")}},
+		{id: "2.10", send: []frame{ping("1"), ping("2"), ping("3")}, want: []frame{pong("1"), pong("2"), pong("3")}},
+
+		// 3 Reserved bits
+		{id: "3.1", send: []frame{{fin: true, rsv: 0x20, op: OpText, payload: []byte("rsv2")}}, closed: CloseProtocolError},
+		{id: "3.2", send: []frame{text("before"), {fin: true, rsv: 0x10, op: OpText}}, want: []frame{text("before")}, closed: CloseProtocolError},
+		{id: "3.6", send: []frame{{fin: true, rsv: 0x60, op: OpPing}}, closed: CloseProtocolError},
+
+		// 4 Opcodes
+		{id: "4.1.1", send: []frame{{fin: true, op: 0x3}}, closed: CloseProtocolError},
+		{id: "4.1.3", send: []frame{text("before"), {fin: true, op: 0x5}, ping("")}, want: []frame{text("before")}, closed: CloseProtocolError},
+		{id: "4.2.1", send: []frame{{fin: true, op: 0xb}}, closed: CloseProtocolError},
+		{id: "4.2.5", send: []frame{{fin: true, op: 0xf, payload: []byte("reserved")}}, closed: CloseProtocolError},
+
+		// 5 Fragmentation
+		{id: "5.1", send: []frame{part(OpPing, "frag"), last("ment")}, closed: CloseProtocolError},
+		{id: "5.3", send: []frame{part(OpText, "frag"), last("ment")}, want: []frame{text("fragment")}},
+		{id: "5.6", send: []frame{part(OpText, "frag"), ping("in between"), last("ment")}, want: []frame{pong("in between"), text("fragment")}},
+		{id: "5.9", send: []frame{last("no start")}, closed: CloseProtocolError},
+		{id: "5.15", send: []frame{part(OpText, "a"), last("b"), last("c")}, want: []frame{text("ab")}, closed: CloseProtocolError},
+		{id: "5.18", send: []frame{part(OpText, "first"), text("second")}, closed: CloseProtocolError},
+		{id: "5.19", send: []frame{part(OpText, "a"), part(OpContinuation, "b"), ping("p"), part(OpContinuation, "c"), last("d")}, want: []frame{pong("p"), text("abcd")}},
+
+		// 6 UTF-8 handling: κόσμε split inside a code point is fine, broken sequences are not
+		{id: "6.1.3", send: []frame{part(OpText, ""), part(OpContinuation, ""), last("")}, want: []frame{text("")}},
+		{id: "6.2.3", send: []frame{part(OpText, "\xce\xba\xe1"), last("\xbd\xb9\xcf\x83\xce\xbc\xce\xb5")}, want: []frame{text("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5")}},
+		{id: "6.3.1", send: []frame{text("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80edited")}, closed: CloseInvalidPayload},
+		{id: "6.4.1", send: []frame{part(OpText, "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5"), last("\xf4\x90\x80\x80")}, closed: CloseInvalidPayload},
+		{id: "6.6.1", send: []frame{text("\xce")}, closed: CloseInvalidPayload},
+
+		// 7 Closing
+		{id: "7.1.1", send: []frame{text("hello"), closeFrame(CloseNormal, "")}, want: []frame{text("hello")}, closed: CloseNormal},
+		{id: "7.3.1", send: []frame{{fin: true, op: OpClose}}, closed: CloseNoStatus},
+		{id: "7.3.2", send: []frame{{fin: true, op: OpClose, payload: []byte{0x03}}}, closed: CloseProtocolError},
+		{id: "7.3.4", send: []frame{closeFrame(CloseNormal, "bye")}, closed: CloseNormal},
+		{id: "7.3.5", send: []frame{closeFrame(CloseNormal, strings.Repeat("*", 123))}, closed: CloseNormal},
+		{id: "7.3.6", send: []frame{closeFrame(CloseNormal, strings.Repeat("*", 124))}, closed: CloseProtocolError},
+		{id: "7.5.1", send: []frame{closeFrame(CloseNormal, "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80")}, closed: CloseInvalidPayload},
+	}
+	for _, code := range []int{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		cases = append(cases, autobahnCase{id: "7.7/" + strconv.Itoa(code), send: []frame{closeFrame(code, "")}, closed: code})
+	}
+	for _, code := range []int{0, 999, 1004, 1005, 1006, 1015, 1016, 1100, 2000, 2999, 5000, 65535} {
+		cases = append(cases, autobahnCase{id: "7.9/" + strconv.Itoa(code), send: []frame{closeFrame(code, "")}, closed: CloseProtocolError})
+	}
+
+	runCases(t, addr, false, cases)
+}
+
+func TestAutobahnLimits(t *testing.T) {
+	addr := startEcho(t, &Upgrader{ReadLimit: 1 << 16, EnableCompression: true})
+
+	// 9 Limits and performance: large messages in one frame and in many
+	t.Run("9.1.6", func(t *testing.T) {
+		runCases(t, addr, false, []autobahnCase{
+			{id: "single frame", send: []frame{data(1 << 16)}, want: []frame{data(1 << 16)}},
+			{id: "over the limit", send: []frame{data(1<<16 + 1)}, closed: CloseMessageTooBig},
+		})
+	})
+
+	t.Run("9.2.6", func(t *testing.T) {
+		var send []frame
+		for i := 0; i < 1<<6; i++ {
+			send = append(send, part(OpContinuation, strings.Repeat("x", 1<<10)))
+		}
+		send[0].op = OpText
+		over := append(append([]frame(nil), send...), last("x"))
+		send[len(send)-1].fin = true
+		runCases(t, addr, false, []autobahnCase{
+			{id: "fragmented", send: send, want: []frame{text(strings.Repeat("x", 1<<16))}},
+			{id: "fragmented over the limit", send: over, closed: CloseMessageTooBig},
+		})
+	})
+
+	// A compressed message that inflates past the limit is refused as well
+	t.Run("12.5", func(t *testing.T) {
+		runCases(t, addr, true, []autobahnCase{
+			{id: "deflate bomb", send: []frame{deflated(OpBinary, make([]byte, 1<<17))}, closed: CloseMessageTooBig},
+		})
+	})
+}
+
+func TestAutobahnCompression(t *testing.T) {
+	addr := startEcho(t, &Upgrader{EnableCompression: true})
+
+	// 12 and 13 permessage-deflate: our echo replies compressed, so decode through Conn
+	for _, size := range []int{0, 16, 64, 256, 1024, 4096, 8192, 65536, 131072} {
+		t.Run("12.1/"+strconv.Itoa(size), func(t *testing.T) {
+			c := dial(t, addr, ClientOptions{Compression: true})
+			require.True(t, c.Compression())
+			msg := bytes.Repeat([]byte("All work and no play. "), size/22+1)[:size]
+			for i := 0; i < 10; i++ {
+				require.NoError(t, c.WriteMessage(OpText, msg))
+				op, got, err := c.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, OpText, op)
+				assert.Equal(t, msg, got)
+			}
+			require.NoError(t, c.CloseHandshake(CloseNormal, "", time.Second))
+		})
+	}
+
+	runCases(t, addr, true, []autobahnCase{
+		// A compressed message whose first frame carries RSV1, split over continuations
+		{id: "13.2", send: func() []frame {
+			f := deflated(OpText, []byte("compressed fragments"))
+			return []frame{{rsv: 0x40, op: OpText, payload: f.payload[:3]}, last(string(f.payload[3:]))}
+		}(), want: []frame{compressed(text("compressed fragments"))}},
+		{id: "13.3", send: []frame{text("uncompressed")}, want: []frame{compressed(text("uncompressed"))}},
+		{id: "13.4", send: []frame{part(OpText, "a"), {fin: true, rsv: 0x40, op: OpContinuation, payload: []byte("b")}}, closed: CloseProtocolError},
+		{id: "13.5", send: []frame{{fin: true, rsv: 0x40, op: OpPing}}, closed: CloseProtocolError},
+		{id: "13.6", send: []frame{{fin: true, rsv: 0x40, op: OpBinary, payload: []byte{0xff, 0xff, 0xff}}}, closed: CloseInvalidPayload},
+	})
+}
+
+// deflated compresses data the way permessage-deflate sends it, as a single frame
+func deflated(op Opcode, data []byte) frame {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	fw.Write(data)
+	fw.Flush()
+	return frame{fin: true, rsv: 0x40, op: op, payload: bytes.TrimSuffix(buf.Bytes(), deflateTail)}
+}
@@ -0,0 +1,79 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strings"
+)
+
+// deflateTail is the empty stored block a sync flush ends with. Senders strip it
+// from every message and receivers put it back before inflating (RFC 7692 Section 7.2).
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateFinal is an empty final stored block, so the inflater reaches a clean EOF
+var deflateFinal = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+var errTooLarge = errors.New("websocket: decompressed message too large")
+
+// decompress inflates a permessage-deflate payload of at most limit bytes.
+// Every message is compressed on its own (no context takeover), so no
+// window carries over between calls.
+func decompress(data []byte, limit int64) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(
+		bytes.NewReader(data),
+		bytes.NewReader(deflateTail),
+		bytes.NewReader(deflateFinal),
+	))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errTooLarge
+	}
+	return out, nil
+}
+
+// deflateResponse is the extension we agree to. Both sides start a fresh
+// compression context for every message, which keeps per-connection memory flat.
+const deflateResponse = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+// acceptDeflate reports whether one of the offers in a Sec-WebSocket-Extensions
+// header is a permessage-deflate we can honour
+func acceptDeflate(header string) bool {
+	for _, offer := range strings.Split(header, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		if deflateParamsOK(params[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// deflateParamsOK checks the parameters of a permessage-deflate offer.
+// compress/flate always uses a 32KB window, so an offer that limits ours is declined.
+func deflateParamsOK(params []string) bool {
+	for _, param := range params {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(name) {
+		case "server_no_context_takeover", "client_no_context_takeover":
+		case "client_max_window_bits":
+			// The client may use a smaller window, decompression copes with any
+		case "server_max_window_bits":
+			if value != "15" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,234 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// acceptGUID is appended to the client's key to compute Sec-WebSocket-Accept (RFC 6455 Section 1.3)
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrBadHandshake is wrapped by the errors of a failed opening handshake
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Upgrader turns HTTP/1.1 requests into WebSocket connections
+type Upgrader struct {
+	// Subprotocols lists the subprotocols the server speaks, most preferred first.
+	// The first one the client also offers is selected.
+	Subprotocols []string
+
+	// CheckOrigin decides whether a browser request from another origin is allowed.
+	// If nil, the Origin header, when present, must match the Host header.
+	CheckOrigin func(req *request.Request) bool
+
+	// EnableCompression accepts permessage-deflate when the client offers it
+	EnableCompression bool
+
+	// ReadLimit is set on every new connection, see Conn.ReadLimit
+	ReadLimit int64
+}
+
+// Upgrade performs the server side of the opening handshake and takes over the connection.
+// If the request isn't a valid upgrade, Upgrade writes an error response and returns
+// an error wrapping ErrBadHandshake; the handler should just return then.
+func (u *Upgrader) Upgrade(req *request.Request, w *response.Writer) (*Conn, error) {
+	if req.RequestLine.Method != "GET" {
+		return nil, reject(w, response.StatusMethodNotAllowed, "method must be GET")
+	}
+	if !headerHasToken(req.Headers["connection"], "upgrade") || !headerHasToken(req.Headers["upgrade"], "websocket") {
+		return nil, reject(w, response.StatusBadRequest, "missing Connection: Upgrade and Upgrade: websocket")
+	}
+	if req.Headers["sec-websocket-version"] != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, reject(w, response.StatusUpgradeRequired, "unsupported Sec-WebSocket-Version")
+	}
+	key := strings.TrimSpace(req.Headers["sec-websocket-key"])
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, reject(w, response.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return nil, reject(w, response.StatusForbidden, "origin not allowed")
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", AcceptKey(key))
+
+	subprotocol := u.selectSubprotocol(req.Headers["sec-websocket-protocol"])
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	compression := u.EnableCompression && acceptDeflate(req.Headers["sec-websocket-extensions"])
+	if compression {
+		h.Set("Sec-WebSocket-Extensions", deflateResponse)
+	}
+
+	w.WriteStatusLine(response.StatusSwitchingProtocols)
+	w.WriteHeaders(h)
+	conn, rw, err := w.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadHandshake, err)
+	}
+
+	c := newConn(conn, rw.Reader, rw.Writer, true)
+	c.compression = compression
+	c.subprotocol = subprotocol
+	c.ReadLimit = u.ReadLimit
+	return c, nil
+}
+
+func (u *Upgrader) selectSubprotocol(offered string) string {
+	for _, supported := range u.Subprotocols {
+		for _, candidate := range strings.Split(offered, ",") {
+			if strings.TrimSpace(candidate) == supported {
+				return supported
+			}
+		}
+	}
+	return ""
+}
+
+// sameOrigin accepts requests without an Origin header (non-browser clients)
+// and those whose origin has the same host as the request
+func sameOrigin(req *request.Request) bool {
+	origin, ok := req.Headers["origin"]
+	if !ok {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Headers["host"])
+}
+
+// reject answers a failed handshake with a plain-text error
+func reject(w *response.Writer, status response.StatusCode, reason string) error {
+	w.WriteStatusLine(status)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(reason + "\n"))
+	return fmt.Errorf("%w: %s", ErrBadHandshake, reason)
+}
+
+// headerHasToken reports whether a comma-separated header value contains token, ignoring case
+func headerHasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientOptions configures the client side of the opening handshake
+type ClientOptions struct {
+	Subprotocols []string
+	Compression  bool
+	Headers      headers.Headers // extra request headers, e.g. Origin or Authorization
+}
+
+// Client performs the client side of the opening handshake over conn,
+// requesting target (e.g. "/chat") from host
+func Client(conn net.Conn, host, target string, opts ClientOptions) (*Conn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\n", target)
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	b.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Key: %s\r\n", key)
+	if len(opts.Subprotocols) > 0 {
+		fmt.Fprintf(&b, "Sec-WebSocket-Protocol: %s\r\n", strings.Join(opts.Subprotocols, ", "))
+	}
+	if opts.Compression {
+		fmt.Fprintf(&b, "Sec-WebSocket-Extensions: %s\r\n", deflateResponse)
+	}
+	for name, value := range opts.Headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+	b.WriteString("\r\n")
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	statusLine, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(statusLine, "HTTP/1.1 101 ") {
+		return nil, fmt.Errorf("%w: server answered %q", ErrBadHandshake, strings.TrimSpace(statusLine))
+	}
+
+	h := headers.NewHeaders()
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		n, done, err := h.Parse([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadHandshake, err)
+		}
+		if done {
+			break
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("%w: header line without CRLF", ErrBadHandshake)
+		}
+	}
+
+	if h["sec-websocket-accept"] != AcceptKey(key) {
+		return nil, fmt.Errorf("%w: wrong Sec-WebSocket-Accept", ErrBadHandshake)
+	}
+
+	c := newConn(conn, br, nil, false)
+	c.subprotocol = h["sec-websocket-protocol"]
+	if extensions, ok := h["sec-websocket-extensions"]; ok {
+		// We can only inflate messages compressed without context takeover
+		if !opts.Compression || !headerParamsInclude(extensions, "server_no_context_takeover") {
+			return nil, fmt.Errorf("%w: unexpected extensions %q", ErrBadHandshake, extensions)
+		}
+		c.compression = true
+	}
+	return c, nil
+}
+
+// headerParamsInclude reports whether a ;-separated extension value lists param
+func headerParamsInclude(value, param string) bool {
+	for _, p := range strings.Split(value, ";") {
+		if strings.TrimSpace(p) == param {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,574 @@
+// Package websocket implements the WebSocket protocol (RFC 6455) with the
+// permessage-deflate extension (RFC 7692) on top of a hijacked connection.
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Opcode is the frame type
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xa
+)
+
+// IsControl reports whether op is a control frame (close, ping, pong)
+func (op Opcode) IsControl() bool {
+	return op&0x8 != 0
+}
+
+// Close status codes (RFC 6455 Section 7.4.1)
+const (
+	CloseNormal             = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatus           = 1005 // reported when a close frame had no code, never sent
+	CloseAbnormal           = 1006 // reported when the connection dropped, never sent
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+)
+
+const (
+	// DefaultReadLimit is the largest message ReadMessage accepts unless ReadLimit says otherwise
+	DefaultReadLimit = 16 << 20
+
+	// maxControlPayload is the payload limit of close, ping and pong frames
+	maxControlPayload = 125
+
+	// fragmentSize is the frame size messages written through NextWriter are split into
+	fragmentSize = 4096
+)
+
+var (
+	// ErrProtocol is wrapped by the errors ReadMessage returns after the peer broke the protocol;
+	// the connection has been failed with a close frame by then
+	ErrProtocol = errors.New("websocket: protocol error")
+
+	// ErrCloseSent is returned by writes after the close frame went out
+	ErrCloseSent = errors.New("websocket: close frame already sent")
+)
+
+// CloseError is returned by ReadMessage once the peer has closed the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. One goroutine may read while others write:
+// whole messages and control frames are written atomically.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	server bool // the server unmasks what it reads, the client masks what it writes
+
+	compression bool
+	subprotocol string
+
+	// ReadLimit caps the size of a message, after decompression. The peer gets
+	// a 1009 close when it sends more. 0 means DefaultReadLimit.
+	ReadLimit int64
+
+	// OnPing and OnPong, if set, are called with the payload of every ping
+	// (after it was answered) and pong the reader comes across
+	OnPing func(data []byte)
+	OnPong func(data []byte)
+
+	// messageMu keeps the frames of one message together; writeMu guards
+	// single frames, so control frames can go out between fragments
+	messageMu sync.Mutex
+	writeMu   sync.Mutex
+	bw        *bufio.Writer
+	closeSent bool
+
+	// read side, owned by the reading goroutine
+	readErr         error
+	fragmentOp      Opcode // opcode of the message being reassembled, 0 if none
+	fragmentDeflate bool
+	fragments       bytes.Buffer
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, bw *bufio.Writer, server bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	if bw == nil {
+		bw = bufio.NewWriter(conn)
+	}
+	return &Conn{conn: conn, br: br, bw: bw, server: server}
+}
+
+// Subprotocol returns the subprotocol agreed on in the handshake, or ""
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Compression reports whether permessage-deflate was negotiated
+func (c *Conn) Compression() bool {
+	return c.compression
+}
+
+// RemoteAddr returns the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the underlying connection without a closing handshake
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// frameHeader is the decoded start of a frame (RFC 6455 Section 5.2)
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	rsv2   bool
+	rsv3   bool
+	opcode Opcode
+	masked bool
+	mask   [4]byte
+	length uint64
+}
+
+func (c *Conn) readFrameHeader() (frameHeader, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(c.br, b[:2]); err != nil {
+		return frameHeader{}, err
+	}
+
+	h := frameHeader{
+		fin:    b[0]&0x80 != 0,
+		rsv1:   b[0]&0x40 != 0,
+		rsv2:   b[0]&0x20 != 0,
+		rsv3:   b[0]&0x10 != 0,
+		opcode: Opcode(b[0] & 0x0f),
+		masked: b[1]&0x80 != 0,
+		length: uint64(b[1] & 0x7f),
+	}
+
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(c.br, b[:2]); err != nil {
+			return frameHeader{}, err
+		}
+		h.length = uint64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.br, b[:8]); err != nil {
+			return frameHeader{}, err
+		}
+		h.length = binary.BigEndian.Uint64(b[:8])
+		if h.length>>63 != 0 {
+			return h, c.fail(CloseProtocolError, "payload length with the most significant bit set")
+		}
+	}
+
+	if h.masked {
+		if _, err := io.ReadFull(c.br, h.mask[:]); err != nil {
+			return frameHeader{}, err
+		}
+	}
+	return h, nil
+}
+
+// ReadMessage returns the next text or binary message, reassembled from its fragments
+// and decompressed. Pings are answered and a close frame is echoed on the way;
+// after the peer's close it returns a *CloseError.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	op, msg, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		return 0, nil, err
+	}
+	return op, msg, nil
+}
+
+func (c *Conn) readMessage() (Opcode, []byte, error) {
+	limit := c.ReadLimit
+	if limit <= 0 {
+		limit = DefaultReadLimit
+	}
+
+	for {
+		h, err := c.readFrameHeader()
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := c.checkFrame(h); err != nil {
+			return 0, nil, err
+		}
+		if !h.opcode.IsControl() && uint64(c.fragments.Len())+h.length > uint64(limit) {
+			return 0, nil, c.fail(CloseMessageTooBig, fmt.Sprintf("message larger than %d bytes", limit))
+		}
+
+		payload := make([]byte, h.length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return 0, nil, err
+		}
+		if h.masked {
+			maskBytes(h.mask, payload)
+		}
+
+		switch h.opcode {
+		case OpPing:
+			if err := c.WriteControl(OpPong, payload); err != nil && err != ErrCloseSent {
+				return 0, nil, err
+			}
+			if c.OnPing != nil {
+				c.OnPing(payload)
+			}
+			continue
+		case OpPong:
+			if c.OnPong != nil {
+				c.OnPong(payload)
+			}
+			continue
+		case OpClose:
+			return 0, nil, c.handleClose(payload)
+		case OpText, OpBinary:
+			c.fragmentOp = h.opcode
+			c.fragmentDeflate = h.rsv1
+		}
+
+		c.fragments.Write(payload)
+		if !h.fin {
+			continue
+		}
+
+		op := c.fragmentOp
+		msg := make([]byte, c.fragments.Len())
+		copy(msg, c.fragments.Bytes())
+		c.fragmentOp = 0
+		c.fragments.Reset()
+
+		if c.fragmentDeflate {
+			msg, err = decompress(msg, limit)
+			if errors.Is(err, errTooLarge) {
+				return 0, nil, c.fail(CloseMessageTooBig, fmt.Sprintf("message larger than %d bytes", limit))
+			}
+			if err != nil {
+				return 0, nil, c.fail(CloseInvalidPayload, "invalid compressed data")
+			}
+		}
+		if op == OpText && !utf8.Valid(msg) {
+			return 0, nil, c.fail(CloseInvalidPayload, "text message is not valid UTF-8")
+		}
+		return op, msg, nil
+	}
+}
+
+// checkFrame enforces the framing rules before the payload is read
+func (c *Conn) checkFrame(h frameHeader) error {
+	switch {
+	case h.rsv2 || h.rsv3:
+		return c.fail(CloseProtocolError, "reserved bits set")
+	case h.rsv1 && !c.compression:
+		return c.fail(CloseProtocolError, "RSV1 set without permessage-deflate")
+	case h.rsv1 && (h.opcode.IsControl() || h.opcode == OpContinuation):
+		return c.fail(CloseProtocolError, "RSV1 set on a control or continuation frame")
+	case c.server && !h.masked:
+		return c.fail(CloseProtocolError, "client frames must be masked")
+	case !c.server && h.masked:
+		return c.fail(CloseProtocolError, "server frames must not be masked")
+	}
+
+	switch h.opcode {
+	case OpClose, OpPing, OpPong:
+		if !h.fin {
+			return c.fail(CloseProtocolError, "fragmented control frame")
+		}
+		if h.length > maxControlPayload {
+			return c.fail(CloseProtocolError, "control frame payload over 125 bytes")
+		}
+	case OpText, OpBinary:
+		if c.fragmentOp != 0 {
+			return c.fail(CloseProtocolError, "new message before the previous one was finished")
+		}
+	case OpContinuation:
+		if c.fragmentOp == 0 {
+			return c.fail(CloseProtocolError, "continuation frame without a message to continue")
+		}
+	default:
+		return c.fail(CloseProtocolError, fmt.Sprintf("reserved opcode 0x%x", byte(h.opcode)))
+	}
+	return nil
+}
+
+// handleClose answers the peer's close frame and returns the resulting CloseError
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "close payload of 1 byte")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, fmt.Sprintf("invalid close code %d", closeErr.Code))
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(CloseInvalidPayload, "close reason is not valid UTF-8")
+		}
+	}
+
+	// Echo the code back to complete the closing handshake
+	var reply []byte
+	if closeErr.Code != CloseNoStatus {
+		reply = payload[:2]
+	}
+	if err := c.WriteControl(OpClose, reply); err != nil && err != ErrCloseSent {
+		return err
+	}
+	return closeErr
+}
+
+// validCloseCode reports whether code may appear in a close frame
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// fail sends a close frame with code and returns the matching ErrProtocol error
+func (c *Conn) fail(code int, reason string) error {
+	c.WriteClose(code, reason)
+	return fmt.Errorf("%w: %s", ErrProtocol, reason)
+}
+
+// WriteMessage sends data as a single text or binary message
+func (c *Conn) WriteMessage(op Opcode, data []byte) error {
+	w, err := c.NextWriter(op)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// NextWriter starts a text or binary message whose length needn't be known up front.
+// Writes are sent as fragments; Close sends the final one. Other writers wait
+// until Close, but control frames may still go out between the fragments.
+func (c *Conn) NextWriter(op Opcode) (io.WriteCloser, error) {
+	if op != OpText && op != OpBinary {
+		return nil, fmt.Errorf("websocket: %v is not a message opcode", op)
+	}
+
+	c.messageMu.Lock()
+	w := &messageWriter{c: c, op: op}
+	if c.compression {
+		w.flate, _ = flate.NewWriter(&w.buf, flate.BestSpeed)
+	}
+	return w, nil
+}
+
+// messageWriter collects a message and sends it in fragmentSize frames
+type messageWriter struct {
+	c      *Conn
+	op     Opcode // the message opcode for the first frame, then OpContinuation
+	flate  *flate.Writer
+	buf    bytes.Buffer
+	sent   bool // the first frame is out
+	closed bool
+	err    error
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("websocket: write to a closed message writer")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.flate != nil {
+		w.flate.Write(p)
+	} else {
+		w.buf.Write(p)
+	}
+
+	// Keep 4 bytes back: the final frame must be able to drop the flush marker
+	for w.buf.Len() > fragmentSize+4 {
+		if w.err = w.writeFragment(w.buf.Next(fragmentSize), false); w.err != nil {
+			return 0, w.err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.c.messageMu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	final := w.buf.Bytes()
+	if w.flate != nil {
+		w.flate.Flush()
+		// The sync flush ends with an empty stored block, which RFC 7692 leaves off
+		final = bytes.TrimSuffix(w.buf.Bytes(), deflateTail)
+	}
+	return w.writeFragment(final, true)
+}
+
+func (w *messageWriter) writeFragment(p []byte, fin bool) error {
+	op := w.op
+	if w.sent {
+		op = OpContinuation
+	}
+	rsv1 := w.flate != nil && !w.sent
+	w.sent = true
+	return w.c.writeFrame(fin, rsv1, op, p)
+}
+
+// WriteControl sends a ping, pong or close frame
+func (c *Conn) WriteControl(op Opcode, payload []byte) error {
+	if !op.IsControl() {
+		return fmt.Errorf("websocket: %v is not a control opcode", op)
+	}
+	if len(payload) > maxControlPayload {
+		return errors.New("websocket: control frame payload over 125 bytes")
+	}
+	return c.writeFrame(true, false, op, payload)
+}
+
+// Ping sends a ping; the pong comes back through OnPong while a goroutine is reading
+func (c *Conn) Ping(data []byte) error {
+	return c.WriteControl(OpPing, data)
+}
+
+// WriteClose starts the closing handshake. The peer's close frame still has to be
+// read, ReadMessage returns a *CloseError when it arrives.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.WriteControl(OpClose, payload)
+}
+
+// CloseHandshake sends a close frame, waits up to timeout for the peer's, and closes
+// the connection. Use it when no other goroutine is reading.
+func (c *Conn) CloseHandshake(code int, reason string, timeout time.Duration) error {
+	defer c.conn.Close()
+	if err := c.WriteClose(code, reason); err != nil {
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (c *Conn) writeFrame(fin, rsv1 bool, op Opcode, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if op == OpClose {
+		c.closeSent = true
+	}
+
+	var header [14]byte
+	if fin {
+		header[0] |= 0x80
+	}
+	if rsv1 {
+		header[0] |= 0x40
+	}
+	header[0] |= byte(op)
+
+	n := 2
+	switch length := len(payload); {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+		n += 2
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+		n += 8
+	}
+
+	if !c.server {
+		// Clients mask every frame with a fresh unpredictable key (RFC 6455 Section 5.3)
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		header[1] |= 0x80
+		copy(header[n:], mask[:])
+		n += 4
+		payload = append([]byte(nil), payload...)
+		maskBytes(mask, payload)
+	}
+
+	if _, err := c.bw.Write(header[:n]); err != nil {
+		return err
+	}
+	if _, err := c.bw.Write(payload); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// maskBytes applies (or removes) the XOR mask
+func maskBytes(mask [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= mask[i&3]
+	}
+}
@@ -0,0 +1,222 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+// startEcho serves an echo endpoint upgraded by u and returns its address
+func startEcho(t *testing.T, u *Upgrader) string {
+	t.Helper()
+	s := &server.Server{Handler: func(req *request.Request, w *response.Writer) {
+		conn, err := u.Upgrade(req, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			op, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(op, msg); err != nil {
+				return
+			}
+		}
+	}}
+	require.NoError(t, s.Start())
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("127.0.0.1:%d", s.Port)
+}
+
+// dial opens a WebSocket client connection to addr
+func dial(t *testing.T, addr string, opts ClientOptions) *Conn {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { nc.Close() })
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c, err := Client(nc, addr, "/", opts)
+	require.NoError(t, err)
+	return c
+}
+
+func TestAcceptKey(t *testing.T) {
+	// The example from RFC 6455 Section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestUpgradeRejectsBadHandshakes(t *testing.T) {
+	addr := startEcho(t, &Upgrader{})
+
+	valid := "Host: " + addr + "\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	tests := []struct {
+		name   string
+		raw    string
+		status string
+	}{
+		{"plain request", "GET / HTTP/1.1\r\nHost: " + addr + "\r\n\r\n", "400 Bad Request"},
+		{"wrong method", "POST / HTTP/1.1\r\n" + valid + "Sec-WebSocket-Version: 13\r\nContent-Length: 0\r\n\r\n", "405 Method Not Allowed"},
+		{"old version", "GET / HTTP/1.1\r\n" + valid + "Sec-WebSocket-Version: 8\r\n\r\n", "426 Upgrade Required"},
+		{"short key", "GET / HTTP/1.1\r\nHost: " + addr + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: c2hvcnQ=\r\nSec-WebSocket-Version: 13\r\n\r\n", "400 Bad Request"},
+		{"foreign origin", "GET / HTTP/1.1\r\n" + valid + "Sec-WebSocket-Version: 13\r\nOrigin: https://evil.example\r\n\r\n", "403 Forbidden"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			_, err = conn.Write([]byte(tc.raw))
+			require.NoError(t, err)
+			resp, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 "+tc.status+"\r\n"), string(resp))
+			if tc.status == "426 Upgrade Required" {
+				assert.Contains(t, strings.ToLower(string(resp)), "sec-websocket-version: 13\r\n")
+			}
+		})
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	addr := startEcho(t, &Upgrader{Subprotocols: []string{"chat.v2", "chat.v1"}, EnableCompression: true})
+
+	t.Run("subprotocol", func(t *testing.T) {
+		c := dial(t, addr, ClientOptions{Subprotocols: []string{"chat.v1", "chat.v2"}})
+		assert.Equal(t, "chat.v2", c.Subprotocol())
+		assert.False(t, c.Compression())
+	})
+
+	t.Run("same origin", func(t *testing.T) {
+		h := headers.NewHeaders()
+		h.Set("Origin", "http://"+addr)
+		c := dial(t, addr, ClientOptions{Headers: h})
+		assert.Equal(t, "", c.Subprotocol())
+	})
+
+	t.Run("echo", func(t *testing.T) {
+		for _, compression := range []bool{false, true} {
+			c := dial(t, addr, ClientOptions{Compression: compression})
+			assert.Equal(t, compression, c.Compression())
+
+			messages := [][]byte{
+				[]byte("hello"),
+				{},
+				bytes.Repeat([]byte("abcdefgh"), 4096), // several fragments
+			}
+			for _, msg := range messages {
+				require.NoError(t, c.WriteMessage(OpBinary, msg))
+				op, got, err := c.ReadMessage()
+				require.NoError(t, err)
+				assert.Equal(t, OpBinary, op)
+				assert.Equal(t, msg, got)
+			}
+
+			require.NoError(t, c.CloseHandshake(CloseNormal, "bye", time.Second))
+		}
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		c := dial(t, addr, ClientOptions{})
+		var pong []byte
+		c.OnPong = func(data []byte) { pong = data }
+
+		require.NoError(t, c.Ping([]byte("are you there")))
+		require.NoError(t, c.WriteMessage(OpText, []byte("after ping")))
+		_, msg, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "after ping", string(msg))
+		assert.Equal(t, "are you there", string(pong))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		c := dial(t, addr, ClientOptions{})
+		require.NoError(t, c.WriteClose(4000, "done"))
+		_, _, err := c.ReadMessage()
+		var closeErr *CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, 4000, closeErr.Code)
+
+		assert.ErrorIs(t, c.WriteMessage(OpText, []byte("late")), ErrCloseSent)
+	})
+}
+
+func TestClientRejectsWrongAccept(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer srv.Close()
+		br := bufio.NewReader(srv)
+		for line := ""; line != "\r\n"; {
+			line, _ = br.ReadString('\n')
+		}
+		srv.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"))
+		io.Copy(io.Discard, srv)
+	}()
+
+	_, err := Client(client, "example.com", "/", ClientOptions{})
+	assert.ErrorIs(t, err, ErrBadHandshake)
+}
+
+func TestHijackUnavailable(t *testing.T) {
+	// A Writer without a hijacker, like an HTTP/2 stream, can't be upgraded
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "1.1"},
+		Headers: headers.Headers{
+			"host":                  "example.com",
+			"upgrade":               "websocket",
+			"connection":            "Upgrade",
+			"sec-websocket-key":     "dGhlIHNhbXBsZSBub25jZQ==",
+			"sec-websocket-version": "13",
+		},
+	}
+	w := response.NewWriter(io.Discard)
+	_, err := (&Upgrader{}).Upgrade(req, w)
+	assert.ErrorIs(t, err, ErrBadHandshake)
+	assert.ErrorIs(t, err, response.ErrNotHijackable)
+}
+
+func TestWriteFrameLengths(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		var buf bytes.Buffer
+		c := newConn(nil, bufio.NewReader(bytes.NewReader(nil)), nil, true)
+		c.bw.Reset(&buf)
+		require.NoError(t, c.writeFrame(true, false, OpBinary, make([]byte, size)))
+
+		header := buf.Bytes()
+		assert.Equal(t, byte(0x82), header[0])
+		switch {
+		case size <= 125:
+			assert.Equal(t, byte(size), header[1])
+			assert.Equal(t, 2+size, buf.Len())
+		case size <= 0xffff:
+			assert.Equal(t, byte(126), header[1])
+			assert.Equal(t, uint16(size), binary.BigEndian.Uint16(header[2:]))
+			assert.Equal(t, 4+size, buf.Len())
+		default:
+			assert.Equal(t, byte(127), header[1])
+			assert.Equal(t, uint64(size), binary.BigEndian.Uint64(header[2:]))
+			assert.Equal(t, 10+size, buf.Len())
+		}
+	}
+}